@@ -0,0 +1,111 @@
+package evaluator
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// CommandError is returned when a shell command exits unsuccessfully
+type CommandError struct {
+	Command string // The command as passed to the shell
+	Output  string // Last lines of the command's output, if capture is enabled
+	Err     error  // The underlying execution error
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("command failed: %v", e.Err)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// TaskError is returned when a task fails. It reports the same message as
+// the underlying error, but lets callers find which task and command failed
+// with errors.As. A failing dependency's TaskError is wrapped by its parent.
+type TaskError struct {
+	Task     string // Full name of the task that failed
+	Command  string // The failing shell command, if a command failed
+	ExitCode int    // The command's exit status, or -1 if it didn't exit with one
+	Err      error  // The underlying error
+}
+
+func (e *TaskError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TaskError) Unwrap() error {
+	return e.Err
+}
+
+// newTaskError wraps a task's failure in a TaskError, unless it already is
+// one, as when a task() call inside the task failed
+func newTaskError(task string, err error) error {
+	var taskErr *TaskError
+	if errors.As(err, &taskErr) {
+		return err
+	}
+
+	taskErr = &TaskError{Task: task, ExitCode: -1, Err: err}
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) {
+		taskErr.Command = cmdErr.Command
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		taskErr.ExitCode = exitErr.ExitCode()
+	}
+	return taskErr
+}
+
+// tailWriter keeps the last max lines written to it
+type tailWriter struct {
+	mu      sync.Mutex
+	max     int
+	lines   []string
+	partial strings.Builder
+}
+
+func newTailWriter(max int) *tailWriter {
+	return &tailWriter{max: max}
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, b := range p {
+		if b == '\n' {
+			t.addLine(t.partial.String())
+			t.partial.Reset()
+			continue
+		}
+		t.partial.WriteByte(b)
+	}
+	return len(p), nil
+}
+
+func (t *tailWriter) addLine(line string) {
+	t.lines = append(t.lines, strings.TrimRight(line, "\r"))
+	if len(t.lines) > t.max {
+		t.lines = t.lines[len(t.lines)-t.max:]
+	}
+}
+
+// String returns the captured lines, including any unterminated final line
+func (t *tailWriter) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lines := t.lines
+	if t.partial.Len() > 0 {
+		lines = append(append([]string{}, lines...), t.partial.String())
+		if len(lines) > t.max {
+			lines = lines[len(lines)-t.max:]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
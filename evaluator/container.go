@@ -0,0 +1,63 @@
+package evaluator
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"miren.dev/quake/internal/term"
+)
+
+// defaultContainerRuntime runs the commands of tasks with a run_in attribute,
+// unless the front matter sets container_runtime
+const defaultContainerRuntime = "docker"
+
+// containerWorkDir is where the current directory is mounted in a container
+const containerWorkDir = "/work"
+
+// containerRuntime returns the program that runs containers, like docker or
+// podman
+func (e *Evaluator) containerRuntime() string {
+	if runtime := e.quakefile.Config["container_runtime"]; runtime != "" {
+		return runtime
+	}
+	return defaultContainerRuntime
+}
+
+// checkContainerRuntime verifies that the container runtime can be found
+func (e *Evaluator) checkContainerRuntime() error {
+	runtime := e.containerRuntime()
+	if _, err := exec.LookPath(runtime); err != nil {
+		return fmt.Errorf("run_in needs %s, which isn't installed: %w", runtime, err)
+	}
+	return nil
+}
+
+// containerCommand builds the command that runs argv in a container of image,
+// like docker run --rm -v $PWD:/work -w /work image argv... Exported variables
+// are passed into the container. With stdin attached, it's passed on with -i,
+// and a terminal is allocated with -t when the command talks to the user's
+// terminal, so prompts and interactive programs work.
+func (e *Evaluator) containerCommand(image string, argv []string, stdin io.Reader, stdout io.Writer) *exec.Cmd {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = "."
+	}
+
+	args := []string{"run", "--rm"}
+	if stdin != nil {
+		args = append(args, "-i")
+		if stdin == os.Stdin && stdout == os.Stdout && stdinIsTerminal() && term.IsTerminal(os.Stdout) {
+			args = append(args, "-t")
+		}
+	}
+	args = append(args, "-v", dir+":"+containerWorkDir, "-w", containerWorkDir)
+	for _, name := range e.exported {
+		// The value comes from the runtime's own environment
+		args = append(args, "-e", name)
+	}
+	args = append(args, image)
+	args = append(args, argv...)
+	return exec.Command(e.containerRuntime(), args...)
+}
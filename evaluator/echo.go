@@ -0,0 +1,179 @@
+package evaluator
+
+import (
+	"strings"
+
+	"miren.dev/quake/parser"
+)
+
+// echoWriter builds what sh's echo prints for its arguments: quotes are
+// removed and the spacing inside them is kept, while unquoted spaces only
+// separate words, which are joined by a single space.
+type echoWriter struct {
+	buf    strings.Builder
+	single bool // Inside '...'
+	double bool // Inside "..."
+	inWord bool // A word has started and not yet ended
+	words  int
+}
+
+// startWord begins a word if one isn't in progress, separating it from the
+// previous one
+func (w *echoWriter) startWord() {
+	if w.inWord {
+		return
+	}
+	if w.words > 0 {
+		w.buf.WriteByte(' ')
+	}
+	w.inWord = true
+	w.words++
+}
+
+func (w *echoWriter) writeByte(c byte) {
+	w.startWord()
+	w.buf.WriteByte(c)
+}
+
+// value adds the value of a variable or expression. Unquoted, it's split
+// into words like the shell would.
+func (w *echoWriter) value(v string) {
+	if w.single || w.double {
+		w.startWord()
+		w.buf.WriteString(v)
+		return
+	}
+	for i := 0; i < len(v); i++ {
+		if isEchoSpace(v[i]) {
+			w.inWord = false
+			continue
+		}
+		w.writeByte(v[i])
+	}
+}
+
+// text adds literal command text, tracking quotes across calls. Variable
+// references in it are expanded with expand, except inside single quotes.
+func (w *echoWriter) text(s string, expand func(string) string) {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\'' && !w.double:
+			w.startWord()
+			w.single = !w.single
+		case c == '"' && !w.single:
+			w.startWord()
+			w.double = !w.double
+		case w.single && c == '\\' && i+1 < len(s) && s[i+1] == '$':
+			// An escaped dollar from the parser, which sh would print as is
+			w.writeByte('$')
+			i++
+		case w.single:
+			w.writeByte(c)
+		case c == '\\' && i+1 < len(s):
+			next := s[i+1]
+			if w.double && !strings.ContainsRune("$`\"\\", rune(next)) {
+				w.writeByte(c)
+				continue
+			}
+			w.writeByte(next)
+			i++
+		case c == '$':
+			end := shellReferenceEnd(s, i)
+			if end == i+1 {
+				w.writeByte(c)
+				continue
+			}
+			w.value(expand(s[i:end]))
+			i = end - 1
+		case isEchoSpace(c) && !w.double:
+			w.inWord = false
+		default:
+			w.writeByte(c)
+		}
+	}
+}
+
+func (w *echoWriter) String() string {
+	return w.buf.String()
+}
+
+// shellReferenceEnd returns the end of the $NAME, ${...} or $? style
+// reference starting at the $ at i, or i+1 if there isn't one
+func shellReferenceEnd(s string, i int) int {
+	if i+1 >= len(s) {
+		return i + 1
+	}
+	next := s[i+1]
+	switch {
+	case next == '{':
+		if end := matchingBrace(s, i+1); end >= 0 {
+			return end + 1
+		}
+	case isShellSpecialVar(next):
+		return i + 2
+	case isNameChar(next):
+		j := i + 1
+		for j < len(s) && isNameChar(s[j]) {
+			j++
+		}
+		return j
+	}
+	return i + 1
+}
+
+// echoNeedsShell reports whether an echo command uses something native echo
+// doesn't handle, so the shell has to run it: an unquoted redirection, pipe,
+// separator or comment, an option like -n as the first argument, or an
+// unbalanced quote
+func echoNeedsShell(cmd parser.Command) bool {
+	var single, double bool
+	wordStart := true
+	words := 0 // Words so far, counting echo itself
+	for i, elem := range cmd.Elements {
+		str, ok := elem.(parser.StringElement)
+		if !ok {
+			// A variable, expression or command substitution
+			if wordStart {
+				words++
+			}
+			wordStart = false
+			continue
+		}
+		text := str.Value
+		if i == 0 {
+			text = strings.TrimLeft(text, " \t")
+		}
+		for j := 0; j < len(text); j++ {
+			c := text[j]
+			if wordStart && !single && !double && !isEchoSpace(c) {
+				words++
+				if c == '#' || (c == '-' && words == 2) {
+					return true
+				}
+			}
+			switch {
+			case single:
+				single = c != '\''
+			case c == '\\':
+				j++
+			case c == '\'' && !double:
+				single = true
+			case c == '"':
+				double = !double
+			case double:
+			case isEchoSpace(c):
+				wordStart = true
+				continue
+			case strings.IndexByte("<>|&;", c) >= 0:
+				return true
+			}
+			wordStart = false
+		}
+	}
+	return single || double
+}
+
+func isEchoSpace(c byte) bool {
+	return c == ' ' || c == '\t'
+}
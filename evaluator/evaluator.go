@@ -1,11 +1,25 @@
 package evaluator
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"miren.dev/quake/internal/color"
 	"miren.dev/quake/parser"
@@ -13,46 +27,340 @@ import (
 
 // Evaluator handles task execution
 type Evaluator struct {
-	quakefile *parser.QuakeFile
-	env       map[string]string
-	taskArgs  []string // Arguments passed to the current task
+	quakefile  *parser.QuakeFile
+	env        map[string]string
+	taskName   string   // Full name of the current task, for {{task.name}}
+	taskArgs   []string // Arguments passed to the current task
+	alwaysMake bool     // Run file targets even when they're up to date
+	capture    int      // Number of output lines to attach to command errors (0 disables)
+	exported   []string // Names of variables passed to subprocesses' environment
+	shell      string   // Shell for the task currently running, or "" for the Quakefile default
+	shellFlags string   // Shell flags for the task currently running, used when shell is set
+	runIn      string   // Container image the current task's commands run in, from run_in
+	timings    *Timings // Records how long each task runs, if set
+	tracing    *Trace   // Records when tasks and commands run, if set
+	since      string   // Git ref; tasks whose inputs haven't changed since it are skipped
+	assumeYes  bool     // Run tasks with a confirm attribute without asking
+	strict     bool     // Fail when a command substitution fails instead of using ""
+	varErrors  []error  // Command substitutions that failed while evaluating variables
+
+	namespaceVars map[string]map[string]string // Evaluated variables of each namespace, keyed by its path like docker:build
+
+	stdout      io.Writer         // Where command output goes; nil means os.Stdout
+	taskOutputs map[string]string // Cached output of tasks called with task("name")
+	calling     map[string]bool   // Tasks whose output task() is capturing, to stop recursion
+	exprErr     error             // First task() failure since the last takeExprError
+	planning    bool              // Building a plan, so task() calls must not run anything
+
+	cleanEnv     bool // Give subprocesses a minimal environment instead of inheriting ours
+	taskCleanEnv bool // The running task asked for a clean environment with env: clean
+
+	jobs int // Commands of a parallel block that run at once, if set (see maxJobs)
+
+	errorHandled bool // An onerror handler has run, so it won't run again
+
+	completedDeps map[string]bool // Dependencies the top-level task has run, so each runs once
+
+	changedFiles []string // Files changed since the --since ref, once listed
+
+	substitutions map[string]substitution // Results of command substitutions, keyed by command, so each runs once
+
+	// trace, if set, is called for each global variable as it's loaded
+	trace func(variable parser.Variable, overridden bool)
 }
 
+// cleanEnvVars are the only system environment variables passed to
+// subprocesses in a clean environment. The QUAKE_ variables keep the
+// recursion limit working for nested quake invocations.
+var cleanEnvVars = []string{"PATH", "HOME", "TERM", "QUAKE_DEPTH", "QUAKE_MAX_DEPTH"}
+
 // New creates a new evaluator
 func New(quakefile *parser.QuakeFile) *Evaluator {
+	return NewWithOverrides(quakefile, nil)
+}
+
+// NewWithOverrides creates a new evaluator where the given variables replace
+// the Quakefile's own definitions, like `make VAR=value`
+func NewWithOverrides(quakefile *parser.QuakeFile, overrides map[string]string) *Evaluator {
 	e := &Evaluator{
 		quakefile: quakefile,
 		env:       make(map[string]string),
 	}
 	// Load global variables into the environment
-	e.loadGlobalVariables()
+	e.loadGlobalVariables(overrides)
+	e.loadNamespaceVariables(quakefile.Namespaces, "", overrides)
 	return e
 }
 
-// loadGlobalVariables loads top-level variables from the Quakefile into the environment
-func (e *Evaluator) loadGlobalVariables() {
+// SetAlwaysMake forces file targets to run even when they're newer than their prerequisites
+func (e *Evaluator) SetAlwaysMake(always bool) {
+	e.alwaysMake = always
+}
+
+// SetCaptureOutput attaches the last n lines of a failing command's output to
+// the returned CommandError. Capture is disabled when n is 0.
+func (e *Evaluator) SetCaptureOutput(n int) {
+	e.capture = n
+}
+
+// SetStrictVariables makes a failing command substitution (VAR = `cmd`) an
+// error instead of leaving the variable empty
+func (e *Evaluator) SetStrictVariables(strict bool) {
+	e.strict = strict
+}
+
+// checkVariables returns the first command substitution failure in strict
+// mode, and the first missing env.require() variable in any mode
+func (e *Evaluator) checkVariables() error {
+	for _, err := range e.varErrors {
+		var required *requiredEnvError
+		if e.strict || errors.As(err, &required) {
+			return err
+		}
+	}
+	return nil
+}
+
+// requiredEnvError is returned when a variable named by env.require() isn't set
+type requiredEnvError struct {
+	name string
+}
+
+func (e *requiredEnvError) Error() string {
+	return fmt.Sprintf("required environment variable %s is not set", e.name)
+}
+
+// SetCleanEnv gives commands and Go tasks only PATH, HOME and TERM from the
+// system environment plus exported Quakefile variables, like env: clean on
+// every task
+func (e *Evaluator) SetCleanEnv(clean bool) {
+	e.cleanEnv = clean
+}
+
+// SetJobs limits how many commands of a parallel block run at once, over the
+// front matter's jobs setting. 0 leaves it to the front matter.
+func (e *Evaluator) SetJobs(jobs int) {
+	e.jobs = jobs
+}
+
+// maxJobs returns how many commands of a parallel block run at once, or 0
+// for all of them
+func (e *Evaluator) maxJobs() int {
+	if e.jobs > 0 {
+		return e.jobs
+	}
+	if n, err := strconv.Atoi(e.quakefile.Config["jobs"]); err == nil && n > 0 {
+		return n
+	}
+	return 0
+}
+
+// SetTrace records when every task and command begins and ends into t
+func (e *Evaluator) SetTrace(t *Trace) {
+	e.tracing = t
+}
+
+// SetAssumeYes runs tasks with a confirm attribute without asking, as is
+// needed to run them without a terminal
+func (e *Evaluator) SetAssumeYes(yes bool) {
+	e.assumeYes = yes
+}
+
+// SetSince skips tasks with an inputs attribute when none of the files it
+// matches changed since the git ref. Tasks without inputs always run.
+func (e *Evaluator) SetSince(ref string) {
+	e.since = ref
+}
+
+// SetTimings records the duration of every task run into t
+func (e *Evaluator) SetTimings(t *Timings) {
+	e.timings = t
+}
+
+// loadGlobalVariables loads top-level variables from the Quakefile into the
+// environment. Overridden variables keep their override value, and later
+// variables that reference them see it.
+func (e *Evaluator) loadGlobalVariables(overrides map[string]string) {
+	for name, value := range overrides {
+		e.env[name] = value
+	}
+
 	for _, variable := range e.quakefile.Variables {
-		value := e.evaluateVariable(variable)
-		e.env[variable.Name] = value
+		if variable.Exported {
+			e.exported = append(e.exported, variable.Name)
+		}
+		if _, ok := overrides[variable.Name]; ok {
+			if e.trace != nil {
+				e.trace(variable, true)
+			}
+			continue
+		}
+		e.assignVariable(variable)
+		if e.trace != nil {
+			e.trace(variable, false)
+		}
+	}
+}
+
+// loadNamespaceVariables evaluates the variables of each namespace in the
+// scope of the global variables and those of its enclosing namespaces. They
+// only become part of the environment while the namespace's tasks run.
+func (e *Evaluator) loadNamespaceVariables(namespaces []parser.Namespace, prefix string, overrides map[string]string) {
+	for _, ns := range namespaces {
+		path := prefix + ns.Name
+		saved := make(savedVariables)
+		values := make(map[string]string)
+		for _, variable := range ns.Variables {
+			if _, ok := overrides[variable.Name]; ok {
+				continue
+			}
+			saved.save(e.env, variable.Name)
+			e.assignVariable(variable)
+			values[variable.Name] = e.env[variable.Name]
+		}
+		if len(values) > 0 {
+			if e.namespaceVars == nil {
+				e.namespaceVars = make(map[string]map[string]string)
+			}
+			e.namespaceVars[path] = values
+		}
+
+		e.loadNamespaceVariables(ns.Namespaces, path+":", overrides)
+		saved.restore(e.env)
+	}
+}
+
+// enterNamespace puts the variables of a task's namespaces into the
+// environment, innermost last. The returned function takes them out again.
+func (e *Evaluator) enterNamespace(taskName string) func() {
+	saved := make(savedVariables)
+	parts := strings.Split(taskName, ":")
+	for i := 1; i < len(parts); i++ {
+		for name, value := range e.namespaceVars[strings.Join(parts[:i], ":")] {
+			saved.save(e.env, name)
+			e.env[name] = value
+		}
+	}
+	return func() { saved.restore(e.env) }
+}
+
+// savedVariables records the values variables had before being assigned, so
+// they can be put back. A nil value means the variable wasn't set.
+type savedVariables map[string]*string
+
+// save records name's current value unless it was already saved
+func (s savedVariables) save(env map[string]string, name string) {
+	if _, ok := s[name]; ok {
+		return
+	}
+	if old, exists := env[name]; exists {
+		s[name] = &old
+	} else {
+		s[name] = nil
 	}
 }
 
+// restore puts back every saved value
+func (s savedVariables) restore(env map[string]string) {
+	for name, old := range s {
+		if old != nil {
+			env[name] = *old
+		} else {
+			delete(env, name)
+		}
+	}
+}
+
+// assignVariable evaluates a variable into the environment. NAME += value
+// appends to the current value, separated by a space.
+func (e *Evaluator) assignVariable(variable parser.Variable) {
+	value := e.evaluateVariable(variable)
+	if prev := e.env[variable.Name]; variable.Append && prev != "" {
+		if value == "" {
+			value = prev
+		} else {
+			value = prev + " " + value
+		}
+	}
+	e.env[variable.Name] = value
+}
+
+// commandEnv returns the environment for subprocesses: the system environment
+// (or just cleanEnvVars from it in a clean environment) plus exported
+// Quakefile variables. It returns nil (inherit) if nothing needs changing.
+func (e *Evaluator) commandEnv() []string {
+	clean := e.cleanEnv || e.taskCleanEnv
+	if len(e.exported) == 0 && !clean {
+		return nil
+	}
+
+	var env []string
+	if clean {
+		// Non-nil, so an empty environment isn't taken as inherit
+		env = []string{}
+		for _, name := range cleanEnvVars {
+			if val, ok := os.LookupEnv(name); ok {
+				env = append(env, name+"="+val)
+			}
+		}
+	} else {
+		env = os.Environ()
+	}
+	for _, name := range e.exported {
+		env = append(env, name+"="+e.env[name])
+	}
+	return env
+}
+
+// substitution is the outcome of a command substitution: its trimmed output,
+// or why it failed
+type substitution struct {
+	output string
+	err    string
+}
+
+// substitute runs a command substitution and captures its output. Results are
+// cached by command, so variables with the same command share one run.
+func (e *Evaluator) substitute(cmdStr string) substitution {
+	if result, ok := e.substitutions[cmdStr]; ok {
+		return result
+	}
+
+	var result substitution
+	cmd := e.shellCommand(cmdStr, os.Stdin, nil)
+	cmd.Stdin = os.Stdin
+	output, err := outputProcess(cmd)
+	if err != nil {
+		result.err = err.Error()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(bytes.TrimSpace(exitErr.Stderr)) > 0 {
+			result.err = string(bytes.TrimSpace(exitErr.Stderr))
+		}
+	} else {
+		// Trim whitespace from output
+		result.output = strings.TrimSpace(string(output))
+	}
+
+	if e.substitutions == nil {
+		e.substitutions = make(map[string]substitution)
+	}
+	e.substitutions[cmdStr] = result
+	return result
+}
+
 // evaluateVariable evaluates a variable's value based on its type
 func (e *Evaluator) evaluateVariable(variable parser.Variable) string {
 	// Handle command substitution (backticks)
 	if variable.CommandSubstitution {
 		if cmdStr, ok := variable.Value.(string); ok {
 			// Remove the backticks from the command string
-			cmdStr = strings.Trim(cmdStr, "`")
-			// Execute the command and capture output
-			cmd := exec.Command("sh", "-c", cmdStr)
-			output, err := cmd.Output()
-			if err != nil {
-				// If command fails, return empty string
+			result := e.substitute(strings.Trim(cmdStr, "`"))
+			if result.err != "" {
+				// If command fails, return empty string (an error in strict mode)
+				e.varErrors = append(e.varErrors, fmt.Errorf("failed to evaluate %s: %s", variable.Name, result.err))
 				return ""
 			}
-			// Trim whitespace from output
-			return strings.TrimSpace(string(output))
+			return result.output
 		}
 		return ""
 	}
@@ -60,7 +368,11 @@ func (e *Evaluator) evaluateVariable(variable parser.Variable) string {
 	// Handle expressions ({{...}})
 	if variable.IsExpression {
 		if expr, ok := variable.Value.(parser.Expression); ok {
-			return e.expressionToString(expr)
+			val := e.expressionToString(expr)
+			if err := e.takeExprError(); err != nil {
+				e.varErrors = append(e.varErrors, fmt.Errorf("failed to evaluate %s: %w", variable.Name, err))
+			}
+			return val
 		}
 		return ""
 	}
@@ -77,6 +389,9 @@ func (e *Evaluator) evaluateVariable(variable parser.Variable) string {
 			str = strings.ReplaceAll(str, "\\\\", "\\")
 			str = strings.ReplaceAll(str, "\\n", "\n")
 			str = strings.ReplaceAll(str, "\\t", "\t")
+		} else if len(str) >= 2 && str[0] == '\'' && str[len(str)-1] == '\'' {
+			// Single-quoted strings are taken literally, without expansion
+			return str[1 : len(str)-1]
 		}
 		// Expand any variable references within the string value
 		return e.expandShellVariables(str)
@@ -85,31 +400,150 @@ func (e *Evaluator) evaluateVariable(variable parser.Variable) string {
 	return ""
 }
 
+// taskShell returns the shell a task's commands run with: the task's shell
+// attribute, else the Quakefile's shell directive, else sh
+func (e *Evaluator) taskShell(task *parser.Task) string {
+	if shell := task.Attributes["shell"]; shell != "" {
+		return shell
+	}
+	if e.quakefile.Shell != "" {
+		return e.quakefile.Shell
+	}
+	return "sh"
+}
+
+// taskShellFlags returns the flags passed to a task's shell before -c: the
+// task's shell_flags attribute, else the Quakefile's shell_flags directive
+func (e *Evaluator) taskShellFlags(task *parser.Task) string {
+	if flags, ok := task.Attributes["shell_flags"]; ok {
+		return flags
+	}
+	return e.quakefile.ShellFlags
+}
+
+// checkShellFlags verifies that each of the shell flags looks like a flag.
+// The -c flag is always added by quake, so it can't be given.
+func checkShellFlags(flags string) error {
+	for _, flag := range strings.Fields(flags) {
+		if !strings.HasPrefix(flag, "-") || flag == "-" {
+			return fmt.Errorf("invalid shell flag '%s' (flags must start with -)", flag)
+		}
+		if flag == "-c" {
+			return fmt.Errorf("invalid shell flag '-c' (it's added by quake)")
+		}
+	}
+	return nil
+}
+
+// CheckShell verifies that a shell command's program can be found
+func CheckShell(shell string) error {
+	fields := strings.Fields(shell)
+	if len(fields) == 0 {
+		return fmt.Errorf("empty shell")
+	}
+	if _, err := exec.LookPath(fields[0]); err != nil {
+		return fmt.Errorf("shell '%s' not found: %w", fields[0], err)
+	}
+	return nil
+}
+
+// shellCommand builds the command that runs cmdStr with the current shell.
+// Extra words in the shell setting are passed through, e.g. "bash -eo pipefail",
+// followed by any shell flags. stdin and stdout are what the command will be
+// connected to, with nil for stdout when its output is captured.
+func (e *Evaluator) shellCommand(cmdStr string, stdin io.Reader, stdout io.Writer) *exec.Cmd {
+	shell, flags := e.shell, e.shellFlags
+	if shell == "" {
+		shell, flags = e.quakefile.Shell, e.quakefile.ShellFlags
+	}
+	fields := strings.Fields(shell)
+	if len(fields) == 0 {
+		fields = []string{"sh"}
+	}
+
+	flag := "-c"
+	switch filepath.Base(fields[0]) {
+	case "pwsh", "powershell", "pwsh.exe", "powershell.exe":
+		flag = "-Command"
+	}
+
+	args := append(fields[1:len(fields):len(fields)], strings.Fields(flags)...)
+	args = append(args, flag, cmdStr)
+	if e.runIn != "" {
+		return e.containerCommand(e.runIn, append([]string{fields[0]}, args...), stdin, stdout)
+	}
+	return exec.Command(fields[0], args...)
+}
+
 // RunTask executes a specific task by name (without arguments)
 func (e *Evaluator) RunTask(taskName string) error {
 	return e.RunTaskWithArgs(taskName, nil)
 }
 
-// RunTaskWithArgs executes a specific task by name with arguments
+// RunTaskWithArgs executes a specific task by name with arguments. Its
+// dependencies run first, each at most once: a dependency shared by several
+// tasks, like the bottom of a diamond, runs the first time it's needed. The
+// next top-level task runs them again.
 func (e *Evaluator) RunTaskWithArgs(taskName string, args []string) error {
 	// Handle default task if no name provided
 	if taskName == "" {
 		taskName = "default"
 	}
 
-	// Find the task
+	if err := e.checkVariables(); err != nil {
+		return err
+	}
+
+	// Find the task. A namespace's name runs its default task.
 	task := e.findTask(taskName)
 	if task == nil {
-		return fmt.Errorf("task '%s' not found", taskName)
+		name, err := e.namespaceDefault(taskName)
+		if err != nil {
+			return err
+		}
+		if name != "" {
+			taskName, task = name, e.findTask(name)
+		}
+	}
+	if task == nil {
+		return e.runMissingTask(taskName, args)
+	}
+	args, err := resolveArgs(taskName, task, args)
+	if err != nil {
+		return err
+	}
+	if err := checkArgTypes(task, args); err != nil {
+		return fmt.Errorf("task '%s': %w", taskName, err)
+	}
+
+	// Make sure the shell, or the container runtime for run_in, exists
+	// before running anything
+	if task.Attributes["run_in"] != "" {
+		if err := e.checkContainerRuntime(); err != nil {
+			return fmt.Errorf("task '%s': %w", taskName, err)
+		}
+	} else if err := CheckShell(e.taskShell(task)); err != nil {
+		return fmt.Errorf("task '%s': %w", taskName, err)
+	}
+	if err := checkShellFlags(e.taskShellFlags(task)); err != nil {
+		return fmt.Errorf("task '%s': %w", taskName, err)
 	}
 
 	// Note: We allow fewer arguments than defined - they'll just be empty strings
 	// This allows for optional arguments with default values using || in expressions
 
-	// Save current args and restore after task execution
-	oldArgs := e.taskArgs
-	e.taskArgs = args
-	defer func() { e.taskArgs = oldArgs }()
+	// Namespaced tasks see their namespaces' variables
+	defer e.enterNamespace(taskName)()
+
+	// Each top-level task starts with none of its dependencies run
+	if e.taskName == "" {
+		e.completedDeps = nil
+	}
+
+	// Save current name and args and restore after task execution
+	oldName, oldArgs := e.taskName, e.taskArgs
+	e.taskName, e.taskArgs = taskName, args
+	defer func() { e.taskName, e.taskArgs = oldName, oldArgs }()
 
 	// Set up argument variables
 	for i, argName := range task.Arguments {
@@ -120,114 +554,639 @@ func (e *Evaluator) RunTaskWithArgs(taskName string, args []string) error {
 		}
 	}
 
+	// Dangerous tasks ask before anything runs
+	if err := e.confirmTask(taskName, task); err != nil {
+		return err
+	}
+
+	// With --since, skip a task none of whose inputs changed, along with its
+	// dependencies
+	if e.since != "" {
+		changed, err := e.inputsChanged(task)
+		if err != nil {
+			return fmt.Errorf("task '%s': %w", taskName, err)
+		}
+		if !changed {
+			fmt.Printf("%s [ %s ] %s\n", color.FaintText("┌────"), color.BoldText(taskName), color.FaintText("unchanged since "+e.since))
+			return nil
+		}
+	}
+
 	// Execute dependencies first (without arguments)
-	for _, dep := range task.Dependencies {
+	taskDeps, filePrereqs, err := e.splitDependencies(taskName, task)
+	if err != nil {
+		return fmt.Errorf("task '%s': %w", taskName, err)
+	}
+	for _, dep := range taskDeps {
+		// A dependency shared by several tasks, like in a diamond, only runs once
+		if e.completedDeps[dep] {
+			continue
+		}
 		if err := e.RunTask(dep); err != nil {
+			e.handleError(taskName, task)
 			return fmt.Errorf("dependency '%s' failed: %w", dep, err)
 		}
+		if e.completedDeps == nil {
+			e.completedDeps = make(map[string]bool)
+		}
+		e.completedDeps[dep] = true
+	}
+
+	// Skip the task if its target files are newer than all its file
+	// prerequisites. The targets are its outputs, or else its name.
+	targets := task.Outputs
+	if len(targets) == 0 {
+		targets = []string{taskName}
+	}
+	if len(filePrereqs) > 0 && !e.alwaysMake && isUpToDate(targets, filePrereqs) {
+		fmt.Printf("%s [ %s ] %s\n", color.FaintText("┌────"), color.BoldText(taskName), color.FaintText("up to date"))
+		return nil
+	}
+
+	// Execute the task
+	if len(args) > 0 {
+		fmt.Printf("%s [ %s %s ]\n", color.FaintText("┌────"), color.BoldText(taskName), formatArgs(args))
+	} else {
+		fmt.Printf("%s [ %s ]\n", color.FaintText("┌────"), color.BoldText(taskName))
+	}
+
+	if e.tracing != nil {
+		defer e.tracing.Begin("task", taskName, mainThread)()
+	}
+
+	start := time.Now()
+	err = e.executeTaskWithRetry(task)
+	if e.timings != nil {
+		e.timings.Add(taskName, time.Since(start))
+	}
+	if err != nil {
+		e.handleError(taskName, task)
+		return newTaskError(taskName, err)
+	}
+	return nil
+}
+
+// confirmTask asks on the terminal before running a task with a confirm
+// attribute, like confirm: "This deletes all data. Continue?", and fails
+// unless the answer is yes. Without a terminal it fails unless SetAssumeYes
+// was used.
+func (e *Evaluator) confirmTask(taskName string, task *parser.Task) error {
+	prompt := task.Attributes["confirm"]
+	if prompt == "" || e.assumeYes {
+		return nil
+	}
+	if !stdinIsTerminal() {
+		return fmt.Errorf("task '%s' needs confirmation; use --yes to run it without a terminal", taskName)
+	}
+
+	fmt.Printf("%s (y/n): ", prompt)
+	reader := bufio.NewReader(os.Stdin)
+	confirmation, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read confirmation: %w", err)
+	}
+	confirmation = strings.ToLower(strings.TrimSpace(confirmation))
+
+	if confirmation != "y" && confirmation != "yes" {
+		return fmt.Errorf("task '%s' was not confirmed", taskName)
+	}
+	return nil
+}
+
+// runMissingTask handles a task that doesn't exist. By default that's an
+// error; with on_missing passthrough, the name and its arguments are run as a
+// shell command instead.
+func (e *Evaluator) runMissingTask(taskName string, args []string) error {
+	switch e.quakefile.OnMissing {
+	case "":
+		return fmt.Errorf("task '%s' not found", taskName)
+	case "passthrough":
+	default:
+		return fmt.Errorf("task '%s' not found (unknown on_missing mode '%s')", taskName, e.quakefile.OnMissing)
+	}
+
+	if err := CheckShell(e.taskShell(&parser.Task{})); err != nil {
+		return err
+	}
+
+	words := make([]string, 0, len(args)+1)
+	for _, word := range append([]string{taskName}, args...) {
+		words = append(words, shellQuote(word))
+	}
+	cmdStr := strings.Join(words, " ")
+
+	fmt.Printf("%s [ %s ]\n", color.FaintText("┌────"), color.BoldText(taskName))
+	fmt.Printf("%s %s\n", color.FaintText("└"), cmdStr)
+	return e.runShell(cmdStr, os.Stdin, e.output(), os.Stderr)
+}
+
+// shellQuote quotes s for the shell unless it's made only of characters the
+// shell leaves alone
+func shellQuote(s string) string {
+	if s != "" && !strings.ContainsFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=,+@%", r))
+	}) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// handleError runs the error handler for a failed task, or a task whose
+// dependency failed: its onerror attribute, or else the Quakefile's onerror
+// directive. The handler gets the task's name as its argument and runs at
+// most once, so a failing dependency's own handler comes first. Its own failure is
+// reported but doesn't replace the original error.
+func (e *Evaluator) handleError(taskName string, task *parser.Task) {
+	handler := task.Attributes["onerror"]
+	if handler == "" {
+		handler = e.quakefile.OnError
+	}
+	if handler == "" || e.errorHandled || Interrupted() {
+		return
+	}
+	e.errorHandled = true
+
+	if err := e.RunTaskWithArgs(handler, []string{taskName}); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: onerror handler '%s' failed: %v\n", handler, err)
+	}
+}
+
+// executeTaskWithRetry runs a task, retrying it according to its retries and
+// backoff attributes, e.g. task fetch(retries: 3, backoff: "2s")
+func (e *Evaluator) executeTaskWithRetry(task *parser.Task) error {
+	retries := 0
+	if v, ok := task.Attributes["retries"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("task '%s' has invalid retries attribute %q", task.Name, v)
+		}
+		retries = n
+	}
+
+	var backoff time.Duration
+	if v, ok := task.Attributes["backoff"]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("task '%s' has invalid backoff attribute %q", task.Name, v)
+		}
+		backoff = d
+	}
+
+	err := e.executeTask(task)
+	for attempt := 1; err != nil && attempt <= retries; attempt++ {
+		msg := fmt.Sprintf("retry %d/%d after failure: %v", attempt, retries, err)
+		if backoff > 0 {
+			msg = fmt.Sprintf("retry %d/%d in %s after failure: %v", attempt, retries, backoff, err)
+		}
+		fmt.Printf("%s %s\n", color.FaintText("│"), color.YellowText(msg))
+
+		time.Sleep(backoff)
+		err = e.executeTask(task)
+	}
+	return err
+}
+
+// splitDependencies separates task dependencies from file prerequisites.
+// Dependencies that aren't tasks but exist on disk are files, like in Make.
+// Patterns like test:* expand to the matching tasks other than the task itself.
+func (e *Evaluator) splitDependencies(name string, task *parser.Task) (tasks []string, files []string, err error) {
+	for _, dep := range task.Dependencies {
+		if parser.IsTaskPattern(dep) {
+			matches, err := e.quakefile.ExpandDependency(dep)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, match := range matches {
+				if match != name {
+					tasks = append(tasks, match)
+				}
+			}
+			continue
+		}
+		if e.findTask(dep) == nil {
+			if _, err := os.Stat(dep); err == nil {
+				files = append(files, dep)
+				continue
+			}
+		}
+		tasks = append(tasks, dep)
+	}
+	return tasks, files, nil
+}
+
+// isUpToDate reports whether every target file exists and is newer than every
+// prerequisite. A directory never counts as up to date.
+func isUpToDate(targets []string, prereqs []string) bool {
+	for _, target := range targets {
+		targetInfo, err := os.Stat(target)
+		if err != nil || targetInfo.IsDir() {
+			return false
+		}
+
+		for _, prereq := range prereqs {
+			info, err := os.Stat(prereq)
+			if err != nil || !targetInfo.ModTime().After(info.ModTime()) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// findTask locates a task by name, checking namespaces if needed
+func (e *Evaluator) findTask(name string) *parser.Task {
+	return e.quakefile.FindTask(name)
+}
+
+// namespaceDefault returns the default task of the namespace called name,
+// like db:default for db, or "" if there's no such namespace. A namespace
+// without a default task is an error that lists its tasks.
+func (e *Evaluator) namespaceDefault(name string) (string, error) {
+	prefix := name + ":"
+	var tasks []string
+	for _, taskName := range e.quakefile.TaskNames() {
+		if strings.HasPrefix(taskName, prefix) {
+			tasks = append(tasks, taskName)
+		}
+	}
+	if len(tasks) == 0 {
+		return "", nil
+	}
+	if e.findTask(prefix+"default") == nil {
+		return "", fmt.Errorf("'%s' is a namespace without a default task; its tasks are: %s", name, strings.Join(tasks, ", "))
+	}
+	return prefix + "default", nil
+}
+
+// executeTask runs all commands in a task
+func (e *Evaluator) executeTask(task *parser.Task) error {
+	// Handle Go tasks differently
+	if task.IsGoTask {
+		return e.executeGoTask(task)
+	}
+
+	// Run this task's commands with its shell and environment
+	oldShell, oldShellFlags, oldRunIn, oldCleanEnv := e.shell, e.shellFlags, e.runIn, e.taskCleanEnv
+	e.shell, e.shellFlags, e.runIn = e.taskShell(task), e.taskShellFlags(task), task.Attributes["run_in"]
+	defer func() {
+		e.shell, e.shellFlags, e.runIn, e.taskCleanEnv = oldShell, oldShellFlags, oldRunIn, oldCleanEnv
+	}()
+
+	switch env := task.Attributes["env"]; env {
+	case "", "inherit":
+		e.taskCleanEnv = false
+	case "clean":
+		e.taskCleanEnv = true
+	default:
+		return fmt.Errorf("task '%s' has invalid env attribute %q (expected: clean or inherit)", task.Name, env)
+	}
+
+	// Restore any variables assigned by `set` statements once the task finishes
+	saved := make(savedVariables)
+	defer saved.restore(e.env)
+
+	// Variables of env blocks reach this task's commands only
+	defer e.setTaskEnv(task, saved)()
+
+	for i, cmd := range task.Commands {
+		run, err := e.conditionHolds(cmd)
+		if err != nil {
+			return err
+		}
+		if !run {
+			continue
+		}
+
+		// Handle `set NAME = value` statements
+		if cmd.Set != nil {
+			saved.save(e.env, cmd.Set.Name)
+			e.assignVariable(*cmd.Set)
+			if err := e.checkVariables(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		isLastCommand := i == len(task.Commands)-1
+		if len(cmd.Parallel) > 0 {
+			if err := e.executeParallel(cmd.Parallel, isLastCommand); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := e.executeCommandWithPosition(cmd, isLastCommand); err != nil {
+			if !cmd.ContinueOnError {
+				return err
+			}
+			// Continue on error if specified
+			fmt.Printf("Warning: command failed but continuing: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// setTaskEnv assigns the variables of a task's env blocks, saving their old
+// values into saved, and exports them to its commands. Their values can refer
+// to other variables. The returned function stops exporting them.
+func (e *Evaluator) setTaskEnv(task *parser.Task, saved savedVariables) func() {
+	oldExported := e.exported
+	names := slices.Sorted(maps.Keys(task.Env))
+	for _, name := range names {
+		value := e.evaluateVariable(parser.Variable{Name: name, Value: task.Env[name]})
+		saved.save(e.env, name)
+		e.env[name] = value
+		if !slices.Contains(e.exported, name) {
+			e.exported = append(slices.Clip(e.exported), name)
+		}
+	}
+	return func() { e.exported = oldExported }
+}
+
+// conditionHolds reports whether a command's if {{expr}}: condition is
+// truthy. Commands without a condition always run.
+func (e *Evaluator) conditionHolds(cmd parser.Command) (bool, error) {
+	if cmd.Condition == nil {
+		return true, nil
+	}
+	value := e.expressionToString(cmd.Condition)
+	if err := e.takeExprError(); err != nil {
+		return false, err
+	}
+	return isTruthy(value), nil
+}
+
+// executeGoTask runs a Go task by building the qtasks directory with the
+// dispatcher and running the result. Building first means compile errors
+// aren't mistaken for the task failing. Besides its arguments, the task can
+// read the environment described in goTaskEnv.
+func (e *Evaluator) executeGoTask(task *parser.Task) error {
+	if task.GoDispatcher == "" {
+		return fmt.Errorf("Go task '%s' has no dispatcher", task.Name)
+	}
+
+	if task.GoSourceDir == "" {
+		return fmt.Errorf("Go task '%s' has no source directory", task.Name)
+	}
+
+	env := e.goTaskEnv(task)
+	binary, err := goTasksBinary(task.GoSourceDir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(binary), 0755); err != nil {
+		return fmt.Errorf("failed to create Go task build directory: %w", err)
+	}
+
+	// go reports compile errors on stderr itself; point at where they are
+	build := exec.Command("go", e.goBuildArgs(task, binary)...)
+	build.Env = env
+	build.Stdout = os.Stderr
+	build.Stderr = os.Stderr
+	if err := runProcess(build); err != nil {
+		return fmt.Errorf("Go task compilation failed in %s: %w", task.GoSourceDir, err)
+	}
+
+	// No shell sees the arguments, so expand globs like one would
+	cmd := exec.Command(binary, append([]string{task.Name}, expandGlobs(e.taskArgs)...)...)
+	cmd.Env = env
+	cmd.Stdout = e.output()
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+
+	if err := runProcess(cmd); err != nil {
+		return fmt.Errorf("Go task failed: %w", err)
+	}
+
+	return nil
+}
+
+// expandGlobs expands arguments containing an unescaped *, ? or [ into the
+// files they match, sorted, as a shell would. An argument that matches
+// nothing is kept as is, and \*, \? and \[ stand for the literal characters.
+func expandGlobs(args []string) []string {
+	expanded := make([]string, 0, len(args))
+	for _, arg := range args {
+		if hasGlob(arg) {
+			if matches, err := filepath.Glob(arg); err == nil && len(matches) > 0 {
+				expanded = append(expanded, matches...)
+				continue
+			}
+		}
+		expanded = append(expanded, globEscape.ReplaceAllString(arg, "$1"))
+	}
+	return expanded
+}
+
+// globEscape matches an escaped glob character
+var globEscape = regexp.MustCompile(`\\([*?\[])`)
+
+// hasGlob reports whether arg contains an unescaped glob character
+func hasGlob(arg string) bool {
+	for i := 0; i < len(arg); i++ {
+		switch arg[i] {
+		case '\\':
+			i++
+		case '*', '?', '[':
+			return true
+		}
+	}
+	return false
+}
+
+// goTasksBinary returns where the Go tasks of a qtasks directory are built.
+// Each directory has its own path under the user cache directory, so the
+// binary is replaced by the next build rather than left behind.
+func goTasksBinary(sourceDir string) (string, error) {
+	abs, err := filepath.Abs(sourceDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", sourceDir, err)
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
 	}
 
-	// Execute the task
-	if len(args) > 0 {
-		fmt.Printf("%s [ %s %s ]\n", color.FaintText("┌────"), color.BoldText(taskName), strings.Join(args, ", "))
-	} else {
-		fmt.Printf("%s [ %s ]\n", color.FaintText("┌────"), color.BoldText(taskName))
+	sum := sha256.Sum256([]byte(abs))
+	name := "tasks"
+	if runtime.GOOS == "windows" {
+		name += ".exe"
 	}
-	return e.executeTask(task)
+	return filepath.Join(cacheDir, "quake", "gotasks", hex.EncodeToString(sum[:8]), name), nil
 }
 
-// findTask locates a task by name, checking namespaces if needed
-func (e *Evaluator) findTask(name string) *parser.Task {
-	// First, look in top-level tasks (including flattened namespace:name tasks)
-	for i := range e.quakefile.Tasks {
-		if e.quakefile.Tasks[i].Name == name {
-			return &e.quakefile.Tasks[i]
-		}
+// namedArgPattern matches a name=value task argument
+var namedArgPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// resolveArgs maps name=value arguments, like env=prod, onto the task's
+// declared arguments by name, in any order. Named passing starts once any
+// argument names one of the task's arguments; otherwise all arguments are
+// positional, so a value like KEY=value still reaches the task as is. The two
+// can't be mixed in one call.
+func resolveArgs(taskName string, task *parser.Task, args []string) ([]string, error) {
+	names := make([]string, len(task.Arguments))
+	for i, arg := range task.Arguments {
+		names[i] = strings.TrimSuffix(arg, "...")
 	}
 
-	// If not found and contains ':', also check actual namespace structures
-	if strings.Contains(name, ":") {
-		parts := strings.Split(name, ":")
-		return e.findNamespacedTask(parts, e.quakefile.Namespaces)
+	isNamed := false
+	for _, arg := range args {
+		if name, _, ok := strings.Cut(arg, "="); ok && namedArgPattern.MatchString(arg) && slices.Contains(names, name) {
+			isNamed = true
+			break
+		}
+	}
+	if !isNamed {
+		return args, nil
 	}
 
-	return nil
+	resolved := make([]string, len(names))
+	given := make(map[string]bool)
+	count := 0
+	for _, arg := range args {
+		if !namedArgPattern.MatchString(arg) {
+			return nil, fmt.Errorf("task '%s': can't mix named and positional arguments", taskName)
+		}
+		name, value, _ := strings.Cut(arg, "=")
+		i := slices.Index(names, name)
+		if i < 0 {
+			return nil, fmt.Errorf("task '%s' has no argument '%s' (arguments: %s)", taskName, name, strings.Join(names, ", "))
+		}
+		if given[name] {
+			return nil, fmt.Errorf("task '%s': argument '%s' is given more than once", taskName, name)
+		}
+		given[name] = true
+		resolved[i] = value
+		count = max(count, i+1)
+	}
+	return resolved[:count], nil
 }
 
-// findNamespacedTask searches for a task in namespaces
-func (e *Evaluator) findNamespacedTask(parts []string, namespaces []parser.Namespace) *parser.Task {
-	if len(parts) == 0 {
+// checkArgTypes verifies that the arguments given to a task match their
+// declared types. Arguments that weren't given, or are empty, aren't checked.
+func checkArgTypes(task *parser.Task, args []string) error {
+	if len(task.ArgTypes) == 0 {
 		return nil
 	}
-
-	// Look for matching namespace
-	for _, ns := range namespaces {
-		if ns.Name == parts[0] {
-			if len(parts) == 2 {
-				// Look for task in this namespace
-				for i := range ns.Tasks {
-					if ns.Tasks[i].Name == parts[1] {
-						return &ns.Tasks[i]
-					}
-				}
-			} else if len(parts) > 2 {
-				// Recurse into nested namespaces
-				return e.findNamespacedTask(parts[1:], ns.Namespaces)
+	for i, value := range args {
+		// The values of a variadic argument are all checked against its type
+		if i >= len(task.Arguments) {
+			i = len(task.Arguments) - 1
+			if i < 0 || !strings.HasSuffix(task.Arguments[i], "...") {
+				break
 			}
 		}
+		if value == "" {
+			continue
+		}
+		name := strings.TrimSuffix(task.Arguments[i], "...")
+		if err := checkArgType(name, task.ArgTypes[name], value); err != nil {
+			return err
+		}
 	}
-
 	return nil
 }
 
-// executeTask runs all commands in a task
-func (e *Evaluator) executeTask(task *parser.Task) error {
-	// Handle Go tasks differently
-	if task.IsGoTask {
-		return e.executeGoTask(task)
+// checkArgType verifies a single argument value against its type
+func checkArgType(name, argType, value string) error {
+	switch argType {
+	case "":
+		return nil
+	case "int":
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Errorf("argument '%s' must be an integer, got '%s'", name, value)
+		}
+	case "bool":
+		if value != "true" && value != "false" {
+			return fmt.Errorf("argument '%s' must be true or false, got '%s'", name, value)
+		}
+	case "path":
+		if _, err := os.Stat(value); err != nil {
+			return fmt.Errorf("argument '%s' must be an existing path, got '%s'", name, value)
+		}
+	default:
+		values := parser.EnumValues(argType)
+		if !slices.Contains(values, value) {
+			return fmt.Errorf("argument '%s' must be one of %s, got '%s'", name, strings.Join(values, ", "), value)
+		}
 	}
+	return nil
+}
 
-	for i, cmd := range task.Commands {
-		isLastCommand := i == len(task.Commands)-1
-		if err := e.executeCommandWithPosition(cmd, isLastCommand); err != nil {
-			if !cmd.ContinueOnError {
-				return err
-			}
-			// Continue on error if specified
-			fmt.Printf("Warning: command failed but continuing: %v\n", err)
+// formatArgs formats task arguments for display, quoting any that are empty
+// or contain whitespace or commas so each one's boundaries stay visible
+func formatArgs(args []string) string {
+	formatted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\r,") {
+			arg = strconv.Quote(arg)
 		}
+		formatted[i] = arg
 	}
-	return nil
+	return strings.Join(formatted, ", ")
 }
 
-// executeGoTask runs a Go task by invoking go run with the dispatcher
-func (e *Evaluator) executeGoTask(task *parser.Task) error {
-	if task.GoDispatcher == "" {
-		return fmt.Errorf("Go task '%s' has no dispatcher", task.Name)
+// goTaskEnv returns the environment of a Go task. Along with what commands get
+// (the system environment and exported variables) it holds:
+//
+//	QUAKE_TASK         the task's name
+//	QUAKE_VAR_<NAME>   every Quakefile variable, exported or not
+//	QUAKE_ARG_COUNT    the number of arguments passed to the task
+//	QUAKE_ARG_<N>      each argument, starting at QUAKE_ARG_0
+//
+// followed by the settings of the gotasks block.
+func (e *Evaluator) goTaskEnv(task *parser.Task) []string {
+	env := e.commandEnv()
+	if env == nil {
+		env = os.Environ()
 	}
 
-	if task.GoSourceDir == "" {
-		return fmt.Errorf("Go task '%s' has no source directory", task.Name)
+	env = append(env, "QUAKE_TASK="+task.Name)
+
+	names := make([]string, 0, len(e.env))
+	for name := range e.env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, "QUAKE_VAR_"+name+"="+e.env[name])
 	}
 
-	// Build command arguments: go run <dir> taskname args...
-	// This will compile all .go files in the directory together
-	// Use absolute path to the Go source directory
-	qtasksPath, _ := filepath.Abs(task.GoSourceDir)
-	args := []string{"run", qtasksPath, task.Name}
-	args = append(args, e.taskArgs...)
+	env = append(env, "QUAKE_ARG_COUNT="+strconv.Itoa(len(e.taskArgs)))
+	for i, arg := range e.taskArgs {
+		env = append(env, fmt.Sprintf("QUAKE_ARG_%d=%s", i, arg))
+	}
 
-	// Execute using go run from the project root
-	cmd := exec.Command("go", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
+	// Settings from the gotasks block, like CGO_ENABLED
+	if config := e.quakefile.GoTasks; config != nil {
+		names := make([]string, 0, len(config.Env))
+		for name := range config.Env {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			env = append(env, name+"="+config.Env[name])
+		}
+	}
+	return env
+}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("Go task failed: %w", err)
+// goBuildArgs builds the arguments for building a Go task's directory into
+// output: go build -o output [flags] <dir>, with the build tags and flags of
+// the gotasks block
+func (e *Evaluator) goBuildArgs(task *parser.Task, output string) []string {
+	args := []string{"build", "-o", output}
+	if config := e.quakefile.GoTasks; config != nil {
+		if config.Tags != "" {
+			args = append(args, "-tags", config.Tags)
+		}
+		args = append(args, strings.Fields(config.Flags)...)
 	}
 
-	return nil
+	// This will compile all .go files in the directory together
+	// Use absolute path to the Go source directory
+	qtasksPath, _ := filepath.Abs(task.GoSourceDir)
+	return append(args, qtasksPath)
 }
 
 // executeCommand runs a single command (for backward compatibility)
@@ -238,12 +1197,18 @@ func (e *Evaluator) executeCommand(cmd parser.Command) error {
 // executeCommandWithPosition runs a single command with position info
 func (e *Evaluator) executeCommandWithPosition(cmd parser.Command, isLast bool) error {
 	// Check if this is an @echo command - use native printer instead of shell
-	if cmd.Silent && e.isEchoCommand(cmd) {
+	if cmd.Silent && !cmd.Quiet && e.isEchoCommand(cmd) {
 		return e.executeNativeEcho(cmd)
 	}
+	if isFailCommand(cmd) {
+		return e.executeFail(cmd, isLast)
+	}
 
 	// Convert command to string
 	cmdStr := e.commandToString(cmd)
+	if err := e.takeExprError(); err != nil {
+		return err
+	}
 
 	// Handle silent mode
 	if cmd.Silent {
@@ -257,20 +1222,141 @@ func (e *Evaluator) executeCommandWithPosition(cmd parser.Command, isLast bool)
 	}
 
 	// Execute via shell
-	shellCmd := exec.Command("sh", "-c", cmdStr)
-	shellCmd.Stdout = os.Stdout
-	shellCmd.Stderr = os.Stderr
-	shellCmd.Stdin = os.Stdin
+	if e.tracing != nil {
+		defer e.tracing.Begin("command", cmdStr, mainThread)()
+	}
+	if cmd.Quiet {
+		return e.runShell(cmdStr, os.Stdin, io.Discard, io.Discard)
+	}
+	return e.runShell(cmdStr, os.Stdin, e.output(), os.Stderr)
+}
 
-	err := shellCmd.Run()
+// output returns where command output is written
+func (e *Evaluator) output() io.Writer {
+	if e.stdout != nil {
+		return e.stdout
+	}
+	return os.Stdout
+}
+
+// runShell runs a command string with the task's shell and environment.
+// Output sent to io.Discard isn't captured for errors either.
+func (e *Evaluator) runShell(cmdStr string, stdin io.Reader, stdout, stderr io.Writer) error {
+	shellCmd := e.shellCommand(cmdStr, stdin, stdout)
+	shellCmd.Env = e.commandEnv()
+	shellCmd.Stdout = stdout
+	shellCmd.Stderr = stderr
+	shellCmd.Stdin = stdin
+
+	var tail *tailWriter
+	if e.capture > 0 && stdout != io.Discard {
+		tail = newTailWriter(e.capture)
+		shellCmd.Stdout = io.MultiWriter(stdout, tail)
+		shellCmd.Stderr = io.MultiWriter(stderr, tail)
+	}
+
+	err := runProcess(shellCmd)
 	if err != nil {
-		return fmt.Errorf("command failed: %w", err)
+		cmdErr := &CommandError{Command: cmdStr, Err: err}
+		if tail != nil {
+			cmdErr.Output = tail.String()
+		}
+		return cmdErr
 	}
 
 	return nil
 }
 
-// isEchoCommand checks if a command is an echo command
+// executeParallel runs the commands of a parallel { ... } block concurrently
+// and waits for all of them. Each command's output lines are prefixed with its
+// number so they can be told apart.
+func (e *Evaluator) executeParallel(cmds []parser.Command, isLast bool) error {
+	prefix := "├"
+	if isLast {
+		prefix = "└"
+	}
+	fmt.Printf("%s parallel\n", color.FaintText(prefix))
+
+	var running []parser.Command
+	for _, cmd := range cmds {
+		if cmd.Set != nil || len(cmd.Parallel) > 0 {
+			return fmt.Errorf("parallel blocks can only contain commands")
+		}
+		if isFailCommand(cmd) {
+			return fmt.Errorf("fail can't be used in a parallel block")
+		}
+		run, err := e.conditionHolds(cmd)
+		if err != nil {
+			return err
+		}
+		if run {
+			running = append(running, cmd)
+		}
+	}
+	cmds = running
+
+	cmdStrs := make([]string, len(cmds))
+	for i, cmd := range cmds {
+		cmdStrs[i] = e.commandToString(cmd)
+		if err := e.takeExprError(); err != nil {
+			return err
+		}
+		if !cmd.Silent {
+			fmt.Printf("%s [%d] %s\n", color.FaintText("│"), i+1, cmdStrs[i])
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var slots chan struct{}
+	if n := e.maxJobs(); n > 0 {
+		slots = make(chan struct{}, n)
+	}
+	errs := make([]error, len(cmds))
+	for i, cmd := range cmds {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if slots != nil {
+				slots <- struct{}{}
+				defer func() { <-slots }()
+			}
+			label := fmt.Sprintf("%s [%d] ", color.FaintText("│"), i+1)
+			stdout := newPrefixWriter(&mu, e.output(), label)
+			stderr := newPrefixWriter(&mu, os.Stderr, label)
+
+			var end func()
+			if e.tracing != nil {
+				end = e.tracing.Begin("command", cmdStrs[i], mainThread+1+i)
+			}
+			var err error
+			if cmd.Quiet {
+				err = e.runShell(cmdStrs[i], nil, io.Discard, io.Discard)
+			} else {
+				err = e.runShell(cmdStrs[i], nil, stdout, stderr)
+			}
+			if end != nil {
+				end()
+			}
+			stdout.Flush()
+			stderr.Flush()
+
+			if err != nil && cmd.ContinueOnError {
+				mu.Lock()
+				fmt.Printf("Warning: command failed but continuing: %v\n", err)
+				mu.Unlock()
+				err = nil
+			}
+			errs[i] = err
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// isEchoCommand checks if a command is an echo command that can be printed
+// natively, without the shell (see echoNeedsShell)
 func (e *Evaluator) isEchoCommand(cmd parser.Command) bool {
 	if len(cmd.Elements) == 0 {
 		return false
@@ -281,105 +1367,113 @@ func (e *Evaluator) isEchoCommand(cmd parser.Command) bool {
 	if str, ok := first.(parser.StringElement); ok {
 		trimmed := strings.TrimSpace(str.Value)
 		// Check if it's exactly "echo" or starts with "echo "
-		return trimmed == "echo" || strings.HasPrefix(trimmed, "echo ")
+		if trimmed != "echo" && !strings.HasPrefix(trimmed, "echo ") {
+			return false
+		}
+		return !echoNeedsShell(cmd)
 	}
 
 	return false
 }
 
-// executeNativeEcho executes an echo command using native Go printing
+// executeNativeEcho executes an echo command using native Go printing. It
+// prints what sh's echo would: quotes are removed with the spacing inside
+// them kept, and unquoted words are separated by a single space.
 func (e *Evaluator) executeNativeEcho(cmd parser.Command) error {
 	if len(cmd.Elements) == 0 {
 		fmt.Printf("%s\n", color.FaintText("│"))
 		return nil
 	}
 
-	var output strings.Builder
+	// For native echo, we could execute backtick commands but for simplicity,
+	// we'll fall back to the full command string. This is an edge case that's
+	// less common with @echo
+	for _, elem := range cmd.Elements {
+		if _, ok := elem.(parser.BacktickElement); ok {
+			cmdStr := e.commandToString(cmd)
+			// Remove the "echo " prefix
+			cmdStr = strings.TrimSpace(strings.TrimPrefix(cmdStr, "echo"))
+			fmt.Printf("%s %s\n", color.FaintText("│"), cmdStr)
+			return nil
+		}
+	}
+
+	output := e.builtinArgs(cmd, "echo")
+	if err := e.takeExprError(); err != nil {
+		return err
+	}
+
+	// Output captured by task() is just the echoed text
+	if e.stdout != nil {
+		fmt.Fprintln(e.stdout, output)
+		return nil
+	}
+
+	// Print with colored pipe prefix, on each line of a multi-line message
+	pipe := color.FaintText("│")
+	fmt.Printf("%s %s\n", pipe, strings.ReplaceAll(output, "\n", "\n"+pipe+" "))
+	return nil
+}
+
+// builtinArgs renders the arguments of a built-in command like echo or fail,
+// after its keyword, the way sh would pass them to echo. Command
+// substitutions are left as written.
+func (e *Evaluator) builtinArgs(cmd parser.Command, keyword string) string {
+	var output echoWriter
 
 	for i, elem := range cmd.Elements {
 		switch el := elem.(type) {
 		case parser.StringElement:
 			val := el.Value
-			// Skip "echo " prefix from the first element
+			// Skip the keyword of the first element
 			if i == 0 {
-				trimmed := strings.TrimSpace(val)
-				if trimmed == "echo" {
-					continue
-				} else if strings.HasPrefix(trimmed, "echo ") {
-					// Remove "echo " prefix
-					val = strings.TrimPrefix(val, "echo ")
-					val = strings.TrimLeft(val, " \t")
-				}
+				val = strings.TrimPrefix(strings.TrimLeft(val, " \t"), keyword)
 			}
-
-			// Handle quotes - strip leading/trailing quotes but preserve content
-			val = e.stripQuotesForEcho(val, i == 1 || (i == 0 && !strings.HasPrefix(strings.TrimSpace(el.Value), "echo")))
-			output.WriteString(val)
+			output.text(val, e.expandShellVariables)
 		case parser.VariableElement:
-			// Resolve variable
-			if val, ok := e.env[el.Name]; ok {
-				output.WriteString(val)
-			} else if val, ok := os.LookupEnv(el.Name); ok {
-				output.WriteString(val)
-			}
-			// If variable not found, don't output anything (bash behavior)
+			// Expanded unless it's inside single quotes, like in the shell
+			output.text("$"+el.Name, e.expandShellVariables)
 		case parser.BacktickElement:
-			// For native echo, we could execute the backtick command
-			// but for simplicity, we'll fall back to the full command string
-			// This is an edge case that's less common with @echo
-			cmdStr := e.commandToString(cmd)
-			// Remove the "echo " prefix
-			cmdStr = strings.TrimSpace(strings.TrimPrefix(cmdStr, "echo"))
-			fmt.Printf("%s %s\n", color.FaintText("│"), cmdStr)
-			return nil
+			output.value(el.Source())
 		case parser.ExpressionElement:
 			// Evaluate the expression
-			val := e.expressionToString(el.Expression)
-			output.WriteString(val)
+			output.value(e.expressionToString(el.Expression))
 		}
 	}
-
-	// Print with colored pipe prefix
-	fmt.Printf("%s %s\n", color.FaintText("│"), output.String())
-	return nil
+	return output.String()
 }
 
-// stripQuotesForEcho removes quotes and expands variables for echo command
-// It handles multiple quoted sections within a single string
-func (e *Evaluator) stripQuotesForEcho(s string, isFirstArg bool) string {
-	// Don't trim! We need to preserve spaces inside quotes
-	// If the entire string is a single quoted section, handle it simply
-	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' && !strings.Contains(s[1:len(s)-1], "\"") {
-		return e.expandShellVariables(s[1 : len(s)-1])
-	} else if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' && !strings.Contains(s[1:len(s)-1], "'") {
-		// Single quotes - no variable expansion
-		return s[1 : len(s)-1]
+// isFailCommand reports whether a command is the fail "message" built-in
+func isFailCommand(cmd parser.Command) bool {
+	if len(cmd.Elements) == 0 {
+		return false
 	}
+	str, ok := cmd.Elements[0].(parser.StringElement)
+	if !ok {
+		return false
+	}
+	trimmed := strings.TrimSpace(str.Value)
+	return trimmed == "fail" || strings.HasPrefix(trimmed, "fail ")
+}
 
-	// Handle strings with multiple quoted sections or mixed quoted/unquoted parts
-	// Process character by character, removing quotes and expanding variables in double-quoted sections
-	var result strings.Builder
-	inDoubleQuote := false
-	inSingleQuote := false
-
-	for i := 0; i < len(s); i++ {
-		ch := s[i]
+// executeFail stops the task with the message of a fail "message" command
+func (e *Evaluator) executeFail(cmd parser.Command, isLast bool) error {
+	message := e.builtinArgs(cmd, "fail")
+	if err := e.takeExprError(); err != nil {
+		return err
+	}
 
-		if ch == '"' && !inSingleQuote {
-			// Toggle double quote state, but don't include the quote character
-			inDoubleQuote = !inDoubleQuote
-			continue
-		} else if ch == '\'' && !inDoubleQuote {
-			// Toggle single quote state, but don't include the quote character
-			inSingleQuote = !inSingleQuote
-			continue
+	if !cmd.Silent {
+		prefix := "├"
+		if isLast {
+			prefix = "└"
 		}
-
-		result.WriteByte(ch)
+		fmt.Printf("%s %s\n", color.FaintText(prefix), e.commandToString(cmd))
 	}
-
-	// Expand variables in the result (respecting the quoting context)
-	return e.expandShellVariables(result.String())
+	if message == "" {
+		return errors.New("failed")
+	}
+	return errors.New(message)
 }
 
 // unquoteString removes surrounding quotes and expands shell variables
@@ -402,34 +1496,18 @@ func (e *Evaluator) unquoteString(s string) string {
 	return s
 }
 
-// expandShellVariables expands ${VAR} and $VAR syntax
-func (e *Evaluator) expandShellVariables(s string) string {
-	// Expand ${VAR} syntax
-	result := os.Expand(s, func(key string) string {
-		// Check evaluator environment first
-		if val, ok := e.env[key]; ok {
-			return val
-		}
-		// Fall back to system environment
-		return os.Getenv(key)
-	})
-
-	return result
-}
-
 // commandToString converts a command to an executable string
 func (e *Evaluator) commandToString(cmd parser.Command) string {
 	var parts []string
+	var quotes shellQuotes
 
 	for _, elem := range cmd.Elements {
 		switch el := elem.(type) {
 		case parser.StringElement:
-			parts = append(parts, el.Value)
+			parts = append(parts, quotes.literalDollars(el.Value))
 		case parser.VariableElement:
 			// For now, use environment variable or empty string
-			if val, ok := e.env[el.Name]; ok {
-				parts = append(parts, val)
-			} else if val, ok := os.LookupEnv(el.Name); ok {
+			if val, ok := e.lookupVariable(el.Name); ok {
 				parts = append(parts, val)
 			} else {
 				// If we don't have it, just include as-is (shell will evaluate)
@@ -437,7 +1515,7 @@ func (e *Evaluator) commandToString(cmd parser.Command) string {
 			}
 		case parser.BacktickElement:
 			// For now, include the backtick command as-is (shell will evaluate)
-			parts = append(parts, "`"+el.Command+"`")
+			parts = append(parts, el.Source())
 		case parser.ExpressionElement:
 			// For now, convert expression to string representation
 			parts = append(parts, e.expressionToString(el.Expression))
@@ -449,6 +1527,44 @@ func (e *Evaluator) commandToString(cmd parser.Command) string {
 	return strings.Join(parts, "")
 }
 
+// shellQuotes tracks whether the literal text of a command is inside single
+// or double quotes, across its elements
+type shellQuotes struct {
+	single bool
+	double bool
+}
+
+// literalDollars returns the command text s with the escaped dollars the
+// parser wrote as \$ turned into a bare $ inside single quotes, where the
+// shell would keep the backslash
+func (q *shellQuotes) literalDollars(s string) string {
+	if !strings.Contains(s, "\\$") && !strings.ContainsAny(s, "'\"") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case q.single && c == '\\' && i+1 < len(s) && s[i+1] == '$':
+			b.WriteByte('$')
+			i++
+			continue
+		case q.single:
+			q.single = c != '\''
+		case c == '\\' && i+1 < len(s):
+			b.WriteByte(c)
+			i++
+			c = s[i]
+		case c == '\'' && !q.double:
+			q.single = true
+		case c == '"':
+			q.double = !q.double
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
 // expressionToString converts an expression to a string (simplified for now)
 func (e *Evaluator) expressionToString(expr parser.Expression) string {
 	switch ex := expr.(type) {
@@ -457,6 +1573,17 @@ func (e *Evaluator) expressionToString(expr parser.Expression) string {
 		if val, ok := e.env[ex.Name]; ok {
 			return val
 		}
+		if val, ok := builtinIdentifier(ex.Name); ok {
+			return val
+		}
+		// args is ARGS, as in {{args}}
+		name := ex.Name
+		if name == "args" {
+			name = "ARGS"
+		}
+		if val, ok := e.argsVariable(name); ok {
+			return val
+		}
 		if val, ok := os.LookupEnv(ex.Name); ok {
 			return val
 		}
@@ -464,30 +1591,273 @@ func (e *Evaluator) expressionToString(expr parser.Expression) string {
 	case parser.StringLiteral:
 		return ex.Value
 	case parser.AccessId:
-		switch fmt.Sprint(ex.Object) {
-		case "env":
-			// Look up in environment
-			if val, ok := e.env[ex.Property]; ok {
-				return val
-			}
-			if val, ok := os.LookupEnv(ex.Property); ok {
-				return val
-			}
+		path, ok := accessPath(ex.Object)
+		if !ok {
 			return ""
 		}
-
-		// For now, just return empty string for complex expressions
-		// This will be implemented properly later
-		return ""
+		if path == "env" {
+			val, _ := e.lookupEnv(ex.Property)
+			return val
+		}
+		if val, ok := e.taskIdentifier(path, ex.Property); ok {
+			return val
+		}
+		// A namespace variable, like docker.IMAGE_NAME
+		return e.namespaceVars[path][ex.Property]
+	case parser.NumberLiteral:
+		return strconv.FormatFloat(ex.Value, 'f', -1, 64)
+	case parser.BoolLiteral:
+		return strconv.FormatBool(ex.Value)
 	case parser.Or:
 		// Evaluate left side first
 		left := e.expressionToString(ex.Left)
-		if left != "" {
+		if isTruthy(left) {
+			return left
+		}
+		// If left is falsy, evaluate right
+		return e.expressionToString(ex.Right)
+	case parser.And:
+		left := e.expressionToString(ex.Left)
+		if !isTruthy(left) {
 			return left
 		}
-		// If left is empty, evaluate right
 		return e.expressionToString(ex.Right)
+	case parser.Concat:
+		return e.expressionToString(ex.Left) + e.expressionToString(ex.Right)
+	case parser.Compare:
+		left := e.expressionToString(ex.Left)
+		right := e.expressionToString(ex.Right)
+		return strconv.FormatBool(compareValues(ex.Op, left, right))
+	case parser.FuncCall:
+		return e.callFunction(ex)
+	default:
+		return ""
+	}
+}
+
+// builtinIdentifier returns the value of identifiers quake defines in
+// expressions: os and arch, the platform quake runs on (like linux and amd64).
+// Quakefile variables of the same name take precedence.
+func builtinIdentifier(name string) (string, bool) {
+	switch name {
+	case "os":
+		return runtime.GOOS, true
+	case "arch":
+		return runtime.GOARCH, true
+	}
+	return "", false
+}
+
+// taskIdentifier returns the value of task.name, the running task's full
+// name, and task.args, its arguments separated by spaces
+func (e *Evaluator) taskIdentifier(path, property string) (string, bool) {
+	if path != "task" {
+		return "", false
+	}
+	switch property {
+	case "name":
+		return e.taskName, true
+	case "args":
+		return strings.Join(e.taskArgs, " "), true
+	}
+	return "", false
+}
+
+// accessPath turns the object of a dot access into a namespace path, so
+// a.b in a.b.NAME becomes a:b
+func accessPath(expr parser.Expression) (string, bool) {
+	switch ex := expr.(type) {
+	case parser.Identifier:
+		return ex.Name, true
+	case parser.AccessId:
+		prefix, ok := accessPath(ex.Object)
+		if !ok {
+			return "", false
+		}
+		return prefix + ":" + ex.Property, true
+	}
+	return "", false
+}
+
+// callFunction evaluates a function call in an expression. Failures are
+// recorded for takeExprError and evaluate to "".
+func (e *Evaluator) callFunction(call parser.FuncCall) string {
+	switch call.Name {
+	case "task":
+		if len(call.Args) != 1 {
+			e.setExprError(fmt.Errorf("task() takes 1 argument, got %d", len(call.Args)))
+			return ""
+		}
+		// Don't run anything while planning; show the call instead
+		if e.planning {
+			return "{{" + parser.FormatExpression(call) + "}}"
+		}
+		out, err := e.callTask(e.expressionToString(call.Args[0]))
+		if err != nil {
+			e.setExprError(err)
+			return ""
+		}
+		return out
+	case "env.require":
+		if len(call.Args) != 1 {
+			e.setExprError(fmt.Errorf("env.require() takes 1 argument, got %d", len(call.Args)))
+			return ""
+		}
+		name := e.expressionToString(call.Args[0])
+		val, ok := e.lookupEnv(name)
+		if !ok {
+			e.setExprError(&requiredEnvError{name: name})
+		}
+		return val
+	case "file":
+		if len(call.Args) != 1 {
+			e.setExprError(fmt.Errorf("file() takes 1 argument, got %d", len(call.Args)))
+			return ""
+		}
+		return e.readFile(e.expressionToString(call.Args[0]))
 	default:
+		e.setExprError(fmt.Errorf("unknown function %s()", call.Name))
+		return ""
+	}
+}
+
+// readFile returns the trimmed contents of a file for file("path"). Relative
+// paths are from the main Quakefile's directory, or the current directory if
+// it isn't known. A file that can't be read is an error in strict mode and
+// empty otherwise.
+func (e *Evaluator) readFile(path string) string {
+	full := path
+	if !filepath.IsAbs(path) && e.quakefile.Dir != "" {
+		full = filepath.Join(e.quakefile.Dir, path)
+	}
+	data, err := os.ReadFile(full)
+	if err != nil {
+		err = fmt.Errorf("file(%q) failed: %w", path, err)
+		if e.strict {
+			e.setExprError(err)
+		} else {
+			// Reported if --strict-vars is turned on once variables are loaded
+			e.varErrors = append(e.varErrors, err)
+		}
 		return ""
 	}
+	return strings.TrimSpace(string(data))
+}
+
+// lookupEnv looks up env.name: a Quakefile variable, else the system
+// environment
+func (e *Evaluator) lookupEnv(name string) (string, bool) {
+	if val, ok := e.env[name]; ok {
+		return val, true
+	}
+	return os.LookupEnv(name)
+}
+
+// callTask runs a task and returns its trimmed stdout for task("name"). Each
+// task's output is cached, so it runs at most once per evaluator.
+func (e *Evaluator) callTask(name string) (string, error) {
+	if out, ok := e.taskOutputs[name]; ok {
+		return out, nil
+	}
+	if e.calling[name] {
+		return "", fmt.Errorf("task '%s' calls itself through task()", name)
+	}
+
+	if e.calling == nil {
+		e.calling = make(map[string]bool)
+	}
+	e.calling[name] = true
+	defer delete(e.calling, name)
+
+	var buf bytes.Buffer
+	oldStdout := e.stdout
+	e.stdout = &buf
+	err := e.RunTask(name)
+	e.stdout = oldStdout
+	if err != nil {
+		return "", fmt.Errorf("task(%q) failed: %w", name, err)
+	}
+
+	out := strings.TrimSpace(buf.String())
+	if e.taskOutputs == nil {
+		e.taskOutputs = make(map[string]string)
+	}
+	e.taskOutputs[name] = out
+	return out, nil
+}
+
+// setExprError records the first error from evaluating an expression
+func (e *Evaluator) setExprError(err error) {
+	if e.exprErr == nil {
+		e.exprErr = err
+	}
+}
+
+// takeExprError returns and clears the error recorded while evaluating expressions
+func (e *Evaluator) takeExprError() error {
+	err := e.exprErr
+	e.exprErr = nil
+	return err
+}
+
+// EvalExpression evaluates an expression as written between {{ and }}, with
+// env as its variables, without loading a Quakefile. Names not in env are
+// looked up in the process environment.
+func EvalExpression(expr string, env map[string]string) (string, error) {
+	parsed, err := parser.ParseExpression(expr)
+	if err != nil {
+		return "", err
+	}
+
+	e := &Evaluator{quakefile: &parser.QuakeFile{}, env: maps.Clone(env)}
+	if e.env == nil {
+		e.env = make(map[string]string)
+	}
+	value := e.expressionToString(parsed)
+	if err := e.takeExprError(); err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// isTruthy reports whether an expression value counts as true for || and &&.
+// The empty string and "false" are falsy; everything else, including "0", is truthy.
+// a || b yields a if it's truthy, else b; a && b yields a if it's falsy, else b.
+func isTruthy(s string) bool {
+	return s != "" && s != "false"
+}
+
+// compareValues applies a comparison operator. Operands are compared as numbers
+// when both parse as numbers, otherwise as strings.
+func compareValues(op, left, right string) bool {
+	cmp := strings.Compare(left, right)
+	if l, err := strconv.ParseFloat(left, 64); err == nil {
+		if r, err := strconv.ParseFloat(right, 64); err == nil {
+			switch {
+			case l < r:
+				cmp = -1
+			case l > r:
+				cmp = 1
+			default:
+				cmp = 0
+			}
+		}
+	}
+
+	switch op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	default:
+		return false
+	}
 }
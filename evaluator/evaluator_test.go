@@ -0,0 +1,1726 @@
+package evaluator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"miren.dev/quake/parser"
+)
+
+func parseQuakefile(t *testing.T, input string) *parser.QuakeFile {
+	t.Helper()
+	result, ok, err := parser.ParseQuakefile(input)
+	require.True(t, ok, "parsing should succeed")
+	require.NoError(t, err, "should not return error")
+	return &result
+}
+
+func TestSetStatementAssignsTaskLocalVariable(t *testing.T) {
+	out := t.TempDir() + "/out"
+	qf := parseQuakefile(t, `task capture {
+    set TOKEN = `+"`echo secret-token`"+`
+    echo $TOKEN > `+out+`
+}`)
+
+	eval := New(qf)
+	require.NoError(t, eval.RunTask("capture"))
+
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "secret-token\n", string(data))
+
+	_, exists := eval.env["TOKEN"]
+	require.False(t, exists, "set variables should not leak out of the task")
+}
+
+func TestExpandShellVariablesDefaults(t *testing.T) {
+	t.Setenv("QUAKE_TEST_OS_VAR", "from-os")
+	t.Setenv("QUAKE_TEST_EMPTY_OS_VAR", "")
+
+	eval := New(parseQuakefile(t, `GREETING = "hi"
+EMPTY = ""
+FALLBACK = "fallback"`))
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"plain reference", "$GREETING world", "hi world"},
+		{"braced reference", "${GREETING}world", "hiworld"},
+		{"default when set", "${GREETING:-hello}", "hi"},
+		{"default when unset", "${MISSING:-hello}", "hello"},
+		{"default when empty", "${EMPTY:-hello}", "hello"},
+		{"dash default keeps empty", "${EMPTY-hello}", ""},
+		{"dash default when unset", "${MISSING-hello}", "hello"},
+		{"alternate when set", "${GREETING:+alt}", "alt"},
+		{"alternate when unset", "${MISSING:+alt}", ""},
+		{"alternate when empty", "${EMPTY:+alt}", ""},
+		{"plus alternate when empty", "${EMPTY+alt}", "alt"},
+		{"os environment", "${QUAKE_TEST_OS_VAR:-nope}", "from-os"},
+		{"empty os environment", "${QUAKE_TEST_EMPTY_OS_VAR:-default}", "default"},
+		{"nested default", "${MISSING:-$FALLBACK}", "fallback"},
+		{"nested braced default", "${MISSING:-${ALSO_MISSING:-deep}}", "deep"},
+		{"lone dollar", "cost: $ 5", "cost: $ 5"},
+		{"escaped dollar", `cost: \$5 \$GREETING`, "cost: $5 $GREETING"},
+		{"double dollar", "cost: $$5 $$GREETING", "cost: $5 $GREETING"},
+		{"unterminated brace", "${GREETING", "${GREETING"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, eval.expandShellVariables(tt.input))
+		})
+	}
+}
+
+func TestFileDependencies(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	qf := parseQuakefile(t, `task output.txt => input.txt {
+    echo built >> runs.txt
+    touch output.txt
+}`)
+
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, os.WriteFile("input.txt", []byte("in"), 0644))
+	require.NoError(t, os.Chtimes("input.txt", past, past))
+
+	runs := func() int {
+		data, err := os.ReadFile("runs.txt")
+		if os.IsNotExist(err) {
+			return 0
+		}
+		require.NoError(t, err)
+		return strings.Count(string(data), "built")
+	}
+
+	// Target doesn't exist yet, so it is built
+	require.NoError(t, New(qf).RunTask("output.txt"))
+	require.Equal(t, 1, runs())
+
+	// Target is newer than its prerequisite, so it is skipped
+	require.NoError(t, New(qf).RunTask("output.txt"))
+	require.Equal(t, 1, runs())
+
+	// Always-make forces a rebuild
+	eval := New(qf)
+	eval.SetAlwaysMake(true)
+	require.NoError(t, eval.RunTask("output.txt"))
+	require.Equal(t, 2, runs())
+
+	// Touching the prerequisite makes the target stale again
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes("input.txt", future, future))
+	require.NoError(t, New(qf).RunTask("output.txt"))
+	require.Equal(t, 3, runs())
+}
+
+func TestOutputsAsTargets(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	qf := parseQuakefile(t, `task build(outputs: ["app", "app.sha256"]) => main.c {
+    echo built >> runs.txt
+    touch app app.sha256
+}`)
+
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, os.WriteFile("main.c", []byte("int main;"), 0644))
+	require.NoError(t, os.Chtimes("main.c", past, past))
+
+	runs := func() int {
+		data, err := os.ReadFile("runs.txt")
+		require.NoError(t, err)
+		return strings.Count(string(data), "built")
+	}
+
+	require.NoError(t, New(qf).RunTask("build"))
+	require.Equal(t, 1, runs())
+
+	// Both outputs are newer than main.c
+	require.NoError(t, New(qf).RunTask("build"))
+	require.Equal(t, 1, runs())
+
+	// A missing output makes the task stale
+	require.NoError(t, os.Remove("app.sha256"))
+	require.NoError(t, New(qf).RunTask("build"))
+	require.Equal(t, 2, runs())
+}
+
+func TestMissingDependencyIsNotAFile(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	qf := parseQuakefile(t, `task output.txt => missing.txt {
+    touch output.txt
+}`)
+
+	err := New(qf).RunTask("output.txt")
+	require.ErrorContains(t, err, "task 'missing.txt' not found")
+}
+
+func TestCommandErrorCapturesOutput(t *testing.T) {
+	qf := parseQuakefile(t, `task fail {
+    echo one && echo two && echo three && exit 3
+}
+
+task fail_stderr {
+    echo oops >&2 && false
+}`)
+
+	eval := New(qf)
+	eval.SetCaptureOutput(2)
+	err := eval.RunTask("fail")
+
+	var cmdErr *CommandError
+	require.ErrorAs(t, err, &cmdErr)
+	require.Equal(t, "two\nthree", cmdErr.Output)
+	require.Equal(t, "echo one && echo two && echo three && exit 3", cmdErr.Command)
+	require.EqualError(t, err, "command failed: exit status 3")
+
+	// Stderr is captured too
+	err = eval.RunTask("fail_stderr")
+	require.ErrorAs(t, err, &cmdErr)
+	require.Equal(t, "oops", cmdErr.Output)
+}
+
+func TestCommandErrorWithoutCapture(t *testing.T) {
+	qf := parseQuakefile(t, `task fail {
+    echo noisy && false
+}`)
+
+	err := New(qf).RunTask("fail")
+
+	var cmdErr *CommandError
+	require.ErrorAs(t, err, &cmdErr)
+	require.Empty(t, cmdErr.Output, "output is only captured when enabled")
+}
+
+func TestPlanTask(t *testing.T) {
+	qf := parseQuakefile(t, `VERSION = "1.0"
+API_KEY = "s3cr3t"
+
+task clean {
+    rm -rf build
+}
+
+task build => clean {
+    go build -o build/app-$VERSION .
+}
+
+task test => clean {
+    go test ./...
+}
+
+task deploy(env) => build, test {
+    set TOKEN = `+"`fetch-token`"+`
+    deploy --env {{env}} --version $VERSION
+}`)
+
+	eval := New(qf)
+	plan := NewPlan("/project")
+	require.NoError(t, eval.PlanTask(plan, "deploy", []string{"prod"}))
+
+	data, err := json.Marshal(plan)
+	require.NoError(t, err)
+
+	require.JSONEq(t, `{
+		"working_dir": "/project",
+		"tasks": [
+			{
+				"name": "clean",
+				"commands": ["rm -rf build"],
+				"env": {"VERSION": "1.0", "API_KEY": "********", "env": "prod"},
+				"working_dir": "/project"
+			},
+			{
+				"name": "build",
+				"dependencies": ["clean"],
+				"commands": ["go build -o build/app-1.0 ."],
+				"env": {"VERSION": "1.0", "API_KEY": "********", "env": "prod"},
+				"working_dir": "/project"
+			},
+			{
+				"name": "test",
+				"dependencies": ["clean"],
+				"commands": ["go test ./..."],
+				"env": {"VERSION": "1.0", "API_KEY": "********", "env": "prod"},
+				"working_dir": "/project"
+			},
+			{
+				"name": "deploy",
+				"args": ["prod"],
+				"dependencies": ["build", "test"],
+				"commands": ["set TOKEN = `+"`fetch-token`"+`", "deploy --env prod --version 1.0"],
+				"env": {"VERSION": "1.0", "API_KEY": "********", "env": "prod"},
+				"working_dir": "/project"
+			}
+		]
+	}`, string(data))
+}
+
+func TestPlanTaskNotFound(t *testing.T) {
+	qf := parseQuakefile(t, `task build => missing {
+    make
+}`)
+
+	err := New(qf).PlanTask(NewPlan("/project"), "build", nil)
+	require.EqualError(t, err, "dependency 'missing' failed: task 'missing' not found")
+}
+
+func TestExportedVariablesReachSubprocesses(t *testing.T) {
+	dir := t.TempDir()
+	qf := parseQuakefile(t, `export QUAKE_TEST_EXPORTED = "0"
+QUAKE_TEST_LOCAL = "hidden"
+
+task env {
+    printenv QUAKE_TEST_EXPORTED > `+dir+`/exported.txt
+    -printenv QUAKE_TEST_LOCAL > `+dir+`/local.txt
+}`)
+
+	require.NoError(t, New(qf).RunTask("env"))
+
+	data, err := os.ReadFile(dir + "/exported.txt")
+	require.NoError(t, err)
+	require.Equal(t, "0\n", string(data))
+
+	// Non-exported variables are only substituted, never added to the environment
+	data, err = os.ReadFile(dir + "/local.txt")
+	require.NoError(t, err)
+	require.Empty(t, string(data))
+}
+
+func TestTaskRetries(t *testing.T) {
+	dir := t.TempDir()
+	// Fails until the third attempt
+	qf := parseQuakefile(t, `task flaky(retries: 3, backoff: "1ms") {
+    echo attempt >> `+dir+`/attempts.txt
+    test $(wc -l < `+dir+`/attempts.txt) -ge 3
+}
+
+task broken(retries: 2) {
+    echo attempt >> `+dir+`/broken.txt
+    false
+}
+
+task invalid(retries: lots) {
+    true
+}`)
+
+	require.NoError(t, New(qf).RunTask("flaky"))
+	data, err := os.ReadFile(dir + "/attempts.txt")
+	require.NoError(t, err)
+	require.Equal(t, 3, strings.Count(string(data), "attempt"))
+
+	// Fails after the initial attempt plus two retries
+	require.Error(t, New(qf).RunTask("broken"))
+	data, err = os.ReadFile(dir + "/broken.txt")
+	require.NoError(t, err)
+	require.Equal(t, 3, strings.Count(string(data), "attempt"))
+
+	require.EqualError(t, New(qf).RunTask("invalid"), `task 'invalid' has invalid retries attribute "lots"`)
+}
+
+func TestShellDirective(t *testing.T) {
+	dir := t.TempDir()
+	qf := parseQuakefile(t, `shell = "bash"
+
+task bashism {
+    [[ "quake" == q* ]] && echo matched > `+dir+`/bash.txt
+}
+
+task posix(shell: "sh") {
+    echo ok > `+dir+`/sh.txt
+}
+
+task missing(shell: "no-such-shell-quake") {
+    echo never > `+dir+`/missing.txt
+}`)
+
+	require.NoError(t, New(qf).RunTask("bashism"))
+	data, err := os.ReadFile(dir + "/bash.txt")
+	require.NoError(t, err)
+	require.Equal(t, "matched\n", string(data))
+
+	require.NoError(t, New(qf).RunTask("posix"))
+	_, err = os.Stat(dir + "/sh.txt")
+	require.NoError(t, err)
+
+	err = New(qf).RunTask("missing")
+	require.ErrorContains(t, err, "task 'missing': shell 'no-such-shell-quake' not found")
+	_, err = os.Stat(dir + "/missing.txt")
+	require.True(t, os.IsNotExist(err), "no commands run when the shell is missing")
+}
+
+func TestShellFlags(t *testing.T) {
+	dir := t.TempDir()
+	qf := parseQuakefile(t, `shell_flags = "-eu"
+
+task strict {
+    echo "$QUAKE_UNSET_VARIABLE" > `+dir+`/strict.txt
+}
+
+task relaxed(shell_flags: "") {
+    echo "$QUAKE_UNSET_VARIABLE" > `+dir+`/relaxed.txt
+}
+
+task invalid(shell_flags: "-e u") {
+    echo never > `+dir+`/invalid.txt
+}`)
+	require.Equal(t, "-eu", qf.ShellFlags)
+
+	require.Error(t, New(qf).RunTask("strict"))
+	_, err := os.Stat(dir + "/strict.txt")
+	require.True(t, os.IsNotExist(err), "-u stops the command at the unset variable")
+
+	require.NoError(t, New(qf).RunTask("relaxed"))
+	data, err := os.ReadFile(dir + "/relaxed.txt")
+	require.NoError(t, err)
+	require.Equal(t, "\n", string(data))
+
+	require.EqualError(t, New(qf).RunTask("invalid"), "task 'invalid': invalid shell flag 'u' (flags must start with -)")
+	require.EqualError(t, checkShellFlags("-c"), "invalid shell flag '-c' (it's added by quake)")
+}
+
+func TestRunIn(t *testing.T) {
+	// A fake docker records how it was run
+	bin := t.TempDir()
+	out := t.TempDir() + "/docker.txt"
+	script := "#!/bin/sh\nprintf '%s|' \"$@\" > " + out + "\necho \"TOKEN=$TOKEN\" >> " + out + "\n"
+	require.NoError(t, os.WriteFile(bin+"/docker", []byte(script), 0755))
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	dir := t.TempDir()
+	t.Chdir(dir)
+	qf := parseQuakefile(t, `export TOKEN = "abc"
+
+task build(run_in: "golang:1.22") {
+    go build ./...
+}`)
+
+	require.NoError(t, New(qf).RunTask("build"))
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "run|--rm|-i|-v|"+dir+":/work|-w|/work|-e|TOKEN|golang:1.22|sh|-c|go build ./...|TOKEN=abc\n", string(data))
+
+	// Without stdin, the container doesn't keep it open
+	cmd := New(qf).containerCommand("golang:1.22", []string{"true"}, nil, io.Discard)
+	require.Equal(t, []string{"docker", "run", "--rm", "-v", dir + ":/work", "-w", "/work", "-e", "TOKEN", "golang:1.22", "true"}, cmd.Args)
+
+	qf.Config = map[string]string{"container_runtime": "no-such-runtime-quake"}
+	err = New(qf).RunTask("build")
+	require.ErrorContains(t, err, "task 'build': run_in needs no-such-runtime-quake, which isn't installed")
+}
+
+func TestExpressionLiteralsAndComparisons(t *testing.T) {
+	qf := parseQuakefile(t, `replicas = "12"
+enabled = "true"
+name = "beta"
+
+big = {{replicas > 3}}
+small = {{replicas < 3}}
+numeric = {{replicas == 12.0}}
+lexical = {{name < "alpha"}}
+flag = {{enabled == true}}
+both = {{enabled && name}}
+neither = {{missing && name}}
+fallback = {{false || 7}}
+`)
+
+	eval := New(qf)
+	expected := map[string]string{
+		"big":      "true", // 12 > 3 numerically, though "12" < "3" as strings
+		"small":    "false",
+		"numeric":  "true",
+		"lexical":  "false", // "beta" > "alpha"
+		"flag":     "true",
+		"both":     "beta",
+		"neither":  "",
+		"fallback": "7", // false is falsy
+	}
+	for name, value := range expected {
+		require.Equal(t, value, eval.env[name], name)
+	}
+}
+
+func TestEvalExpression(t *testing.T) {
+	env := map[string]string{"replicas": "12", "name": "beta"}
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{`replicas > 3`, "true"},
+		{`missing || "dev"`, "dev"},
+		{` name == "beta" && name `, "beta"},
+		{`os`, runtime.GOOS},
+		{`name + "-" + replicas`, "beta-12"},
+		{`missing + "x" || "dev"`, "x"},
+		{`name + "-rc" == "beta-rc"`, "true"},
+	}
+	for _, tt := range tests {
+		value, err := EvalExpression(tt.expr, env)
+		require.NoError(t, err, tt.expr)
+		require.Equal(t, tt.expected, value, tt.expr)
+	}
+
+	_, err := EvalExpression(`env.require("QUAKE_TEST_UNSET_VARIABLE")`, nil)
+	require.EqualError(t, err, "required environment variable QUAKE_TEST_UNSET_VARIABLE is not set")
+
+	_, err = EvalExpression(`name ==`, env)
+	require.ErrorContains(t, err, `invalid expression "name =="`)
+}
+
+func TestBuiltinIdentifiers(t *testing.T) {
+	qf := parseQuakefile(t, `goos = {{os}}
+goarch = {{arch}}
+windows = {{os == "windows"}}
+rm = {{os == "windows" && "rmdir /s" || "rm -rf"}}
+`)
+
+	eval := New(qf)
+	require.Equal(t, runtime.GOOS, eval.env["goos"])
+	require.Equal(t, runtime.GOARCH, eval.env["goarch"])
+	require.Equal(t, strconv.FormatBool(runtime.GOOS == "windows"), eval.env["windows"])
+	if runtime.GOOS == "windows" {
+		require.Equal(t, "rmdir /s", eval.env["rm"])
+	} else {
+		require.Equal(t, "rm -rf", eval.env["rm"])
+	}
+
+	// Quakefile variables take precedence
+	qf = parseQuakefile(t, `os = "plan9"
+goos = {{os}}
+`)
+	require.Equal(t, "plan9", New(qf).env["goos"])
+}
+
+func TestTimingsRecordsEachTask(t *testing.T) {
+	qf := parseQuakefile(t, `task all => left, right {
+    sleep 0.05
+}
+
+task left => shared {
+    true
+}
+
+task right => shared {
+    true
+}
+
+task shared {
+    sleep 0.15
+}`)
+
+	timings := NewTimings()
+	eval := New(qf)
+	eval.SetTimings(timings)
+	require.NoError(t, eval.RunTask("all"))
+
+	// A task's time excludes its dependencies, and the shared dependency only
+	// runs once
+	require.GreaterOrEqual(t, timings.Duration("all"), 50*time.Millisecond)
+	require.GreaterOrEqual(t, timings.Duration("shared"), 150*time.Millisecond)
+	require.Less(t, timings.Duration("shared"), 300*time.Millisecond)
+	require.Less(t, timings.Duration("all"), timings.Duration("shared"))
+	require.Less(t, timings.Duration("left"), timings.Duration("shared"))
+
+	var buf strings.Builder
+	timings.WriteSummary(&buf, 1500*time.Millisecond)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Equal(t, "Timings:", lines[0])
+	require.Len(t, lines, 6)
+	require.True(t, strings.HasPrefix(strings.TrimSpace(lines[1]), "shared"), "slowest task first")
+	require.Equal(t, "  total   1.5s", lines[5])
+}
+
+func TestSingleQuotedVariablesAreLiteral(t *testing.T) {
+	qf := parseQuakefile(t, `NAME = 'myapp'
+PATTERN = '$NAME-\n'
+QUOTED = "$NAME"
+`)
+
+	eval := New(qf)
+	require.Equal(t, "myapp", eval.env["NAME"])
+	require.Equal(t, `$NAME-\n`, eval.env["PATTERN"])
+	require.Equal(t, "myapp", eval.env["QUOTED"])
+}
+
+func TestStrictVariables(t *testing.T) {
+	qf := parseQuakefile(t, `VERSION = `+"`echo oops >&2; exit 1`"+`
+
+task show {
+    true
+}
+
+task local {
+    set TOKEN = `+"`exit 3`"+`
+    true
+}`)
+
+	// By default a failing command substitution leaves the variable empty
+	eval := New(qf)
+	require.Equal(t, "", eval.env["VERSION"])
+	require.NoError(t, eval.RunTask("show"))
+
+	eval = New(qf)
+	eval.SetStrictVariables(true)
+	err := eval.RunTask("show")
+	require.EqualError(t, err, "failed to evaluate VERSION: oops")
+
+	// Task-local set statements are checked too
+	qf.Variables = nil
+	eval = New(qf)
+	eval.SetStrictVariables(true)
+	require.NoError(t, eval.RunTask("show"))
+	err = eval.RunTask("local")
+	require.ErrorContains(t, err, "failed to evaluate TOKEN")
+}
+
+func TestSharedDependencyRunsOnce(t *testing.T) {
+	out := t.TempDir() + "/out"
+	qf := parseQuakefile(t, `task all => left, right {
+    echo all >> `+out+`
+}
+
+task left => shared {
+    echo left >> `+out+`
+}
+
+task right => shared {
+    echo right >> `+out+`
+}
+
+task shared {
+    echo shared >> `+out+`
+}`)
+
+	eval := New(qf)
+	require.NoError(t, eval.RunTask("all"))
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "shared\nleft\nright\nall\n", string(data))
+
+	// The next top-level task runs its dependencies again
+	require.NoError(t, eval.RunTask("left"))
+	data, err = os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "shared\nleft\nright\nall\nshared\nleft\n", string(data))
+}
+
+func TestParallelBlock(t *testing.T) {
+	dir := t.TempDir()
+	qf := parseQuakefile(t, `task build {
+    parallel {
+        sleep 0.3; echo a > `+dir+`/a
+        sleep 0.3; echo b > `+dir+`/b
+        sleep 0.3; echo c > `+dir+`/c
+    }
+}
+
+task failing {
+    parallel {
+        exit 1
+        -exit 2
+        exit 3
+    }
+}`)
+
+	eval := New(qf)
+	start := time.Now()
+	require.NoError(t, eval.RunTask("build"))
+	require.Less(t, time.Since(start), 800*time.Millisecond, "commands should run concurrently")
+	for _, name := range []string{"a", "b", "c"} {
+		require.FileExists(t, dir+"/"+name)
+	}
+
+	// Failures are aggregated, except for commands marked to continue on error
+	err := eval.RunTask("failing")
+	require.Error(t, err)
+	var joined interface{ Unwrap() []error }
+	require.ErrorAs(t, err, &joined)
+	var cmdErrs []*CommandError
+	for _, e := range joined.Unwrap() {
+		var cmdErr *CommandError
+		if errors.As(e, &cmdErr) {
+			cmdErrs = append(cmdErrs, cmdErr)
+		}
+	}
+	require.Len(t, cmdErrs, 2)
+	require.Equal(t, "exit 1", cmdErrs[0].Command)
+	require.Equal(t, "exit 3", cmdErrs[1].Command)
+}
+
+func TestParallelJobs(t *testing.T) {
+	qf := parseQuakefile(t, `task build {
+    parallel {
+        sleep 0.3
+        sleep 0.3
+        sleep 0.3
+    }
+}`)
+
+	// The front matter limits the block to one command at a time
+	qf.Config = map[string]string{"jobs": "1"}
+	start := time.Now()
+	require.NoError(t, New(qf).RunTask("build"))
+	require.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond, "commands should run one at a time")
+
+	// SetJobs wins over the front matter
+	eval := New(qf)
+	eval.SetJobs(3)
+	start = time.Now()
+	require.NoError(t, eval.RunTask("build"))
+	require.Less(t, time.Since(start), 800*time.Millisecond, "commands should run concurrently")
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var mu sync.Mutex
+	var buf strings.Builder
+	w := newPrefixWriter(&mu, &buf, "> ")
+
+	fmt.Fprint(w, "one\ntw")
+	require.Equal(t, "> one\n", buf.String(), "partial lines are held back")
+	fmt.Fprint(w, "o\nthree")
+	require.NoError(t, w.Flush())
+	require.Equal(t, "> one\n> two\n> three\n", buf.String())
+}
+
+func TestTaskFunction(t *testing.T) {
+	dir := t.TempDir()
+	qf := parseQuakefile(t, `VERSION = {{task("version")}}
+
+task version {
+    echo run >> `+dir+`/runs
+    echo "  1.2.3  "
+}
+
+task build {
+    echo "$VERSION-{{task("version")}}" > `+dir+`/out
+}
+
+task loop {
+    echo {{task("loop")}}
+}
+
+task broken {
+    echo {{task("missing")}}
+}`)
+
+	eval := New(qf)
+	require.NoError(t, eval.RunTask("build"))
+
+	data, err := os.ReadFile(dir + "/out")
+	require.NoError(t, err)
+	require.Equal(t, "1.2.3-1.2.3\n", string(data))
+
+	// The version task runs once; later calls use the cached output
+	runs, err := os.ReadFile(dir + "/runs")
+	require.NoError(t, err)
+	require.Equal(t, "run\n", string(runs))
+
+	require.ErrorContains(t, eval.RunTask("loop"), "task 'loop' calls itself through task()")
+	require.ErrorContains(t, eval.RunTask("broken"), "task(\"missing\") failed: task 'missing' not found")
+}
+
+func TestEscapedDollarInCommands(t *testing.T) {
+	out := t.TempDir() + "/out"
+	qf := parseQuakefile(t, `task price {
+    echo "Price: \$5" > `+out+`
+    echo "$$" >> `+out+`
+    echo '$$HOME \$PATH' "it's \$" >> `+out+`
+}
+
+task quoted {
+    @echo '$$HOME' "\$PATH"
+}`)
+
+	require.NoError(t, New(qf).RunTask("price"))
+
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "Price: $5\n$\n$HOME $PATH it's $\n", string(data))
+
+	// Native echo prints the same
+	var buf strings.Builder
+	eval := New(qf)
+	eval.stdout = &buf
+	require.NoError(t, eval.RunTask("quoted"))
+	require.Equal(t, "$HOME $PATH\n", buf.String())
+}
+
+func TestAppendVariables(t *testing.T) {
+	out := t.TempDir() + "/out"
+	qf := parseQuakefile(t, `CFLAGS = "-O2"
+CFLAGS += "-g"
+EXTRA += "-v"
+
+task build {
+    set CFLAGS += "-DDEBUG"
+    echo "$CFLAGS|$EXTRA" > `+out+`
+}`)
+
+	eval := New(qf)
+	require.Equal(t, "-O2 -g", eval.env["CFLAGS"])
+	require.Equal(t, "-v", eval.env["EXTRA"], "appending to an undefined variable defines it")
+
+	require.NoError(t, eval.RunTask("build"))
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "-O2 -g -DDEBUG|-v\n", string(data))
+	require.Equal(t, "-O2 -g", eval.env["CFLAGS"], "set += is task-local")
+}
+
+func TestCleanEnv(t *testing.T) {
+	t.Setenv("QUAKE_TEST_LEAK", "leaked")
+	dir := t.TempDir()
+	qf := parseQuakefile(t, `export TOKEN = "abc"
+
+task inherit {
+    env > `+dir+`/inherit
+}
+
+task hermetic(env: clean) {
+    env > `+dir+`/hermetic
+}
+
+task bad(env: "weird") {
+    true
+}`)
+
+	read := func(name string) string {
+		data, err := os.ReadFile(dir + "/" + name)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	eval := New(qf)
+	require.NoError(t, eval.RunTask("inherit"))
+	require.Contains(t, read("inherit"), "QUAKE_TEST_LEAK=leaked")
+	require.Contains(t, read("inherit"), "TOKEN=abc")
+
+	require.NoError(t, eval.RunTask("hermetic"))
+	require.NotContains(t, read("hermetic"), "QUAKE_TEST_LEAK")
+	require.Contains(t, read("hermetic"), "TOKEN=abc")
+	require.Contains(t, read("hermetic"), "PATH=")
+
+	// --clean-env applies to every task
+	eval.SetCleanEnv(true)
+	require.NoError(t, eval.RunTask("inherit"))
+	require.NotContains(t, read("inherit"), "QUAKE_TEST_LEAK")
+
+	require.ErrorContains(t, eval.RunTask("bad"), `task 'bad' has invalid env attribute "weird"`)
+}
+
+func TestHeredoc(t *testing.T) {
+	out := t.TempDir() + "/out"
+	qf := parseQuakefile(t, `NAME = "quake"
+
+task write {
+    cat <<EOF > `+out+`
+    hello $NAME
+      indented
+    EOF
+    cat <<'EOF' >> `+out+`
+    $NAME
+    EOF
+}`)
+
+	require.NoError(t, New(qf).RunTask("write"))
+
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "    hello quake\n      indented\n    $NAME\n", string(data))
+}
+
+func TestExplainVariable(t *testing.T) {
+	t.Setenv("QUAKE_TEST_EXPLAIN_EMPTY", "")
+	t.Setenv("QUAKE_TEST_EXPLAIN_OS", "from-os")
+	qf := parseQuakefile(t, `API_KEY = {{env.QUAKE_TEST_EXPLAIN_EMPTY || DEFAULT_KEY || "fallback"}}
+CFLAGS = "-O2"
+export CFLAGS += "-g"`)
+	qf.Variables = append([]parser.Variable{{Name: "DEFAULT_KEY", Value: `""`}}, qf.Variables...)
+
+	ex, err := ExplainVariable(qf, nil, "API_KEY")
+	require.NoError(t, err)
+	require.Equal(t, "fallback", ex.Value)
+	require.Equal(t, "Quakefile", ex.Source)
+	require.Equal(t, `Variable: API_KEY
+Definitions:
+  API_KEY = {{env.QUAKE_TEST_EXPLAIN_EMPTY || DEFAULT_KEY || "fallback"}} (expression)
+    env.QUAKE_TEST_EXPLAIN_EMPTY => "" (falsy, skipped)
+    DEFAULT_KEY => "" (falsy, skipped)
+    "fallback" => "fallback" (used)
+    => "fallback"
+Value: "fallback"
+Source: Quakefile
+`, ex.String())
+
+	ex, err = ExplainVariable(qf, nil, "CFLAGS")
+	require.NoError(t, err)
+	require.Len(t, ex.Definitions, 2)
+	require.Equal(t, "-O2", ex.Definitions[0].Value)
+	require.Equal(t, "-O2 -g", ex.Definitions[1].Value)
+	require.Contains(t, ex.String(), `export CFLAGS += "-g" (string)`)
+
+	// A command line override wins without evaluating the definitions
+	ex, err = ExplainVariable(qf, map[string]string{"CFLAGS": "-O0"}, "CFLAGS")
+	require.NoError(t, err)
+	require.Equal(t, "-O0", ex.Value)
+	require.Equal(t, "command line", ex.Source)
+	require.False(t, ex.Definitions[0].Evaluated)
+
+	ex, err = ExplainVariable(qf, nil, "QUAKE_TEST_EXPLAIN_OS")
+	require.NoError(t, err)
+	require.Equal(t, "from-os", ex.Value)
+	require.Equal(t, "environment", ex.Source)
+
+	_, err = ExplainVariable(qf, nil, "QUAKE_TEST_EXPLAIN_MISSING")
+	require.EqualError(t, err, "variable 'QUAKE_TEST_EXPLAIN_MISSING' is not defined in the Quakefile or the environment")
+}
+
+func TestPatternDependencies(t *testing.T) {
+	out := t.TempDir() + "/out"
+	qf := parseQuakefile(t, `task test => test* {
+    echo test >> `+out+`
+}
+
+task test-unit {
+    echo unit >> `+out+`
+}
+
+task test-api {
+    echo api >> `+out+`
+}
+
+task missing => lint-* {
+    echo missing
+}`)
+
+	eval := New(qf)
+	require.NoError(t, eval.RunTask("test"))
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "api\nunit\ntest\n", string(data), "matches run in sorted order, skipping the task itself")
+
+	require.EqualError(t, eval.RunTask("missing"), "task 'missing': dependency pattern 'lint-*' matches no tasks (end it with ? to make it optional)")
+}
+
+func TestInterrupt(t *testing.T) {
+	defer ResetInterrupt()
+
+	qf := parseQuakefile(t, `task slow {
+    sleep 30
+}
+
+task after {
+    echo after
+}`)
+	eval := New(qf)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- eval.RunTask("slow")
+	}()
+
+	require.Eventually(t, func() bool {
+		processes.Lock()
+		defer processes.Unlock()
+		return len(processes.running) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	start := time.Now()
+	Interrupt(os.Interrupt)
+
+	select {
+	case err := <-done:
+		require.Error(t, err)
+		require.Less(t, time.Since(start), interruptGrace+time.Second)
+	case <-time.After(10 * time.Second):
+		t.Fatal("task kept running after the interrupt")
+	}
+
+	require.True(t, Interrupted())
+	require.ErrorIs(t, eval.RunTask("after"), ErrInterrupted, "no new commands start once interrupted")
+}
+
+func TestOnError(t *testing.T) {
+	out := t.TempDir() + "/out"
+	qf := parseQuakefile(t, `onerror cleanup
+
+task build {
+    echo build >> `+out+`
+}
+
+task broken => build {
+    false
+}
+
+task deploy(onerror: rollback) {
+    false
+}
+
+task cleanup(failed) {
+    echo "cleanup $failed" >> `+out+`
+}
+
+task rollback(failed) {
+    echo "rollback $failed" >> `+out+`
+    false
+}`)
+
+	eval := New(qf)
+	err := eval.RunTask("broken")
+	require.Error(t, err)
+	require.ErrorContains(t, err, "exit status 1")
+
+	// The handler only runs once per evaluator
+	require.Error(t, eval.RunTask("broken"))
+
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "build\ncleanup broken\nbuild\n", string(data))
+
+	require.NoError(t, os.Remove(out))
+	err = New(qf).RunTask("deploy")
+	require.ErrorContains(t, err, "exit status 1", "a failing handler doesn't mask the original error")
+	require.NotContains(t, err.Error(), "rollback")
+
+	data, err = os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "rollback deploy\n", string(data), "the task's own handler replaces the Quakefile's")
+
+	// A failing dependency runs the handler of the task that depends on it
+	qf = parseQuakefile(t, `task compile {
+    false
+}
+
+task release(onerror: rollback) => compile {
+    echo release >> `+out+`
+}
+
+task rollback(failed) {
+    echo "rollback $failed" >> `+out+`
+}`)
+	require.NoError(t, os.Remove(out))
+	err = New(qf).RunTask("release")
+	require.ErrorContains(t, err, "dependency 'compile' failed")
+	data, err = os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "rollback release\n", string(data))
+}
+
+func TestNamespaceVariables(t *testing.T) {
+	t.Setenv("QUAKE_TEST_NS", "from env")
+	out := t.TempDir() + "/out"
+	qf := parseQuakefile(t, `VERSION = "1.0"
+IMAGE_TAG = "global"
+
+namespace docker {
+    IMAGE_NAME = "myapp"
+    IMAGE_TAG = "$VERSION"
+
+    task build {
+        echo "$IMAGE_NAME:$IMAGE_TAG" >> `+out+`
+    }
+
+    namespace compose {
+        FILE = "$IMAGE_NAME.yml"
+
+        task up {
+            echo "$FILE $IMAGE_TAG" >> `+out+`
+        }
+    }
+}
+
+task push {
+    echo "{{docker.IMAGE_NAME}} {{docker.compose.FILE}} $IMAGE_TAG {{env.QUAKE_TEST_NS}}" >> `+out+`
+}`)
+
+	eval := New(qf)
+	require.NoError(t, eval.RunTask("docker:build"))
+	require.NoError(t, eval.RunTask("docker:compose:up"))
+	require.NoError(t, eval.RunTask("push"))
+
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "myapp:1.0\nmyapp.yml 1.0\nmyapp myapp.yml global from env\n", string(data))
+}
+
+func TestCommandCondition(t *testing.T) {
+	t.Setenv("QUAKE_TEST_CI", "true")
+	out := t.TempDir() + "/out"
+	qf := parseQuakefile(t, `EMPTY = ""
+
+task ci {
+    if {{env.QUAKE_TEST_CI == "true"}}: echo true >> `+out+`
+    if {{env.QUAKE_TEST_CI == "false"}}: echo false >> `+out+`
+    if {{EMPTY}}: echo empty >> `+out+`
+    if {{EMPTY || "yes"}}: set NAME = "set"
+    echo "$NAME" >> `+out+`
+    parallel {
+        if {{false}}: echo skipped >> `+out+`
+        echo parallel >> `+out+`
+    }
+}`)
+
+	require.NoError(t, New(qf).RunTask("ci"))
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "true\nset\nparallel\n", string(data))
+}
+
+func TestGoTaskEnv(t *testing.T) {
+	qf := parseQuakefile(t, `export REGION = "us-east-1"
+VERSION = "1.0"
+`)
+	eval := New(qf)
+	eval.taskArgs = []string{"prod", "hello world"}
+
+	env := eval.goTaskEnv(&parser.Task{Name: "deploy", IsGoTask: true})
+	require.Contains(t, env, "REGION=us-east-1")
+	require.Contains(t, env, "QUAKE_TASK=deploy")
+	require.Contains(t, env, "QUAKE_VAR_REGION=us-east-1")
+	require.Contains(t, env, "QUAKE_VAR_VERSION=1.0")
+	require.Contains(t, env, "QUAKE_ARG_COUNT=2")
+	require.Contains(t, env, "QUAKE_ARG_0=prod")
+	require.Contains(t, env, "QUAKE_ARG_1=hello world")
+	require.NotContains(t, env, "VERSION=1.0", "unexported variables keep their prefix")
+}
+
+func TestMultiLineArguments(t *testing.T) {
+	out := t.TempDir() + "/out"
+	qf := parseQuakefile(t, `task send(message, to) {
+    printf '%s|%s' "{{message}}" "{{to}}" > `+out+`
+}`)
+
+	eval := New(qf)
+	require.NoError(t, eval.RunTaskWithArgs("send", []string{"hello  world\nbye", "--"}))
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "hello  world\nbye|--", string(data))
+
+	require.Equal(t, `a, "hello world", "", "x\ny", "1,2"`, formatArgs([]string{"a", "hello world", "", "x\ny", "1,2"}))
+}
+
+func TestOnMissingPassthrough(t *testing.T) {
+	out := t.TempDir() + "/out"
+
+	err := New(parseQuakefile(t, "task build {\n    true\n}")).RunTaskWithArgs("sh", nil)
+	require.EqualError(t, err, "task 'sh' not found")
+
+	qf := parseQuakefile(t, "on_missing passthrough\n\ntask build {\n    true\n}")
+	require.Equal(t, "passthrough", qf.OnMissing)
+	err = New(qf).RunTaskWithArgs("sh", []string{"-c", `printf '%s|' "$@" > ` + out, "sh", "hello world", "it's"})
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "hello world|it's|", string(data))
+
+	err = New(parseQuakefile(t, "on_missing ignore\n")).RunTask("deploy")
+	require.EqualError(t, err, "task 'deploy' not found (unknown on_missing mode 'ignore')")
+}
+
+func TestCommandSubstitutionCache(t *testing.T) {
+	count := t.TempDir() + "/count"
+	qf := parseQuakefile(t, "A = `echo run >> "+count+"; echo value`\nB = `echo run >> "+count+"; echo value`\nC = `echo other`\n")
+
+	eval := New(qf)
+	require.Equal(t, "value", eval.env["A"])
+	require.Equal(t, "value", eval.env["B"])
+	require.Equal(t, "other", eval.env["C"])
+
+	data, err := os.ReadFile(count)
+	require.NoError(t, err)
+	require.Equal(t, "run\n", string(data), "identical commands share one run")
+}
+
+func TestDollarSubstitutionInCommand(t *testing.T) {
+	out := t.TempDir() + "/out.txt"
+	qf := parseQuakefile(t, `task stamp {
+    echo $(echo $(echo quake)) $((1 + 2)) > `+out+`
+}`)
+
+	require.NoError(t, New(qf).RunTask("stamp"))
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "quake 3\n", string(data))
+}
+
+func TestTrace(t *testing.T) {
+	qf := parseQuakefile(t, `task build => gen {
+    parallel {
+        true
+        true
+    }
+}
+
+task gen {
+    true
+}`)
+
+	trace := NewTrace()
+	eval := New(qf)
+	eval.SetTrace(trace)
+	require.NoError(t, eval.RunTask("build"))
+
+	var buf strings.Builder
+	require.NoError(t, trace.WriteJSON(&buf))
+
+	var data struct {
+		TraceEvents []traceEvent `json:"traceEvents"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(buf.String()), &data))
+
+	var events []string
+	threads := make(map[int]bool)
+	for _, event := range data.TraceEvents {
+		if event.Category == "task" {
+			events = append(events, event.Phase+" "+event.Name)
+		}
+		threads[event.TID] = true
+	}
+	require.Equal(t, []string{"B gen", "E gen", "B build", "E build"}, events)
+	require.Len(t, data.TraceEvents, 10)
+	require.Equal(t, map[int]bool{1: true, 2: true, 3: true}, threads, "parallel commands get threads of their own")
+}
+
+func TestTaskIdentifiers(t *testing.T) {
+	out := t.TempDir() + "/out"
+	qf := parseQuakefile(t, `task deploy(env) => prepare {
+    echo "{{task.name}}: {{task.args}}" >> `+out+`
+}
+
+task prepare {
+    echo "{{task.name}}: {{task.args}}" >> `+out+`
+}
+
+namespace db {
+    task migrate {
+        echo "{{task.name}}" >> `+out+`
+    }
+}`)
+
+	eval := New(qf)
+	require.NoError(t, eval.RunTaskWithArgs("deploy", []string{"prod", "us-east-1"}))
+	require.NoError(t, eval.RunTask("db:migrate"))
+
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "prepare: \ndeploy: prod us-east-1\ndb:migrate\n", string(data))
+}
+
+func TestArgsVariables(t *testing.T) {
+	out := t.TempDir() + "/out"
+	qf := parseQuakefile(t, `task test => prepare {
+    echo $ARGS >> `+out+`
+    printf '[%s]' $ARGV >> `+out+`
+    echo >> `+out+`
+    echo "{{args}}" >> `+out+`
+}
+
+task prepare {
+    echo "prepare: $ARGS." >> `+out+`
+}`)
+
+	require.NoError(t, New(qf).RunTaskWithArgs("test", []string{"-run", "TestFoo", "a b"}))
+
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "prepare: .\n-run TestFoo a b\n[-run][TestFoo][a b]\n-run TestFoo a b\n", string(data))
+}
+
+func TestSince(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	require.NoError(t, os.MkdirAll("src", 0755))
+	require.NoError(t, os.WriteFile("src/main.go", []byte("package main\n"), 0644))
+	require.NoError(t, os.WriteFile("README.md", []byte("docs\n"), 0644))
+	git("init", "-q")
+	git("add", ".")
+	git("commit", "-qm", "initial")
+
+	out := filepath.Join(dir, "out")
+	qf := parseQuakefile(t, `task test(inputs: ["src/**"]) => build {
+    echo test >> `+out+`
+}
+
+task build {
+    echo build >> `+out+`
+}
+
+task docs(inputs: "README.md") {
+    echo docs >> `+out+`
+}
+
+task all(inputs: "**") {
+    echo all >> `+out+`
+}`)
+
+	run := func(task string) string {
+		os.Remove(out)
+		eval := New(qf)
+		eval.SetSince("HEAD")
+		require.NoError(t, eval.RunTask(task))
+		data, _ := os.ReadFile(out)
+		return string(data)
+	}
+
+	// quake's state isn't a change, even if git would list it
+	require.NoError(t, os.MkdirAll(".quake", 0755))
+	require.NoError(t, os.WriteFile(".quake/state.json", []byte("{}\n"), 0644))
+	require.Equal(t, "", run("all"))
+
+	require.Equal(t, "", run("test"), "nothing changed, so the task and its dependencies are skipped")
+	require.Equal(t, "build\n", run("build"), "tasks without inputs always run")
+
+	require.NoError(t, os.WriteFile("src/util.go", []byte("package main\n"), 0644))
+	require.Equal(t, "build\ntest\n", run("test"), "untracked files count as changes")
+	require.Equal(t, "", run("docs"))
+
+	require.NoError(t, os.WriteFile("README.md", []byte("more docs\n"), 0644))
+	require.Equal(t, "docs\n", run("docs"))
+
+	eval := New(qf)
+	eval.SetSince("no-such-ref")
+	require.ErrorContains(t, eval.RunTask("docs"), "failed to list files changed since no-such-ref")
+}
+
+func TestTaskError(t *testing.T) {
+	qf := parseQuakefile(t, `task deploy => build {
+    echo deploy
+}
+
+task build {
+    exit 3
+}
+
+namespace db {
+    task migrate {
+        {{task("missing")}}
+    }
+}`)
+
+	err := New(qf).RunTask("deploy")
+	require.EqualError(t, err, "dependency 'build' failed: command failed: exit status 3")
+
+	var taskErr *TaskError
+	require.ErrorAs(t, err, &taskErr)
+	require.Equal(t, "build", taskErr.Task)
+	require.Equal(t, "exit 3", taskErr.Command)
+	require.Equal(t, 3, taskErr.ExitCode)
+
+	err = New(qf).RunTask("db:migrate")
+	require.ErrorAs(t, err, &taskErr)
+	require.Equal(t, "db:migrate", taskErr.Task)
+	require.Empty(t, taskErr.Command)
+	require.Equal(t, -1, taskErr.ExitCode)
+}
+
+func TestNativeEchoSpacing(t *testing.T) {
+	t.Setenv("QUAKE_ECHO_NAME", "x   y")
+	lines := []string{
+		`echo "  build      Build the binary"`,
+		`echo "  test       Run the tests"`,
+		`echo   a    b   "c   d"  'e  $QUAKE_ECHO_NAME'`,
+		`echo "Name:  $QUAKE_ECHO_NAME" $QUAKE_ECHO_NAME`,
+		`echo col1\ \ col2 "" end\$`,
+		`echo`,
+		// The shell runs these
+		`echo "x" > out.txt`,
+		`echo -n foo`,
+		`echo a # c`,
+		`echo 'a | b' "c; d" e\;`,
+		`echo one && echo two`,
+	}
+	t.Chdir(t.TempDir())
+
+	var body strings.Builder
+	for _, line := range lines {
+		body.WriteString("    @" + line + "\n")
+	}
+	qf := parseQuakefile(t, "task help {\n"+body.String()+"}")
+
+	var buf strings.Builder
+	eval := New(qf)
+	eval.stdout = &buf
+	require.NoError(t, eval.RunTask("help"))
+
+	// The output matches the shell's echo
+	data, err := os.ReadFile("out.txt")
+	require.NoError(t, err)
+	require.Equal(t, "x\n", string(data))
+	require.NoError(t, os.Remove("out.txt"))
+
+	expected, err := exec.Command("sh", "-c", strings.Join(lines, "\n")).Output()
+	require.NoError(t, err)
+	require.Equal(t, string(expected), buf.String())
+
+	// An unbalanced quote is the shell's error, not silently dropped
+	qf = parseQuakefile(t, "task quote {\n    @echo it's\n}")
+	eval = New(qf)
+	eval.stdout = &buf
+	require.Error(t, eval.RunTask("quote"))
+}
+
+func TestQuietCommand(t *testing.T) {
+	qf := parseQuakefile(t, `task secret {
+    @@echo s3cr3t
+    echo shown
+    parallel {
+        @@echo hidden
+    }
+}
+
+task leak {
+    @@echo s3cr3t; exit 2
+}`)
+
+	var buf strings.Builder
+	eval := New(qf)
+	eval.stdout = &buf
+	eval.SetCaptureOutput(5)
+	require.NoError(t, eval.RunTask("secret"))
+	require.Equal(t, "shown\n", buf.String())
+
+	err := eval.RunTask("leak")
+	require.EqualError(t, err, "command failed: exit status 2", "quiet commands still fail the task")
+	var cmdErr *CommandError
+	require.ErrorAs(t, err, &cmdErr)
+	require.Empty(t, cmdErr.Output, "quiet output isn't captured")
+}
+
+func TestGoTasksConfig(t *testing.T) {
+	task := &parser.Task{Name: "deploy", IsGoTask: true, GoSourceDir: "qtasks"}
+	qtasksPath, err := filepath.Abs("qtasks")
+	require.NoError(t, err)
+
+	eval := New(parseQuakefile(t, "task build {\n    go build\n}"))
+	require.Equal(t, []string{"build", "-o", "bin", qtasksPath}, eval.goBuildArgs(task, "bin"))
+
+	eval = New(parseQuakefile(t, `gotasks { tags = "integration,e2e"; flags = "-race -trimpath"; CGO_ENABLED = "1" }`))
+	require.Equal(t, []string{"build", "-o", "bin", "-tags", "integration,e2e", "-race", "-trimpath", qtasksPath}, eval.goBuildArgs(task, "bin"))
+	env := eval.goTaskEnv(task)
+	require.Equal(t, "CGO_ENABLED=1", env[len(env)-1])
+
+	// Each qtasks directory builds to a path of its own
+	binary, err := goTasksBinary("qtasks")
+	require.NoError(t, err)
+	other, err := goTasksBinary("lib/qtasks")
+	require.NoError(t, err)
+	same, err := goTasksBinary(qtasksPath)
+	require.NoError(t, err)
+	require.NotEqual(t, binary, other)
+	require.Equal(t, binary, same)
+}
+
+func TestNamedArguments(t *testing.T) {
+	task := &parser.Task{Name: "deploy", Arguments: []string{"env", "region", "tag"}}
+
+	args, err := resolveArgs("deploy", task, []string{"region=us-east", "env=prod"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"prod", "us-east"}, args)
+
+	args, err = resolveArgs("deploy", task, []string{"prod", "KEY=value"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"prod", "KEY=value"}, args, "arguments that don't name one of the task's stay positional")
+
+	_, err = resolveArgs("deploy", task, []string{"env=prod", "us-east"})
+	require.EqualError(t, err, "task 'deploy': can't mix named and positional arguments")
+	_, err = resolveArgs("deploy", task, []string{"env=prod", "regoin=us-east"})
+	require.EqualError(t, err, "task 'deploy' has no argument 'regoin' (arguments: env, region, tag)")
+	_, err = resolveArgs("deploy", task, []string{"env=prod", "env=dev"})
+	require.EqualError(t, err, "task 'deploy': argument 'env' is given more than once")
+
+	out := t.TempDir() + "/out"
+	qf := parseQuakefile(t, `task deploy(env, region) {
+    echo "{{env}} {{region || "default"}}" >> `+out+`
+}`)
+	require.NoError(t, New(qf).RunTaskWithArgs("deploy", []string{"region=eu-west", "env=a=b"}))
+	require.NoError(t, New(qf).RunTaskWithArgs("deploy", []string{"env=prod"}))
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "a=b eu-west\nprod default\n", string(data))
+}
+
+func TestConfirmAttribute(t *testing.T) {
+	out := t.TempDir() + "/out"
+	qf := parseQuakefile(t, `task drop(confirm: "This deletes all data. Continue?") => backup {
+    echo drop >> `+out+`
+}
+
+task backup {
+    echo backup >> `+out+`
+}`)
+
+	if stdinIsTerminal() {
+		t.Skip("stdin is a terminal, so confirmation would be asked for")
+	}
+	err := New(qf).RunTask("drop")
+	require.EqualError(t, err, "task 'drop' needs confirmation; use --yes to run it without a terminal")
+	require.NoFileExists(t, out, "nothing runs before the task is confirmed")
+
+	eval := New(qf)
+	eval.SetAssumeYes(true)
+	require.NoError(t, eval.RunTask("drop"))
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "backup\ndrop\n", string(data))
+}
+
+func TestPrintEnv(t *testing.T) {
+	qf := parseQuakefile(t, `REGISTRY = "ghcr.io"
+API_TOKEN = "abc123"
+ssh_key = "id_ed25519"
+EMPTY_SECRET = ""`)
+	e := NewWithOverrides(qf, map[string]string{"REGISTRY": "localhost"})
+
+	var out strings.Builder
+	e.PrintEnv(&out, false)
+	require.Equal(t, "API_TOKEN=********\nEMPTY_SECRET=\nREGISTRY=localhost\nssh_key=********\n", out.String())
+
+	out.Reset()
+	e.PrintEnv(&out, true)
+	require.Equal(t, "API_TOKEN=abc123\nEMPTY_SECRET=\nREGISTRY=localhost\nssh_key=id_ed25519\n", out.String())
+}
+
+func TestTaskEnvBlock(t *testing.T) {
+	qf := parseQuakefile(t, `RACE = "-race"
+
+task test => other {
+    env { QUAKE_TEST_FLAGS = "$RACE -count=1" }
+    printenv QUAKE_TEST_FLAGS
+}
+
+task other {
+    printenv QUAKE_TEST_FLAGS || echo unset
+}`)
+
+	var buf strings.Builder
+	eval := New(qf)
+	eval.stdout = &buf
+	require.NoError(t, eval.RunTask("test"))
+	require.Equal(t, "unset\n-race -count=1\n", buf.String())
+
+	// Other tasks don't see it afterwards
+	buf.Reset()
+	require.NoError(t, eval.RunTask("other"))
+	require.Equal(t, "unset\n", buf.String())
+	require.NotContains(t, eval.exported, "QUAKE_TEST_FLAGS")
+}
+
+func TestExpandGlobs(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"b.go", "a.go", "notes.txt"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0644))
+	}
+	t.Chdir(dir)
+
+	require.Equal(t,
+		[]string{"-w", "a.go", "b.go", "*.md", "*.go", "notes.txt"},
+		expandGlobs([]string{"-w", "*.go", "*.md", `\*.go`, "note?.txt"}))
+}
+
+func TestEnvRequire(t *testing.T) {
+	t.Setenv("QUAKE_TEST_REQUIRED", "from-env")
+	qf := parseQuakefile(t, `REGION = "eu"
+
+task deploy {
+    echo {{env.require("QUAKE_TEST_REQUIRED")}} {{env.require("REGION")}}
+}
+
+task missing {
+    echo {{env.require("QUAKE_TEST_MISSING")}}
+}`)
+
+	var buf strings.Builder
+	eval := New(qf)
+	eval.stdout = &buf
+	require.NoError(t, eval.RunTask("deploy"))
+	require.Equal(t, "from-env eu\n", buf.String())
+
+	err := eval.RunTask("missing")
+	require.ErrorContains(t, err, "required environment variable QUAKE_TEST_MISSING is not set")
+
+	// A variable that requires one fails the run even without strict mode
+	qf = parseQuakefile(t, `TOKEN = {{env.require("QUAKE_TEST_MISSING")}}
+
+task build {
+    echo ok
+}`)
+	err = New(qf).RunTask("build")
+	require.EqualError(t, err, "failed to evaluate TOKEN: required environment variable QUAKE_TEST_MISSING is not set")
+}
+
+func TestFileFunction(t *testing.T) {
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.MkdirAll("secrets", 0755))
+	require.NoError(t, os.WriteFile("secrets/token", []byte("s3cr3t\n"), 0600))
+
+	qf := parseQuakefile(t, `TOKEN = file("secrets/token")
+MISSING = file("secrets/missing")
+
+task show {
+    echo {{file("secrets/token")}}-$MISSING
+}`)
+
+	var buf strings.Builder
+	eval := New(qf)
+	eval.stdout = &buf
+	require.Equal(t, "s3cr3t", eval.env["TOKEN"])
+	require.NoError(t, eval.RunTask("show"))
+	require.Equal(t, "s3cr3t-\n", buf.String())
+
+	// A file that can't be read fails the run in strict mode
+	eval = New(qf)
+	eval.SetStrictVariables(true)
+	err := eval.RunTask("show")
+	require.ErrorContains(t, err, `file("secrets/missing") failed: `)
+}
+
+func TestFailCommand(t *testing.T) {
+	dir := t.TempDir()
+	qf := parseQuakefile(t, `REGION = "eu"
+
+task deploy(env) {
+    if {{env == ""}}: fail "env is required (region: $REGION)"
+    echo {{env}} > `+dir+`/deploy.txt
+}
+
+task lenient {
+    -fail "not fatal"
+    echo after > `+dir+`/lenient.txt
+}
+
+task racing {
+    parallel {
+        fail
+        true
+    }
+}`)
+
+	err := New(qf).RunTask("deploy")
+	require.EqualError(t, err, "env is required (region: eu)")
+	_, statErr := os.Stat(dir + "/deploy.txt")
+	require.True(t, os.IsNotExist(statErr), "fail stops the task")
+
+	require.NoError(t, New(qf).RunTaskWithArgs("deploy", []string{"prod"}))
+	data, err := os.ReadFile(dir + "/deploy.txt")
+	require.NoError(t, err)
+	require.Equal(t, "prod\n", string(data))
+
+	require.NoError(t, New(qf).RunTask("lenient"))
+	_, err = os.Stat(dir + "/lenient.txt")
+	require.NoError(t, err)
+
+	require.ErrorContains(t, New(qf).RunTask("racing"), "fail can't be used in a parallel block")
+}
+
+func TestTypedArguments(t *testing.T) {
+	dir := t.TempDir()
+	qf := parseQuakefile(t, `task scale(replicas: int, env: enum(dev,staging,prod), dry: bool) {
+    echo $replicas $env $dry >> `+dir+`/scale.txt
+}
+
+task lint(files...: path) {
+    echo $files >> `+dir+`/lint.txt
+}`)
+
+	require.NoError(t, New(qf).RunTaskWithArgs("scale", []string{"3", "prod", "true"}))
+	require.NoError(t, New(qf).RunTaskWithArgs("scale", []string{"env=dev"}))
+	data, err := os.ReadFile(dir + "/scale.txt")
+	require.NoError(t, err)
+	require.Equal(t, "3 prod true\ndev\n", string(data))
+
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"abc"}, "task 'scale': argument 'replicas' must be an integer, got 'abc'"},
+		{[]string{"3", "qa"}, "task 'scale': argument 'env' must be one of dev, staging, prod, got 'qa'"},
+		{[]string{"3", "dev", "yes"}, "task 'scale': argument 'dry' must be true or false, got 'yes'"},
+	}
+	for _, tt := range tests {
+		require.EqualError(t, New(qf).RunTaskWithArgs("scale", tt.args), tt.err)
+	}
+
+	require.NoError(t, New(qf).RunTaskWithArgs("lint", []string{dir, dir + "/scale.txt"}))
+	err = New(qf).RunTaskWithArgs("lint", []string{dir, dir + "/missing.go"})
+	require.EqualError(t, err, "task 'lint': argument 'files' must be an existing path, got '"+dir+"/missing.go'")
+}
+
+func TestNamespaceDefault(t *testing.T) {
+	out := t.TempDir() + "/out"
+	qf := parseQuakefile(t, `namespace db {
+    task default => db:migrate
+
+    task migrate {
+        echo migrate >> `+out+`
+    }
+}
+
+namespace docs {
+    task build {
+        echo build
+    }
+
+    task serve {
+        echo serve
+    }
+}`)
+
+	require.NoError(t, New(qf).RunTask("db"))
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "migrate\n", string(data))
+
+	require.EqualError(t, New(qf).RunTask("docs"), "'docs' is a namespace without a default task; its tasks are: docs:build, docs:serve")
+	require.EqualError(t, New(qf).RunTask("nothing"), "task 'nothing' not found")
+}
+
+func TestAllowFailureBlock(t *testing.T) {
+	qf := parseQuakefile(t, `task cleanup {
+    allow-failure {
+        exit 1
+        echo still running
+    }
+    echo done
+}
+
+task strict {
+    allow-failure {
+        strict {
+            exit 3
+        }
+    }
+    echo unreachable
+}`)
+
+	var buf strings.Builder
+	eval := New(qf)
+	eval.stdout = &buf
+	require.NoError(t, eval.RunTask("cleanup"))
+	require.Equal(t, "still running\ndone\n", buf.String())
+
+	buf.Reset()
+	require.EqualError(t, eval.RunTask("strict"), "command failed: exit status 3")
+	require.Empty(t, buf.String())
+}
@@ -0,0 +1,167 @@
+package evaluator
+
+import (
+	"os"
+	"strings"
+)
+
+// expandShellVariables expands $VAR and ${VAR} references, including the
+// shell-style ${VAR:-default}, ${VAR-default}, ${VAR:+alt} and ${VAR+alt} forms.
+// Default and alternate words are expanded recursively, so ${A:-$B} works.
+// \$ and $$ are escapes for a literal dollar sign.
+func (e *Evaluator) expandShellVariables(s string) string {
+	var buf strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && s[i+1] == '$' {
+			buf.WriteByte('$')
+			i++
+			continue
+		}
+		if s[i] != '$' || i+1 >= len(s) {
+			buf.WriteByte(s[i])
+			continue
+		}
+
+		next := s[i+1]
+		switch {
+		case next == '$':
+			buf.WriteByte('$')
+			i++
+		case next == '{':
+			end := matchingBrace(s, i+1)
+			if end < 0 {
+				// Unterminated ${, leave it as-is
+				buf.WriteString(s[i:])
+				return buf.String()
+			}
+			buf.WriteString(e.expandBraced(s[i+2 : end]))
+			i = end
+		case isShellSpecialVar(next):
+			buf.WriteString(e.lookupValue(string(next)))
+			i++
+		case isNameChar(next):
+			j := i + 1
+			for j < len(s) && isNameChar(s[j]) {
+				j++
+			}
+			buf.WriteString(e.lookupValue(s[i+1 : j]))
+			i = j - 1
+		default:
+			// $ not followed by a name, keep the dollar sign
+			buf.WriteByte(s[i])
+		}
+	}
+
+	return buf.String()
+}
+
+// expandBraced expands the inside of a ${...} reference
+func (e *Evaluator) expandBraced(inner string) string {
+	n := 0
+	for n < len(inner) && isNameChar(inner[n]) {
+		n++
+	}
+	name, rest := inner[:n], inner[n:]
+
+	if name == "" || rest == "" {
+		return e.lookupValue(inner)
+	}
+
+	value, ok := e.lookupVariable(name)
+
+	switch {
+	case strings.HasPrefix(rest, ":-"):
+		if !ok || value == "" {
+			return e.expandShellVariables(rest[2:])
+		}
+		return value
+	case strings.HasPrefix(rest, ":+"):
+		if ok && value != "" {
+			return e.expandShellVariables(rest[2:])
+		}
+		return ""
+	case strings.HasPrefix(rest, "-"):
+		if !ok {
+			return e.expandShellVariables(rest[1:])
+		}
+		return value
+	case strings.HasPrefix(rest, "+"):
+		if ok {
+			return e.expandShellVariables(rest[1:])
+		}
+		return ""
+	default:
+		// Unsupported operator, fall back to a plain lookup like os.Expand
+		return e.lookupValue(inner)
+	}
+}
+
+// lookupVariable finds a variable in the evaluator environment, then the
+// running task's ARGS and ARGV, then the system environment
+func (e *Evaluator) lookupVariable(key string) (string, bool) {
+	if val, ok := e.env[key]; ok {
+		return val, true
+	}
+	if val, ok := e.argsVariable(key); ok {
+		return val, true
+	}
+	return os.LookupEnv(key)
+}
+
+// argsVariable returns the synthetic variables holding all of the running
+// task's arguments: ARGS joins them with spaces, while ARGV quotes each one so
+// the shell sees them as separate words, like "$@"
+func (e *Evaluator) argsVariable(key string) (string, bool) {
+	if e.taskName == "" {
+		return "", false
+	}
+	switch key {
+	case "ARGS":
+		return strings.Join(e.taskArgs, " "), true
+	case "ARGV":
+		words := make([]string, len(e.taskArgs))
+		for i, arg := range e.taskArgs {
+			words[i] = shellQuote(arg)
+		}
+		return strings.Join(words, " "), true
+	}
+	return "", false
+}
+
+// lookupValue returns a variable's value, or "" if it isn't set
+func (e *Evaluator) lookupValue(key string) string {
+	val, _ := e.lookupVariable(key)
+	return val
+}
+
+// matchingBrace returns the index of the } closing the { at open, or -1
+func matchingBrace(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// isShellSpecialVar reports whether c names a single-character shell variable like $1 or $@
+func isShellSpecialVar(c byte) bool {
+	switch c {
+	case '*', '#', '$', '@', '!', '?', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return true
+	}
+	return false
+}
+
+// isNameChar reports whether c can appear in a variable name
+func isNameChar(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
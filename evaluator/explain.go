@@ -0,0 +1,187 @@
+package evaluator
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"miren.dev/quake/parser"
+)
+
+// VariableExplanation describes how a global variable got its value
+type VariableExplanation struct {
+	Name        string
+	Definitions []VariableDefinition // Assignments in the Quakefile, in order
+	Value       string
+	Source      string // Where the value came from: command line, Quakefile or environment
+}
+
+// VariableDefinition is one assignment to a variable in the Quakefile
+type VariableDefinition struct {
+	Variable  parser.Variable
+	Kind      string   // string, command, expression or multiline
+	Evaluated bool     // False if a command line override skipped it
+	Value     string   // The variable's value after this assignment
+	Steps     []string // How the operands of a || expression evaluated, up to the one used
+}
+
+// ExplainVariable loads the Quakefile's global variables as New does and
+// reports how name was resolved. It returns an error if name isn't set on the
+// command line, in the Quakefile or in the environment.
+func ExplainVariable(qf *parser.QuakeFile, overrides map[string]string, name string) (*VariableExplanation, error) {
+	ex := &VariableExplanation{Name: name}
+
+	e := &Evaluator{
+		quakefile: qf,
+		env:       make(map[string]string),
+	}
+	e.trace = func(variable parser.Variable, overridden bool) {
+		if variable.Name != name {
+			return
+		}
+		def := VariableDefinition{
+			Variable:  variable,
+			Kind:      variableKind(variable),
+			Evaluated: !overridden,
+		}
+		if !overridden {
+			def.Value = e.env[name]
+			if expr, ok := variable.Value.(parser.Expression); ok && variable.IsExpression {
+				def.Steps = e.explainOr(expr)
+			}
+		}
+		ex.Definitions = append(ex.Definitions, def)
+	}
+	e.loadGlobalVariables(overrides)
+
+	if val, ok := overrides[name]; ok {
+		ex.Value, ex.Source = val, "command line"
+	} else if len(ex.Definitions) > 0 {
+		ex.Value, ex.Source = e.env[name], "Quakefile"
+	} else if val, ok := os.LookupEnv(name); ok {
+		ex.Value, ex.Source = val, "environment"
+	} else {
+		return nil, fmt.Errorf("variable '%s' is not defined in the Quakefile or the environment", name)
+	}
+	return ex, nil
+}
+
+// variableKind names how a variable's value is written
+func variableKind(v parser.Variable) string {
+	switch {
+	case v.CommandSubstitution:
+		return "command"
+	case v.IsExpression:
+		return "expression"
+	case v.IsMultiline:
+		return "multiline"
+	default:
+		return "string"
+	}
+}
+
+// explainOr evaluates each operand of an a || b || ... expression until one
+// is truthy, describing what each produced. Other expressions have no steps.
+func (e *Evaluator) explainOr(expr parser.Expression) []string {
+	if _, ok := expr.(parser.Or); !ok {
+		return nil
+	}
+
+	var operands []parser.Expression
+	for {
+		or, ok := expr.(parser.Or)
+		if !ok {
+			break
+		}
+		operands = append([]parser.Expression{or.Right}, operands...)
+		expr = or.Left
+	}
+	operands = append([]parser.Expression{expr}, operands...)
+
+	var steps []string
+	for i, operand := range operands {
+		val := e.expressionToString(operand)
+		step := fmt.Sprintf("%s => %q", parser.FormatExpression(operand), val)
+		if isTruthy(val) || i == len(operands)-1 {
+			steps = append(steps, step+" (used)")
+			break
+		}
+		steps = append(steps, step+" (falsy, skipped)")
+	}
+	return steps
+}
+
+// String formats the explanation for display
+func (ex *VariableExplanation) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Variable: %s\n", ex.Name)
+
+	if len(ex.Definitions) > 0 {
+		b.WriteString("Definitions:\n")
+		for _, def := range ex.Definitions {
+			op := "="
+			if def.Variable.Append {
+				op = "+="
+			}
+			raw := parser.FormatVariableValue(def.Variable)
+			if def.Variable.IsMultiline {
+				raw = `"""` + "\n" + raw + `"""`
+			}
+			export := ""
+			if def.Variable.Exported {
+				export = "export "
+			}
+			fmt.Fprintf(&b, "  %s%s %s %s (%s)\n", export, ex.Name, op, raw, def.Kind)
+			if !def.Evaluated {
+				b.WriteString("    not evaluated, overridden on the command line\n")
+				continue
+			}
+			for _, step := range def.Steps {
+				fmt.Fprintf(&b, "    %s\n", step)
+			}
+			fmt.Fprintf(&b, "    => %q\n", def.Value)
+		}
+	}
+
+	fmt.Fprintf(&b, "Value: %q\n", ex.Value)
+	fmt.Fprintf(&b, "Source: %s\n", ex.Source)
+	return b.String()
+}
+
+// secretPatterns mark variables whose values PrintEnv and plans mask
+var secretPatterns = []string{"SECRET", "TOKEN", "KEY"}
+
+// secretMask replaces the value of a secret variable
+const secretMask = "********"
+
+// isSecret reports whether a variable's name suggests it holds a secret
+func isSecret(name string) bool {
+	upper := strings.ToUpper(name)
+	for _, pattern := range secretPatterns {
+		if strings.Contains(upper, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// PrintEnv writes the resolved variables, including command line overrides,
+// to w sorted by name. Values of variables named like *SECRET*, *TOKEN* or
+// *KEY* are masked unless full is set.
+func (e *Evaluator) PrintEnv(w io.Writer, full bool) {
+	names := make([]string, 0, len(e.env))
+	for name := range e.env {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		value := e.env[name]
+		if !full && value != "" && isSecret(name) {
+			value = secretMask
+		}
+		fmt.Fprintf(w, "%s=%s\n", name, value)
+	}
+}
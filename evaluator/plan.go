@@ -0,0 +1,174 @@
+package evaluator
+
+import (
+	"fmt"
+	"strings"
+
+	"miren.dev/quake/parser"
+)
+
+// Plan is the resolved execution plan for one or more task invocations
+type Plan struct {
+	WorkingDir string        `json:"working_dir"`
+	Tasks      []PlannedTask `json:"tasks"`
+
+	planned map[string]bool
+}
+
+// PlannedTask is a single task in an execution plan, in the order it would run
+type PlannedTask struct {
+	Name              string            `json:"name"`
+	Args              []string          `json:"args,omitempty"`
+	Dependencies      []string          `json:"dependencies,omitempty"`       // Tasks that run first
+	FilePrerequisites []string          `json:"file_prerequisites,omitempty"` // Files the task is built from
+	Commands          []string          `json:"commands"`
+	Env               map[string]string `json:"env,omitempty"` // Resolved variables, with secrets masked
+	WorkingDir        string            `json:"working_dir"`
+	IsGoTask          bool              `json:"is_go_task,omitempty"`
+}
+
+// NewPlan creates an empty plan for tasks run from the given directory
+func NewPlan(workingDir string) *Plan {
+	return &Plan{
+		WorkingDir: workingDir,
+		Tasks:      []PlannedTask{},
+		planned:    make(map[string]bool),
+	}
+}
+
+// PlanTask adds a task and its dependencies to the plan without executing anything.
+// Tasks already in the plan are not added again.
+func (e *Evaluator) PlanTask(plan *Plan, taskName string, args []string) error {
+	if taskName == "" {
+		taskName = "default"
+	}
+
+	task := e.findTask(taskName)
+	if task == nil {
+		return fmt.Errorf("task '%s' not found", taskName)
+	}
+	args, err := resolveArgs(taskName, task, args)
+	if err != nil {
+		return err
+	}
+
+	// Dependencies run without arguments, so they only need planning once
+	key := taskName
+	if len(args) > 0 {
+		key += "\x00" + strings.Join(args, "\x00")
+	}
+	if plan.planned[key] {
+		return nil
+	}
+	plan.planned[key] = true
+
+	oldName, oldArgs, oldPlanning := e.taskName, e.taskArgs, e.planning
+	e.taskName, e.taskArgs, e.planning = taskName, args, true
+	defer func() { e.taskName, e.taskArgs, e.planning = oldName, oldArgs, oldPlanning }()
+	defer e.enterNamespace(taskName)()
+
+	for i, argName := range task.Arguments {
+		if i < len(args) {
+			e.env[argName] = args[i]
+		} else {
+			e.env[argName] = ""
+		}
+	}
+
+	taskDeps, filePrereqs, err := e.splitDependencies(taskName, task)
+	if err != nil {
+		return fmt.Errorf("task '%s': %w", taskName, err)
+	}
+	for _, dep := range taskDeps {
+		if err := e.PlanTask(plan, dep, nil); err != nil {
+			return fmt.Errorf("dependency '%s' failed: %w", dep, err)
+		}
+	}
+
+	// Plans end up in CI logs, so secrets are masked like with PrintEnv
+	env := make(map[string]string, len(e.env))
+	for k, v := range e.env {
+		if v != "" && isSecret(k) {
+			v = secretMask
+		}
+		env[k] = v
+	}
+
+	plan.Tasks = append(plan.Tasks, PlannedTask{
+		Name:              taskName,
+		Args:              args,
+		Dependencies:      taskDeps,
+		FilePrerequisites: filePrereqs,
+		Commands:          e.planCommands(task),
+		Env:               env,
+		WorkingDir:        plan.WorkingDir,
+		IsGoTask:          task.IsGoTask,
+	})
+	return nil
+}
+
+// planCommands resolves a task's commands to the strings that would be executed
+func (e *Evaluator) planCommands(task *parser.Task) []string {
+	if task.IsGoTask {
+		binary, err := goTasksBinary(task.GoSourceDir)
+		if err != nil {
+			return []string{}
+		}
+		return []string{
+			"go " + strings.Join(e.goBuildArgs(task, binary), " "),
+			strings.Join(append([]string{binary, task.Name}, e.taskArgs...), " "),
+		}
+	}
+
+	commands := []string{}
+	for _, cmd := range task.Commands {
+		// Leave out commands whose condition doesn't hold
+		if run, _ := e.conditionHolds(cmd); !run {
+			continue
+		}
+		if cmd.Set != nil {
+			// Don't run command substitutions while planning
+			op := "="
+			if cmd.Set.Append {
+				op = "+="
+			}
+			commands = append(commands, fmt.Sprintf("set %s %s %v", cmd.Set.Name, op, cmd.Set.Value))
+			continue
+		}
+		if len(cmd.Parallel) > 0 {
+			var parts []string
+			for _, inner := range cmd.Parallel {
+				if run, _ := e.conditionHolds(inner); run {
+					parts = append(parts, e.commandToString(inner))
+				}
+			}
+			commands = append(commands, "parallel { "+strings.Join(parts, "; ")+" }")
+			continue
+		}
+		commands = append(commands, e.commandToString(cmd))
+	}
+	return commands
+}
+
+// String renders the plan as a human-readable list
+func (p *Plan) String() string {
+	var b strings.Builder
+	for i, task := range p.Tasks {
+		fmt.Fprintf(&b, "%d. %s", i+1, task.Name)
+		if len(task.Args) > 0 {
+			fmt.Fprintf(&b, " %s", strings.Join(task.Args, ", "))
+		}
+		if len(task.Dependencies) > 0 {
+			fmt.Fprintf(&b, " (after %s)", strings.Join(task.Dependencies, ", "))
+		}
+		b.WriteString("\n")
+
+		if len(task.FilePrerequisites) > 0 {
+			fmt.Fprintf(&b, "   from %s\n", strings.Join(task.FilePrerequisites, ", "))
+		}
+		for _, cmd := range task.Commands {
+			fmt.Fprintf(&b, "   $ %s\n", cmd)
+		}
+	}
+	return b.String()
+}
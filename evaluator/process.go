@@ -0,0 +1,133 @@
+package evaluator
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"miren.dev/quake/internal/term"
+)
+
+// interruptGrace is how long subprocesses get to exit after an interrupt
+// before they're killed
+const interruptGrace = 2 * time.Second
+
+// ErrInterrupted is returned for commands that didn't start because quake
+// was interrupted
+var ErrInterrupted = errors.New("interrupted")
+
+// processes tracks the running subprocesses so an interrupt can reach them
+var processes = struct {
+	sync.Mutex
+	running     map[*exec.Cmd]bool
+	interrupted bool
+}{running: make(map[*exec.Cmd]bool)}
+
+// runProcess runs cmd like cmd.Run, tracking it for Interrupt. Commands that
+// don't read from a terminal get their own process group so an interrupt
+// reaches everything they started.
+func runProcess(cmd *exec.Cmd) error {
+	if !readsTerminal(cmd) {
+		setProcessGroup(cmd)
+	}
+
+	processes.Lock()
+	if processes.interrupted {
+		processes.Unlock()
+		return ErrInterrupted
+	}
+	if err := cmd.Start(); err != nil {
+		processes.Unlock()
+		return err
+	}
+	processes.running[cmd] = true
+	processes.Unlock()
+
+	err := cmd.Wait()
+
+	processes.Lock()
+	delete(processes.running, cmd)
+	processes.Unlock()
+	return err
+}
+
+// outputProcess runs cmd like cmd.Output, tracking it for Interrupt
+func outputProcess(cmd *exec.Cmd) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	if cmd.Stderr == nil {
+		cmd.Stderr = &stderr
+	}
+
+	err := runProcess(cmd)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitErr.Stderr = stderr.Bytes()
+	}
+	return stdout.Bytes(), err
+}
+
+// stdinIsTerminal reports whether quake's stdin is a terminal
+var stdinIsTerminal = sync.OnceValue(func() bool {
+	return term.IsTerminal(os.Stdin)
+})
+
+// readsTerminal reports whether cmd reads from the terminal. Such commands
+// stay in quake's process group: a background group can't read the terminal,
+// and Ctrl-C already reaches them from there.
+func readsTerminal(cmd *exec.Cmd) bool {
+	return cmd.Stdin == os.Stdin && stdinIsTerminal()
+}
+
+// Interrupt passes sig on to the running subprocesses and kills any that are
+// still running after a short grace period. Commands started afterwards fail
+// with ErrInterrupted. A second interrupt kills them right away.
+func Interrupt(sig os.Signal) {
+	processes.Lock()
+	again := processes.interrupted
+	processes.interrupted = true
+	running := make([]*exec.Cmd, 0, len(processes.running))
+	for cmd := range processes.running {
+		running = append(running, cmd)
+	}
+	processes.Unlock()
+
+	if again {
+		killRunning()
+		return
+	}
+
+	for _, cmd := range running {
+		signalProcess(cmd, sig)
+	}
+	if len(running) > 0 {
+		time.AfterFunc(interruptGrace, killRunning)
+	}
+}
+
+// Interrupted reports whether Interrupt has been called
+func Interrupted() bool {
+	processes.Lock()
+	defer processes.Unlock()
+	return processes.interrupted
+}
+
+// ResetInterrupt clears the state Interrupt leaves behind, so commands can
+// start again. Subprocesses that are still running aren't affected.
+func ResetInterrupt() {
+	processes.Lock()
+	defer processes.Unlock()
+	processes.interrupted = false
+}
+
+// killRunning kills every subprocess that is still running
+func killRunning() {
+	processes.Lock()
+	defer processes.Unlock()
+	for cmd := range processes.running {
+		killProcess(cmd)
+	}
+}
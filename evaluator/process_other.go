@@ -0,0 +1,20 @@
+//go:build !unix
+
+package evaluator
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup does nothing; process groups are only used on Unix
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// signalProcess does nothing; the console delivers Ctrl-C to every process
+// attached to it
+func signalProcess(cmd *exec.Cmd, sig os.Signal) {}
+
+// killProcess kills cmd
+func killProcess(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
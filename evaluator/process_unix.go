@@ -0,0 +1,48 @@
+//go:build unix
+
+package evaluator
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts cmd in a process group of its own
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// hasProcessGroup reports whether cmd was started in its own process group
+func hasProcessGroup(cmd *exec.Cmd) bool {
+	return cmd.SysProcAttr != nil && cmd.SysProcAttr.Setpgid
+}
+
+// signalProcess sends sig to cmd's process group
+func signalProcess(cmd *exec.Cmd, sig os.Signal) {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return
+	}
+	if hasProcessGroup(cmd) {
+		syscall.Kill(-cmd.Process.Pid, s)
+		return
+	}
+	// The process shares quake's group, so a Ctrl-C from the terminal
+	// already reached it
+	if s != syscall.SIGINT {
+		cmd.Process.Signal(s)
+	}
+}
+
+// killProcess kills cmd's process group
+func killProcess(cmd *exec.Cmd) {
+	if hasProcessGroup(cmd) {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		return
+	}
+	cmd.Process.Kill()
+}
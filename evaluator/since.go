@@ -0,0 +1,68 @@
+package evaluator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"miren.dev/quake/internal/glob"
+	"miren.dev/quake/parser"
+)
+
+// inputsChanged reports whether any file matching the task's inputs
+// attribute changed since the --since ref. Tasks without inputs count as
+// changed.
+func (e *Evaluator) inputsChanged(task *parser.Task) (bool, error) {
+	inputs := parser.ListAttribute(task.Attributes["inputs"])
+	if len(inputs) == 0 {
+		return true, nil
+	}
+
+	if e.changedFiles == nil {
+		files, err := changedSince(e.since)
+		if err != nil {
+			return false, err
+		}
+		e.changedFiles = files
+	}
+
+	for _, file := range e.changedFiles {
+		for _, pattern := range inputs {
+			if glob.Match(pattern, file) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// changedSince lists the files under the current directory that differ from
+// the git ref, including untracked ones, relative to the current directory.
+// quake's own state in .quake directories is left out.
+func changedSince(ref string) ([]string, error) {
+	files := []string{}
+	for _, args := range [][]string{
+		{"diff", "--name-only", "--relative", ref},
+		{"ls-files", "--others", "--exclude-standard"},
+	} {
+		output, err := outputProcess(exec.Command("git", args...))
+		if err != nil {
+			msg := err.Error()
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) && len(bytes.TrimSpace(exitErr.Stderr)) > 0 {
+				msg = string(bytes.TrimSpace(exitErr.Stderr))
+			}
+			return nil, fmt.Errorf("failed to list files changed since %s: %s", ref, msg)
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, ".quake/") || strings.Contains(line, "/.quake/") {
+				continue
+			}
+			files = append(files, line)
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,62 @@
+package evaluator
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// Timings records how long each task took to run. A task's time excludes its
+// dependencies, which are recorded separately. A Timings can be shared by
+// several evaluators to summarize a whole invocation.
+type Timings struct {
+	order     []string
+	durations map[string]time.Duration
+}
+
+// NewTimings creates an empty timing recorder
+func NewTimings() *Timings {
+	return &Timings{durations: make(map[string]time.Duration)}
+}
+
+// Add records that a task ran for d. Repeated runs of a task accumulate.
+func (t *Timings) Add(task string, d time.Duration) {
+	if _, ok := t.durations[task]; !ok {
+		t.order = append(t.order, task)
+	}
+	t.durations[task] += d
+}
+
+// Duration returns the recorded time for a task
+func (t *Timings) Duration(task string) time.Duration {
+	return t.durations[task]
+}
+
+// WriteSummary writes a table of task timings, slowest first, followed by the
+// total wall-clock time of the run
+func (t *Timings) WriteSummary(w io.Writer, total time.Duration) {
+	tasks := append([]string(nil), t.order...)
+	sort.SliceStable(tasks, func(i, j int) bool {
+		return t.durations[tasks[i]] > t.durations[tasks[j]]
+	})
+
+	width := len("total")
+	for _, task := range tasks {
+		width = max(width, len(task))
+	}
+
+	fmt.Fprintln(w, "Timings:")
+	for _, task := range tasks {
+		fmt.Fprintf(w, "  %-*s  %s\n", width, task, formatDuration(t.durations[task]))
+	}
+	fmt.Fprintf(w, "  %-*s  %s\n", width, "total", formatDuration(total))
+}
+
+// formatDuration rounds a duration for display, e.g. 1.2s or 35ms
+func formatDuration(d time.Duration) string {
+	if d >= time.Second {
+		return d.Round(100 * time.Millisecond).String()
+	}
+	return d.Round(time.Millisecond).String()
+}
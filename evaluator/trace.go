@@ -0,0 +1,71 @@
+package evaluator
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Trace records when tasks and commands begin and end, for viewing in
+// chrome://tracing or Perfetto. Commands of a parallel block are recorded on
+// a thread of their own. A Trace can be shared by several evaluators to cover
+// a whole invocation.
+type Trace struct {
+	mu     sync.Mutex
+	start  time.Time
+	events []traceEvent
+}
+
+// traceEvent is one event in the Chrome trace event format
+type traceEvent struct {
+	Name      string `json:"name"`
+	Category  string `json:"cat"`
+	Phase     string `json:"ph"`
+	Timestamp int64  `json:"ts"` // Microseconds since the trace started
+	PID       int    `json:"pid"`
+	TID       int    `json:"tid"`
+}
+
+// mainThread is the trace thread of everything that doesn't run in parallel
+const mainThread = 1
+
+// NewTrace creates an empty trace starting now
+func NewTrace() *Trace {
+	return &Trace{start: time.Now()}
+}
+
+// Begin records the start of a task or command on thread tid. The returned
+// function records its end.
+func (t *Trace) Begin(category, name string, tid int) func() {
+	t.add(traceEvent{Name: name, Category: category, Phase: "B", TID: tid})
+	return func() {
+		t.add(traceEvent{Name: name, Category: category, Phase: "E", TID: tid})
+	}
+}
+
+func (t *Trace) add(event traceEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	event.Timestamp = time.Since(t.start).Microseconds()
+	event.PID = os.Getpid()
+	t.events = append(t.events, event)
+}
+
+// WriteJSON writes the trace in the Chrome trace event format
+func (t *Trace) WriteJSON(w io.Writer) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	events := t.events
+	if events == nil {
+		events = []traceEvent{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		TraceEvents     []traceEvent `json:"traceEvents"`
+		DisplayTimeUnit string       `json:"displayTimeUnit"`
+	}{events, "ms"})
+}
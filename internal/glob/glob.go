@@ -0,0 +1,90 @@
+// Package glob matches paths against glob patterns where a ** segment
+// matches any number of directories
+package glob
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Files expands a glob pattern relative to baseDir. Unlike filepath.Glob,
+// a ** path segment matches any number of directories, so "tasks/**/*.quake"
+// finds .quake files at any depth under tasks.
+func Files(baseDir, pattern string) ([]string, error) {
+	pattern = filepath.ToSlash(filepath.Clean(pattern))
+	if !strings.Contains(pattern, "**") {
+		return filepath.Glob(filepath.Join(baseDir, pattern))
+	}
+
+	// Walk from the longest directory prefix without wildcards
+	patternSegs := strings.Split(pattern, "/")
+	root := baseDir
+	for len(patternSegs) > 1 && !hasGlobMeta(patternSegs[0]) {
+		root = filepath.Join(root, patternSegs[0])
+		patternSegs = patternSegs[1:]
+	}
+
+	var matches []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Missing or unreadable directories just don't match
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		if matchSegments(patternSegs, strings.Split(filepath.ToSlash(rel), "/")) {
+			matches = append(matches, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// Match reports whether a slash-separated path matches pattern
+func Match(pattern, path string) bool {
+	pattern = filepath.ToSlash(filepath.Clean(pattern))
+	path = filepath.ToSlash(filepath.Clean(path))
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(path, "/"))
+}
+
+// matchSegments matches path segments against pattern segments, where a **
+// segment matches zero or more path segments
+func matchSegments(pattern, path []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(path); i++ {
+				if matchSegments(pattern[1:], path[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(path) == 0 {
+			return false
+		}
+		if ok, err := filepath.Match(pattern[0], path[0]); err != nil || !ok {
+			return false
+		}
+		pattern, path = pattern[1:], path[1:]
+	}
+	return len(path) == 0
+}
+
+// hasGlobMeta reports whether a path segment contains glob wildcards
+func hasGlobMeta(s string) bool {
+	return strings.ContainsAny(s, "*?[\\")
+}
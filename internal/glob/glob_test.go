@@ -0,0 +1,36 @@
+package glob
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchSegments(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"**/*.quake", "a.quake", true},
+		{"**/*.quake", "x/y/a.quake", true},
+		{"a/**/b/*.quake", "a/b/c.quake", true},
+		{"a/**/b/*.quake", "a/x/y/b/c.quake", true},
+		{"a/**/b/*.quake", "a/x/c.quake", false},
+		{"*.quake", "x/a.quake", false},
+		{"src/**", "src/a/b.go", true},
+		{"src/**", "docs/a.md", false},
+	}
+
+	for _, tt := range tests {
+		got := matchSegments(strings.Split(tt.pattern, "/"), strings.Split(tt.path, "/"))
+		require.Equal(t, tt.match, got, "%s against %s", tt.pattern, tt.path)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	require.True(t, Match("src/**/*.go", "src/cmd/main.go"))
+	require.True(t, Match("./go.mod", "go.mod"))
+	require.False(t, Match("src/**/*.go", "src/README.md"))
+}
@@ -17,7 +17,7 @@ func NewTaskCache() (*TaskCache, error) {
 	}, nil
 }
 
-// GetDispatcherPath returns the path to the dispatcher file for go run
+// GetDispatcherPath returns the path to the dispatcher file built with the qtasks
 func (c *TaskCache) GetDispatcherPath(tasks []TaskFunc, qtasksDir string) (string, error) {
 	if len(tasks) == 0 {
 		return "", fmt.Errorf("no tasks to generate")
@@ -26,8 +26,67 @@ type TaskFunc struct {
 func DiscoverTasks(dir string) ([]TaskFunc, error) {
 	var tasks []TaskFunc
 
-	// Walk the directory to find .go files
-	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+	err := walkGoFiles(dir, func(path string) {
+		// Parse the Go file
+		fileTasks, err := parseGoFile(path)
+		if err != nil {
+			// Skip files that can't be parsed
+			fmt.Printf("Warning: failed to parse %s: %v\n", path, err)
+			return
+		}
+
+		tasks = append(tasks, fileTasks...)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return tasks, nil
+}
+
+// CheckTasks reports problems that make DiscoverTasks skip code in the given
+// directory: Go files that don't parse and exported functions whose
+// signature can't be run as a task
+func CheckTasks(dir string) ([]string, error) {
+	var problems []string
+
+	err := walkGoFiles(dir, func(path string) {
+		fset := token.NewFileSet()
+		node, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("failed to parse %s: %v", path, err))
+			return
+		}
+
+		// Only package main files hold tasks
+		if node.Name.Name != "main" {
+			return
+		}
+
+		for _, decl := range node.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv != nil || fn.Name.Name == "main" || !ast.IsExported(fn.Name.Name) {
+				continue
+			}
+
+			if analyzeFunction(fn, path, node.Name.Name) == nil {
+				problems = append(problems, fmt.Sprintf("%s: %s is not a valid task: parameters must be strings and the only result may be an error",
+					fset.Position(fn.Pos()), fn.Name.Name))
+			}
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return problems, nil
+}
+
+// walkGoFiles calls fn for every non-test Go file within dir
+func walkGoFiles(dir string, fn func(path string)) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
@@ -42,23 +101,9 @@ func DiscoverTasks(dir string) ([]TaskFunc, error) {
 			return nil
 		}
 
-		// Parse the Go file
-		fileTasks, err := parseGoFile(path)
-		if err != nil {
-			// Skip files that can't be parsed
-			fmt.Printf("Warning: failed to parse %s: %v\n", path, err)
-			return nil
-		}
-
-		tasks = append(tasks, fileTasks...)
+		fn(path)
 		return nil
 	})
-
-	if err != nil {
-		return nil, err
-	}
-
-	return tasks, nil
 }
 
 // parseGoFile parses a single Go file and extracts exported functions
@@ -203,31 +248,24 @@ func isErrorType(expr ast.Expr) bool {
 	return false
 }
 
-// parseTaskComment parses the comment for custom name/namespace and description
+// parseTaskComment parses the comment for custom name/namespace and description.
+// The description is the whole comment: its first line is the summary, and
+// the lines after it, including blank lines between paragraphs, are kept.
 func parseTaskComment(doc *ast.CommentGroup, task *TaskFunc) {
 	if doc == nil || len(doc.List) == 0 {
 		return
 	}
 
-	// Get the full comment text
-	var lines []string
-	for _, comment := range doc.List {
-		text := comment.Text
-		// Remove // or /* */ markers
-		text = strings.TrimPrefix(text, "//")
-		text = strings.TrimPrefix(text, "/*")
-		text = strings.TrimSuffix(text, "*/")
-		text = strings.TrimSpace(text)
-		if text != "" {
-			lines = append(lines, text)
-		}
-	}
-
-	if len(lines) == 0 {
+	// Get the full comment text, without markers or leading and trailing
+	// blank lines
+	text := strings.TrimRight(doc.Text(), "\n")
+	if text == "" {
 		return
 	}
+	lines := strings.Split(text, "\n")
 
-	firstLine := lines[0]
+	firstLine := strings.TrimSpace(lines[0])
+	summary, rest := firstLine, lines[1:]
 
 	// Check if the first line matches the pattern [name] :: or [namespace:name] ::
 	// We're looking for a pattern like: word or word:word followed by ::
@@ -250,19 +288,15 @@ func parseTaskComment(doc *ast.CommentGroup, task *TaskFunc) {
 				task.Name = strings.ToLower(strings.TrimSpace(nameSpec))
 			}
 
-			// The description is everything after ::
-			task.Description = strings.TrimSpace(firstLine[idx+2:])
+			// The summary is everything after ::
+			summary = strings.TrimSpace(firstLine[idx+2:])
 
-			// If description is empty but there are more lines, use the next line
-			if task.Description == "" && len(lines) > 1 {
-				task.Description = lines[1]
+			// If the summary is empty but there are more lines, use the next one
+			for summary == "" && len(rest) > 0 {
+				summary, rest = strings.TrimSpace(rest[0]), rest[1:]
 			}
-		} else {
-			// No brackets, just use the whole first line as description
-			task.Description = firstLine
 		}
-	} else {
-		// No :: pattern, just use the first line as description
-		task.Description = firstLine
 	}
+
+	task.Description = strings.TrimRight(strings.Join(append([]string{summary}, rest...), "\n"), "\n")
 }
@@ -0,0 +1,49 @@
+package gotasks
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscoverTaskComments(t *testing.T) {
+	dir := t.TempDir()
+	source := `package main
+
+// [db:Migrate] ::
+// Run the database migrations.
+//
+// Pending migrations run in order.
+//
+//go:generate echo not part of the description
+func Migrate() error { return nil }
+
+// Build compiles the project.
+//
+// It builds every package.
+func Build() {}
+
+//go:noinline
+func Plain() {}
+`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tasks.go"), []byte(source), 0644))
+
+	tasks, err := DiscoverTasks(dir)
+	require.NoError(t, err)
+	require.Len(t, tasks, 3)
+
+	// The summary after an empty [ns:name] :: line is the next line, and the
+	// paragraphs after it are kept without the //go: directive
+	require.Equal(t, "db", tasks[0].Namespace)
+	require.Equal(t, "migrate", tasks[0].Name)
+	require.Equal(t, "Run the database migrations.\n\nPending migrations run in order.", tasks[0].Description)
+
+	require.Equal(t, "build", tasks[1].Name)
+	require.Equal(t, "Build compiles the project.\n\nIt builds every package.", tasks[1].Description)
+
+	// A comment with only directives has no description
+	require.Equal(t, "plain", tasks[2].Name)
+	require.Empty(t, tasks[2].Description)
+}
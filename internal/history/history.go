@@ -0,0 +1,146 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Entry records how often and how recently a task has been run
+type Entry struct {
+	Count   int       `json:"count"`
+	LastRun time.Time `json:"last_run"`
+}
+
+// History holds the run history for the tasks of a single Quakefile
+type History struct {
+	Tasks map[string]Entry `json:"tasks"`
+}
+
+// Store persists run history for all Quakefiles in a single JSON file
+type Store struct {
+	path string
+}
+
+// NewStore creates a store in the user's state directory
+func NewStore() (*Store, error) {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to locate home directory: %w", err)
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return NewStoreAt(filepath.Join(dir, "quake", "history.json")), nil
+}
+
+// NewStoreAt creates a store backed by the given file
+func NewStoreAt(path string) *Store {
+	return &Store{path: path}
+}
+
+// readAll reads the history for every Quakefile, keyed by Quakefile path
+func (s *Store) readAll() (map[string]*History, error) {
+	all := make(map[string]*History)
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return all, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, fmt.Errorf("failed to parse history file %s: %w", s.path, err)
+	}
+	return all, nil
+}
+
+// Load returns the run history for the given Quakefile
+func (s *Store) Load(quakefile string) (*History, error) {
+	all, err := s.readAll()
+	if err != nil {
+		return nil, err
+	}
+
+	h, ok := all[quakefile]
+	if !ok || h == nil {
+		return &History{Tasks: make(map[string]Entry)}, nil
+	}
+	if h.Tasks == nil {
+		h.Tasks = make(map[string]Entry)
+	}
+	return h, nil
+}
+
+// Record notes that a task from the given Quakefile was run at the given time
+func (s *Store) Record(quakefile, task string, at time.Time) error {
+	all, err := s.readAll()
+	if err != nil {
+		return err
+	}
+
+	h, ok := all[quakefile]
+	if !ok || h == nil {
+		h = &History{}
+		all[quakefile] = h
+	}
+	if h.Tasks == nil {
+		h.Tasks = make(map[string]Entry)
+	}
+
+	entry := h.Tasks[task]
+	entry.Count++
+	entry.LastRun = at
+	h.Tasks[task] = entry
+
+	data, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temp file and rename so concurrent runs never see a partial file
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), "history-*.json")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// SortByUsage orders task names by run count, then by most recent run.
+// Tasks without any history are placed last in alphabetical order.
+func SortByUsage(names []string, h *History) {
+	var tasks map[string]Entry
+	if h != nil {
+		tasks = h.Tasks
+	}
+
+	sort.SliceStable(names, func(i, j int) bool {
+		a, b := tasks[names[i]], tasks[names[j]]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if !a.LastRun.Equal(b.LastRun) {
+			return a.LastRun.After(b.LastRun)
+		}
+		return names[i] < names[j]
+	})
+}
@@ -0,0 +1,55 @@
+package history
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSortByUsage(t *testing.T) {
+	now := time.Now()
+	h := &History{Tasks: map[string]Entry{
+		"build":  {Count: 5, LastRun: now.Add(-time.Hour)},
+		"test":   {Count: 5, LastRun: now},
+		"deploy": {Count: 1, LastRun: now},
+	}}
+
+	names := []string{"clean", "deploy", "build", "lint", "test"}
+	SortByUsage(names, h)
+
+	require.Equal(t, []string{"test", "build", "deploy", "clean", "lint"}, names)
+}
+
+func TestSortByUsageWithoutHistory(t *testing.T) {
+	names := []string{"lint", "build", "test", "clean"}
+	SortByUsage(names, nil)
+
+	require.Equal(t, []string{"build", "clean", "lint", "test"}, names)
+}
+
+func TestStoreRecordAndLoad(t *testing.T) {
+	store := NewStoreAt(filepath.Join(t.TempDir(), "quake", "history.json"))
+
+	// Loading before anything is recorded returns empty history
+	h, err := store.Load("/project/Quakefile")
+	require.NoError(t, err)
+	require.Empty(t, h.Tasks)
+
+	first := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	second := first.Add(time.Minute)
+	require.NoError(t, store.Record("/project/Quakefile", "build", first))
+	require.NoError(t, store.Record("/project/Quakefile", "build", second))
+	require.NoError(t, store.Record("/other/Quakefile", "test", first))
+
+	h, err = store.Load("/project/Quakefile")
+	require.NoError(t, err)
+	require.Equal(t, map[string]Entry{
+		"build": {Count: 2, LastRun: second},
+	}, h.Tasks)
+
+	h, err = store.Load("/other/Quakefile")
+	require.NoError(t, err)
+	require.Equal(t, 1, h.Tasks["test"].Count)
+}
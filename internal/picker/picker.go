@@ -0,0 +1,133 @@
+package picker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"miren.dev/quake/internal/color"
+)
+
+// ErrCancelled is returned when the user dismisses the picker without choosing
+var ErrCancelled = errors.New("selection cancelled")
+
+// Item is a single choice shown in the picker
+type Item struct {
+	Label       string
+	Description string
+}
+
+// Pick shows an arrow-key menu on the terminal and returns the chosen index
+func Pick(title string, items []Item) (int, error) {
+	if len(items) == 0 {
+		return -1, fmt.Errorf("nothing to choose from")
+	}
+
+	restore, err := makeRaw()
+	if err != nil {
+		return -1, fmt.Errorf("failed to configure terminal: %w", err)
+	}
+	defer restore()
+
+	m := &model{items: items}
+	out := os.Stderr
+
+	fmt.Fprintf(out, "%s\r\n", color.BoldText(title))
+	m.render(out, false)
+
+	buf := make([]byte, 8)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return -1, err
+		}
+
+		done, cancelled := m.handle(buf[:n])
+		if cancelled {
+			m.clear(out)
+			return -1, ErrCancelled
+		}
+		if done {
+			m.clear(out)
+			return m.cursor, nil
+		}
+		m.render(out, true)
+	}
+}
+
+// model tracks the picker's cursor position
+type model struct {
+	items  []Item
+	cursor int
+}
+
+// handle applies a key press, reporting whether a choice was made or cancelled
+func (m *model) handle(key []byte) (done bool, cancelled bool) {
+	switch string(key) {
+	case "\x1b[A", "k":
+		if m.cursor > 0 {
+			m.cursor--
+		}
+	case "\x1b[B", "j":
+		if m.cursor < len(m.items)-1 {
+			m.cursor++
+		}
+	case "\r", "\n":
+		return true, false
+	case "\x1b", "\x03", "q":
+		return false, true
+	}
+	return false, false
+}
+
+// render draws the item list, redrawing over the previous frame if needed
+func (m *model) render(out io.Writer, redraw bool) {
+	if redraw {
+		fmt.Fprintf(out, "\x1b[%dA", len(m.items))
+	}
+
+	width := 0
+	for _, item := range m.items {
+		if len(item.Label) > width {
+			width = len(item.Label)
+		}
+	}
+
+	for i, item := range m.items {
+		label := item.Label + strings.Repeat(" ", width-len(item.Label))
+		line := fmt.Sprintf("  %s  %s", label, color.FaintText(item.Description))
+		if i == m.cursor {
+			line = fmt.Sprintf("%s %s  %s", color.CyanText(">"), color.BoldText(label), item.Description)
+		}
+		fmt.Fprintf(out, "\x1b[2K%s\r\n", line)
+	}
+}
+
+// clear erases the item list so the chosen task's output starts cleanly
+func (m *model) clear(out io.Writer) {
+	fmt.Fprintf(out, "\x1b[%dA\x1b[J", len(m.items))
+}
+
+// makeRaw puts the terminal in raw mode and returns a function restoring it
+func makeRaw() (func(), error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return nil, err
+	}
+	return func() {
+		stty(strings.TrimSpace(saved))
+	}, nil
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
@@ -0,0 +1,38 @@
+package picker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestModelNavigation(t *testing.T) {
+	m := &model{items: []Item{{Label: "build"}, {Label: "test"}, {Label: "lint"}}}
+
+	// Cursor doesn't move above the first item
+	m.handle([]byte("\x1b[A"))
+	require.Equal(t, 0, m.cursor)
+
+	m.handle([]byte("\x1b[B"))
+	m.handle([]byte("j"))
+	require.Equal(t, 2, m.cursor)
+
+	// Cursor doesn't move past the last item
+	m.handle([]byte("\x1b[B"))
+	require.Equal(t, 2, m.cursor)
+
+	m.handle([]byte("k"))
+	done, cancelled := m.handle([]byte("\r"))
+	require.True(t, done)
+	require.False(t, cancelled)
+	require.Equal(t, 1, m.cursor)
+}
+
+func TestModelCancel(t *testing.T) {
+	for _, key := range []string{"\x1b", "\x03", "q"} {
+		m := &model{items: []Item{{Label: "build"}}}
+		done, cancelled := m.handle([]byte(key))
+		require.False(t, done)
+		require.True(t, cancelled, "key %q should cancel", key)
+	}
+}
@@ -0,0 +1,114 @@
+// Package sources remembers the files a project's tasks are defined in, so
+// quake can tell which of them changed since the last run.
+package sources
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// State maps each source file, relative to the Quakefile's directory, to the
+// SHA-256 of its contents
+type State struct {
+	Files map[string]string `json:"files"`
+}
+
+// Path returns where the state of the project with the Quakefile in dir is
+// kept
+func Path(dir string) string {
+	return filepath.Join(dir, ".quake", "state.json")
+}
+
+// gitignore keeps git from listing the state directory in a user's project
+const gitignore = "*\n"
+
+// Load reads the state at path. It's nil if nothing was recorded yet.
+func Load(path string) (*State, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse source state %s: %w", path, err)
+	}
+	return &state, nil
+}
+
+// Snapshot hashes the given files, which are relative to dir. Files that
+// can't be read are left out.
+func Snapshot(dir string, files []string) *State {
+	state := &State{Files: make(map[string]string, len(files))}
+	for _, file := range files {
+		if hash, err := hashFile(filepath.Join(dir, file)); err == nil {
+			state.Files[file] = hash
+		}
+	}
+	return state
+}
+
+// Changed reports whether a file, relative to dir, differs from when the
+// state was recorded. Everything counts as changed without a state.
+func (s *State) Changed(dir, file string) bool {
+	if s == nil {
+		return true
+	}
+	recorded, ok := s.Files[file]
+	if !ok {
+		return true
+	}
+	hash, err := hashFile(filepath.Join(dir, file))
+	return err != nil || hash != recorded
+}
+
+// Save writes the state to path. Its directory gets a .gitignore, so git
+// doesn't show it as untracked.
+func (s *State) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	ignorePath := filepath.Join(filepath.Dir(path), ".gitignore")
+	if _, err := os.Stat(ignorePath); os.IsNotExist(err) {
+		if err := os.WriteFile(ignorePath, []byte(gitignore), 0644); err != nil {
+			return err
+		}
+	}
+
+	// Write to a temp file and rename so concurrent runs never see a partial file
+	tmp, err := os.CreateTemp(filepath.Dir(path), "state-*.json")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func hashFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
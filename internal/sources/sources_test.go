@@ -0,0 +1,37 @@
+package sources
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateChanged(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Quakefile"), []byte("task a {\n}\n"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "qtasks"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "qtasks", "b.quake"), []byte("task b {\n}\n"), 0644))
+
+	// Nothing recorded yet, so everything is changed
+	path := Path(dir)
+	state, err := Load(path)
+	require.NoError(t, err)
+	require.Nil(t, state)
+	require.True(t, state.Changed(dir, "Quakefile"))
+
+	require.NoError(t, Snapshot(dir, []string{"Quakefile", "qtasks/b.quake", "missing.quake"}).Save(path))
+	ignore, err := os.ReadFile(filepath.Join(dir, ".quake", ".gitignore"))
+	require.NoError(t, err)
+	require.Equal(t, "*\n", string(ignore))
+	state, err = Load(path)
+	require.NoError(t, err)
+	require.Len(t, state.Files, 2)
+	require.False(t, state.Changed(dir, "Quakefile"))
+	require.False(t, state.Changed(dir, "qtasks/b.quake"))
+	require.True(t, state.Changed(dir, "qtasks/new.quake"))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "qtasks", "b.quake"), []byte("task b {\n  echo b\n}\n"), 0644))
+	require.True(t, state.Changed(dir, "qtasks/b.quake"))
+}
@@ -0,0 +1,20 @@
+// Package term tells whether quake is attached to a terminal
+package term
+
+import (
+	"os"
+	"os/exec"
+)
+
+// IsTerminal reports whether the file is attached to a terminal
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+
+	// Character devices like /dev/null aren't terminals; stty fails on those
+	cmd := exec.Command("stty", "-g")
+	cmd.Stdin = f
+	return cmd.Run() == nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// logDrainTimeout is how long stopping the log file waits for output still
+// in flight. Background processes started by tasks can keep the pipes open
+// forever, so it doesn't wait for them.
+const logDrainTimeout = time.Second
+
+// startLogFile copies everything written to stdout and stderr from then on,
+// by quake and the commands it runs, into the file at path, while still
+// showing it on the terminal. Colors are removed from the file copy. The
+// returned function restores stdout and stderr and closes the file.
+func startLogFile(path string) (func(), error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create log file: %w", err)
+	}
+
+	var mu sync.Mutex // Keeps stdout and stderr writes to the file whole
+	var wg sync.WaitGroup
+	tee := func(terminal *os.File) (*os.File, error) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		log := &colorStripper{w: file}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer r.Close()
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := r.Read(buf)
+				if n > 0 {
+					terminal.Write(buf[:n])
+					mu.Lock()
+					log.Write(buf[:n])
+					mu.Unlock()
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+		return w, nil
+	}
+
+	stdout, stderr := os.Stdout, os.Stderr
+	outPipe, err := tee(stdout)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to start log file: %w", err)
+	}
+	errPipe, err := tee(stderr)
+	if err != nil {
+		outPipe.Close()
+		wg.Wait()
+		file.Close()
+		return nil, fmt.Errorf("failed to start log file: %w", err)
+	}
+	os.Stdout, os.Stderr = outPipe, errPipe
+
+	return func() {
+		os.Stdout, os.Stderr = stdout, stderr
+		outPipe.Close()
+		errPipe.Close()
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(logDrainTimeout):
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if err := file.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to write log file: %v\n", err)
+		}
+	}, nil
+}
+
+// colorStripper writes to w with ANSI escape sequences like \033[1m removed.
+// A sequence can be split across writes.
+type colorStripper struct {
+	w     io.Writer
+	state int // 0: text, 1: after ESC, 2: inside a CSI sequence
+}
+
+func (s *colorStripper) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p))
+	for _, c := range p {
+		switch s.state {
+		case 0:
+			if c == 0x1b {
+				s.state = 1
+				continue
+			}
+			out = append(out, c)
+		case 1:
+			if c == '[' {
+				s.state = 2
+			} else {
+				// A two-character escape; drop it too
+				s.state = 0
+			}
+		case 2:
+			// Parameters and intermediates run until a final byte in @-~
+			if c >= 0x40 && c <= 0x7e {
+				s.state = 0
+			}
+		}
+	}
+	if _, err := s.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -3,18 +3,33 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"miren.dev/mflags"
 	"miren.dev/quake/evaluator"
-	"miren.dev/quake/internal/gotasks"
+	"miren.dev/quake/internal/color"
+	"miren.dev/quake/internal/history"
+	"miren.dev/quake/internal/picker"
+	"miren.dev/quake/internal/sources"
+	"miren.dev/quake/internal/term"
 	"miren.dev/quake/parser"
+	"miren.dev/quake/quake"
 )
 
 func main() {
@@ -23,26 +38,99 @@ func main() {
 
 func realMain() int {
 	// Ensure cleanup on exit
-	defer func() {
-		if globalTaskCache != nil {
-			globalTaskCache.Cleanup()
-		}
-	}()
+	defer quake.Cleanup()
+
+	// Refuse to run if tasks keep invoking quake recursively
+	if err := enterNestedInvocation(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
 
 	var listTasks bool
-	var verbose bool
+	var lo listOptions
 	var generateTask bool
+	var newTaskSignature string
 	var initQuakefile bool
+	var initMinimal bool
 	var quakefilePath string
+	var showGraph bool
+	var opts quake.Options
+	var printPlan bool
+	var jsonOutput bool
+	var showTimings bool
+	var tracePath string
+	var traceJSON bool
+	var outputDir string
+	var showTaskName string
+	var checkOnly bool
+	var explainVar string
+	var dumpAST bool
+	var keepGoing bool
+	var chain bool
+	var doctor bool
+	var cleanTask string
+	var repeatCount string
+	var jobsCount string
+	var untilFail bool
+	var cpuProfile string
+	var memProfile string
+	var logFile string
 
 	flags := mflags.NewFlagSet("quake")
 	flags.BoolVar(&listTasks, "list", 'l', false, "List all tasks with their documentation")
-	flags.BoolVar(&verbose, "", 'v', false, "Verbose output (show source file locations with -l)")
+	flags.BoolVar(&lo.tree, "tree", 0, false, "Group tasks by namespace with -l")
+	flags.BoolVar(&lo.all, "all", 0, false, "Include private tasks (names starting with _) with -l")
+	flags.BoolVar(&lo.names, "names-only", 0, false, "With -l, print only task names, one per line")
+	flags.BoolVar(&lo.changed, "changed", 0, false, "With -l, only list tasks whose source file changed since the last run")
+	flags.BoolVar(&lo.verbose, "", 'v', false, "Verbose output (show source file locations with -l)")
 	flags.BoolVar(&generateTask, "generate", 'g', false, "Generate a new task using Claude AI")
+	flags.StringVar(&newTaskSignature, "new-task", 0, "", "Add an empty task like 'deploy(env) => build' to the Quakefile, or to the .quake file given as an argument")
 	flags.BoolVar(&initQuakefile, "init", 0, false, "Initialize a new Quakefile using Claude AI")
-	flags.StringVar(&quakefilePath, "file", 'f', "", "Path to Quakefile (default: search for Quakefile in current and parent directories)")
+	flags.BoolVar(&initMinimal, "minimal", 0, false, "With --init, generate a starter Quakefile from built-in templates instead of Claude")
+	flags.BoolVar(&showGraph, "graph", 0, false, "Output the task dependency graph in Graphviz DOT format")
+	flags.BoolVar(&printPlan, "print-plan", 0, false, "Print the resolved execution plan without running anything")
+	flags.BoolVar(&jsonOutput, "json", 0, false, "Output in JSON format (with --print-plan or --list)")
+	flags.BoolVar(&checkOnly, "check", 0, false, "Check the Quakefile for problems without running anything")
+	flags.BoolVar(&doctor, "doctor", 0, false, "Check that quake has what it needs: a Quakefile, its shell, go and claude")
+	flags.StringVar(&cleanTask, "clean", 0, "", "Remove the files a task lists in outputs: [...] instead of running it")
+	flags.BoolVar(&dumpAST, "dump-ast", 0, false, "Print the loaded Quakefile, including .quake files and Go tasks, as JSON")
+	flags.BoolVar(&keepGoing, "keep-going", 'k', false, "Keep running the remaining task groups after one fails")
+	flags.BoolVar(&chain, "chain", 0, false, "Run all task groups with one evaluator, so task() results and command substitutions carry over between them")
+	flags.StringVar(&repeatCount, "repeat", 0, "", "Run the tasks this many times, stopping at the first failure unless -k is given")
+	flags.BoolVar(&untilFail, "until-fail", 0, false, "Run the tasks over and over until they fail (at most --repeat times, if given)")
+	flags.BoolVar(&showTimings, "timings", 0, false, "Print how long each task took after the run")
+	flags.StringVar(&tracePath, "trace", 0, "", "Write a Chrome trace (chrome://tracing) of the run's tasks and commands to this file")
+	flags.BoolVar(&traceJSON, "trace-json", 0, false, "Like --trace, writing the trace to trace.json (in --output-dir, if given)")
+	flags.StringVar(&logFile, "log-file", 0, "", "Also write everything quake and its commands print to this file, without colors")
+	flags.StringVar(&outputDir, "output-dir", 0, "", "Write diagnostics into this directory: graph.dot with --graph, timings.txt with --timings, trace.json with --trace-json, and a relative --trace file")
+	flags.StringVar(&jobsCount, "jobs", 'j', "", "Run at most this many commands of a parallel block at once (default: the front matter's jobs, or all)")
+	flags.StringVar(&opts.Color, "color", 0, "", "Use colors: always, never or auto (default: the front matter's color, or auto)")
+	flags.BoolVar(&opts.AlwaysMake, "always-make", 'B', false, "Run file targets even if they are up to date")
+	flags.BoolVar(&opts.AssumeYes, "yes", 'y', false, "Run tasks with a confirm attribute without asking")
+	flags.StringVar(&opts.Since, "since", 0, "", "Skip tasks with inputs: [...] when none of their input files changed since this git ref")
+	flags.BoolVar(&opts.StrictVars, "strict-vars", 0, false, "Fail if a variable's command substitution fails instead of leaving it empty")
+	flags.BoolVar(&opts.CleanEnv, "clean-env", 0, false, "Run commands with only PATH, HOME and TERM from the environment plus exported variables")
+	flags.BoolVar(&opts.WarnUnused, "warn-unused", 0, false, "Warn about variables and task arguments that are never used")
+	flags.BoolVar(&opts.WarnShadow, "warn-shadow", 0, false, "Warn about tasks named like shell built-ins or common commands, such as ls or test")
+	flags.BoolVar(&opts.PrintEnv, "print-env", 0, false, "Print the resolved variables to stderr before running, masking *SECRET*, *TOKEN* and *KEY* values unless given as --print-env=full")
+	flags.BoolVar(&opts.NoRemote, "no-remote", 0, false, "Load remote .quake files only from the cache instead of fetching them")
+	flags.BoolVar(&opts.AllowOverrides, "allow-overrides", 0, false, "Allow tasks to be defined more than once (the main Quakefile's definition wins)")
+	flags.StringVar(&showTaskName, "show", 0, "", "Show a task's description, arguments, dependencies and commands without running it")
+	flags.StringVar(&explainVar, "explain-var", 0, "", "Show how a variable's value is resolved")
+	flags.StringVar(&lo.sortBy, "sort", 0, "", "Sort order for --list: order (as defined), name, source (grouped by file) or usage (most frequently/recently run first)")
+	flags.StringVar(&lo.filter, "filter", 0, "", "With --list, only show tasks whose name or description contains this text")
+	flags.StringVar(&cpuProfile, "cpuprofile", 0, "", "Write a CPU profile of quake itself to this file, for debugging quake")
+	flags.StringVar(&memProfile, "memprofile", 0, "", "Write a heap profile of quake itself to this file on exit, for debugging quake")
+	flags.StringVar(&quakefilePath, "file", 'f', "", "Path to Quakefile or a directory containing one (default: search for Quakefile in current and parent directories)")
+
+	flagArgs, printEnvFull, err := splitPrintEnvFull(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	opts.PrintEnvFull = printEnvFull
 
-	if err := flags.Parse(os.Args[1:]); err != nil {
+	if err := flags.Parse(flagArgs); err != nil {
 		if errors.Is(err, mflags.ErrHelp) {
 			return 1
 		}
@@ -51,6 +139,80 @@ func realMain() int {
 		return 1
 	}
 
+	// Profiling starts as soon as the flags are known. Its deferred stop runs
+	// before quake.Cleanup, so the profiles are written while the task cache
+	// still exists and cover everything but removing it.
+	stopProfiling, err := startProfiling(cpuProfile, memProfile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	defer stopProfiling()
+
+	if logFile != "" {
+		stopLog, err := startLogFile(logFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		defer stopLog()
+	}
+
+	// With --until-fail and no --repeat, there's no limit
+	repeat := 1
+	if untilFail {
+		repeat = 0
+	}
+	if repeatCount != "" {
+		n, err := strconv.Atoi(repeatCount)
+		if err != nil || n < 1 {
+			fmt.Fprintf(os.Stderr, "Error: invalid --repeat %q (expected a positive number)\n", repeatCount)
+			return 1
+		}
+		repeat = n
+	}
+
+	if jobsCount != "" {
+		n, err := strconv.Atoi(jobsCount)
+		if err != nil || n < 1 {
+			fmt.Fprintf(os.Stderr, "Error: invalid --jobs %q (expected a positive number)\n", jobsCount)
+			return 1
+		}
+		opts.Jobs = n
+	}
+
+	switch opts.Color {
+	case "", "auto":
+	case "always", "never":
+		setColor(opts.Color)
+	default:
+		fmt.Fprintf(os.Stderr, "Error: invalid --color %q (expected: always, never or auto)\n", opts.Color)
+		return 1
+	}
+
+	if traceJSON && tracePath == "" {
+		tracePath = "trace.json"
+	}
+
+	if outputDir != "" {
+		if err := os.MkdirAll(outputDir, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to create output directory: %v\n", err)
+			return 1
+		}
+		// A relative --trace file goes in the output directory too
+		if tracePath != "" && !filepath.IsAbs(tracePath) {
+			tracePath = filepath.Join(outputDir, tracePath)
+		}
+	}
+
+	if initQuakefile && initMinimal {
+		if err := initMinimalQuakefile(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
 	if initQuakefile {
 		if err := initQuakefileWithClaude(); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
@@ -67,8 +229,81 @@ func realMain() int {
 		return 0
 	}
 
+	if newTaskSignature != "" {
+		var target string
+		if args := flags.Args(); len(args) > 0 {
+			target = args[0]
+		}
+		path, err := addNewTask(newTaskSignature, target, quakefilePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		fmt.Printf("✅ Task added to %s\n", path)
+		return 0
+	}
+
+	if showGraph {
+		w, closeOutput, err := openDiagnostic(outputDir, "graph.dot", os.Stdout)
+		if err == nil {
+			err = printTaskGraph(w, quakefilePath, opts)
+			if closeErr := closeOutput(); err == nil {
+				err = closeErr
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
 	if listTasks {
-		if err := listAllTasks(verbose, quakefilePath); err != nil {
+		lo.json = jsonOutput
+		if err := listAllTasks(lo, quakefilePath, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	if checkOnly {
+		problems, err := checkQuakefile(os.Stdout, quakefilePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		if problems > 0 {
+			return 1
+		}
+		return 0
+	}
+
+	if doctor {
+		if runDoctor(os.Stdout, quakefilePath) > 0 {
+			return 1
+		}
+		return 0
+	}
+
+	if cleanTask != "" {
+		if err := cleanOutputs(os.Stdout, cleanTask, quakefilePath, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	if dumpAST {
+		if err := dumpQuakefile(os.Stdout, quakefilePath, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	if showTaskName != "" {
+		if err := showTask(showTaskName, quakefilePath, opts); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			return 1
 		}
@@ -78,405 +313,1382 @@ func realMain() int {
 	// Parse arguments to support multiple tasks separated by --
 	args := flags.Args()
 
-	// Split arguments into groups separated by --
-	var taskGroups [][]string
-	currentGroup := []string{}
+	// KEY=VALUE arguments before the first task override Quakefile variables
+	opts.Variables, args = splitVariableOverrides(args)
 
-	for _, arg := range args {
-		if arg == "--" {
-			if len(currentGroup) > 0 {
-				taskGroups = append(taskGroups, currentGroup)
-				currentGroup = []string{}
-			}
-		} else {
-			currentGroup = append(currentGroup, arg)
+	if explainVar != "" {
+		if err := explainVariable(explainVar, quakefilePath, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
 		}
-	}
-	// Add the last group if not empty
-	if len(currentGroup) > 0 {
-		taskGroups = append(taskGroups, currentGroup)
+		return 0
 	}
 
-	// If no tasks specified, run default
-	if len(taskGroups) == 0 {
-		if err := runTask("", nil, quakefilePath); err != nil {
+	taskGroups := splitTaskGroups(args)
+
+	if printPlan {
+		if err := printExecutionPlan(taskGroups, quakefilePath, opts, jsonOutput); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			return 1
 		}
 		return 0
 	}
 
-	// Execute each task group in sequence
-	for _, group := range taskGroups {
-		taskName := group[0]
-		var taskArgs []string
-		if len(group) > 1 {
-			taskArgs = group[1:]
+	if showTimings {
+		opts.Timings = evaluator.NewTimings()
+		start := time.Now()
+		defer func() {
+			w, closeOutput, err := openDiagnostic(outputDir, "timings.txt", os.Stderr)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				return
+			}
+			opts.Timings.WriteSummary(w, time.Since(start))
+			closeOutput()
+		}()
+	}
+
+	if tracePath != "" {
+		opts.Trace = evaluator.NewTrace()
+		defer func() {
+			if err := writeTrace(tracePath, opts.Trace); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			}
+		}()
+	}
+
+	// Pass Ctrl-C and SIGTERM on to the running command rather than leaving
+	// it behind, then return normally so deferred cleanup still runs
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		for sig := range signals {
+			evaluator.Interrupt(sig)
 		}
+	}()
+
+	// Execute each task group in sequence
+	run := func() error {
+		return runTaskGroups(taskGroups, quakefilePath, opts, keepGoing, chain)
+	}
 
-		if err := runTask(taskName, taskArgs, quakefilePath); err != nil {
+	// If no tasks specified, run default (or let the user pick one if there is none)
+	if len(taskGroups) == 0 {
+		taskName, err := pickTaskIfNoDefault(quakefilePath, opts)
+		if err != nil {
+			if errors.Is(err, picker.ErrCancelled) {
+				return 1
+			}
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			return 1
 		}
+
+		run = func() error {
+			return runTask(taskName, nil, quakefilePath, opts)
+		}
+	}
+
+	if err := repeatRun(os.Stderr, repeat, untilFail, keepGoing, run); err != nil {
+		return runFailed(err)
 	}
 
 	return 0
 }
 
-// findQuakeFiles finds all .quake files in the qtasks directories
-func findQuakeFiles(baseDir string) []string {
-	var quakeFiles []string
+// loadQuakefile loads the Quakefile at path like quake.LoadWithOptions and
+// applies its color setting
+func loadQuakefile(path string, opts quake.Options) (*parser.QuakeFile, error) {
+	qf, err := quake.LoadWithOptions(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	setColor(quake.Color(qf, opts))
+	return qf, nil
+}
 
-	// Directories to search for .quake files
-	taskDirs := []string{
-		filepath.Join(baseDir, "qtasks"),
-		filepath.Join(baseDir, "lib", "qtasks"),
-		filepath.Join(baseDir, "internal", "qtasks"),
+// setColor turns colors on for always and off for never, leaving auto alone.
+// NO_COLOR in the environment still wins.
+func setColor(mode string) {
+	switch mode {
+	case "always":
+		color.NoColor = os.Getenv("NO_COLOR") != ""
+	case "never":
+		color.NoColor = true
 	}
+}
 
-	for _, dir := range taskDirs {
-		// Check if directory exists
-		if _, err := os.Stat(dir); os.IsNotExist(err) {
-			continue
+// repeatRun calls run repeat times, or with untilFail until it fails (at most
+// repeat times, unless repeat is 0), printing the iteration number to w
+// before each. A failure stops the repetitions unless keepGoing is set.
+func repeatRun(w io.Writer, repeat int, untilFail, keepGoing bool, run func() error) error {
+	if repeat == 1 && !untilFail {
+		return run()
+	}
+
+	failed := 0
+	for i := 1; repeat == 0 || i <= repeat; i++ {
+		if repeat == 0 {
+			fmt.Fprintln(w, color.BoldText(fmt.Sprintf("Iteration %d", i)))
+		} else {
+			fmt.Fprintln(w, color.BoldText(fmt.Sprintf("Iteration %d/%d", i, repeat)))
 		}
 
-		// Find all .quake files in the directory
-		files, err := filepath.Glob(filepath.Join(dir, "*.quake"))
-		if err != nil {
+		err := run()
+		if err == nil {
 			continue
 		}
+		if untilFail || !keepGoing || evaluator.Interrupted() {
+			return fmt.Errorf("iteration %d failed: %w", i, err)
+		}
+		fmt.Fprintf(w, "Error: %v\n", err)
+		failed++
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d iterations failed", failed, repeat)
+	}
+	return nil
+}
+
+// splitTaskGroups splits the command line into task groups separated by --.
+// Each argument reaches its task exactly as the shell passed it, so a quoted
+// value keeps its spaces and newlines. An argument of \-- passes a literal --
+// to the task instead of starting a new group.
+func splitTaskGroups(args []string) [][]string {
+	var taskGroups [][]string
+	currentGroup := []string{}
 
-		quakeFiles = append(quakeFiles, files...)
+	for _, arg := range args {
+		switch arg {
+		case "--":
+			if len(currentGroup) > 0 {
+				taskGroups = append(taskGroups, currentGroup)
+				currentGroup = []string{}
+			}
+		case `\--`:
+			currentGroup = append(currentGroup, "--")
+		default:
+			currentGroup = append(currentGroup, arg)
+		}
+	}
+	// Add the last group if not empty
+	if len(currentGroup) > 0 {
+		taskGroups = append(taskGroups, currentGroup)
 	}
+	return taskGroups
+}
 
-	return quakeFiles
+// openDiagnostic returns where a diagnostic is written: the named file in
+// outputDir, or fallback if there's no output directory. The returned
+// function closes the file.
+func openDiagnostic(outputDir, name string, fallback io.Writer) (io.Writer, func() error, error) {
+	if outputDir == "" {
+		return fallback, func() error { return nil }, nil
+	}
+	f, err := os.Create(filepath.Join(outputDir, name))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return f, f.Close, nil
 }
 
-// mergeQuakefiles merges multiple QuakeFile structs into one
-func mergeQuakefiles(files ...parser.QuakeFile) parser.QuakeFile {
-	result := parser.QuakeFile{}
+// writeTrace writes a recorded trace to path
+func writeTrace(path string, trace *evaluator.Trace) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to write trace: %w", err)
+	}
+	defer f.Close()
+
+	if err := trace.WriteJSON(f); err != nil {
+		return fmt.Errorf("failed to write trace to %s: %w", path, err)
+	}
+	return nil
+}
 
-	for _, file := range files {
-		result.Tasks = append(result.Tasks, file.Tasks...)
-		result.Variables = append(result.Variables, file.Variables...)
-		result.Namespaces = append(result.Namespaces, file.Namespaces...)
+// startProfiling starts the CPU profile for --cpuprofile. The returned
+// function stops it and writes the heap profile for --memprofile; errors are
+// reported to stderr since quake is exiting by then.
+func startProfiling(cpuPath, memPath string) (func(), error) {
+	var cpuFile *os.File
+	if cpuPath != "" {
+		f, err := os.Create(cpuPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create CPU profile: %w", err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to start CPU profile: %w", err)
+		}
+		cpuFile = f
 	}
 
-	return result
+	return func() {
+		if cpuFile != nil {
+			pprof.StopCPUProfile()
+			if err := cpuFile.Close(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to write CPU profile: %v\n", err)
+			}
+		}
+		if memPath != "" {
+			if err := writeHeapProfile(memPath); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			}
+		}
+	}, nil
 }
 
-// Global task cache that will be cleaned up on exit
-var globalTaskCache *gotasks.TaskCache
+// writeHeapProfile writes a heap profile of what's in use after a garbage
+// collection
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create heap profile: %w", err)
+	}
+	defer f.Close()
+
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		return fmt.Errorf("failed to write heap profile: %w", err)
+	}
+	return nil
+}
 
-// discoverGoTasks finds and prepares Go tasks in all qtasks directories
-func discoverGoTasks(baseDir string) ([]parser.Task, error) {
-	var allTasks []parser.Task
+// runFailed reports a failed run and returns the exit code: 130 if quake was
+// interrupted, 1 otherwise
+func runFailed(err error) int {
+	if evaluator.Interrupted() {
+		fmt.Fprintln(os.Stderr, "Interrupted")
+		return 130
+	}
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	return 1
+}
 
-	// Directories to search for Go tasks (same as .quake files)
-	taskDirs := []string{
-		filepath.Join(baseDir, "qtasks"),
-		filepath.Join(baseDir, "lib", "qtasks"),
-		filepath.Join(baseDir, "internal", "qtasks"),
+// runTaskGroups runs each task group in sequence. Every group starts from the
+// directory quake was invoked in, so a relative --file path and the Quakefile
+// search resolve the same way for each group. With keepGoing, a failed group
+// is reported and the rest still run, like make -k. Groups are isolated from
+// each other unless chain is set, which runs them all with one evaluator.
+func runTaskGroups(taskGroups [][]string, customPath string, opts quake.Options, keepGoing, chain bool) error {
+	startDir, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get current directory: %w", err)
 	}
 
-	// Create task cache if not exists
-	if globalTaskCache == nil {
-		var err error
-		globalTaskCache, err = gotasks.NewTaskCache()
+	run := func(taskName string, args []string) error {
+		return runTask(taskName, args, customPath, opts)
+	}
+	if chain {
+		run, err = chainedRunner(customPath, opts)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create task cache: %w", err)
+			return err
 		}
 	}
 
-	for _, qtasksDir := range taskDirs {
-		// Check if directory exists
-		if _, err := os.Stat(qtasksDir); os.IsNotExist(err) {
-			continue
+	var failed []string
+	for _, group := range taskGroups {
+		taskName := group[0]
+		var taskArgs []string
+		if len(group) > 1 {
+			taskArgs = group[1:]
+		}
+
+		err := run(taskName, taskArgs)
+		// Each group loads the same Quakefile, so only warn once
+		opts.WarnUnused = false
+		opts.WarnShadow = false
+
+		// Make sure the next group doesn't inherit a stray working directory
+		if cwd, cwdErr := os.Getwd(); cwdErr != nil || cwd != startDir {
+			if chdirErr := os.Chdir(startDir); chdirErr != nil {
+				return fmt.Errorf("failed to restore working directory %s: %w", startDir, chdirErr)
+			}
 		}
 
-		// Discover Go functions in this directory
-		taskFuncs, err := gotasks.DiscoverTasks(qtasksDir)
 		if err != nil {
-			// Warning but don't fail
-			fmt.Fprintf(os.Stderr, "Warning: failed to discover Go tasks in %s: %v\n", qtasksDir, err)
-			continue
+			if !keepGoing || evaluator.Interrupted() {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			failed = append(failed, strings.Join(group, " "))
 		}
+	}
 
-		if len(taskFuncs) == 0 {
-			// No Go tasks in this directory
-			continue
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d task groups failed: %s", len(failed), len(taskGroups), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// variableOverrideRe matches a KEY=VALUE command-line argument
+var variableOverrideRe = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)=(.*)$`)
+
+// splitVariableOverrides removes leading KEY=VALUE arguments and returns them
+// as variable overrides. Arguments after the first task name are left alone so
+// that `quake deploy ENV=prod` still passes ENV=prod to the task.
+func splitVariableOverrides(args []string) (map[string]string, []string) {
+	var overrides map[string]string
+	for len(args) > 0 {
+		m := variableOverrideRe.FindStringSubmatch(args[0])
+		if m == nil {
+			break
 		}
+		if overrides == nil {
+			overrides = make(map[string]string)
+		}
+		overrides[m[1]] = m[2]
+		args = args[1:]
+	}
+	return overrides, args
+}
 
-		// Get the dispatcher path for this directory's tasks
-		dispatcherPath, err := globalTaskCache.GetDispatcherPath(taskFuncs, qtasksDir)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: failed to generate dispatcher for %s: %v\n", qtasksDir, err)
+// splitPrintEnvFull removes --print-env=full from the arguments before the
+// flags are parsed, since a bool flag can't take a value, and reports whether
+// it was given. --print-env=masked becomes plain --print-env. Arguments after
+// -- are left alone.
+func splitPrintEnvFull(args []string) ([]string, bool, error) {
+	full := false
+	var out []string
+	for i, arg := range args {
+		if arg == "--" {
+			out = append(out, args[i:]...)
+			break
+		}
+		value, ok := strings.CutPrefix(arg, "--print-env=")
+		if !ok {
+			out = append(out, arg)
 			continue
 		}
+		switch value {
+		case "full":
+			full = true
+		case "masked":
+			out = append(out, "--print-env")
+		default:
+			return nil, false, fmt.Errorf("invalid --print-env %q (expected full or masked)", value)
+		}
+	}
+	return out, full, nil
+}
 
-		// Convert discovered functions to Task structs for this directory
-		for _, fn := range taskFuncs {
-			// Use extracted comment as description, or fall back to generic description
-			description := fn.Description
-			if description == "" {
-				description = fmt.Sprintf("Go task from %s", filepath.Base(fn.SourceFile))
-			}
-
-			task := parser.Task{
-				Name:         fn.Name,
-				Description:  description,
-				Arguments:    fn.Params,
-				IsGoTask:     true,
-				GoDispatcher: dispatcherPath,
-				GoSourceDir:  qtasksDir,
-				SourceFile:   fn.SourceFile,
-				Commands:     []parser.Command{}, // Go tasks don't have shell commands
-			}
+// defaultMaxDepth is how deeply quake may invoke itself unless QUAKE_MAX_DEPTH says otherwise
+const defaultMaxDepth = 10
 
-			// If task has a namespace, prepend it to the name
-			if fn.Namespace != "" {
-				task.Name = fn.Namespace + ":" + task.Name
-			}
+// enterNestedInvocation tracks how deeply quake is nested inside its own tasks
+// using the QUAKE_DEPTH environment variable, which child processes inherit.
+// It fails once the depth reaches QUAKE_MAX_DEPTH to stop runaway recursion.
+func enterNestedInvocation() error {
+	depth := 0
+	if v := os.Getenv("QUAKE_DEPTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid QUAKE_DEPTH %q: %w", v, err)
+		}
+		depth = n
+	}
 
-			allTasks = append(allTasks, task)
+	maxDepth := defaultMaxDepth
+	if v := os.Getenv("QUAKE_MAX_DEPTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid QUAKE_MAX_DEPTH %q: %w", v, err)
 		}
+		maxDepth = n
+	}
+
+	if depth >= maxDepth {
+		return fmt.Errorf("quake is nested %d levels deep (QUAKE_MAX_DEPTH=%d); a task is probably invoking quake recursively", depth, maxDepth)
 	}
 
-	return allTasks, nil
+	return os.Setenv("QUAKE_DEPTH", strconv.Itoa(depth+1))
 }
 
-// loadAllQuakefiles loads and merges the main Quakefile with all .quake files
-func loadAllQuakefiles(mainPath string) (parser.QuakeFile, error) {
-	// Read and parse the main Quakefile
-	data, err := os.ReadFile(mainPath)
-	if err != nil {
-		return parser.QuakeFile{}, fmt.Errorf("failed to read Quakefile: %w", err)
+// listEntry is a task as shown by --list, with its fully-qualified name
+type listEntry struct {
+	Name string
+	Task parser.Task
+}
+
+// collectListEntries gathers all top-level and namespaced tasks in definition order
+func collectListEntries(result parser.QuakeFile) []listEntry {
+	var entries []listEntry
+	for _, task := range result.Tasks {
+		entries = append(entries, listEntry{Name: task.Name, Task: task})
 	}
 
-	mainResult, ok, err := parser.ParseQuakefileWithSource(string(data), mainPath)
-	if !ok {
-		return parser.QuakeFile{}, fmt.Errorf("failed to parse Quakefile: %w", err)
+	// Also list tasks in namespaces
+	for _, namespace := range result.Namespaces {
+		entries = append(entries, collectNamespaceEntries(namespace, namespace.Name)...)
 	}
-	if err != nil {
-		return parser.QuakeFile{}, fmt.Errorf("error parsing Quakefile: %w", err)
+
+	return entries
+}
+
+func collectNamespaceEntries(namespace parser.Namespace, prefix string) []listEntry {
+	var entries []listEntry
+	for _, task := range namespace.Tasks {
+		entries = append(entries, listEntry{Name: prefix + ":" + task.Name, Task: task})
 	}
 
-	// Find and load .quake files from qtasks directories
-	baseDir := filepath.Dir(mainPath)
-	quakeFiles := findQuakeFiles(baseDir)
+	// Recurse into nested namespaces
+	for _, nested := range namespace.Namespaces {
+		entries = append(entries, collectNamespaceEntries(nested, prefix+":"+nested.Name)...)
+	}
 
-	var additionalResults []parser.QuakeFile
-	for _, qfile := range quakeFiles {
-		data, err := os.ReadFile(qfile)
-		if err != nil {
-			// Skip files that can't be read
-			fmt.Fprintf(os.Stderr, "Warning: failed to read %s: %v\n", qfile, err)
-			continue
-		}
+	return entries
+}
 
-		result, ok, err := parser.ParseQuakefileWithSource(string(data), qfile)
-		if !ok || err != nil {
-			// Skip files that can't be parsed
-			fmt.Fprintf(os.Stderr, "Warning: failed to parse %s: %v\n", qfile, err)
-			continue
-		}
+// isPrivateTask reports whether a task is private: its name (ignoring any
+// namespace) starts with _. Private tasks can run but are hidden from listings.
+func isPrivateTask(name string) bool {
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.HasPrefix(name, "_")
+}
+
+// publicListEntries drops private tasks from entries
+func publicListEntries(entries []listEntry) []listEntry {
+	var public []listEntry
+	for _, entry := range entries {
+		if !isPrivateTask(entry.Name) {
+			public = append(public, entry)
+		}
+	}
+	return public
+}
+
+// filterListEntries keeps the entries whose name or description contains
+// substr, ignoring case
+func filterListEntries(entries []listEntry, substr string) []listEntry {
+	substr = strings.ToLower(substr)
+	var matched []listEntry
+	for _, entry := range entries {
+		if strings.Contains(strings.ToLower(entry.Name), substr) ||
+			strings.Contains(strings.ToLower(entry.Task.Description), substr) {
+			matched = append(matched, entry)
+		}
+	}
+	return matched
+}
+
+// sortListEntries reorders entries according to the --sort option
+func sortListEntries(entries []listEntry, sortBy string, quakefilePath string) error {
+	switch sortBy {
+	case "", "order":
+		// Keep definition order
+		return nil
+	case "name":
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].Name < entries[j].Name
+		})
+		return nil
+	case "source":
+		// Group by file, keeping each file's tasks in definition order
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].Task.SourceFile < entries[j].Task.SourceFile
+		})
+		return nil
+	case "usage":
+		var h *history.History
+		if store, err := history.NewStore(); err == nil {
+			h, _ = store.Load(quakefilePath)
+		}
+
+		names := make([]string, len(entries))
+		byName := make(map[string]listEntry, len(entries))
+		for i, entry := range entries {
+			names[i] = entry.Name
+			byName[entry.Name] = entry
+		}
+		history.SortByUsage(names, h)
+		for i, name := range names {
+			entries[i] = byName[name]
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown sort order '%s' (expected: order, name, source or usage)", sortBy)
+	}
+}
+
+// listOptions control how --list shows tasks
+type listOptions struct {
+	verbose bool   // Show where each task is defined
+	all     bool   // Include private tasks
+	tree    bool   // Group tasks under their namespaces
+	sortBy  string // Sort order (see sortListEntries)
+	json    bool   // Write the tasks as JSON for tools
+	filter  string // Only list tasks whose name or description contains this, ignoring case
+	names   bool   // Print just the task names, one per line, for scripts
+	changed bool   // Only list tasks whose source file changed since the last run
+}
+
+func listAllTasks(lo listOptions, customPath string, opts quake.Options) error {
+	// Look for Quakefile in current or parent directories
+	quakefilePath, err := quake.Find(customPath)
+	if err != nil {
+		return err
+	}
+
+	// Load all quakefiles (main + qtasks directories)
+	result, err := loadQuakefile(quakefilePath, opts)
+	if err != nil {
+		return err
+	}
+
+	entries := collectListEntries(*result)
+	if !lo.all {
+		entries = publicListEntries(entries)
+	}
+	if lo.filter != "" {
+		entries = filterListEntries(entries, lo.filter)
+	}
+	if lo.changed {
+		entries, err = changedListEntries(entries, quakefilePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := sortListEntries(entries, lo.sortBy, quakefilePath); err != nil {
+		return err
+	}
+
+	if lo.json {
+		return writeTaskListJSON(os.Stdout, entries)
+	}
+	if lo.names {
+		writeTaskNames(os.Stdout, entries)
+		return nil
+	}
+
+	// List all tasks
+	if len(entries) == 0 {
+		if lo.filter != "" {
+			fmt.Printf("No tasks match '%s'\n", lo.filter)
+			return nil
+		}
+		if lo.changed {
+			fmt.Println("No tasks changed since the last run")
+			return nil
+		}
+		fmt.Println("No tasks defined in Quakefile")
+		return nil
+	}
+
+	fmt.Println("Available tasks:")
+	if lo.tree {
+		writeTaskTree(os.Stdout, entries, lo.verbose)
+		return nil
+	}
+	if hasGroups(entries) {
+		writeTaskGroups(os.Stdout, entries, lo.verbose)
+		return nil
+	}
+	for _, entry := range entries {
+		writeListEntry(os.Stdout, "  ", entry.Name, entry.Task, lo.verbose)
+	}
+
+	return nil
+}
+
+// changedListEntries keeps the tasks whose source file changed since tasks
+// were last run. Without a record of the last run, every task is kept.
+func changedListEntries(entries []listEntry, quakefilePath string) ([]listEntry, error) {
+	dir := filepath.Dir(quakefilePath)
+	state, err := sources.Load(sources.Path(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []listEntry
+	for _, entry := range entries {
+		if state.Changed(dir, sourcePath(dir, entry.Task.SourceFile)) {
+			changed = append(changed, entry)
+		}
+	}
+	return changed, nil
+}
+
+// recordSources records the source files of the Quakefile's tasks for
+// --changed; failures here never block the run
+func recordSources(quakefilePath string, result *parser.QuakeFile) {
+	dir := filepath.Dir(quakefilePath)
+	var files []string
+	seen := make(map[string]bool)
+	for _, entry := range collectListEntries(*result) {
+		file := sourcePath(dir, entry.Task.SourceFile)
+		if !seen[file] {
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+	sources.Snapshot(dir, files).Save(sources.Path(dir))
+}
+
+// sourcePath returns a task's source file relative to the Quakefile's directory
+func sourcePath(dir, file string) string {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return file
+	}
+	if rel, err := filepath.Rel(dir, abs); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return abs
+}
+
+// hasGroups reports whether any task has a group attribute
+func hasGroups(entries []listEntry) bool {
+	for _, entry := range entries {
+		if entry.Task.Group != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTaskGroups writes tasks under the headings of their groups, in the
+// order the groups first appear, with tasks without a group last
+func writeTaskGroups(w io.Writer, entries []listEntry, verbose bool) {
+	var groups []string
+	byGroup := make(map[string][]listEntry)
+	for _, entry := range entries {
+		group := entry.Task.Group
+		if _, ok := byGroup[group]; !ok && group != "" {
+			groups = append(groups, group)
+		}
+		byGroup[group] = append(byGroup[group], entry)
+	}
+	if len(byGroup[""]) > 0 {
+		groups = append(groups, "")
+	}
+
+	for _, group := range groups {
+		heading := group
+		if heading == "" {
+			heading = "Other"
+		}
+		fmt.Fprintf(w, "  %s\n", color.BoldText(heading+":"))
+		for _, entry := range byGroup[group] {
+			writeListEntry(w, "    ", entry.Name, entry.Task, verbose)
+		}
+	}
+}
+
+// writeTaskNames writes each task's full name on a line of its own
+func writeTaskNames(w io.Writer, entries []listEntry) {
+	for _, entry := range entries {
+		fmt.Fprintln(w, entry.Name)
+	}
+}
+
+// taskListVersion is the schema version of --list --json output. Bump it
+// whenever the fields of listedTask change so tools can tell.
+const taskListVersion = 2
+
+// taskList is the --list --json output
+type taskList struct {
+	Version int          `json:"version"`
+	Tasks   []listedTask `json:"tasks"`
+}
+
+// listedTask is a task in --list --json output
+type listedTask struct {
+	Name         string   `json:"name"`
+	Description  string   `json:"description,omitempty"`
+	Arguments    []string `json:"arguments,omitempty"`
+	Dependencies []string `json:"dependencies,omitempty"`
+	SourceFile   string   `json:"source_file,omitempty"`
+	IsGoTask     bool     `json:"is_go_task,omitempty"`
+	Group        string   `json:"group,omitempty"`
+}
+
+// writeTaskListJSON writes entries as a versioned JSON task list
+func writeTaskListJSON(w io.Writer, entries []listEntry) error {
+	list := taskList{Version: taskListVersion, Tasks: []listedTask{}}
+	for _, entry := range entries {
+		list.Tasks = append(list.Tasks, listedTask{
+			Name:         entry.Name,
+			Description:  entry.Task.Description,
+			Arguments:    entry.Task.Arguments,
+			Dependencies: entry.Task.Dependencies,
+			SourceFile:   entry.Task.SourceFile,
+			IsGoTask:     entry.Task.IsGoTask,
+			Group:        entry.Task.Group,
+		})
+	}
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal task list: %w", err)
+	}
+	fmt.Fprintln(w, string(data))
+	return nil
+}
+
+// writeListEntry writes one line of --list output for a task
+func writeListEntry(w io.Writer, indent string, name string, task parser.Task, verbose bool) {
+	// Get first line of documentation if available
+	docFirstLine := getFirstLine(task.Description)
+
+	// Show how to call the task, and in verbose mode what it depends on
+	if len(task.Arguments) > 0 {
+		name += "(" + strings.Join(task.Arguments, ", ") + ")"
+	}
+	if verbose && len(task.Dependencies) > 0 {
+		name += " => " + strings.Join(task.Dependencies, ", ")
+	}
+
+	// Keep descriptions in the same column however deeply the name is indented
+	width := max(22-len(indent), 0)
+
+	if verbose && task.SourceFile != "" {
+		// Show source file in verbose mode (relative to current directory)
+		cwd, _ := os.Getwd()
+		relPath, err := filepath.Rel(cwd, task.SourceFile)
+		if err != nil {
+			relPath = task.SourceFile // fallback to absolute path
+		}
+		if docFirstLine != "" {
+			fmt.Fprintf(w, "%s%-*s %s [%s]\n", indent, width, name, docFirstLine, relPath)
+		} else {
+			fmt.Fprintf(w, "%s%-*s [%s]\n", indent, width, name, relPath)
+		}
+	} else {
+		// Normal mode
+		if docFirstLine != "" {
+			fmt.Fprintf(w, "%s%-*s %s\n", indent, width, name, docFirstLine)
+		} else {
+			fmt.Fprintf(w, "%s%s\n", indent, name)
+		}
+	}
+}
+
+// taskTreeNode is a namespace in --list --tree output
+type taskTreeNode struct {
+	name     string
+	tasks    []listEntry // Entries named relative to this namespace
+	children []*taskTreeNode
+}
+
+func (n *taskTreeNode) child(name string) *taskTreeNode {
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+	c := &taskTreeNode{name: name}
+	n.children = append(n.children, c)
+	return c
+}
+
+// writeTaskTree writes tasks grouped under namespace headings. Tasks named
+// ns:name, whether from namespace blocks or not, go under their namespace.
+func writeTaskTree(w io.Writer, entries []listEntry, verbose bool) {
+	root := &taskTreeNode{}
+	for _, entry := range entries {
+		parts := strings.Split(entry.Name, ":")
+		node := root
+		for _, ns := range parts[:len(parts)-1] {
+			node = node.child(ns)
+		}
+		node.tasks = append(node.tasks, listEntry{Name: parts[len(parts)-1], Task: entry.Task})
+	}
+	writeTaskTreeNode(w, root, "  ", verbose)
+}
+
+func writeTaskTreeNode(w io.Writer, node *taskTreeNode, indent string, verbose bool) {
+	for _, entry := range node.tasks {
+		writeListEntry(w, indent, entry.Name, entry.Task, verbose)
+	}
+	for _, child := range node.children {
+		fmt.Fprintf(w, "%s%s\n", indent, color.FaintText(child.name+":"))
+		writeTaskTreeNode(w, child, indent+"  ", verbose)
+	}
+}
+
+// printTaskGraph writes the task dependency graph to w in Graphviz DOT format
+func printTaskGraph(w io.Writer, customPath string, opts quake.Options) error {
+	quakefilePath, err := quake.Find(customPath)
+	if err != nil {
+		return err
+	}
+
+	result, err := loadQuakefile(quakefilePath, opts)
+	if err != nil {
+		return err
+	}
+
+	// Draw an edge to each task a pattern like test:* matches
+	entries := collectListEntries(*result)
+	for i, entry := range entries {
+		var deps []string
+		for _, dep := range entry.Task.Dependencies {
+			matches, err := result.ExpandDependency(dep)
+			if err != nil {
+				return fmt.Errorf("task '%s': %w", entry.Name, err)
+			}
+			for _, match := range matches {
+				if match != entry.Name {
+					deps = append(deps, match)
+				}
+			}
+		}
+		entries[i].Task.Dependencies = deps
+	}
+
+	writeTaskGraph(w, entries)
+	return nil
+}
+
+// writeTaskGraph writes a DOT digraph with a node per task and an edge per
+// dependency. File prerequisites, dependencies that aren't tasks or
+// namespaces, are drawn as notes.
+func writeTaskGraph(w io.Writer, entries []listEntry) {
+	fmt.Fprintln(w, "digraph quake {")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	fmt.Fprintln(w, "  node [shape=box, style=rounded];")
+
+	names := make(map[string]bool)
+	for _, entry := range entries {
+		names[entry.Name] = true
+		for prefix := entry.Name; strings.Contains(prefix, ":"); {
+			prefix = prefix[:strings.LastIndex(prefix, ":")]
+			names[prefix] = true
+		}
+	}
+	files := make(map[string]bool)
+	for _, entry := range entries {
+		for _, dep := range entry.Task.Dependencies {
+			if !names[dep] && !files[dep] {
+				files[dep] = true
+				fmt.Fprintf(w, "  %s [shape=note];\n", strconv.Quote(dep))
+			}
+		}
+	}
+
+	for _, entry := range entries {
+		attrs := []string{}
+		if entry.Task.IsGoTask {
+			// Go tasks stand out from shell tasks
+			attrs = append(attrs, "shape=component", "style=filled", `fillcolor="#e0f0ff"`)
+		}
+		if doc := getFirstLine(entry.Task.Description); doc != "" {
+			attrs = append(attrs, "tooltip="+strconv.Quote(doc))
+		}
+
+		if len(attrs) > 0 {
+			fmt.Fprintf(w, "  %s [%s];\n", strconv.Quote(entry.Name), strings.Join(attrs, ", "))
+		} else {
+			fmt.Fprintf(w, "  %s;\n", strconv.Quote(entry.Name))
+		}
+	}
+
+	for _, entry := range entries {
+		for _, dep := range entry.Task.Dependencies {
+			fmt.Fprintf(w, "  %s -> %s;\n", strconv.Quote(entry.Name), strconv.Quote(dep))
+		}
+	}
+
+	fmt.Fprintln(w, "}")
+}
+
+// checkQuakefile writes the problems quake.Check finds in the Quakefile and
+// returns how many there were. Its warnings are written too, but don't count.
+func checkQuakefile(w io.Writer, customPath string) (int, error) {
+	quakefilePath, err := quake.Find(customPath)
+	if err != nil {
+		return 0, err
+	}
+
+	findings, warnings, err := quake.Check(quakefilePath)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, warning := range warnings {
+		fmt.Fprintf(w, "Warning: %s\n", warning)
+	}
+
+	if len(findings) == 0 {
+		fmt.Fprintf(w, "No problems found in %s\n", quakefilePath)
+		return 0, nil
+	}
+
+	for _, finding := range findings {
+		fmt.Fprintln(w, finding)
+	}
+	plural := "s"
+	if len(findings) == 1 {
+		plural = ""
+	}
+	fmt.Fprintf(w, "%d problem%s found\n", len(findings), plural)
+	return len(findings), nil
+}
+
+// runDoctor writes a checklist of what quake needs to w: the Quakefile, its
+// shell, its .quake files and Go tasks, and the go and claude commands. It
+// returns how many of the checks failed, not counting go and claude, which
+// only some features need.
+func runDoctor(w io.Writer, customPath string) int {
+	version := "(unknown)"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		version = info.Main.Version
+	}
+	fmt.Fprintf(w, "quake %s\n", version)
+
+	failed := 0
+	check := func(ok, required bool, label, detail string) {
+		if ok {
+			fmt.Fprintf(w, "✅ %s: %s\n", label, detail)
+			return
+		}
+		fmt.Fprintf(w, "❌ %s: %s\n", label, color.RedText(detail))
+		if required {
+			failed++
+		}
+	}
+
+	quakefilePath, err := quake.Find(customPath)
+	if err != nil {
+		check(false, true, "Quakefile", err.Error())
+	} else {
+		check(true, true, "Quakefile", quakefilePath)
+
+		qf, loadErrs, err := quake.LoadErrors(quakefilePath)
+		switch {
+		case err != nil:
+			check(false, true, "Tasks", err.Error())
+		case len(loadErrs) > 0:
+			for _, loadErr := range loadErrs {
+				check(false, true, "Tasks", loadErr.Error())
+			}
+		default:
+			check(true, true, "Tasks", fmt.Sprintf("%d loaded", len(collectListEntries(*qf))))
+		}
+
+		if qf != nil {
+			shell := qf.Shell
+			if shell == "" {
+				shell = "sh"
+			}
+			if err := evaluator.CheckShell(shell); err != nil {
+				check(false, true, "Shell", err.Error())
+			} else {
+				check(true, true, "Shell", shell)
+			}
+		}
+	}
+
+	if path, err := exec.LookPath("go"); err != nil {
+		check(false, false, "go", "not found (needed for Go tasks)")
+	} else {
+		check(true, false, "go", path)
+	}
+	if path, err := findClaude(); err != nil {
+		check(false, false, "claude", "not found (needed for -g and --init)")
+	} else {
+		check(true, false, "claude", path)
+	}
+
+	return failed
+}
+
+// dumpQuakefile writes the Quakefile as quake loads it, merged with its .quake
+// files and Go tasks, as indented JSON
+func dumpQuakefile(w io.Writer, customPath string, opts quake.Options) error {
+	quakefilePath, err := quake.Find(customPath)
+	if err != nil {
+		return err
+	}
+
+	result, err := loadQuakefile(quakefilePath, opts)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal Quakefile: %w", err)
+	}
+	fmt.Fprintln(w, string(data))
+	return nil
+}
+
+// explainVariable prints how a global variable's value is resolved
+func explainVariable(name string, customPath string, opts quake.Options) error {
+	quakefilePath, err := quake.Find(customPath)
+	if err != nil {
+		return err
+	}
+
+	result, err := loadQuakefile(quakefilePath, opts)
+	if err != nil {
+		return err
+	}
+
+	// Evaluate from the Quakefile's directory, as when running tasks
+	originalDir, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get current directory: %w", err)
+	}
+	if err := os.Chdir(filepath.Dir(quakefilePath)); err != nil {
+		return fmt.Errorf("failed to change to Quakefile directory: %w", err)
+	}
+	defer os.Chdir(originalDir)
+
+	ex, err := evaluator.ExplainVariable(result, opts.Variables, name)
+	if err != nil {
+		return err
+	}
+	fmt.Print(ex.String())
+	return nil
+}
+
+// showTask prints what a task does without running anything
+func showTask(name string, customPath string, opts quake.Options) error {
+	quakefilePath, err := quake.Find(customPath)
+	if err != nil {
+		return err
+	}
+
+	result, err := loadQuakefile(quakefilePath, opts)
+	if err != nil {
+		return err
+	}
+
+	task := result.FindTask(name)
+	if task == nil {
+		return fmt.Errorf("task '%s' not found", name)
+	}
+
+	writeTaskDetails(os.Stdout, name, task)
+	return nil
+}
+
+// cleanOutputs removes the files and directories a task lists in its outputs
+// attribute. Outputs are relative to the Quakefile's directory and must be
+// inside it.
+func cleanOutputs(w io.Writer, name string, customPath string, opts quake.Options) error {
+	quakefilePath, err := quake.Find(customPath)
+	if err != nil {
+		return err
+	}
+
+	result, err := loadQuakefile(quakefilePath, opts)
+	if err != nil {
+		return err
+	}
+
+	task := result.FindTask(name)
+	if task == nil {
+		return fmt.Errorf("task '%s' not found", name)
+	}
+	if len(task.Outputs) == 0 {
+		return fmt.Errorf("task '%s' has no outputs to clean", name)
+	}
+	for _, output := range task.Outputs {
+		if !filepath.IsLocal(output) || filepath.Clean(output) == "." {
+			return fmt.Errorf("task '%s': won't remove %s, which is outside the Quakefile's directory", name, output)
+		}
+	}
+
+	return inQuakefileDir(quakefilePath, func() error {
+		for _, output := range task.Outputs {
+			if _, err := os.Lstat(output); os.IsNotExist(err) {
+				continue
+			}
+			if err := os.RemoveAll(output); err != nil {
+				return fmt.Errorf("failed to remove %s: %w", output, err)
+			}
+			fmt.Fprintf(w, "Removed %s\n", output)
+		}
+		return nil
+	})
+}
+
+// writeTaskDetails writes a task's definition, with commands shown as written
+// in the Quakefile rather than with variables substituted
+func writeTaskDetails(w io.Writer, name string, task *parser.Task) {
+	fmt.Fprintf(w, "Task: %s\n", name)
+	if task.Description != "" {
+		fmt.Fprintf(w, "Description:\n")
+		for _, line := range strings.Split(task.Description, "\n") {
+			// Blank lines between paragraphs stay blank
+			if line == "" {
+				fmt.Fprintln(w)
+				continue
+			}
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+	}
+	if len(task.Arguments) > 0 {
+		args := make([]string, len(task.Arguments))
+		for i, arg := range task.Arguments {
+			args[i] = arg
+			if argType := task.ArgTypes[strings.TrimSuffix(arg, "...")]; argType != "" {
+				args[i] += ": " + argType
+			}
+		}
+		fmt.Fprintf(w, "Arguments: %s\n", strings.Join(args, ", "))
+	}
+	if len(task.Dependencies) > 0 {
+		fmt.Fprintf(w, "Dependencies: %s\n", strings.Join(task.Dependencies, ", "))
+	}
+	if task.Group != "" {
+		fmt.Fprintf(w, "Group: %s\n", task.Group)
+	}
+	if len(task.Outputs) > 0 {
+		fmt.Fprintf(w, "Outputs: %s\n", strings.Join(task.Outputs, ", "))
+	}
+	if len(task.Attributes) > 0 {
+		keys := make([]string, 0, len(task.Attributes))
+		for key := range task.Attributes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		attrs := make([]string, len(keys))
+		for i, key := range keys {
+			attrs[i] = key + ": " + strconv.Quote(task.Attributes[key])
+		}
+		fmt.Fprintf(w, "Attributes: %s\n", strings.Join(attrs, ", "))
+	}
+	if len(task.Env) > 0 {
+		names := make([]string, 0, len(task.Env))
+		for name := range task.Env {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		vars := make([]string, len(names))
+		for i, name := range names {
+			vars[i] = name + " = " + task.Env[name]
+		}
+		fmt.Fprintf(w, "Environment: %s\n", strings.Join(vars, "; "))
+	}
+	if task.SourceFile != "" {
+		fmt.Fprintf(w, "Source: %s\n", task.SourceFile)
+	}
+
+	if task.IsGoTask {
+		fmt.Fprintf(w, "Go function: %s\n", task.GoFunction)
+		return
+	}
+
+	if len(task.Commands) > 0 {
+		fmt.Fprintf(w, "Commands:\n")
+		for _, cmd := range task.Commands {
+			// Show commands as they were written when the source is known
+			text := cmd.Raw
+			if text == "" {
+				text = parser.FormatCommand(cmd)
+			}
+			fmt.Fprintf(w, "  %s\n", strings.ReplaceAll(text, "\n", "\n  "))
+		}
+	}
+}
+
+func getFirstLine(description string) string {
+	if description == "" {
+		return ""
+	}
+	// Split by newline and return first non-empty line
+	lines := strings.Split(description, "\n")
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed != "" {
+			return trimmed
+		}
+	}
+	return ""
+}
+
+func runTask(taskName string, args []string, customPath string, opts quake.Options) error {
+	// Look for Quakefile in current or parent directories
+	quakefilePath, err := quake.Find(customPath)
+	if err != nil {
+		return err
+	}
+
+	return inQuakefileDir(quakefilePath, func() error {
+		// Load all quakefiles (main + qtasks directories)
+		result, err := loadQuakefile(quakefilePath, opts)
+		if err != nil {
+			return err
+		}
+
+		// Running resets the interrupted state, so stop here if quake was
+		// interrupted while loading
+		if evaluator.Interrupted() {
+			return evaluator.ErrInterrupted
+		}
+
+		recordRun(quakefilePath, taskName)
+		recordSources(quakefilePath, result)
+		return quake.RunWithOptions(result, taskName, args, opts)
+	})
+}
 
-		additionalResults = append(additionalResults, result)
+// chainedRunner loads the Quakefile once and returns a function that runs
+// tasks with a single evaluator, for --chain
+func chainedRunner(customPath string, opts quake.Options) (func(taskName string, args []string) error, error) {
+	quakefilePath, err := quake.Find(customPath)
+	if err != nil {
+		return nil, err
 	}
-
-	// Discover and add Go tasks
-	goTasks, err := discoverGoTasks(baseDir)
+	quakefilePath, err = filepath.Abs(quakefilePath)
 	if err != nil {
-		// Warning but don't fail
-		fmt.Fprintf(os.Stderr, "Warning: failed to discover Go tasks: %v\n", err)
-	} else if len(goTasks) > 0 {
-		// Add Go tasks as a separate QuakeFile
-		goTasksFile := parser.QuakeFile{
-			Tasks: goTasks,
-		}
-		additionalResults = append(additionalResults, goTasksFile)
+		return nil, fmt.Errorf("failed to resolve %s: %w", quakefilePath, err)
 	}
 
-	// Merge all results
-	allResults := append([]parser.QuakeFile{mainResult}, additionalResults...)
-	return mergeQuakefiles(allResults...), nil
-}
-
-// findQuakefile searches for a Quakefile in the current directory and parent directories
-// If customPath is provided, it validates and returns that path instead
-func findQuakefile(customPath string) (string, error) {
-	// If a custom path was provided, use it
-	if customPath != "" {
-		// Convert to absolute path if relative
-		absPath, err := filepath.Abs(customPath)
+	var eval *evaluator.Evaluator
+	err = inQuakefileDir(quakefilePath, func() error {
+		result, err := loadQuakefile(quakefilePath, opts)
 		if err != nil {
-			return "", fmt.Errorf("invalid path %s: %w", customPath, err)
+			return err
 		}
+		eval = quake.NewEvaluator(result, opts)
+		recordSources(quakefilePath, result)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		// Check if file exists
-		if _, err := os.Stat(absPath); err != nil {
-			return "", fmt.Errorf("Quakefile not found at %s: %w", absPath, err)
-		}
+	return func(taskName string, args []string) error {
+		return inQuakefileDir(quakefilePath, func() error {
+			recordRun(quakefilePath, taskName)
+			return eval.RunTaskWithArgs(taskName, args)
+		})
+	}, nil
+}
 
-		return absPath, nil
+// inQuakefileDir runs fn in the directory containing the Quakefile
+func inQuakefileDir(quakefilePath string, fn func() error) (err error) {
+	// Change to the directory containing the Quakefile
+	quakefileDir := filepath.Dir(quakefilePath)
+	originalDir, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get current directory: %w", err)
 	}
 
-	// Default behavior: search current and parent directories
-	dir, err := os.Getwd()
-	if err != nil {
-		return "", err
+	if quakefileDir != originalDir {
+		if err := os.Chdir(quakefileDir); err != nil {
+			return fmt.Errorf("failed to change to Quakefile directory: %w", err)
+		}
 	}
 
-	for {
-		quakefilePath := filepath.Join(dir, "Quakefile")
-		if _, err := os.Stat(quakefilePath); err == nil {
-			return quakefilePath, nil
+	// Always change back to the original directory when done, even if a task
+	// moved the process elsewhere, and report a failure to do so
+	defer func() {
+		if chdirErr := os.Chdir(originalDir); chdirErr != nil && err == nil {
+			err = fmt.Errorf("failed to return to %s: %w", originalDir, chdirErr)
 		}
+	}()
 
-		parent := filepath.Dir(dir)
-		if parent == dir {
-			// We've reached the root directory
-			break
+	return fn()
+}
+
+// recordRun records a task's invocation for --sort=usage; failures here never
+// block the run
+func recordRun(quakefilePath, taskName string) {
+	if store, err := history.NewStore(); err == nil {
+		if taskName == "" {
+			taskName = "default"
 		}
-		dir = parent
+		store.Record(quakefilePath, taskName, time.Now())
 	}
-
-	return "", fmt.Errorf("no Quakefile found in current directory or any parent directory")
 }
 
-func listAllTasks(verbose bool, customPath string) error {
-	// Look for Quakefile in current or parent directories
-	quakefilePath, err := findQuakefile(customPath)
+// printExecutionPlan resolves the task groups into an execution plan and prints it
+func printExecutionPlan(taskGroups [][]string, customPath string, opts quake.Options, asJSON bool) error {
+	quakefilePath, err := quake.Find(customPath)
 	if err != nil {
 		return err
 	}
 
-	// Load all quakefiles (main + qtasks directories)
-	result, err := loadAllQuakefiles(quakefilePath)
+	// Resolve from the Quakefile directory, as a real run would
+	quakefileDir := filepath.Dir(quakefilePath)
+	originalDir, err := os.Getwd()
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to get current directory: %w", err)
 	}
-
-	// List all tasks
-	if len(result.Tasks) == 0 {
-		fmt.Println("No tasks defined in Quakefile")
-		return nil
+	if err := os.Chdir(quakefileDir); err != nil {
+		return fmt.Errorf("failed to change to Quakefile directory: %w", err)
 	}
+	defer os.Chdir(originalDir)
 
-	fmt.Println("Available tasks:")
-	for _, task := range result.Tasks {
-		// Get first line of documentation if available
-		docFirstLine := getFirstLine(task.Description)
-
-		if verbose && task.SourceFile != "" {
-			// Show source file in verbose mode (relative to current directory)
-			cwd, _ := os.Getwd()
-			relPath, err := filepath.Rel(cwd, task.SourceFile)
-			if err != nil {
-				relPath = task.SourceFile // fallback to absolute path
-			}
-			if docFirstLine != "" {
-				fmt.Printf("  %-20s %s [%s]\n", task.Name, docFirstLine, relPath)
-			} else {
-				fmt.Printf("  %-20s [%s]\n", task.Name, relPath)
-			}
-		} else {
-			// Normal mode
-			if docFirstLine != "" {
-				fmt.Printf("  %-20s %s\n", task.Name, docFirstLine)
-			} else {
-				fmt.Printf("  %s\n", task.Name)
-			}
-		}
+	result, err := loadQuakefile(quakefilePath, opts)
+	if err != nil {
+		return err
 	}
 
-	// Also list tasks in namespaces
-	for _, namespace := range result.Namespaces {
-		listNamespaceTasks(namespace, namespace.Name, verbose)
+	if len(taskGroups) == 0 {
+		taskGroups = [][]string{{""}}
 	}
 
-	return nil
-}
-
-func listNamespaceTasks(namespace parser.Namespace, prefix string, verbose bool) {
-	for _, task := range namespace.Tasks {
-		taskName := prefix + ":" + task.Name
-		docFirstLine := getFirstLine(task.Description)
-
-		if verbose && task.SourceFile != "" {
-			// Show source file in verbose mode (relative to current directory)
-			cwd, _ := os.Getwd()
-			relPath, err := filepath.Rel(cwd, task.SourceFile)
-			if err != nil {
-				relPath = task.SourceFile // fallback to absolute path
-			}
-			if docFirstLine != "" {
-				fmt.Printf("  %-20s %s [%s]\n", taskName, docFirstLine, relPath)
-			} else {
-				fmt.Printf("  %-20s [%s]\n", taskName, relPath)
-			}
-		} else {
-			// Normal mode
-			if docFirstLine != "" {
-				fmt.Printf("  %-20s %s\n", taskName, docFirstLine)
-			} else {
-				fmt.Printf("  %s\n", taskName)
-			}
+	eval := evaluator.NewWithOverrides(result, opts.Variables)
+	plan := evaluator.NewPlan(quakefileDir)
+	for _, group := range taskGroups {
+		if err := eval.PlanTask(plan, group[0], group[1:]); err != nil {
+			return err
 		}
 	}
 
-	// Recurse into nested namespaces
-	for _, nested := range namespace.Namespaces {
-		listNamespaceTasks(nested, prefix+":"+nested.Name, verbose)
+	if asJSON {
+		data, err := json.MarshalIndent(plan, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal plan: %w", err)
+		}
+		fmt.Println(string(data))
+		return nil
 	}
+
+	fmt.Print(plan.String())
+	return nil
 }
 
-func getFirstLine(description string) string {
-	if description == "" {
-		return ""
-	}
-	// Split by newline and return first non-empty line
-	lines := strings.Split(description, "\n")
-	for _, line := range lines {
-		trimmed := strings.TrimSpace(line)
-		if trimmed != "" {
-			return trimmed
-		}
+// pickTaskIfNoDefault shows an interactive task picker when the Quakefile has
+// no default task and stdin is a terminal. It returns "" to run the default task.
+func pickTaskIfNoDefault(customPath string, opts quake.Options) (string, error) {
+	if !term.IsTerminal(os.Stdin) {
+		return "", nil
 	}
-	return ""
-}
 
-func runTask(taskName string, args []string, customPath string) error {
-	// Look for Quakefile in current or parent directories
-	quakefilePath, err := findQuakefile(customPath)
+	quakefilePath, err := quake.Find(customPath)
 	if err != nil {
-		return err
+		// Let runTask report the error
+		return "", nil
 	}
 
-	// Change to the directory containing the Quakefile
-	quakefileDir := filepath.Dir(quakefilePath)
-	originalDir, err := os.Getwd()
+	result, err := loadQuakefile(quakefilePath, opts)
 	if err != nil {
-		return fmt.Errorf("failed to get current directory: %w", err)
+		return "", nil
 	}
 
-	if quakefileDir != originalDir {
-		if err := os.Chdir(quakefileDir); err != nil {
-			return fmt.Errorf("failed to change to Quakefile directory: %w", err)
+	entries := publicListEntries(collectListEntries(*result))
+	items := make([]picker.Item, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Name == "default" {
+			return "", nil
 		}
-		// Change back to original directory when done
-		defer os.Chdir(originalDir)
+		items = append(items, picker.Item{
+			Label:       entry.Name,
+			Description: getFirstLine(entry.Task.Description),
+		})
 	}
 
-	// Load all quakefiles (main + qtasks directories)
-	result, err := loadAllQuakefiles(quakefilePath)
-	if err != nil {
-		return err
+	if len(items) == 0 {
+		return "", nil
 	}
 
-	// Create evaluator and run task with arguments
-	eval := evaluator.New(&result)
-	return eval.RunTaskWithArgs(taskName, args)
+	idx, err := picker.Pick("No default task. Select a task to run:", items)
+	if err != nil {
+		return "", err
+	}
+	return entries[idx].Name, nil
 }
 
 // extractTaskFromOutput extracts a task definition from Claude's output
@@ -537,31 +1749,34 @@ func extractTaskFromOutput(output string) string {
 	return output
 }
 
+// findClaude returns the path of the claude CLI, looking in PATH and then
+// where it's commonly installed
+func findClaude() (string, error) {
+	if path, err := exec.LookPath("claude"); err == nil {
+		return path, nil
+	}
+
+	// Try common locations
+	possiblePaths := []string{
+		"/usr/local/bin/claude",
+		"/usr/bin/claude",
+		filepath.Join(os.Getenv("HOME"), "bin", "claude"),
+		filepath.Join(os.Getenv("HOME"), ".local", "bin", "claude"),
+	}
+	for _, path := range possiblePaths {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("claude CLI not found. Please ensure 'claude' is installed and in your PATH")
+}
+
 // generateTaskWithClaude prompts the user for a task description and uses Claude to generate it
 func generateTaskWithClaude(customPath string) error {
 	// Check if claude CLI is available
-	claudePath, err := exec.LookPath("claude")
+	claudePath, err := findClaude()
 	if err != nil {
-		// Try common locations
-		possiblePaths := []string{
-			"/usr/local/bin/claude",
-			"/usr/bin/claude",
-			filepath.Join(os.Getenv("HOME"), "bin", "claude"),
-			filepath.Join(os.Getenv("HOME"), ".local", "bin", "claude"),
-		}
-
-		found := false
-		for _, path := range possiblePaths {
-			if _, err := os.Stat(path); err == nil {
-				claudePath = path
-				found = true
-				break
-			}
-		}
-
-		if !found {
-			return fmt.Errorf("claude CLI not found. Please ensure 'claude' is installed and in your PATH")
-		}
+		return err
 	}
 
 	// Prompt user for task description
@@ -578,7 +1793,7 @@ func generateTaskWithClaude(customPath string) error {
 	}
 
 	// Find the Quakefile
-	quakefilePath, err := findQuakefile(customPath)
+	quakefilePath, err := quake.Find(customPath)
 	if err != nil {
 		return err
 	}
@@ -658,21 +1873,81 @@ Requirements:
 	}
 
 	// Append the task to the Quakefile
-	updatedContent := string(currentContent)
-	if !strings.HasSuffix(updatedContent, "\n") {
-		updatedContent += "\n"
+	if err := appendTask(quakefilePath, generatedTask); err != nil {
+		return err
+	}
+
+	fmt.Printf("✅ Task added to %s\n", quakefilePath)
+	return nil
+}
+
+// appendTask adds a task definition to the end of a file, after a blank line,
+// creating the file if it doesn't exist
+func appendTask(path string, task string) error {
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %w", path, err)
 	}
-	updatedContent += "\n" + generatedTask + "\n"
 
-	// Write the updated Quakefile
-	if err := os.WriteFile(quakefilePath, []byte(updatedContent), 0644); err != nil {
-		return fmt.Errorf("failed to write updated Quakefile: %w", err)
+	updatedContent := string(content)
+	if updatedContent != "" {
+		if !strings.HasSuffix(updatedContent, "\n") {
+			updatedContent += "\n"
+		}
+		updatedContent += "\n"
 	}
+	updatedContent += strings.TrimRight(task, "\n") + "\n"
 
-	fmt.Printf("✅ Task added to %s\n", quakefilePath)
+	if err := os.WriteFile(path, []byte(updatedContent), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
 	return nil
 }
 
+// addNewTask appends an empty task with the given signature, like
+// deploy(env) => build, to target, or to the Quakefile if target is "". It
+// refuses to add a task that already exists. It returns the file written.
+func addNewTask(signature string, target string, customPath string) (string, error) {
+	signature = strings.TrimSpace(signature)
+	skeleton := fmt.Sprintf("task %s {\n    # TODO\n}\n", signature)
+
+	// Let the parser check the signature
+	parsed, ok, err := parser.ParseQuakefile(skeleton)
+	if !ok || err != nil || len(parsed.Tasks) != 1 {
+		return "", fmt.Errorf("invalid task signature '%s'", signature)
+	}
+	name := parsed.Tasks[0].Name
+
+	quakefilePath, err := quake.Find(customPath)
+	if err != nil {
+		return "", err
+	}
+	existing, err := quake.LoadWithOptions(quakefilePath, quake.Options{AllowOverrides: true})
+	if err != nil {
+		return "", err
+	}
+	if existing.FindTask(name) != nil {
+		return "", fmt.Errorf("task '%s' already exists", name)
+	}
+
+	path := quakefilePath
+	if target != "" {
+		path = target
+		// The target might not be loaded from the Quakefile yet
+		if data, err := os.ReadFile(path); err == nil {
+			qf, ok, err := parser.ParseQuakefile(string(data))
+			if ok && err == nil && qf.FindTask(name) != nil {
+				return "", fmt.Errorf("task '%s' already exists in %s", name, path)
+			}
+		}
+	}
+
+	if err := appendTask(path, skeleton); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
 // analyzeProjectContext examines the current directory to gather context about the project
 func analyzeProjectContext() (string, error) {
 	cwd, err := os.Getwd()
@@ -684,6 +1959,65 @@ func analyzeProjectContext() (string, error) {
 	analysis.WriteString("PROJECT ANALYSIS:\n\n")
 
 	// Detect build system and configuration files
+	detectedFiles := detectBuildFiles(cwd)
+	if len(detectedFiles) > 0 {
+		analysis.WriteString("Detected build/config files:\n")
+		for _, file := range detectedFiles {
+			analysis.WriteString(fmt.Sprintf("  - %s\n", file))
+		}
+		analysis.WriteString("\n")
+	}
+
+	// Detect programming languages by file extensions
+	langs, err := detectLanguages(cwd)
+	if err != nil {
+		return "", err
+	}
+
+	if len(langs) > 0 {
+		analysis.WriteString("Detected programming languages (by file count):\n")
+		for _, lc := range langs {
+			analysis.WriteString(fmt.Sprintf("  - %s (%d files)\n", lc.lang, lc.count))
+		}
+		analysis.WriteString("\n")
+	}
+
+	// List top-level directory structure
+	entries, err := os.ReadDir(cwd)
+	if err != nil {
+		return "", fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	var dirs []string
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		// Skip hidden files and common directories
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		if entry.IsDir() {
+			dirs = append(dirs, name+"/")
+		} else {
+			files = append(files, name)
+		}
+	}
+
+	if len(dirs) > 0 || len(files) > 0 {
+		analysis.WriteString("Top-level directory structure:\n")
+		for _, dir := range dirs {
+			analysis.WriteString(fmt.Sprintf("  %s\n", dir))
+		}
+		for _, file := range files {
+			analysis.WriteString(fmt.Sprintf("  %s\n", file))
+		}
+	}
+
+	return analysis.String(), nil
+}
+
+// detectBuildFiles returns the known build/config files present in dir
+func detectBuildFiles(dir string) []string {
 	buildFiles := []string{
 		"go.mod",             // Go
 		"package.json",       // Node.js
@@ -704,22 +2038,23 @@ func analyzeProjectContext() (string, error) {
 
 	var detectedFiles []string
 	for _, file := range buildFiles {
-		if _, err := os.Stat(filepath.Join(cwd, file)); err == nil {
+		if _, err := os.Stat(filepath.Join(dir, file)); err == nil {
 			detectedFiles = append(detectedFiles, file)
 		}
 	}
+	return detectedFiles
+}
 
-	if len(detectedFiles) > 0 {
-		analysis.WriteString("Detected build/config files:\n")
-		for _, file := range detectedFiles {
-			analysis.WriteString(fmt.Sprintf("  - %s\n", file))
-		}
-		analysis.WriteString("\n")
-	}
+// langCount is a programming language and how many of a project's files use it
+type langCount struct {
+	lang  string
+	count int
+}
 
-	// Detect programming languages by file extensions
+// detectLanguages counts source files under dir by language, most common first
+func detectLanguages(dir string) ([]langCount, error) {
 	languageFiles := make(map[string]int)
-	err = filepath.Walk(cwd, func(path string, info os.FileInfo, err error) error {
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return nil // Skip errors
 		}
@@ -727,16 +2062,16 @@ func analyzeProjectContext() (string, error) {
 		// Skip hidden directories and common ignore patterns
 		if info.IsDir() {
 			name := filepath.Base(path)
-			if strings.HasPrefix(name, ".") ||
+			if path != dir && (strings.HasPrefix(name, ".") ||
 				name == "node_modules" ||
 				name == "vendor" ||
 				name == "target" ||
 				name == "build" ||
-				name == "dist" {
+				name == "dist") {
 				return filepath.SkipDir
 			}
 			// Only go 3 levels deep
-			relPath, _ := filepath.Rel(cwd, path)
+			relPath, _ := filepath.Rel(dir, path)
 			if strings.Count(relPath, string(os.PathSeparator)) > 3 {
 				return filepath.SkipDir
 			}
@@ -752,7 +2087,7 @@ func analyzeProjectContext() (string, error) {
 	})
 
 	if err != nil {
-		return "", fmt.Errorf("failed to analyze project structure: %w", err)
+		return nil, fmt.Errorf("failed to analyze project structure: %w", err)
 	}
 
 	// Map extensions to languages
@@ -777,71 +2112,33 @@ func analyzeProjectContext() (string, error) {
 		".exs":   "Elixir",
 	}
 
-	if len(languageFiles) > 0 {
-		analysis.WriteString("Detected programming languages (by file count):\n")
-		// Sort by count
-		type langCount struct {
-			lang  string
-			count int
-		}
-		var langs []langCount
-		for ext, count := range languageFiles {
-			if lang, ok := extensionToLanguage[ext]; ok && count > 0 {
-				langs = append(langs, langCount{lang, count})
-			}
-		}
-		// Simple sort by count (descending)
-		for i := 0; i < len(langs); i++ {
-			for j := i + 1; j < len(langs); j++ {
-				if langs[j].count > langs[i].count {
-					langs[i], langs[j] = langs[j], langs[i]
-				}
-			}
+	// Languages with several extensions (like Elixir) are combined
+	counts := make(map[string]int)
+	for ext, count := range languageFiles {
+		if lang, ok := extensionToLanguage[ext]; ok && count > 0 {
+			counts[lang] += count
 		}
-		for _, lc := range langs {
-			analysis.WriteString(fmt.Sprintf("  - %s (%d files)\n", lc.lang, lc.count))
-		}
-		analysis.WriteString("\n")
-	}
-
-	// List top-level directory structure
-	entries, err := os.ReadDir(cwd)
-	if err != nil {
-		return "", fmt.Errorf("failed to read directory: %w", err)
 	}
 
-	var dirs []string
-	var files []string
-	for _, entry := range entries {
-		name := entry.Name()
-		// Skip hidden files and common directories
-		if strings.HasPrefix(name, ".") {
-			continue
-		}
-		if entry.IsDir() {
-			dirs = append(dirs, name+"/")
-		} else {
-			files = append(files, name)
-		}
+	var langs []langCount
+	for lang, count := range counts {
+		langs = append(langs, langCount{lang, count})
 	}
-
-	if len(dirs) > 0 || len(files) > 0 {
-		analysis.WriteString("Top-level directory structure:\n")
-		for _, dir := range dirs {
-			analysis.WriteString(fmt.Sprintf("  %s\n", dir))
+	// Sort by count (descending), then name for a stable order
+	sort.Slice(langs, func(i, j int) bool {
+		if langs[i].count != langs[j].count {
+			return langs[i].count > langs[j].count
 		}
-		for _, file := range files {
-			analysis.WriteString(fmt.Sprintf("  %s\n", file))
-		}
-	}
+		return langs[i].lang < langs[j].lang
+	})
 
-	return analysis.String(), nil
+	return langs, nil
 }
 
 // initQuakefileWithClaude analyzes the project and uses Claude to generate an initial Quakefile
 func initQuakefileWithClaude() error {
 	// Check if a Quakefile already exists
-	existingPath, err := findQuakefile("")
+	existingPath, err := quake.Find("")
 	if err == nil {
 		// A Quakefile was found
 		cwd, _ := os.Getwd()
@@ -853,28 +2150,9 @@ func initQuakefileWithClaude() error {
 	}
 
 	// Check if claude CLI is available
-	claudePath, err := exec.LookPath("claude")
+	claudePath, err := findClaude()
 	if err != nil {
-		// Try common locations
-		possiblePaths := []string{
-			"/usr/local/bin/claude",
-			"/usr/bin/claude",
-			filepath.Join(os.Getenv("HOME"), "bin", "claude"),
-			filepath.Join(os.Getenv("HOME"), ".local", "bin", "claude"),
-		}
-
-		found := false
-		for _, path := range possiblePaths {
-			if _, err := os.Stat(path); err == nil {
-				claudePath = path
-				found = true
-				break
-			}
-		}
-
-		if !found {
-			return fmt.Errorf("claude CLI not found. Please ensure 'claude' is installed and in your PATH")
-		}
+		return err
 	}
 
 	fmt.Println("Analyzing project structure...")
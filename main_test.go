@@ -0,0 +1,873 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"miren.dev/quake/internal/color"
+	"miren.dev/quake/parser"
+	"miren.dev/quake/quake"
+)
+
+// TestMain lets tests run the test binary as the quake CLI itself
+func TestMain(m *testing.M) {
+	if os.Getenv("QUAKE_TEST_RUN_MAIN") == "1" {
+		os.Exit(realMain())
+	}
+	os.Exit(m.Run())
+}
+
+func TestRunTaskGroupsWorkingDirectory(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+
+	projectDir, err := filepath.EvalSymlinks(t.TempDir())
+	require.NoError(t, err)
+	subDir := filepath.Join(projectDir, "sub")
+	require.NoError(t, os.Mkdir(subDir, 0755))
+
+	quakefile := `task first {
+    pwd > first.txt
+}
+
+task second {
+    pwd > second.txt
+}
+`
+	require.NoError(t, os.WriteFile(filepath.Join(projectDir, "Quakefile"), []byte(quakefile), 0644))
+
+	// Run from a subdirectory so the Quakefile is found in the parent
+	t.Chdir(subDir)
+
+	err = runTaskGroups([][]string{{"first"}, {"second"}}, "", quake.Options{}, false, false)
+	require.NoError(t, err)
+
+	// Both groups run in the Quakefile directory
+	for _, name := range []string{"first.txt", "second.txt"} {
+		data, err := os.ReadFile(filepath.Join(projectDir, name))
+		require.NoError(t, err, "task should write %s in the Quakefile directory", name)
+		require.Equal(t, projectDir, strings.TrimSpace(string(data)))
+	}
+
+	// The original directory is restored afterwards
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	require.Equal(t, subDir, cwd)
+}
+
+func TestRunTaskGroupsRelativeFilePath(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+
+	rootDir, err := filepath.EvalSymlinks(t.TempDir())
+	require.NoError(t, err)
+	projectDir := filepath.Join(rootDir, "project")
+	require.NoError(t, os.Mkdir(projectDir, 0755))
+
+	quakefile := `task mark {
+    pwd >> marks.txt
+}
+`
+	require.NoError(t, os.WriteFile(filepath.Join(projectDir, "Quakefile"), []byte(quakefile), 0644))
+
+	t.Chdir(rootDir)
+
+	// A relative --file path must resolve the same way for every group
+	err = runTaskGroups([][]string{{"mark"}, {"mark"}}, "project", quake.Options{}, false, false)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(projectDir, "marks.txt"))
+	require.NoError(t, err)
+	require.Equal(t, projectDir+"\n"+projectDir+"\n", string(data))
+
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	require.Equal(t, rootDir, cwd)
+}
+
+func TestRunTaskGroupsKeepGoing(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+
+	projectDir := t.TempDir()
+	quakefile := `task ok(name) {
+    echo $name >> ran.txt
+}
+
+task fail {
+    false
+}
+`
+	require.NoError(t, os.WriteFile(filepath.Join(projectDir, "Quakefile"), []byte(quakefile), 0644))
+	t.Chdir(projectDir)
+
+	groups := [][]string{{"ok", "lint"}, {"fail"}, {"ok", "test"}}
+
+	// Without keep-going the first failure stops the run
+	require.Error(t, runTaskGroups(groups, "", quake.Options{}, false, false))
+	data, err := os.ReadFile(filepath.Join(projectDir, "ran.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "lint\n", string(data))
+
+	require.NoError(t, os.Remove(filepath.Join(projectDir, "ran.txt")))
+	err = runTaskGroups(groups, "", quake.Options{}, true, false)
+	require.EqualError(t, err, "1 of 3 task groups failed: fail")
+	data, err = os.ReadFile(filepath.Join(projectDir, "ran.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "lint\ntest\n", string(data))
+}
+
+func TestRunTaskGroupsChain(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+
+	projectDir := t.TempDir()
+	quakefile := `task version {
+    echo built >> builds.txt
+    echo 1.2.3
+}
+
+task publish {
+    echo {{task("version")}} >> published.txt
+}
+`
+	require.NoError(t, os.WriteFile(filepath.Join(projectDir, "Quakefile"), []byte(quakefile), 0644))
+	t.Chdir(projectDir)
+
+	groups := [][]string{{"publish"}, {"publish"}}
+
+	// Isolated groups each work out the version
+	require.NoError(t, runTaskGroups(groups, "", quake.Options{}, false, false))
+	data, err := os.ReadFile(filepath.Join(projectDir, "builds.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "built\nbuilt\n", string(data))
+
+	// Chained groups share it
+	require.NoError(t, os.Remove(filepath.Join(projectDir, "builds.txt")))
+	require.NoError(t, runTaskGroups(groups, "", quake.Options{}, false, true))
+	data, err = os.ReadFile(filepath.Join(projectDir, "builds.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "built\n", string(data))
+	data, err = os.ReadFile(filepath.Join(projectDir, "published.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "1.2.3\n1.2.3\n1.2.3\n1.2.3\n", string(data))
+}
+
+func TestRecursiveInvocationIsStopped(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	t.Setenv("QUAKE_TEST_RUN_MAIN", "1")
+	t.Setenv("QUAKE_MAX_DEPTH", "3")
+	t.Setenv("QUAKE_DEPTH", "")
+
+	exe, err := os.Executable()
+	require.NoError(t, err)
+
+	projectDir := t.TempDir()
+	quakefile := `task loop {
+    echo "depth $QUAKE_DEPTH" >> depths.txt
+    ` + exe + ` loop
+}
+`
+	require.NoError(t, os.WriteFile(filepath.Join(projectDir, "Quakefile"), []byte(quakefile), 0644))
+
+	cmd := exec.Command(exe, "loop")
+	cmd.Dir = projectDir
+	output, err := cmd.CombinedOutput()
+	require.Error(t, err, "runaway recursion should fail")
+	require.Contains(t, string(output), "quake is nested 3 levels deep (QUAKE_MAX_DEPTH=3)")
+
+	data, err := os.ReadFile(filepath.Join(projectDir, "depths.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "depth 1\ndepth 2\ndepth 3\n", string(data))
+}
+
+func TestListHidesPrivateTasks(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	t.Setenv("QUAKE_TEST_RUN_MAIN", "1")
+
+	exe, err := os.Executable()
+	require.NoError(t, err)
+
+	projectDir := t.TempDir()
+	quakefile := `task _setup {
+    echo setup > setup.txt
+}
+
+task build => _setup {
+    echo build
+}
+
+namespace db {
+    task _reset {
+        echo reset
+    }
+}
+`
+	require.NoError(t, os.WriteFile(filepath.Join(projectDir, "Quakefile"), []byte(quakefile), 0644))
+
+	list := func(args ...string) string {
+		cmd := exec.Command(exe, args...)
+		cmd.Dir = projectDir
+		output, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(output))
+		return string(output)
+	}
+
+	output := list("-l")
+	require.Contains(t, output, "build")
+	require.NotContains(t, output, "_setup")
+	require.NotContains(t, output, "db:_reset")
+
+	output = list("-l", "--all")
+	require.Contains(t, output, "build")
+	require.Contains(t, output, "_setup")
+	require.Contains(t, output, "db:_reset")
+
+	// Private tasks still run as dependencies
+	list("build")
+	require.FileExists(t, filepath.Join(projectDir, "setup.txt"))
+}
+
+func TestGoTaskDescription(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	t.Setenv("QUAKE_TEST_RUN_MAIN", "1")
+
+	exe, err := os.Executable()
+	require.NoError(t, err)
+
+	projectDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(projectDir, "Quakefile"), []byte("task build {\n    echo build\n}\n"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(projectDir, "qtasks"), 0755))
+	source := `package main
+
+// [db:migrate] ::
+// Run the database migrations.
+//
+// Pending migrations run in order.
+//
+//go:generate echo skipped
+func Migrate() error { return nil }
+`
+	require.NoError(t, os.WriteFile(filepath.Join(projectDir, "qtasks", "tasks.go"), []byte(source), 0644))
+
+	run := func(args ...string) string {
+		cmd := exec.Command(exe, args...)
+		cmd.Dir = projectDir
+		output, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(output))
+		return string(output)
+	}
+
+	// The list shows only the summary
+	output := run("-l")
+	require.Contains(t, output, "db:migrate")
+	require.Contains(t, output, "Run the database migrations.")
+	require.NotContains(t, output, "Pending migrations")
+
+	// --show has the whole description, without the directive
+	output = run("--show", "db:migrate")
+	require.Contains(t, output, "Description:\n  Run the database migrations.\n\n  Pending migrations run in order.\n")
+	require.NotContains(t, output, "go:generate")
+	require.NotContains(t, output, "skipped")
+}
+
+func TestTaskGraph(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	t.Setenv("QUAKE_TEST_RUN_MAIN", "1")
+
+	exe, err := os.Executable()
+	require.NoError(t, err)
+
+	projectDir := t.TempDir()
+	quakefile := `task out.txt => in.txt {
+    cp in.txt out.txt
+}
+
+task test:unit {
+    go test ./...
+}
+
+task test:e2e {
+    ./e2e.sh
+}
+
+# Build everything
+task all => out.txt, test:*, db:migrate, deploy {
+    echo done
+}
+
+namespace db {
+    task migrate {
+        ./migrate.sh
+    }
+}
+`
+	require.NoError(t, os.WriteFile(filepath.Join(projectDir, "Quakefile"), []byte(quakefile), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(projectDir, "qtasks"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(projectDir, "qtasks", "tasks.go"), []byte("package main\n\n// Deploy ships it\nfunc Deploy() error { return nil }\n"), 0644))
+
+	cmd := exec.Command(exe, "--graph")
+	cmd.Dir = projectDir
+	output, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(output))
+	graph := string(output)
+
+	require.Contains(t, graph, `"in.txt" [shape=note];`, "file prerequisites aren't drawn like tasks")
+	require.Contains(t, graph, `"out.txt" -> "in.txt";`)
+	require.NotContains(t, graph, `"out.txt" [shape=note]`)
+	require.Contains(t, graph, `"all" [tooltip="Build everything"];`)
+	require.Contains(t, graph, `"deploy" [shape=component, style=filled, fillcolor="#e0f0ff", tooltip="Deploy ships it"];`)
+	require.Contains(t, graph, `"all" -> "db:migrate";`)
+	require.Contains(t, graph, `"db:migrate";`)
+
+	// The pattern is drawn as the tasks it matches
+	require.Contains(t, graph, `"all" -> "test:e2e";`)
+	require.Contains(t, graph, `"all" -> "test:unit";`)
+	require.NotContains(t, graph, "test:*")
+}
+
+func TestSplitVariableOverrides(t *testing.T) {
+	overrides, args := splitVariableOverrides([]string{"VERSION=2.0.0", "EMPTY=", "build", "fast"})
+	require.Equal(t, map[string]string{"VERSION": "2.0.0", "EMPTY": ""}, overrides)
+	require.Equal(t, []string{"build", "fast"}, args)
+
+	// After the task name, KEY=VALUE is a task argument
+	overrides, args = splitVariableOverrides([]string{"deploy", "ENV=prod"})
+	require.Nil(t, overrides)
+	require.Equal(t, []string{"deploy", "ENV=prod"}, args)
+}
+
+func TestSplitPrintEnvFull(t *testing.T) {
+	args, full, err := splitPrintEnvFull([]string{"--print-env=full", "build"})
+	require.NoError(t, err)
+	require.True(t, full)
+	require.Equal(t, []string{"build"}, args)
+
+	args, full, err = splitPrintEnvFull([]string{"--print-env", "build", "--", "--print-env=full"})
+	require.NoError(t, err)
+	require.False(t, full)
+	require.Equal(t, []string{"--print-env", "build", "--", "--print-env=full"}, args)
+
+	args, full, err = splitPrintEnvFull([]string{"--print-env=masked"})
+	require.NoError(t, err)
+	require.False(t, full)
+	require.Equal(t, []string{"--print-env"}, args)
+
+	_, _, err = splitPrintEnvFull([]string{"--print-env=all"})
+	require.EqualError(t, err, `invalid --print-env "all" (expected full or masked)`)
+}
+
+func TestVariableOverridesFromCommandLine(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	t.Setenv("QUAKE_TEST_RUN_MAIN", "1")
+
+	exe, err := os.Executable()
+	require.NoError(t, err)
+
+	projectDir := t.TempDir()
+	quakefile := `VERSION = "1.0.0"
+TAG = "app:$VERSION"
+
+task show(arg) {
+    echo "$TAG $arg" > out.txt
+}
+`
+	require.NoError(t, os.WriteFile(filepath.Join(projectDir, "Quakefile"), []byte(quakefile), 0644))
+
+	run := func(args ...string) string {
+		cmd := exec.Command(exe, args...)
+		cmd.Dir = projectDir
+		output, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(output))
+		data, err := os.ReadFile(filepath.Join(projectDir, "out.txt"))
+		require.NoError(t, err)
+		return strings.TrimSpace(string(data))
+	}
+
+	require.Equal(t, "app:2.0.0 x", run("VERSION=2.0.0", "show", "x"))
+	require.Equal(t, "app:1.0.0 VERSION=2.0.0", run("show", "VERSION=2.0.0"))
+}
+
+func TestWriteTaskDetails(t *testing.T) {
+	result, ok, err := parser.ParseQuakefile(`VERSION = ` + "`echo should-not-run`" + `
+
+# Deploy the app to an environment
+task deploy(env, retries: 2) => build, test {
+    @echo "Deploying $VERSION to {{env || "staging"}}"
+    -rm -rf tmp
+    set TAG = "v$VERSION"
+    ./deploy.sh ` + "`git rev-parse HEAD`" + `
+    go test   ./...
+      | tee test.log
+}
+`)
+	require.True(t, ok)
+	require.NoError(t, err)
+
+	var buf strings.Builder
+	writeTaskDetails(&buf, "deploy", result.FindTask("deploy"))
+
+	expected := `Task: deploy
+Description:
+  Deploy the app to an environment
+Arguments: env
+Dependencies: build, test
+Attributes: retries: "2"
+Commands:
+  @echo "Deploying $VERSION to {{env || "staging"}}"
+  -rm -rf tmp
+  set TAG = "v$VERSION"
+  ./deploy.sh ` + "`git rev-parse HEAD`" + `
+  go test   ./...
+    | tee test.log
+`
+	require.Equal(t, expected, buf.String())
+}
+
+func TestWriteTaskTree(t *testing.T) {
+	result, ok, err := parser.ParseQuakefile(`# Build everything
+task build {
+    go build
+}
+
+namespace db {
+    task migrate {
+        migrate up
+    }
+
+    namespace cache {
+        task clear {
+            redis-cli flushall
+        }
+    }
+}
+`)
+	require.True(t, ok)
+	require.NoError(t, err)
+
+	// A flattened ns:name task, as Go tasks with a namespace are
+	result.Tasks = append(result.Tasks, parser.Task{Name: "db:seed"})
+
+	var buf strings.Builder
+	writeTaskTree(&buf, collectListEntries(result), false)
+
+	expected := "  build                Build everything\n" +
+		"  " + color.FaintText("db:") + "\n" +
+		"    seed\n" +
+		"    migrate\n" +
+		"    " + color.FaintText("cache:") + "\n" +
+		"      clear\n"
+	require.Equal(t, expected, buf.String())
+}
+
+func TestWriteListEntrySignature(t *testing.T) {
+	task := parser.Task{Name: "deploy", Description: "Deploy it", Arguments: []string{"env", "region"}, Dependencies: []string{"build", "test"}}
+
+	var buf strings.Builder
+	writeListEntry(&buf, "  ", "deploy", task, false)
+	writeListEntry(&buf, "  ", "deploy", task, true)
+	writeListEntry(&buf, "  ", "clean", parser.Task{Name: "clean", Dependencies: []string{"stop"}}, false)
+
+	expected := "  deploy(env, region)  Deploy it\n" +
+		"  deploy(env, region) => build, test Deploy it\n" +
+		"  clean\n"
+	require.Equal(t, expected, buf.String())
+}
+
+func TestWriteTaskListJSON(t *testing.T) {
+	var buf strings.Builder
+	require.NoError(t, writeTaskListJSON(&buf, []listEntry{
+		{Name: "build", Task: parser.Task{Name: "build", Description: "Build it", Dependencies: []string{"gen"}, Group: "Compilation"}},
+		{Name: "db:migrate", Task: parser.Task{Name: "migrate", Arguments: []string{"steps"}}},
+	}))
+
+	expected := `{
+  "version": 2,
+  "tasks": [
+    {
+      "name": "build",
+      "description": "Build it",
+      "dependencies": [
+        "gen"
+      ],
+      "group": "Compilation"
+    },
+    {
+      "name": "db:migrate",
+      "arguments": [
+        "steps"
+      ]
+    }
+  ]
+}
+`
+	require.Equal(t, expected, buf.String())
+
+	// An empty list still has the envelope
+	buf.Reset()
+	require.NoError(t, writeTaskListJSON(&buf, nil))
+	require.Equal(t, "{\n  \"version\": 2,\n  \"tasks\": []\n}\n", buf.String())
+}
+
+func TestFilterListEntries(t *testing.T) {
+	entries := []listEntry{
+		{Name: "build", Task: parser.Task{Description: "Build the Docker image"}},
+		{Name: "docker:push", Task: parser.Task{}},
+		{Name: "test", Task: parser.Task{Description: "Run tests"}},
+	}
+
+	var names []string
+	for _, entry := range filterListEntries(entries, "DOCK") {
+		names = append(names, entry.Name)
+	}
+	require.Equal(t, []string{"build", "docker:push"}, names)
+	require.Empty(t, filterListEntries(entries, "deploy"))
+}
+
+func TestSplitTaskGroups(t *testing.T) {
+	groups := splitTaskGroups([]string{"send", "hello world", "line 1\nline 2", "--", "--", "build", "", `\--`, "--"})
+	require.Equal(t, [][]string{
+		{"send", "hello world", "line 1\nline 2"},
+		{"build", "", "--"},
+	}, groups)
+	require.Empty(t, splitTaskGroups([]string{"--"}))
+}
+
+func TestOpenDiagnostic(t *testing.T) {
+	var fallback strings.Builder
+	w, closeOutput, err := openDiagnostic("", "graph.dot", &fallback)
+	require.NoError(t, err)
+	require.Same(t, &fallback, w)
+	require.NoError(t, closeOutput())
+
+	dir := t.TempDir()
+	w, closeOutput, err = openDiagnostic(dir, "graph.dot", &fallback)
+	require.NoError(t, err)
+	fmt.Fprintln(w, "digraph quake {}")
+	require.NoError(t, closeOutput())
+
+	data, err := os.ReadFile(filepath.Join(dir, "graph.dot"))
+	require.NoError(t, err)
+	require.Equal(t, "digraph quake {}\n", string(data))
+	require.Empty(t, fallback.String())
+}
+
+func TestWriteTaskNames(t *testing.T) {
+	entries := []listEntry{
+		{Name: "build", Task: parser.Task{Description: "Build the app"}},
+		{Name: "docker:push", Task: parser.Task{}},
+	}
+
+	var buf strings.Builder
+	writeTaskNames(&buf, entries)
+	require.Equal(t, "build\ndocker:push\n", buf.String())
+}
+
+func TestAddNewTask(t *testing.T) {
+	dir := t.TempDir()
+	quakefilePath := filepath.Join(dir, "Quakefile")
+	require.NoError(t, os.WriteFile(quakefilePath, []byte("task build {\n    go build\n}"), 0644))
+
+	path, err := addNewTask("deploy(env) => build", "", dir)
+	require.NoError(t, err)
+	require.Equal(t, quakefilePath, path)
+
+	data, err := os.ReadFile(quakefilePath)
+	require.NoError(t, err)
+	require.Equal(t, "task build {\n    go build\n}\n\ntask deploy(env) => build {\n    # TODO\n}\n", string(data))
+
+	_, err = addNewTask("deploy", "", dir)
+	require.EqualError(t, err, "task 'deploy' already exists")
+
+	_, err = addNewTask("deploy(env", "", dir)
+	require.EqualError(t, err, "invalid task signature 'deploy(env'")
+
+	// A separate .quake file is created if needed
+	target := filepath.Join(dir, "qtasks", "release.quake")
+	require.NoError(t, os.Mkdir(filepath.Dir(target), 0755))
+	path, err = addNewTask("release", target, dir)
+	require.NoError(t, err)
+	require.Equal(t, target, path)
+
+	data, err = os.ReadFile(target)
+	require.NoError(t, err)
+	require.Equal(t, "task release {\n    # TODO\n}\n", string(data))
+}
+
+func TestSortListEntries(t *testing.T) {
+	entries := func() []listEntry {
+		return []listEntry{
+			{Name: "test", Task: parser.Task{SourceFile: "Quakefile"}},
+			{Name: "db:migrate", Task: parser.Task{SourceFile: "qtasks/db.quake"}},
+			{Name: "build", Task: parser.Task{SourceFile: "Quakefile"}},
+			{Name: "lint", Task: parser.Task{SourceFile: "qtasks/ci.quake"}},
+		}
+	}
+	names := func(entries []listEntry) []string {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name)
+		}
+		return names
+	}
+
+	for sortBy, expected := range map[string][]string{
+		"":       {"test", "db:migrate", "build", "lint"},
+		"order":  {"test", "db:migrate", "build", "lint"},
+		"name":   {"build", "db:migrate", "lint", "test"},
+		"source": {"test", "build", "lint", "db:migrate"},
+	} {
+		sorted := entries()
+		require.NoError(t, sortListEntries(sorted, sortBy, ""))
+		require.Equal(t, expected, names(sorted), sortBy)
+	}
+
+	require.EqualError(t, sortListEntries(entries(), "size", ""), "unknown sort order 'size' (expected: order, name, source or usage)")
+}
+
+func TestRepeatRun(t *testing.T) {
+	var out strings.Builder
+	runs := 0
+	run := func() error {
+		runs++
+		if runs%3 == 0 {
+			return fmt.Errorf("flaked")
+		}
+		return nil
+	}
+
+	require.NoError(t, repeatRun(&out, 1, false, false, run))
+	require.Equal(t, 1, runs)
+	require.Empty(t, out.String(), "a single run isn't numbered")
+
+	runs = 0
+	require.EqualError(t, repeatRun(&out, 5, false, false, run), "iteration 3 failed: flaked")
+	require.Equal(t, 3, runs)
+
+	// With keep-going every iteration runs
+	runs = 0
+	require.EqualError(t, repeatRun(&out, 7, false, true, run), "2 of 7 iterations failed")
+	require.Equal(t, 7, runs)
+
+	runs = 0
+	out.Reset()
+	require.EqualError(t, repeatRun(&out, 0, true, true, run), "iteration 3 failed: flaked")
+	require.Contains(t, out.String(), "Iteration 3")
+
+	// A limit applies to --until-fail too
+	runs = 1
+	require.NoError(t, repeatRun(&out, 1, true, false, run))
+}
+
+func TestWriteTaskGroups(t *testing.T) {
+	entries := []listEntry{
+		{Name: "clean", Task: parser.Task{}},
+		{Name: "build", Task: parser.Task{Group: "Compilation"}},
+		{Name: "test", Task: parser.Task{Group: "Testing"}},
+		{Name: "generate", Task: parser.Task{Group: "Compilation"}},
+	}
+	require.True(t, hasGroups(entries))
+	require.False(t, hasGroups(entries[:1]))
+
+	var buf strings.Builder
+	writeTaskGroups(&buf, entries, false)
+	expected := "  " + color.BoldText("Compilation:") + "\n" +
+		"    build\n" +
+		"    generate\n" +
+		"  " + color.BoldText("Testing:") + "\n" +
+		"    test\n" +
+		"  " + color.BoldText("Other:") + "\n" +
+		"    clean\n"
+	require.Equal(t, expected, buf.String())
+}
+
+func TestRunDoctor(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Quakefile"), []byte("---\nshell: sh -e\n---\ntask build {\n    go build\n}\n"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "qtasks"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "qtasks", "broken.quake"), []byte("task {\n"), 0644))
+
+	var buf strings.Builder
+	require.Equal(t, 1, runDoctor(&buf, dir))
+	out := buf.String()
+	require.Contains(t, out, "✅ Quakefile: "+filepath.Join(dir, "Quakefile"))
+	require.Contains(t, out, "❌ Tasks: ")
+	require.Contains(t, out, "broken.quake")
+	require.Contains(t, out, "✅ Shell: sh -e")
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "qtasks", "broken.quake")))
+	buf.Reset()
+	require.Equal(t, 0, runDoctor(&buf, dir))
+	require.Contains(t, buf.String(), "✅ Tasks: 1 loaded")
+
+	buf.Reset()
+	require.Equal(t, 1, runDoctor(&buf, filepath.Join(dir, "missing")))
+	require.Contains(t, buf.String(), "❌ Quakefile: ")
+}
+
+func TestCleanOutputs(t *testing.T) {
+	dir := t.TempDir()
+	quakefile := `task build(outputs: ["build/app", "dist/", "missing.txt"]) {
+    go build
+}
+
+task escape(outputs: ["../elsewhere"]) {
+    true
+}
+
+task plain {
+    true
+}
+`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Quakefile"), []byte(quakefile), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "build"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "build", "app"), []byte("app"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "dist", "v1"), 0755))
+
+	var buf strings.Builder
+	require.NoError(t, cleanOutputs(&buf, "build", dir, quake.Options{}))
+	require.Equal(t, "Removed build/app\nRemoved dist/\n", buf.String())
+	_, err := os.Stat(filepath.Join(dir, "build", "app"))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "dist"))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "build"))
+	require.NoError(t, err, "only the listed outputs are removed")
+
+	require.ErrorContains(t, cleanOutputs(&buf, "escape", dir, quake.Options{}), "won't remove ../elsewhere")
+	require.EqualError(t, cleanOutputs(&buf, "plain", dir, quake.Options{}), "task 'plain' has no outputs to clean")
+}
+
+func TestStartProfiling(t *testing.T) {
+	dir := t.TempDir()
+	cpu := filepath.Join(dir, "cpu.pprof")
+	mem := filepath.Join(dir, "mem.pprof")
+
+	stop, err := startProfiling(cpu, mem)
+	require.NoError(t, err)
+	stop()
+
+	for _, path := range []string{cpu, mem} {
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.NotZero(t, info.Size())
+	}
+
+	_, err = startProfiling(filepath.Join(dir, "missing", "cpu.pprof"), "")
+	require.ErrorContains(t, err, "failed to create CPU profile")
+}
+
+func TestChangedListEntries(t *testing.T) {
+	dir := t.TempDir()
+	quakefilePath := filepath.Join(dir, "Quakefile")
+	require.NoError(t, os.WriteFile(quakefilePath, []byte("task build {\n    go build\n}\n"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "qtasks"), 0755))
+	extra := filepath.Join(dir, "qtasks", "db.quake")
+	require.NoError(t, os.WriteFile(extra, []byte("task migrate {\n    ./migrate\n}\n"), 0644))
+
+	result, err := quake.Load(quakefilePath)
+	require.NoError(t, err)
+	entries := collectListEntries(*result)
+
+	names := func(entries []listEntry) []string {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name)
+		}
+		return names
+	}
+
+	// Before any run, every task counts as changed
+	changed, err := changedListEntries(entries, quakefilePath)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"build", "migrate"}, names(changed))
+
+	recordSources(quakefilePath, result)
+	require.FileExists(t, filepath.Join(dir, ".quake", "state.json"))
+	changed, err = changedListEntries(entries, quakefilePath)
+	require.NoError(t, err)
+	require.Empty(t, changed)
+
+	require.NoError(t, os.WriteFile(extra, []byte("task migrate {\n    ./migrate up\n}\n"), 0644))
+	changed, err = changedListEntries(entries, quakefilePath)
+	require.NoError(t, err)
+	require.Equal(t, []string{"migrate"}, names(changed))
+}
+
+func TestLogFile(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	t.Setenv("QUAKE_TEST_RUN_MAIN", "1")
+	t.Setenv("NO_COLOR", "")
+
+	exe, err := os.Executable()
+	require.NoError(t, err)
+
+	projectDir := t.TempDir()
+	quakefile := `task build {
+    echo building
+    echo oops >&2
+}
+`
+	require.NoError(t, os.WriteFile(filepath.Join(projectDir, "Quakefile"), []byte(quakefile), 0644))
+
+	cmd := exec.Command(exe, "--log-file", "build.log", "build")
+	cmd.Dir = projectDir
+	output, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(output))
+	require.Contains(t, string(output), color.BoldText("build"))
+	require.Contains(t, string(output), "building\n")
+
+	data, err := os.ReadFile(filepath.Join(projectDir, "build.log"))
+	require.NoError(t, err)
+	require.Contains(t, string(data), "┌──── [ build ]\n")
+	require.Contains(t, string(data), "building\n")
+	require.Contains(t, string(data), "oops\n")
+	require.NotContains(t, string(data), "\033[")
+}
+
+func TestColorStripper(t *testing.T) {
+	var buf strings.Builder
+	w := &colorStripper{w: &buf}
+	for _, part := range []string{"\033[1mbold\033", "[0m and \033[3", "3myellow\033[0m\n"} {
+		n, err := w.Write([]byte(part))
+		require.NoError(t, err)
+		require.Equal(t, len(part), n)
+	}
+	require.Equal(t, "bold and yellow\n", buf.String())
+}
+
+func TestOutputDirTrace(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	t.Setenv("QUAKE_TEST_RUN_MAIN", "1")
+
+	exe, err := os.Executable()
+	require.NoError(t, err)
+
+	projectDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(projectDir, "Quakefile"), []byte("task build {\n    echo building\n}\n"), 0644))
+	run := func(args ...string) {
+		cmd := exec.Command(exe, args...)
+		cmd.Dir = projectDir
+		output, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(output))
+	}
+
+	// --output-dir alone doesn't turn tracing on
+	run("--output-dir", "out", "build")
+	require.DirExists(t, filepath.Join(projectDir, "out"))
+	require.NoFileExists(t, filepath.Join(projectDir, "out", "trace.json"))
+
+	run("--output-dir", "out", "--trace-json", "build")
+	require.FileExists(t, filepath.Join(projectDir, "out", "trace.json"))
+
+	run("--output-dir", "out", "--trace", "run.trace", "build")
+	require.FileExists(t, filepath.Join(projectDir, "out", "run.trace"))
+
+	// An absolute --trace path stays where it is
+	abs := filepath.Join(t.TempDir(), "abs.json")
+	run("--output-dir", "out", "--trace", abs, "build")
+	require.FileExists(t, abs)
+}
@@ -3,14 +3,37 @@ package parser
 import (
 	"encoding/json"
 	"fmt"
+	"path"
+	"sort"
+	"strings"
 )
 
 // QuakeFile represents the root of a parsed Quakefile
 type QuakeFile struct {
-	Tasks         []Task      `json:"tasks"`
-	Namespaces    []Namespace `json:"namespaces,omitempty"`
-	Variables     []Variable  `json:"variables,omitempty"`
-	FileNamespace string      `json:"file_namespace,omitempty"`
+	Tasks         []Task            `json:"tasks"`
+	Namespaces    []Namespace       `json:"namespaces,omitempty"`
+	Variables     []Variable        `json:"variables,omitempty"`
+	FileNamespace string            `json:"file_namespace,omitempty"`
+	Shell         string            `json:"shell,omitempty"`          // Shell used to run commands, from a shell = "..." directive
+	ShellFlags    string            `json:"shell_flags,omitempty"`    // Flags passed to the shell before -c, from a shell_flags = "..." directive
+	Loads         []string          `json:"loads,omitempty"`          // Glob patterns or URLs of extra .quake files, from load "..." directives
+	LoadChecksums map[string]string `json:"load_checksums,omitempty"` // SHA-256 checksums pinned by load "url" sha256 "..."
+	OnError       string            `json:"onerror,omitempty"`        // Task run when a task fails, from an onerror directive
+	OnMissing     string            `json:"on_missing,omitempty"`     // What to do when a task isn't found, from an on_missing directive
+	GoTasks       *GoTasksConfig    `json:"gotasks,omitempty"`        // How Go tasks are run, from a gotasks { ... } block
+	Config        map[string]string `json:"config,omitempty"`         // Settings from the --- front matter block at the start of the file
+	Dir           string            `json:"-"`                        // Directory of the main Quakefile, that file("path") reads relative paths from; set by quake.Load
+
+	matrices []Matrix // Matrix blocks, expanded into Tasks once parsing finishes
+}
+
+// GoTasksConfig configures how Go tasks are built, from a
+// gotasks { tags = "integration"; flags = "-race" } block. Any other setting,
+// like CGO_ENABLED = "1", is set in the environment of the build and the tasks.
+type GoTasksConfig struct {
+	Tags  string            `json:"tags,omitempty"`  // Build tags, passed as go build -tags
+	Flags string            `json:"flags,omitempty"` // Extra go build flags, separated by spaces
+	Env   map[string]string `json:"env,omitempty"`
 }
 
 // UnmarshalJSON ensures empty slices are initialized correctly
@@ -37,17 +60,134 @@ func (q *QuakeFile) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// FindTask locates a task by name, checking namespaces if needed. It returns
+// nil if there is no such task.
+func (q *QuakeFile) FindTask(name string) *Task {
+	// First, look in top-level tasks (including flattened namespace:name tasks)
+	for i := range q.Tasks {
+		if q.Tasks[i].Name == name {
+			return &q.Tasks[i]
+		}
+	}
+
+	// If not found and contains ':', also check actual namespace structures
+	if strings.Contains(name, ":") {
+		parts := strings.Split(name, ":")
+		return findNamespacedTask(parts, q.Namespaces)
+	}
+
+	return nil
+}
+
+// findNamespacedTask searches for a task in namespaces
+func findNamespacedTask(parts []string, namespaces []Namespace) *Task {
+	if len(parts) == 0 {
+		return nil
+	}
+
+	// Look for matching namespace
+	for i := range namespaces {
+		ns := &namespaces[i]
+		if ns.Name == parts[0] {
+			if len(parts) == 2 {
+				// Look for task in this namespace
+				for j := range ns.Tasks {
+					if ns.Tasks[j].Name == parts[1] {
+						return &ns.Tasks[j]
+					}
+				}
+			} else if len(parts) > 2 {
+				// Recurse into nested namespaces
+				return findNamespacedTask(parts[1:], ns.Namespaces)
+			}
+		}
+	}
+
+	return nil
+}
+
+// TaskNames returns the fully-qualified names of all tasks: top-level tasks
+// (including flattened namespace:name tasks), then those in namespaces
+func (q *QuakeFile) TaskNames() []string {
+	var names []string
+	for _, task := range q.Tasks {
+		names = append(names, task.Name)
+	}
+
+	var walk func(namespaces []Namespace, prefix string)
+	walk = func(namespaces []Namespace, prefix string) {
+		for _, ns := range namespaces {
+			for _, task := range ns.Tasks {
+				names = append(names, prefix+ns.Name+":"+task.Name)
+			}
+			walk(ns.Namespaces, prefix+ns.Name+":")
+		}
+	}
+	walk(q.Namespaces, "")
+
+	return names
+}
+
+// IsTaskPattern reports whether a dependency is a glob pattern like test:*
+func IsTaskPattern(dep string) bool {
+	return strings.ContainsAny(dep, "*?[")
+}
+
+// ExpandDependency resolves a dependency to task names. A glob pattern like
+// test:* expands to the matching tasks in sorted order; * and ? don't match
+// across namespaces. A pattern matching no tasks is an error unless it ends
+// with ? to mark it optional, as in test:*?. Other dependencies are returned
+// unchanged.
+func (q *QuakeFile) ExpandDependency(dep string) ([]string, error) {
+	if !IsTaskPattern(dep) {
+		return []string{dep}, nil
+	}
+
+	pattern, optional := dep, false
+	if trimmed, ok := strings.CutSuffix(dep, "?"); ok && IsTaskPattern(trimmed) {
+		pattern, optional = trimmed, true
+	}
+
+	// Match namespaces like path segments so * stops at a :
+	segments := strings.ReplaceAll(pattern, ":", "/")
+	var matches []string
+	seen := make(map[string]bool)
+	for _, name := range q.TaskNames() {
+		ok, err := path.Match(segments, strings.ReplaceAll(name, ":", "/"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid dependency pattern '%s': %w", dep, err)
+		}
+		if ok && !seen[name] {
+			seen[name] = true
+			matches = append(matches, name)
+		}
+	}
+
+	if len(matches) == 0 && !optional {
+		return nil, fmt.Errorf("dependency pattern '%s' matches no tasks (end it with ? to make it optional)", dep)
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
 // Task represents a task definition in a Quakefile
 type Task struct {
-	Name         string    `json:"name"`
-	Description  string    `json:"description,omitempty"`
-	Arguments    []string  `json:"arguments,omitempty"`
-	Dependencies []string  `json:"dependencies,omitempty"`
-	Commands     []Command `json:"commands"`
-	IsGoTask     bool      `json:"is_go_task,omitempty"`
-	GoDispatcher string    `json:"go_dispatcher,omitempty"` // Path to dispatcher main.go
-	GoSourceDir  string    `json:"go_source_dir,omitempty"` // Directory containing Go sources
-	SourceFile   string    `json:"source_file,omitempty"`   // Source file where task is defined
+	Name         string            `json:"name"`
+	Description  string            `json:"description,omitempty"`
+	Arguments    []string          `json:"arguments,omitempty"`
+	ArgTypes     map[string]string `json:"arg_types,omitempty"` // Declared types of arguments, like replicas: int, keyed by name
+	Dependencies []string          `json:"dependencies,omitempty"`
+	Attributes   map[string]string `json:"attributes,omitempty"` // Settings like retries: 3 from the argument list
+	Group        string            `json:"group,omitempty"`      // Heading the task is listed under, from a group: "..." attribute
+	Outputs      []string          `json:"outputs,omitempty"`    // Files the task produces, from an outputs: [...] attribute
+	Commands     []Command         `json:"commands"`
+	Env          map[string]string `json:"env,omitempty"` // Variables from env { ... } blocks, as written, for this task's commands only
+	IsGoTask     bool              `json:"is_go_task,omitempty"`
+	GoDispatcher string            `json:"go_dispatcher,omitempty"` // Path to dispatcher main.go
+	GoSourceDir  string            `json:"go_source_dir,omitempty"` // Directory containing Go sources
+	GoFunction   string            `json:"go_function,omitempty"`   // Go function implementing the task
+	SourceFile   string            `json:"source_file,omitempty"`   // Source file where task is defined
+	Span         *Span             `json:"span,omitempty"`          // Where the task is in its source, from ParseQuakefileWithSpans
 }
 
 // Variable represents a variable assignment
@@ -57,6 +197,9 @@ type Variable struct {
 	IsExpression        bool   `json:"is_expression,omitempty"`
 	CommandSubstitution bool   `json:"command_substitution,omitempty"`
 	IsMultiline         bool   `json:"is_multiline,omitempty"`
+	Exported            bool   `json:"exported,omitempty"` // Passed to subprocesses' environment
+	Append              bool   `json:"append,omitempty"`   // NAME += value, appended to the earlier value with a space
+	Span                *Span  `json:"span,omitempty"`     // Where the assignment is in its source, from ParseQuakefileWithSpans
 }
 
 // Namespace represents a namespace block containing tasks and nested namespaces
@@ -65,13 +208,20 @@ type Namespace struct {
 	Tasks      []Task      `json:"tasks,omitempty"`
 	Variables  []Variable  `json:"variables,omitempty"`
 	Namespaces []Namespace `json:"namespaces,omitempty"`
+	Span       *Span       `json:"span,omitempty"` // Where the block is in its source, from ParseQuakefileWithSpans
 }
 
 // Command represents a single command line in a task
 type Command struct {
 	Elements        []CommandElement `json:"elements"`
 	Silent          bool             `json:"silent,omitempty"`
+	Quiet           bool             `json:"quiet,omitempty"` // From the @@ prefix: the command's output is discarded too
 	ContinueOnError bool             `json:"continue_on_error,omitempty"`
+	Set             *Variable        `json:"set,omitempty"`       // Task-local assignment from a `set NAME = value` statement
+	Parallel        []Command        `json:"parallel,omitempty"`  // Commands in a parallel { ... } block, run concurrently
+	Condition       Expression       `json:"condition,omitempty"` // From an if {{expr}}: prefix; the command only runs if it's truthy
+	Raw             string           `json:"raw,omitempty"`       // Source of the command as written, for display
+	Span            *Span            `json:"span,omitempty"`      // Where the command is in its source, from ParseQuakefileWithSpans
 }
 
 // CommandElement represents a part of a command
@@ -86,13 +236,23 @@ type StringElement struct {
 
 func (StringElement) commandElement() {}
 
-// BacktickElement represents a command substitution
+// BacktickElement represents a command substitution, written as `cmd` or
+// $(cmd)
 type BacktickElement struct {
 	Command string `json:"command"`
+	Dollar  bool   `json:"dollar,omitempty"` // Written as $(cmd)
 }
 
 func (BacktickElement) commandElement() {}
 
+// Source returns the substitution as it was written
+func (b BacktickElement) Source() string {
+	if b.Dollar {
+		return "$(" + b.Command + ")"
+	}
+	return "`" + b.Command + "`"
+}
+
 // ExpressionElement represents an expression like {{expr}}
 type ExpressionElement struct {
 	Expression Expression `json:"expression"`
@@ -142,6 +302,54 @@ type Or struct {
 
 func (Or) expression() {}
 
+// And represents the && operator
+type And struct {
+	Left  Expression `json:"left"`
+	Right Expression `json:"right"`
+}
+
+func (And) expression() {}
+
+// Concat represents the + operator, which joins its operands as strings
+type Concat struct {
+	Left  Expression `json:"left"`
+	Right Expression `json:"right"`
+}
+
+func (Concat) expression() {}
+
+// NumberLiteral represents a number like 3 or 2.5 in expressions
+type NumberLiteral struct {
+	Value float64 `json:"value"`
+}
+
+func (NumberLiteral) expression() {}
+
+// BoolLiteral represents true or false in expressions
+type BoolLiteral struct {
+	Value bool `json:"value"`
+}
+
+func (BoolLiteral) expression() {}
+
+// Compare represents a comparison like replicas > 3. Op is one of
+// ==, !=, <, <=, >, >=.
+type Compare struct {
+	Op    string     `json:"op"`
+	Left  Expression `json:"left"`
+	Right Expression `json:"right"`
+}
+
+func (Compare) expression() {}
+
+// FuncCall represents a function call like task("version")
+type FuncCall struct {
+	Name string       `json:"name"`
+	Args []Expression `json:"args"`
+}
+
+func (FuncCall) expression() {}
+
 // MarshalJSON for Expression interface
 func marshalExpression(expr Expression) (any, error) {
 	switch e := expr.(type) {
@@ -179,6 +387,73 @@ func marshalExpression(expr Expression) (any, error) {
 			Left  any    `json:"left"`
 			Right any    `json:"right"`
 		}{"or", left, right}, nil
+	case And:
+		left, err := marshalExpression(e.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := marshalExpression(e.Right)
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			Type  string `json:"type"`
+			Left  any    `json:"left"`
+			Right any    `json:"right"`
+		}{"and", left, right}, nil
+	case Concat:
+		left, err := marshalExpression(e.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := marshalExpression(e.Right)
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			Type  string `json:"type"`
+			Left  any    `json:"left"`
+			Right any    `json:"right"`
+		}{"concat", left, right}, nil
+	case NumberLiteral:
+		return struct {
+			Type  string  `json:"type"`
+			Value float64 `json:"value"`
+		}{"number", e.Value}, nil
+	case BoolLiteral:
+		return struct {
+			Type  string `json:"type"`
+			Value bool   `json:"value"`
+		}{"bool", e.Value}, nil
+	case Compare:
+		left, err := marshalExpression(e.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := marshalExpression(e.Right)
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			Type  string `json:"type"`
+			Op    string `json:"op"`
+			Left  any    `json:"left"`
+			Right any    `json:"right"`
+		}{"compare", e.Op, left, right}, nil
+	case FuncCall:
+		args := make([]any, len(e.Args))
+		for i, arg := range e.Args {
+			a, err := marshalExpression(arg)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = a
+		}
+		return struct {
+			Type string `json:"type"`
+			Name string `json:"name"`
+			Args []any  `json:"args"`
+		}{"call", e.Name, args}, nil
 	default:
 		return nil, fmt.Errorf("unknown expression type: %T", e)
 	}
@@ -199,7 +474,8 @@ func (c Command) MarshalJSON() ([]byte, error) {
 			elements[i] = struct {
 				Type    string `json:"type"`
 				Command string `json:"command"`
-			}{"backtick", e.Command}
+				Dollar  bool   `json:"dollar,omitempty"`
+			}{"backtick", e.Command, e.Dollar}
 		case ExpressionElement:
 			expr, err := marshalExpression(e.Expression)
 			if err != nil {
@@ -219,14 +495,35 @@ func (c Command) MarshalJSON() ([]byte, error) {
 		}
 	}
 
+	var condition any
+	if c.Condition != nil {
+		var err error
+		condition, err = marshalExpression(c.Condition)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return json.Marshal(struct {
-		Elements        []any `json:"elements"`
-		Silent          bool  `json:"silent,omitempty"`
-		ContinueOnError bool  `json:"continue_on_error,omitempty"`
+		Elements        []any     `json:"elements"`
+		Silent          bool      `json:"silent,omitempty"`
+		Quiet           bool      `json:"quiet,omitempty"`
+		ContinueOnError bool      `json:"continue_on_error,omitempty"`
+		Set             *Variable `json:"set,omitempty"`
+		Parallel        []Command `json:"parallel,omitempty"`
+		Condition       any       `json:"condition,omitempty"`
+		Raw             string    `json:"raw,omitempty"`
+		Span            *Span     `json:"span,omitempty"`
 	}{
 		Elements:        elements,
 		Silent:          c.Silent,
+		Quiet:           c.Quiet,
 		ContinueOnError: c.ContinueOnError,
+		Set:             c.Set,
+		Parallel:        c.Parallel,
+		Condition:       condition,
+		Raw:             c.Raw,
+		Span:            c.Span,
 	})
 }
 
@@ -235,7 +532,12 @@ func (c *Command) UnmarshalJSON(data []byte) error {
 	var temp struct {
 		Elements        []json.RawMessage `json:"elements"`
 		Silent          bool              `json:"silent,omitempty"`
+		Quiet           bool              `json:"quiet,omitempty"`
 		ContinueOnError bool              `json:"continue_on_error,omitempty"`
+		Set             *Variable         `json:"set,omitempty"`
+		Parallel        []Command         `json:"parallel,omitempty"`
+		Raw             string            `json:"raw,omitempty"`
+		Span            *Span             `json:"span,omitempty"`
 	}
 
 	if err := json.Unmarshal(data, &temp); err != nil {
@@ -243,7 +545,12 @@ func (c *Command) UnmarshalJSON(data []byte) error {
 	}
 
 	c.Silent = temp.Silent
+	c.Quiet = temp.Quiet
 	c.ContinueOnError = temp.ContinueOnError
+	c.Set = temp.Set
+	c.Parallel = temp.Parallel
+	c.Raw = temp.Raw
+	c.Span = temp.Span
 	c.Elements = make([]CommandElement, 0, len(temp.Elements))
 
 	for _, raw := range temp.Elements {
@@ -315,11 +622,15 @@ func (v Variable) MarshalJSON() ([]byte, error) {
 		IsExpression        bool   `json:"is_expression,omitempty"`
 		CommandSubstitution bool   `json:"command_substitution,omitempty"`
 		IsMultiline         bool   `json:"is_multiline,omitempty"`
+		Exported            bool   `json:"exported,omitempty"`
+		Append              bool   `json:"append,omitempty"`
 	}{
 		Name:                v.Name,
 		Value:               value,
 		IsExpression:        v.IsExpression,
 		CommandSubstitution: v.CommandSubstitution,
 		IsMultiline:         v.IsMultiline,
+		Exported:            v.Exported,
+		Append:              v.Append,
 	})
 }
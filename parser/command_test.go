@@ -23,16 +23,16 @@ func TestParseBacktickCommands(t *testing.T) {
 		{
 			Name: "deploy",
 			Commands: []Command{
-				{Elements: []CommandElement{
+				{Raw: `echo "Current commit:"`, Elements: []CommandElement{
 					StringElement{Value: "echo \"Current commit:\""},
 				}},
-				{Elements: []CommandElement{
+				{Raw: "`git rev-parse --short HEAD`", Elements: []CommandElement{
 					BacktickElement{Command: "git rev-parse --short HEAD"},
 				}},
-				{Elements: []CommandElement{
+				{Raw: `echo "Current date:"`, Elements: []CommandElement{
 					StringElement{Value: "echo \"Current date:\""},
 				}},
-				{Elements: []CommandElement{
+				{Raw: "`date +%Y-%m-%d`", Elements: []CommandElement{
 					BacktickElement{Command: "date +%Y-%m-%d"},
 				}},
 			},
@@ -59,18 +59,21 @@ func TestParseBacktickWithPrefixes(t *testing.T) {
 			Name: "info",
 			Commands: []Command{
 				{
+					Raw: "@`echo \"Silent command\"`",
 					Elements: []CommandElement{
 						BacktickElement{Command: "echo \"Silent command\""},
 					},
 					Silent: true,
 				},
 				{
+					Raw: "-`false || true`",
 					Elements: []CommandElement{
 						BacktickElement{Command: "false || true"},
 					},
 					ContinueOnError: true,
 				},
 				{
+					Raw: "`pwd`",
 					Elements: []CommandElement{
 						BacktickElement{Command: "pwd"},
 					},
@@ -100,19 +103,19 @@ func TestParseMixedCommandsAndBackticks(t *testing.T) {
 		{
 			Name: "build",
 			Commands: []Command{
-				{Elements: []CommandElement{
+				{Raw: `echo "Building..."`, Elements: []CommandElement{
 					StringElement{Value: "echo \"Building...\""},
 				}},
-				{Elements: []CommandElement{
+				{Raw: "`make clean`", Elements: []CommandElement{
 					BacktickElement{Command: "make clean"},
 				}},
-				{Elements: []CommandElement{
+				{Raw: "make build", Elements: []CommandElement{
 					StringElement{Value: "make build"},
 				}},
-				{Elements: []CommandElement{
+				{Raw: "`make test`", Elements: []CommandElement{
 					BacktickElement{Command: "make test"},
 				}},
-				{Elements: []CommandElement{
+				{Raw: `echo "Done"`, Elements: []CommandElement{
 					StringElement{Value: "echo \"Done\""},
 				}},
 			},
@@ -121,3 +124,284 @@ func TestParseMixedCommandsAndBackticks(t *testing.T) {
 
 	require.Equal(t, expected, result)
 }
+
+func TestParseQuietPrefix(t *testing.T) {
+	commands := parseCommands("@@vault read secret/token\n@echo visible\n@@ -printenv TOKEN")
+	require.Len(t, commands, 3)
+
+	require.True(t, commands[0].Silent)
+	require.True(t, commands[0].Quiet)
+	require.Equal(t, []CommandElement{StringElement{Value: "vault read secret/token"}}, commands[0].Elements)
+
+	require.True(t, commands[1].Silent)
+	require.False(t, commands[1].Quiet)
+
+	require.True(t, commands[2].Quiet)
+	require.False(t, commands[2].ContinueOnError, "only one prefix is recognized, as with @")
+	require.Equal(t, "@@vault read secret/token", FormatCommand(commands[0]))
+}
+
+func TestParseSetStatement(t *testing.T) {
+	input := `task deploy {
+    set TOKEN = ` + "`" + `fetch-token` + "`" + `
+    set REGION = "us-east-1"
+    curl -H "Authorization: $TOKEN" https://example.com/$REGION
+}`
+
+	result, ok, err := ParseQuakefile(input)
+	require.True(t, ok, "parsing should succeed")
+	require.NoError(t, err, "should not return error")
+
+	expected := makeQuakeFile()
+	expected.Tasks = []Task{
+		{
+			Name: "deploy",
+			Commands: []Command{
+				{
+					Raw:      "set TOKEN = `fetch-token`",
+					Elements: []CommandElement{},
+					Set:      &Variable{Name: "TOKEN", Value: "`fetch-token`", CommandSubstitution: true},
+				},
+				{
+					Raw:      `set REGION = "us-east-1"`,
+					Elements: []CommandElement{},
+					Set:      &Variable{Name: "REGION", Value: `"us-east-1"`},
+				},
+				{Raw: `curl -H "Authorization: $TOKEN" https://example.com/$REGION`, Elements: []CommandElement{
+					StringElement{Value: "curl -H \"Authorization: "},
+					VariableElement{Name: "TOKEN"},
+					StringElement{Value: "\" https://example.com/"},
+					VariableElement{Name: "REGION"},
+				}},
+			},
+		},
+	}
+
+	require.Equal(t, expected, result)
+}
+
+func TestParseSetPrefixWithoutAssignment(t *testing.T) {
+	input := `task opts {
+    set -e
+}`
+
+	result, ok, err := ParseQuakefile(input)
+	require.True(t, ok, "parsing should succeed")
+	require.NoError(t, err, "should not return error")
+
+	require.Len(t, result.Tasks, 1)
+	require.Nil(t, result.Tasks[0].Commands[0].Set, "plain shell set should not be an assignment")
+	require.Equal(t, []CommandElement{StringElement{Value: "set -e"}}, result.Tasks[0].Commands[0].Elements)
+}
+
+func TestParseCommentsInTaskBody(t *testing.T) {
+	input := `task build { # builds everything
+    # compile first
+    go build ./...
+    curl https://example.com/page#section
+    awk '{ print $1 } # not a comment' input.txt
+    echo "# quoted"
+}`
+
+	result, ok, err := ParseQuakefile(input)
+	require.True(t, ok, "parsing should succeed")
+	require.NoError(t, err, "should not return error")
+
+	expected := makeQuakeFile()
+	expected.Tasks = []Task{
+		{
+			Name: "build",
+			Commands: []Command{
+				{Raw: "go build ./...", Elements: []CommandElement{
+					StringElement{Value: "go build ./..."},
+				}},
+				{Raw: "curl https://example.com/page#section", Elements: []CommandElement{
+					StringElement{Value: "curl https://example.com/page#section"},
+				}},
+				{Raw: "awk '{ print $1 } # not a comment' input.txt", Elements: []CommandElement{
+					StringElement{Value: "awk '{ print "},
+					VariableElement{Name: "1"},
+					StringElement{Value: " } # not a comment' input.txt"},
+				}},
+				{Raw: `echo "# quoted"`, Elements: []CommandElement{
+					StringElement{Value: "echo \"# quoted\""},
+				}},
+			},
+		},
+	}
+
+	require.Equal(t, expected, result)
+}
+
+func TestParseParallelBlock(t *testing.T) {
+	input := `task build {
+    echo start
+    parallel {
+        go build ./cmd/a
+        -go build ./cmd/b
+    }
+    parallel { echo "a;b"; echo c }
+    echo done
+}`
+
+	result, ok, err := ParseQuakefile(input)
+	require.True(t, ok, "parsing should succeed")
+	require.NoError(t, err, "should not return error")
+
+	commands := result.Tasks[0].Commands
+	require.Len(t, commands, 4)
+
+	require.Equal(t, []Command{
+		{Raw: "go build ./cmd/a", Elements: []CommandElement{StringElement{Value: "go build ./cmd/a"}}},
+		{Raw: "-go build ./cmd/b", Elements: []CommandElement{StringElement{Value: "go build ./cmd/b"}}, ContinueOnError: true},
+	}, commands[1].Parallel)
+
+	require.Equal(t, []Command{
+		{Raw: `echo "a;b"`, Elements: []CommandElement{StringElement{Value: `echo "a;b"`}}},
+		{Raw: "echo c", Elements: []CommandElement{StringElement{Value: "echo c"}}},
+	}, commands[2].Parallel)
+
+	require.Equal(t, `parallel { echo "a;b"; echo c }`, FormatCommand(commands[2]))
+}
+
+func TestParseEscapedDollar(t *testing.T) {
+	input := `task price {
+    echo "Price: \$5 $$ $COST"
+}`
+
+	result, ok, err := ParseQuakefile(input)
+	require.True(t, ok, "parsing should succeed")
+	require.NoError(t, err, "should not return error")
+
+	require.Equal(t, []CommandElement{
+		StringElement{Value: `echo "Price: \$5 \$ `},
+		VariableElement{Name: "COST"},
+		StringElement{Value: `"`},
+	}, result.Tasks[0].Commands[0].Elements)
+}
+
+func TestParseDollarSubstitution(t *testing.T) {
+	input := `task stamp {
+    echo $(echo $(date)) > $OUT
+    echo "$(printf '%s)' "(x")"
+    echo $((1 + 2))
+}`
+
+	result, ok, err := ParseQuakefile(input)
+	require.True(t, ok, "parsing should succeed")
+	require.NoError(t, err, "should not return error")
+
+	cmds := result.Tasks[0].Commands
+	require.Equal(t, []CommandElement{
+		StringElement{Value: "echo "},
+		BacktickElement{Command: "echo $(date)", Dollar: true},
+		StringElement{Value: " > "},
+		VariableElement{Name: "OUT"},
+	}, cmds[0].Elements)
+	require.Equal(t, []CommandElement{
+		StringElement{Value: `echo "`},
+		BacktickElement{Command: `printf '%s)' "(x"`, Dollar: true},
+		StringElement{Value: `"`},
+	}, cmds[1].Elements)
+
+	for i, line := range []string{
+		"echo $(echo $(date)) > $OUT",
+		`echo "$(printf '%s)' "(x")"`,
+		"echo $((1 + 2))",
+	} {
+		require.Equal(t, line, FormatCommand(cmds[i]))
+	}
+}
+
+func TestParseHeredoc(t *testing.T) {
+	input := `task config {
+    cat <<EOF > config.json
+    {"version": "$VERSION", "note": "don't"}
+    EOF
+    cat <<-'RAW'
+	$HOME stays }
+	RAW
+    echo done
+}`
+
+	result, ok, err := ParseQuakefile(input)
+	require.True(t, ok, "parsing should succeed")
+	require.NoError(t, err, "should not return error")
+
+	require.Equal(t, []Command{
+		{Raw: "cat <<EOF > config.json\n{\"version\": \"$VERSION\", \"note\": \"don't\"}\nEOF", Elements: []CommandElement{
+			StringElement{Value: "cat <<EOF > config.json\n    {\"version\": \""},
+			VariableElement{Name: "VERSION"},
+			StringElement{Value: "\", \"note\": \"don't\"}\nEOF"},
+		}},
+		{Raw: "cat <<-'RAW'\n\t$HOME stays }\n\tRAW", Elements: []CommandElement{
+			StringElement{Value: "cat <<-'RAW'\n\t$HOME stays }\nRAW"},
+		}},
+		{Raw: "echo done", Elements: []CommandElement{
+			StringElement{Value: "echo done"},
+		}},
+	}, result.Tasks[0].Commands)
+}
+
+func TestParseTaskEnvBlock(t *testing.T) {
+	input := `task test {
+    env { CGO_ENABLED = "1"; GOFLAGS = "-race" }
+    env {
+        GOOS = $TARGET_OS
+    }
+    go test ./...
+}
+
+task build {
+    env GOOS=linux go build
+}`
+
+	result, ok, err := ParseQuakefile(input)
+	require.True(t, ok, "parsing should succeed")
+	require.NoError(t, err, "should not return error")
+
+	require.Equal(t, map[string]string{
+		"CGO_ENABLED": `"1"`,
+		"GOFLAGS":     `"-race"`,
+		"GOOS":        "$TARGET_OS",
+	}, result.Tasks[0].Env)
+	require.Equal(t, []Command{
+		{Raw: "go test ./...", Elements: []CommandElement{StringElement{Value: "go test ./..."}}},
+	}, result.Tasks[0].Commands)
+
+	// The env command isn't an env block
+	require.Nil(t, result.Tasks[1].Env)
+	require.Len(t, result.Tasks[1].Commands, 1)
+}
+
+func TestParseAllowFailureBlock(t *testing.T) {
+	input := `task cleanup {
+    allow-failure {
+        docker rm old
+        strict {
+            echo must work
+        }
+        parallel {
+            rm -r a
+        }
+    }
+    allow-failure { docker rmi img; @echo done }
+    echo after
+}`
+
+	result, ok, err := ParseQuakefile(input)
+	require.True(t, ok, "parsing should succeed")
+	require.NoError(t, err, "should not return error")
+
+	commands := result.Tasks[0].Commands
+	require.Equal(t, []Command{
+		{Raw: "docker rm old", Elements: []CommandElement{StringElement{Value: "docker rm old"}}, ContinueOnError: true},
+		{Raw: "echo must work", Elements: []CommandElement{StringElement{Value: "echo must work"}}},
+		{Raw: "parallel {\n    rm -r a\n}", Elements: []CommandElement{}, Parallel: []Command{
+			{Raw: "rm -r a", Elements: []CommandElement{StringElement{Value: "rm -r a"}}, ContinueOnError: true},
+		}},
+		{Raw: "docker rmi img", Elements: []CommandElement{StringElement{Value: "docker rmi img"}}, ContinueOnError: true},
+		{Raw: "@echo done", Elements: []CommandElement{StringElement{Value: "echo done"}}, Silent: true, ContinueOnError: true},
+		{Raw: "echo after", Elements: []CommandElement{StringElement{Value: "echo after"}}},
+	}, commands)
+}
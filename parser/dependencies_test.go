@@ -21,7 +21,7 @@ func TestParseSingleDependency(t *testing.T) {
 				Name:         "build",
 				Dependencies: []string{"clean"},
 				Commands: []Command{
-					{Elements: []CommandElement{
+					{Raw: `echo "Building..."`, Elements: []CommandElement{
 						StringElement{Value: `echo "Building..."`},
 					}},
 				},
@@ -49,7 +49,7 @@ func TestParseMultipleDependencies(t *testing.T) {
 				Name:         "test",
 				Dependencies: []string{"compile", "test:prepare"},
 				Commands: []Command{
-					{Elements: []CommandElement{
+					{Raw: `echo "Running tests..."`, Elements: []CommandElement{
 						StringElement{Value: `echo "Running tests..."`},
 					}},
 				},
@@ -78,7 +78,7 @@ func TestParseTaskWithArgumentsAndDependencies(t *testing.T) {
 				Arguments:    []string{"env"},
 				Dependencies: []string{"build", "test"},
 				Commands: []Command{
-					{Elements: []CommandElement{
+					{Raw: `echo "Deploying to environment: $env"`, Elements: []CommandElement{
 						StringElement{Value: `echo "Deploying to environment: `},
 						VariableElement{Name: "env"},
 						StringElement{Value: `"`},
@@ -107,7 +107,7 @@ func TestParseNamespacedTaskNames(t *testing.T) {
 			{
 				Name: "docs:generate",
 				Commands: []Command{
-					{Elements: []CommandElement{
+					{Raw: `echo "Generating documentation..."`, Elements: []CommandElement{
 						StringElement{Value: `echo "Generating documentation..."`},
 					}},
 				},
@@ -135,7 +135,7 @@ func TestParseFileDependencies(t *testing.T) {
 				Name:         "output.txt",
 				Dependencies: []string{"input.txt"},
 				Commands: []Command{
-					{Elements: []CommandElement{
+					{Raw: `echo "Processing input.txt to create output.txt"`, Elements: []CommandElement{
 						StringElement{Value: `echo "Processing input.txt to create output.txt"`},
 					}},
 				},
@@ -170,7 +170,7 @@ task deploy => compile, assets:upload, db:migrate {
 			{
 				Name: "clean",
 				Commands: []Command{
-					{Elements: []CommandElement{
+					{Raw: `echo "Cleaning..."`, Elements: []CommandElement{
 						StringElement{Value: `echo "Cleaning..."`},
 					}},
 				},
@@ -179,7 +179,7 @@ task deploy => compile, assets:upload, db:migrate {
 				Name:         "compile",
 				Dependencies: []string{"clean"},
 				Commands: []Command{
-					{Elements: []CommandElement{
+					{Raw: `echo "Compiling..."`, Elements: []CommandElement{
 						StringElement{Value: `echo "Compiling..."`},
 					}},
 				},
@@ -188,7 +188,7 @@ task deploy => compile, assets:upload, db:migrate {
 				Name:         "deploy",
 				Dependencies: []string{"compile", "assets:upload", "db:migrate"},
 				Commands: []Command{
-					{Elements: []CommandElement{
+					{Raw: `echo "Deploying..."`, Elements: []CommandElement{
 						StringElement{Value: `echo "Deploying..."`},
 					}},
 				},
@@ -216,7 +216,7 @@ func TestParseDependenciesWithSpacing(t *testing.T) {
 				Name:         "deploy",
 				Dependencies: []string{"build", "test", "assets:upload"},
 				Commands: []Command{
-					{Elements: []CommandElement{
+					{Raw: `echo "Deploying with varied spacing..."`, Elements: []CommandElement{
 						StringElement{Value: `echo "Deploying with varied spacing..."`},
 					}},
 				},
@@ -250,7 +250,7 @@ task build {
 			{
 				Name: "build",
 				Commands: []Command{
-					{Elements: []CommandElement{
+					{Raw: `echo "Building..."`, Elements: []CommandElement{
 						StringElement{Value: `echo "Building..."`},
 					}},
 				},
@@ -22,7 +22,7 @@ task build {
 				Name:        "build",
 				Description: "Build the application",
 				Commands: []Command{
-					{Elements: []CommandElement{
+					{Raw: `echo "Building..."`, Elements: []CommandElement{
 						StringElement{Value: `echo "Building..."`},
 					}},
 				},
@@ -82,7 +82,7 @@ func TestParseTaskWithoutDocumentation(t *testing.T) {
 				Name:        "build",
 				Description: "", // No description
 				Commands: []Command{
-					{Elements: []CommandElement{
+					{Raw: `echo "Building..."`, Elements: []CommandElement{
 						StringElement{Value: `echo "Building..."`},
 					}},
 				},
@@ -177,3 +177,51 @@ task build {
 	require.Equal(t, "build", result.Tasks[0].Name)
 	require.Equal(t, "Task documentation", result.Tasks[0].Description)
 }
+
+func TestParseDescAttribute(t *testing.T) {
+	input := `# Leading comment
+task build {
+    desc "Build everything"
+    go build
+}
+
+task test(pkg) => build desc "Run the \"unit\" tests" {
+    go test $pkg
+}
+
+task all => build, test desc "Build and test"
+
+task lint { desc "Lint the code" }
+
+task deploy {
+    echo "desc is only special on the first line"
+    desc "not a description"
+}`
+
+	result, ok, err := ParseQuakefile(input)
+	require.True(t, ok, "parsing should succeed")
+	require.NoError(t, err, "should not return error")
+	require.Len(t, result.Tasks, 5)
+
+	build := result.Tasks[0]
+	require.Equal(t, "Build everything", build.Description, "desc takes precedence over a leading comment")
+	require.Len(t, build.Commands, 1)
+	require.Equal(t, "go build", build.Commands[0].Raw)
+
+	test := result.Tasks[1]
+	require.Equal(t, `Run the "unit" tests`, test.Description)
+	require.Equal(t, []string{"pkg"}, test.Arguments)
+	require.Equal(t, []string{"build"}, test.Dependencies)
+
+	all := result.Tasks[2]
+	require.Equal(t, "Build and test", all.Description)
+	require.Equal(t, []string{"build", "test"}, all.Dependencies)
+
+	lint := result.Tasks[3]
+	require.Equal(t, "Lint the code", lint.Description)
+	require.Empty(t, lint.Commands)
+
+	deploy := result.Tasks[4]
+	require.Empty(t, deploy.Description)
+	require.Len(t, deploy.Commands, 2)
+}
@@ -16,7 +16,7 @@ func TestParseExpressionsInCommands(t *testing.T) {
 			name:  "simple expression in command",
 			input: `task test { echo {{target}} }`,
 			expected: []Command{
-				{Elements: []CommandElement{
+				{Raw: "echo {{target}}", Elements: []CommandElement{
 					StringElement{Value: "echo "},
 					ExpressionElement{Expression: Identifier{Name: "target"}},
 				}},
@@ -26,7 +26,7 @@ func TestParseExpressionsInCommands(t *testing.T) {
 			name:  "access expression in command",
 			input: `task deploy { echo "API: {{env.API_KEY}}" }`,
 			expected: []Command{
-				{Elements: []CommandElement{
+				{Raw: `echo "API: {{env.API_KEY}}"`, Elements: []CommandElement{
 					StringElement{Value: "echo \"API: "},
 					ExpressionElement{Expression: AccessId{
 						Object:   Identifier{Name: "env"},
@@ -40,7 +40,7 @@ func TestParseExpressionsInCommands(t *testing.T) {
 			name:  "or expression in command",
 			input: `task build { make {{target || "release"}} }`,
 			expected: []Command{
-				{Elements: []CommandElement{
+				{Raw: `make {{target || "release"}}`, Elements: []CommandElement{
 					StringElement{Value: "make "},
 					ExpressionElement{Expression: Or{
 						Left:  Identifier{Name: "target"},
@@ -53,7 +53,7 @@ func TestParseExpressionsInCommands(t *testing.T) {
 			name:  "complex expression in command",
 			input: `task deploy { deploy --env={{env.DEPLOY_ENV || "development"}} }`,
 			expected: []Command{
-				{Elements: []CommandElement{
+				{Raw: `deploy --env={{env.DEPLOY_ENV || "development"}}`, Elements: []CommandElement{
 					StringElement{Value: "deploy --env="},
 					ExpressionElement{Expression: Or{
 						Left:  AccessId{Object: Identifier{Name: "env"}, Property: "DEPLOY_ENV"},
@@ -66,7 +66,7 @@ func TestParseExpressionsInCommands(t *testing.T) {
 			name:  "multiple expressions in command",
 			input: `task info { echo "{{app}} v{{version}}" }`,
 			expected: []Command{
-				{Elements: []CommandElement{
+				{Raw: `echo "{{app}} v{{version}}"`, Elements: []CommandElement{
 					StringElement{Value: "echo \""},
 					ExpressionElement{Expression: Identifier{Name: "app"}},
 					StringElement{Value: " v"},
@@ -98,7 +98,7 @@ func TestParseExpressionsWithSpacing(t *testing.T) {
 	require.NoError(t, err, "should not return error")
 
 	expected := []Command{
-		{Elements: []CommandElement{
+		{Raw: `echo {{ env.API_KEY || "default" }}`, Elements: []CommandElement{
 			StringElement{Value: "echo "},
 			ExpressionElement{Expression: Or{
 				Left:  AccessId{Object: Identifier{Name: "env"}, Property: "API_KEY"},
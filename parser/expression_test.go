@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"encoding/json"
 	"testing"
 
 	p "github.com/lab47/peggysue"
@@ -44,6 +45,96 @@ func TestParseExpressions(t *testing.T) {
 				Right: StringLiteral{Value: "development"},
 			},
 		},
+		{
+			name:     "number literal",
+			input:    "3",
+			expected: NumberLiteral{Value: 3},
+		},
+		{
+			name:     "negative decimal literal",
+			input:    "-2.5",
+			expected: NumberLiteral{Value: -2.5},
+		},
+		{
+			name:     "bool literal",
+			input:    "true",
+			expected: BoolLiteral{Value: true},
+		},
+		{
+			name:     "identifier starting with a bool keyword",
+			input:    "falsey",
+			expected: Identifier{Name: "falsey"},
+		},
+		{
+			name:  "numeric comparison",
+			input: "replicas > 3",
+			expected: Compare{
+				Op:    ">",
+				Left:  Identifier{Name: "replicas"},
+				Right: NumberLiteral{Value: 3},
+			},
+		},
+		{
+			name:  "bool comparison",
+			input: "enabled==true",
+			expected: Compare{
+				Op:    "==",
+				Left:  Identifier{Name: "enabled"},
+				Right: BoolLiteral{Value: true},
+			},
+		},
+		{
+			name:  "and binds tighter than or",
+			input: `a && b >= 2 || "none"`,
+			expected: Or{
+				Left: And{
+					Left:  Identifier{Name: "a"},
+					Right: Compare{Op: ">=", Left: Identifier{Name: "b"}, Right: NumberLiteral{Value: 2}},
+				},
+				Right: StringLiteral{Value: "none"},
+			},
+		},
+		{
+			name:  "concatenation",
+			input: `prefix + "-" + suffix`,
+			expected: Concat{
+				Left:  Concat{Left: Identifier{Name: "prefix"}, Right: StringLiteral{Value: "-"}},
+				Right: Identifier{Name: "suffix"},
+			},
+		},
+		{
+			name:  "concatenation binds tighter than comparisons and or",
+			input: `tag+"-rc" == env.TAG || task("version") + ".dev"`,
+			expected: Or{
+				Left: Compare{
+					Op:    "==",
+					Left:  Concat{Left: Identifier{Name: "tag"}, Right: StringLiteral{Value: "-rc"}},
+					Right: AccessId{Object: Identifier{Name: "env"}, Property: "TAG"},
+				},
+				Right: Concat{
+					Left:  FuncCall{Name: "task", Args: []Expression{StringLiteral{Value: "version"}}},
+					Right: StringLiteral{Value: ".dev"},
+				},
+			},
+		},
+		{
+			name:     "function call",
+			input:    `task("version")`,
+			expected: FuncCall{Name: "task", Args: []Expression{StringLiteral{Value: "version"}}},
+		},
+		{
+			name:  "function call with fallback",
+			input: `f( name, 2 ) || g()`,
+			expected: Or{
+				Left:  FuncCall{Name: "f", Args: []Expression{Identifier{Name: "name"}, NumberLiteral{Value: 2}}},
+				Right: FuncCall{Name: "g", Args: []Expression{}},
+			},
+		},
+		{
+			name:     "method-style call",
+			input:    `env.require("API_KEY")`,
+			expected: FuncCall{Name: "env.require", Args: []Expression{StringLiteral{Value: "API_KEY"}}},
+		},
 	}
 
 	for _, tt := range tests {
@@ -59,3 +150,11 @@ func TestParseExpressions(t *testing.T) {
 		})
 	}
 }
+
+func TestMarshalConcat(t *testing.T) {
+	expr := Concat{Left: Identifier{Name: "image"}, Right: StringLiteral{Value: ":latest"}}
+	data, err := json.Marshal(Variable{Name: "TAG", Value: expr, IsExpression: true})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name": "TAG", "is_expression": true, "value": {"type": "concat", "left": {"type": "identifier", "name": "image"}, "right": {"type": "string", "value": ":latest"}}}`, string(data))
+	require.Equal(t, `image + ":latest"`, FormatExpression(expr))
+}
@@ -0,0 +1,100 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FormatCommand renders a command back into Quakefile syntax, without
+// substituting variables or expressions
+func FormatCommand(cmd Command) string {
+	var b strings.Builder
+	if cmd.Condition != nil {
+		b.WriteString("if {{" + FormatExpression(cmd.Condition) + "}}: ")
+	}
+	if cmd.Quiet {
+		b.WriteString("@@")
+	} else if cmd.Silent {
+		b.WriteString("@")
+	}
+	if cmd.ContinueOnError {
+		b.WriteString("-")
+	}
+
+	if len(cmd.Parallel) > 0 {
+		parts := make([]string, len(cmd.Parallel))
+		for i, inner := range cmd.Parallel {
+			parts[i] = FormatCommand(inner)
+		}
+		fmt.Fprintf(&b, "parallel { %s }", strings.Join(parts, "; "))
+		return b.String()
+	}
+
+	if cmd.Set != nil {
+		op := "="
+		if cmd.Set.Append {
+			op = "+="
+		}
+		fmt.Fprintf(&b, "set %s %s %s", cmd.Set.Name, op, FormatVariableValue(*cmd.Set))
+		return b.String()
+	}
+
+	for _, elem := range cmd.Elements {
+		switch el := elem.(type) {
+		case StringElement:
+			b.WriteString(el.Value)
+		case VariableElement:
+			b.WriteString("$" + el.Name)
+		case BacktickElement:
+			b.WriteString(el.Source())
+		case ExpressionElement:
+			b.WriteString("{{" + FormatExpression(el.Expression) + "}}")
+		}
+	}
+	return b.String()
+}
+
+// FormatVariableValue renders a variable's value as it appears in a Quakefile
+func FormatVariableValue(v Variable) string {
+	switch val := v.Value.(type) {
+	case Expression:
+		return "{{" + FormatExpression(val) + "}}"
+	case BacktickElement:
+		return "`" + val.Command + "`"
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+// FormatExpression renders an expression in {{...}} syntax
+func FormatExpression(expr Expression) string {
+	switch e := expr.(type) {
+	case Identifier:
+		return e.Name
+	case AccessId:
+		return FormatExpression(e.Object) + "." + e.Property
+	case StringLiteral:
+		return strconv.Quote(e.Value)
+	case NumberLiteral:
+		return strconv.FormatFloat(e.Value, 'f', -1, 64)
+	case BoolLiteral:
+		return strconv.FormatBool(e.Value)
+	case Or:
+		return FormatExpression(e.Left) + " || " + FormatExpression(e.Right)
+	case And:
+		return FormatExpression(e.Left) + " && " + FormatExpression(e.Right)
+	case Concat:
+		return FormatExpression(e.Left) + " + " + FormatExpression(e.Right)
+	case Compare:
+		return FormatExpression(e.Left) + " " + e.Op + " " + FormatExpression(e.Right)
+	case FuncCall:
+		args := make([]string, len(e.Args))
+		for i, arg := range e.Args {
+			args[i] = FormatExpression(arg)
+		}
+		return e.Name + "(" + strings.Join(args, ", ") + ")"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,52 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// frontMatterDelimiter opens and closes the front matter block
+const frontMatterDelimiter = "---"
+
+// frontMatter splits the settings of a front matter block off the start of a
+// Quakefile:
+//
+//	---
+//	shell: bash -eu
+//	color: never
+//	---
+//
+// Settings are key: value pairs; blank lines and # comments are skipped. The
+// block is blanked out of the returned input, so the offsets and line numbers
+// of what follows don't change.
+func frontMatter(input string) (map[string]string, string, error) {
+	lines := strings.Split(input, "\n")
+	if strings.TrimRight(lines[0], " \t\r") != frontMatterDelimiter {
+		return nil, input, nil
+	}
+
+	config := make(map[string]string)
+	for i := 1; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == frontMatterDelimiter {
+			for j := 0; j <= i; j++ {
+				lines[j] = strings.Repeat(" ", len(lines[j]))
+			}
+			return config, strings.Join(lines, "\n"), nil
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, input, fmt.Errorf("invalid front matter on line %d: expected key: value", i+1)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		config[strings.TrimSpace(key)] = value
+	}
+	return nil, input, fmt.Errorf("front matter isn't closed with %s", frontMatterDelimiter)
+}
@@ -58,7 +58,7 @@ func TestParseHelloTask(t *testing.T) {
 			{
 				Name: "hello",
 				Commands: []Command{
-					{Elements: []CommandElement{
+					{Raw: `echo "Hello, World!"`, Elements: []CommandElement{
 						StringElement{Value: "echo \"Hello, World!\""},
 					}},
 				},
@@ -88,12 +88,12 @@ func TestParseGreetPersonTask(t *testing.T) {
 				Name:      "greet_person",
 				Arguments: []string{"name"},
 				Commands: []Command{
-					{Elements: []CommandElement{
+					{Raw: `echo "Hello, $name!"`, Elements: []CommandElement{
 						StringElement{Value: "echo \"Hello, "},
 						VariableElement{Name: "name"},
 						StringElement{Value: "!\""},
 					}},
-					{Elements: []CommandElement{
+					{Raw: `echo "Nice to meet you"`, Elements: []CommandElement{
 						StringElement{Value: "echo \"Nice to meet you\""},
 					}},
 				},
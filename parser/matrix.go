@@ -0,0 +1,76 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Matrix represents a matrix block, whose tasks are generated once for every
+// combination of its axes' values
+type Matrix struct {
+	Axes []MatrixAxis
+	Body string // Source of the tasks, with {{name}} placeholders
+}
+
+// MatrixAxis is one variable of a matrix, like os = [linux, darwin]
+type MatrixAxis struct {
+	Name   string
+	Values []string
+}
+
+// expandMatrices adds the tasks and namespaces generated by each matrix block
+// to the Quakefile
+func expandMatrices(qf *QuakeFile) error {
+	for _, m := range qf.matrices {
+		seen := make(map[string]bool)
+		for _, axis := range m.Axes {
+			if seen[axis.Name] {
+				return fmt.Errorf("matrix variable '%s' is declared more than once", axis.Name)
+			}
+			seen[axis.Name] = true
+		}
+
+		for _, combination := range m.combinations() {
+			body := m.Body
+			for i, axis := range m.Axes {
+				placeholder := regexp.MustCompile(`\{\{\s*` + axis.Name + `\s*\}\}`)
+				body = placeholder.ReplaceAllLiteralString(body, combination[i])
+			}
+
+			expanded, ok, err := ParseQuakefile(body)
+			if !ok || err != nil {
+				return fmt.Errorf("failed to parse matrix body for %s: %w", m.describe(combination), err)
+			}
+			qf.Tasks = append(qf.Tasks, expanded.Tasks...)
+			qf.Namespaces = append(qf.Namespaces, expanded.Namespaces...)
+		}
+	}
+	qf.matrices = nil
+	return nil
+}
+
+// combinations returns every combination of the axes' values, varying the
+// last axis fastest
+func (m Matrix) combinations() [][]string {
+	result := [][]string{{}}
+	for _, axis := range m.Axes {
+		var next [][]string
+		for _, prefix := range result {
+			for _, value := range axis.Values {
+				next = append(next, append(append([]string{}, prefix...), value))
+			}
+		}
+		result = next
+	}
+	return result
+}
+
+// describe formats a combination like os=linux, arch=amd64
+func (m Matrix) describe(combination []string) string {
+	parts := make([]string, len(m.Axes))
+	for i, axis := range m.Axes {
+		parts[i] = axis.Name + "=" + combination[i]
+	}
+	return strings.Join(parts, ", ")
+}
@@ -1,6 +1,10 @@
 package parser
 
 import (
+	"fmt"
+	"maps"
+	"regexp"
+	"strconv"
 	"strings"
 
 	p "github.com/lab47/peggysue"
@@ -12,15 +16,23 @@ type Grammar struct {
 	topLevelElement        p.Rule
 	comment                p.Rule
 	fileNamespaceDirective p.Rule
+	loadDirective          p.Rule
+	onErrorDirective       p.Rule
+	onMissingDirective     p.Rule
+	goTasksBlock           p.Rule
+	matrix                 p.Rule
 	variable               p.Rule
+	exportedVariable       p.Rule
 	multilineStringVar     p.Rule
 	simpleVariable         p.Rule
 	variableValue          p.Rule
+	singleQuotedString     p.Rule
 	commandSubstitution    p.Rule
 	expressionValue        p.Rule
 	quotedString           p.Rule
 	task                   p.Rule
 	taskSimple             p.Rule
+	taskOneLine            p.Rule
 	taskWithArgs           p.Rule
 	taskWithDeps           p.Rule
 	taskWithArgsAndDeps    p.Rule
@@ -31,6 +43,8 @@ type Grammar struct {
 	argList                p.Rule
 	dependencies           p.Rule
 	word                   p.Rule
+	taskName               p.Rule
+	taskDesc               p.Rule
 	ws                     p.Rule
 	requiredSpace          p.Rule
 	content                p.Rule
@@ -41,15 +55,23 @@ type Grammar struct {
 	commandElements   p.Rule
 	plainText         p.Rule
 	backtickCmd       p.Rule
+	dollarCmd         p.Rule
 	variableRef       p.Rule
 	expressionElement p.Rule
+	commandCondition  p.Rule
 	// Expression parsing rules
 	expr          p.Rule
 	orExpr        p.Rule
+	andExpr       p.Rule
+	compareExpr   p.Rule
+	concatExpr    p.Rule
 	primaryExpr   p.Rule
+	funcCall      p.Rule
 	accessExpr    p.Rule
 	identifier    p.Rule
 	stringLiteral p.Rule
+	numberLiteral p.Rule
+	boolLiteral   p.Rule
 }
 
 // NewGrammar creates and initializes a new grammar
@@ -65,6 +87,7 @@ func (g *Grammar) init() {
 	namespaceRef := p.R("namespace")
 	g.namespaceRef = namespaceRef
 	balancedRef := p.R("balancedContent")
+	parenRef := p.R("parenContent")
 
 	// Define basic rules
 	g.ws = p.Star(p.Or(
@@ -97,6 +120,8 @@ func (g *Grammar) init() {
 
 	// Define content parsing with balanced braces
 	balancedRule := p.Star(p.Or(
+		// Heredoc, whose body may hold anything up to its terminator line
+		p.Scan(scanHeredoc),
 		// Double quoted string
 		p.Seq(
 			p.S("\""),
@@ -236,8 +261,82 @@ func (g *Grammar) init() {
 		),
 	)
 
-	// Primary expression: identifier or string literal
-	g.primaryExpr = p.Or(g.identifier, g.stringLiteral)
+	// Number literal: 3, -1, 2.5
+	g.numberLiteral = p.Transform(
+		p.Seq(
+			p.Maybe(p.S("-")),
+			p.Plus(p.Range('0', '9')),
+			p.Maybe(p.Seq(p.S("."), p.Plus(p.Range('0', '9')))),
+			// Not fails at end of input, so check for that explicitly
+			p.Or(p.EOS(), p.Not(p.Or(p.Range('a', 'z'), p.Range('A', 'Z'), p.S("_")))),
+		),
+		func(s string) any {
+			n, _ := strconv.ParseFloat(s, 64)
+			return NumberLiteral{Value: n}
+		},
+	)
+
+	// Bool literal: true or false (but not identifiers like trueish)
+	g.boolLiteral = p.Transform(
+		p.Seq(
+			p.Or(p.S("true"), p.S("false")),
+			p.Or(p.EOS(), p.Not(p.Or(
+				p.Range('a', 'z'),
+				p.Range('A', 'Z'),
+				p.Range('0', '9'),
+				p.S("_"),
+			))),
+		),
+		func(s string) any {
+			return BoolLiteral{Value: s == "true"}
+		},
+	)
+
+	// Function call: name(arg, ...) where each argument is a literal or
+	// identifier. The name can be dotted, like env.require("API_KEY").
+	funcName := p.Transform(
+		p.Seq(g.identifier, p.Star(p.Seq(p.S("."), g.identifier))),
+		func(s string) any { return s },
+	)
+	funcArg := p.Or(g.boolLiteral, g.numberLiteral, g.identifier, g.stringLiteral)
+	argSep := p.Seq(p.Star(p.Or(p.S(" "), p.S("\t"))), p.S(","), p.Star(p.Or(p.S(" "), p.S("\t"))))
+	g.funcCall = p.Action(
+		p.Seq(
+			p.Named("name", funcName),
+			p.S("("),
+			p.Star(p.Or(p.S(" "), p.S("\t"))),
+			p.Named("args", p.Many(p.Action(
+				p.Seq(
+					p.Named("first", funcArg),
+					p.Named("rest", p.Many(p.Action(
+						p.Seq(argSep, p.Named("arg", funcArg)),
+						func(v p.Values) any { return v.Get("arg") },
+					), 0, -1, func(values []any) any { return values })),
+				),
+				func(v p.Values) any {
+					args := []Expression{v.Get("first").(Expression)}
+					if rest, ok := v.Get("rest").([]any); ok {
+						for _, arg := range rest {
+							args = append(args, arg.(Expression))
+						}
+					}
+					return args
+				},
+			), 0, 1, func(values []any) any { return values })),
+			p.Star(p.Or(p.S(" "), p.S("\t"))),
+			p.S(")"),
+		),
+		func(v p.Values) any {
+			call := FuncCall{Name: v.Get("name").(string), Args: []Expression{}}
+			if args, ok := v.Get("args").([]any); ok && len(args) == 1 {
+				call.Args = args[0].([]Expression)
+			}
+			return call
+		},
+	)
+
+	// Primary expression: literal, function call or identifier
+	g.primaryExpr = p.Or(g.boolLiteral, g.numberLiteral, g.funcCall, g.identifier, g.stringLiteral)
 
 	// Access expression: obj.prop (left-associative)
 	g.accessExpr = p.Action(
@@ -273,16 +372,111 @@ func (g *Grammar) init() {
 		},
 	)
 
+	// Concatenation expression: expr + expr (left-associative, binds tighter
+	// than comparisons)
+	g.concatExpr = p.Action(
+		p.Seq(
+			p.Named("left", g.accessExpr),
+			p.Named("rights", p.Many(p.Action(
+				p.Seq(
+					p.Star(p.Or(p.S(" "), p.S("\t"))),
+					p.S("+"),
+					p.Star(p.Or(p.S(" "), p.S("\t"))),
+					p.Named("right", g.accessExpr),
+				),
+				func(v p.Values) any {
+					return v.Get("right")
+				},
+			), 0, -1, func(values []any) any {
+				return values
+			})),
+		),
+		func(v p.Values) any {
+			result := v.Get("left").(Expression)
+			if rightList, ok := v.Get("rights").([]any); ok {
+				for _, right := range rightList {
+					if rightExpr, ok := right.(Expression); ok {
+						result = Concat{Left: result, Right: rightExpr}
+					}
+				}
+			}
+			return result
+		},
+	)
+
+	// Comparison expression: expr == expr, expr < expr, ... (not chainable)
+	g.compareExpr = p.Action(
+		p.Seq(
+			p.Named("left", g.concatExpr),
+			p.Named("rest", p.Many(p.Action(
+				p.Seq(
+					p.Star(p.Or(p.S(" "), p.S("\t"))),
+					p.Named("op", p.Transform(
+						p.Or(p.S("=="), p.S("!="), p.S("<="), p.S(">="), p.S("<"), p.S(">")),
+						func(s string) any { return s },
+					)),
+					p.Star(p.Or(p.S(" "), p.S("\t"))),
+					p.Named("right", g.concatExpr),
+				),
+				func(v p.Values) any {
+					return Compare{Op: v.Get("op").(string), Right: v.Get("right").(Expression)}
+				},
+			), 0, 1, func(values []any) any {
+				return values
+			})),
+		),
+		func(v p.Values) any {
+			left := v.Get("left").(Expression)
+			if rest, ok := v.Get("rest").([]any); ok && len(rest) == 1 {
+				cmp := rest[0].(Compare)
+				cmp.Left = left
+				return cmp
+			}
+			return left
+		},
+	)
+
+	// And expression: expr && expr (left-associative, binds tighter than ||)
+	g.andExpr = p.Action(
+		p.Seq(
+			p.Named("left", g.compareExpr),
+			p.Named("rights", p.Many(p.Action(
+				p.Seq(
+					p.Star(p.Or(p.S(" "), p.S("\t"))),
+					p.S("&&"),
+					p.Star(p.Or(p.S(" "), p.S("\t"))),
+					p.Named("right", g.compareExpr),
+				),
+				func(v p.Values) any {
+					return v.Get("right")
+				},
+			), 0, -1, func(values []any) any {
+				return values
+			})),
+		),
+		func(v p.Values) any {
+			result := v.Get("left").(Expression)
+			if rightList, ok := v.Get("rights").([]any); ok {
+				for _, right := range rightList {
+					if rightExpr, ok := right.(Expression); ok {
+						result = And{Left: result, Right: rightExpr}
+					}
+				}
+			}
+			return result
+		},
+	)
+
 	// Or expression: expr || expr (left-associative)
 	g.orExpr = p.Action(
 		p.Seq(
-			p.Named("left", g.accessExpr),
+			p.Named("left", g.andExpr),
 			p.Named("rights", p.Many(p.Action(
 				p.Seq(
 					p.Star(p.Or(p.S(" "), p.S("\t"))),
 					p.S("||"),
 					p.Star(p.Or(p.S(" "), p.S("\t"))),
-					p.Named("right", g.accessExpr),
+					p.Named("right", g.andExpr),
 				),
 				func(v p.Values) any {
 					return v.Get("right")
@@ -326,6 +520,190 @@ func (g *Grammar) init() {
 		func(s string) any { return s },
 	)
 
+	// Load directive: load "tasks/**/*.quake", or a URL pinned to a checksum
+	// with load "https://example.com/common.quake" sha256 "...". include is
+	// another spelling, read better for a single file.
+	loadChecksum := p.Action(
+		p.Seq(
+			g.requiredSpace,
+			p.S("sha256"),
+			g.requiredSpace,
+			p.Named("sum", g.quotedString),
+		),
+		func(v p.Values) any {
+			sum := v.Get("sum").(string)
+			return sum[1 : len(sum)-1]
+		},
+	)
+	g.loadDirective = p.Action(
+		p.Seq(
+			p.Or(p.S("load"), p.S("include")),
+			g.requiredSpace,
+			p.Named("pattern", g.quotedString),
+			p.Named("sha256", p.Maybe(loadChecksum)),
+			p.Star(p.Or(p.S(" "), p.S("\t"))),
+			p.Or(p.S("\n"), p.EOS()),
+		),
+		func(v p.Values) any {
+			pattern := v.Get("pattern").(string)
+			directive := LoadDirective{Pattern: pattern[1 : len(pattern)-1]}
+			if sum, ok := v.Get("sha256").(string); ok {
+				directive.SHA256 = sum
+			}
+			return directive
+		},
+	)
+
+	// On-error directive: onerror cleanup
+	g.onErrorDirective = p.Action(
+		p.Seq(
+			p.S("onerror"),
+			g.requiredSpace,
+			p.Named("task", g.word),
+			p.Star(p.Or(p.S(" "), p.S("\t"))),
+			p.Or(p.S("\n"), p.EOS()),
+		),
+		func(v p.Values) any {
+			return OnErrorDirective{Task: v.Get("task").(string)}
+		},
+	)
+
+	// On-missing directive: on_missing passthrough
+	g.onMissingDirective = p.Action(
+		p.Seq(
+			p.S("on_missing"),
+			g.requiredSpace,
+			p.Named("mode", g.word),
+			p.Star(p.Or(p.S(" "), p.S("\t"))),
+			p.Or(p.S("\n"), p.EOS()),
+		),
+		func(v p.Values) any {
+			return OnMissingDirective{Mode: v.Get("mode").(string)}
+		},
+	)
+
+	// Go tasks configuration: gotasks { tags = "integration"; flags = "-race" }
+	goTasksSetting := p.Action(
+		p.Seq(
+			g.ws,
+			p.Named("name", g.identifier),
+			p.Star(p.Or(p.S(" "), p.S("\t"))),
+			p.S("="),
+			p.Star(p.Or(p.S(" "), p.S("\t"))),
+			p.Named("value", g.quotedString),
+			p.Star(p.Or(p.S(" "), p.S("\t"))),
+			p.Maybe(p.S(";")),
+		),
+		func(v p.Values) any {
+			value := v.Get("value").(string)
+			return Variable{Name: v.Get("name").(Identifier).Name, Value: value[1 : len(value)-1]}
+		},
+	)
+	g.goTasksBlock = p.Action(
+		p.Seq(
+			p.S("gotasks"),
+			p.Star(p.Or(p.S(" "), p.S("\t"))),
+			p.S("{"),
+			p.Named("settings", p.Many(goTasksSetting, 0, -1, func(values []any) any { return values })),
+			g.ws,
+			p.S("}"),
+			p.Star(p.Or(p.S(" "), p.S("\t"))),
+			p.Or(p.S("\n"), p.EOS()),
+		),
+		func(v p.Values) any {
+			config := GoTasksConfig{}
+			settings, _ := v.Get("settings").([]any)
+			for _, setting := range settings {
+				setting := setting.(Variable)
+				value := setting.Value.(string)
+				switch setting.Name {
+				case "tags":
+					config.Tags = value
+				case "flags":
+					config.Flags = value
+				default:
+					if config.Env == nil {
+						config.Env = make(map[string]string)
+					}
+					config.Env[setting.Name] = value
+				}
+			}
+			return config
+		},
+	)
+
+	// Matrix block: matrix os = [linux, darwin], arch = [amd64, arm64] { tasks }
+	// The body is kept as text and expanded once per combination after parsing.
+	matrixValue := p.Action(
+		p.Seq(
+			g.ws,
+			p.Named("value", p.Or(g.quotedString, g.word)),
+			g.ws,
+		),
+		func(v p.Values) any {
+			value := v.Get("value").(string)
+			if strings.HasPrefix(value, "\"") {
+				value = value[1 : len(value)-1]
+			}
+			return value
+		},
+	)
+	matrixAxis := p.Action(
+		p.Seq(
+			g.ws,
+			p.Named("name", g.identifier),
+			g.ws,
+			p.S("="),
+			g.ws,
+			p.S("["),
+			p.Named("first", matrixValue),
+			p.Named("rest", p.Many(p.Action(
+				p.Seq(p.S(","), p.Named("value", matrixValue)),
+				func(v p.Values) any { return v.Get("value") },
+			), 0, -1, func(values []any) any { return values })),
+			p.S("]"),
+			g.ws,
+		),
+		func(v p.Values) any {
+			axis := MatrixAxis{
+				Name:   v.Get("name").(Identifier).Name,
+				Values: []string{v.Get("first").(string)},
+			}
+			if rest, ok := v.Get("rest").([]any); ok {
+				for _, value := range rest {
+					axis.Values = append(axis.Values, value.(string))
+				}
+			}
+			return axis
+		},
+	)
+	g.matrix = p.Action(
+		p.Seq(
+			p.S("matrix"),
+			g.requiredSpace,
+			p.Named("first", matrixAxis),
+			p.Named("rest", p.Many(p.Action(
+				p.Seq(p.S(","), p.Named("axis", matrixAxis)),
+				func(v p.Values) any { return v.Get("axis") },
+			), 0, -1, func(values []any) any { return values })),
+			p.S("{"),
+			p.Named("body", g.content),
+			p.S("}"),
+			p.Star(p.Or(p.S(" "), p.S("\t"))),
+			p.Or(p.S("\n"), p.EOS()),
+		),
+		func(v p.Values) any {
+			m := Matrix{Axes: []MatrixAxis{v.Get("first").(MatrixAxis)}}
+			if rest, ok := v.Get("rest").([]any); ok {
+				for _, axis := range rest {
+					m.Axes = append(m.Axes, axis.(MatrixAxis))
+				}
+			}
+			m.Body = v.Get("body").(string)
+			return m
+		},
+	)
+
 	g.commandSubstitution = p.Action(
 		p.Seq(
 			p.S("`"),
@@ -357,10 +735,34 @@ func (g *Grammar) init() {
 		},
 	)
 
+	// Single-quoted string: no escapes or interpolation, like the shell
+	g.singleQuotedString = p.Transform(
+		p.Seq(
+			p.S("'"),
+			p.Star(p.Seq(p.Not(p.S("'")), p.Any())),
+			p.S("'"),
+		),
+		func(s string) any { return s },
+	)
+
+	// A function call needs no {{ }} as a variable's whole value, like
+	// TOKEN = file("secrets/token")
+	funcCallValue := p.Action(
+		p.Named("call", g.funcCall),
+		func(v p.Values) any {
+			return Variable{
+				Value:        v.Get("call").(Expression),
+				IsExpression: true,
+			}
+		},
+	)
+
 	g.variableValue = p.Or(
 		g.commandSubstitution,
 		g.expressionValue,
+		funcCallValue,
 		g.quotedString,
+		g.singleQuotedString,
 	)
 
 	g.multilineStringVar = p.Action(
@@ -391,11 +793,12 @@ func (g *Grammar) init() {
 		},
 	)
 
+	// NAME = value, or NAME += value to append to an earlier definition
 	g.simpleVariable = p.Action(
 		p.Seq(
 			p.Named("name", g.word),
 			p.Star(p.Or(p.S(" "), p.S("\t"))),
-			p.S("="),
+			p.Named("op", p.Transform(p.Or(p.S("+="), p.S("=")), func(s string) any { return s })),
 			p.Star(p.Or(p.S(" "), p.S("\t"))),
 			p.Named("value", g.variableValue),
 			p.Star(p.Or(p.S(" "), p.S("\t"))),
@@ -403,38 +806,73 @@ func (g *Grammar) init() {
 		),
 		func(v p.Values) any {
 			value := v.Get("value")
+			appending := v.Get("op").(string) == "+="
 			switch val := value.(type) {
 			case Variable:
 				val.Name = v.Get("name").(string)
+				val.Append = appending
 				return val
 			default:
 				return Variable{
-					Name:  v.Get("name").(string),
-					Value: val.(string),
+					Name:   v.Get("name").(string),
+					Value:  val.(string),
+					Append: appending,
 				}
 			}
 		},
 	)
 
+	// Exported variable: export NAME = value
+	g.exportedVariable = p.Action(
+		p.Seq(
+			p.S("export"),
+			g.requiredSpace,
+			p.Named("variable", p.Or(
+				g.multilineStringVar,
+				g.simpleVariable,
+			)),
+		),
+		func(v p.Values) any {
+			variable := v.Get("variable").(Variable)
+			variable.Exported = true
+			return variable
+		},
+	)
+
 	g.variable = p.Or(
+		g.exportedVariable,
 		g.multilineStringVar,
 		g.simpleVariable,
 	)
 
 	// Define argument and dependency parsing
+	// Argument list, which can hold a type like enum(a,b) for an argument
 	g.argList = p.Transform(
-		p.Star(p.Seq(
-			p.Not(p.S(")")),
-			p.Any(),
+		p.Star(p.Or(
+			p.Seq(p.S("("), p.Star(p.Seq(p.Not(p.S(")")), p.Any())), p.S(")")),
+			p.Seq(p.Not(p.S(")")), p.Any()),
 		)),
 		func(s string) any {
-			return parseArgumentsFromString(s)
+			return parseTaskParams(s)
+		},
+	)
+
+	// Description clause in a task header: task build desc "Build it" {
+	g.taskDesc = p.Action(
+		p.Seq(
+			g.requiredSpace,
+			p.S("desc"),
+			g.requiredSpace,
+			p.Named("text", g.quotedString),
+		),
+		func(v p.Values) any {
+			return unquoteDescription(v.Get("text").(string))
 		},
 	)
 
 	g.dependencies = p.Transform(
 		p.Star(p.Seq(
-			p.Not(p.Or(p.S("{"), p.S("\n"))),
+			p.Not(p.Or(p.S("{"), p.S("\n"), g.taskDesc)),
 			p.Any(),
 		)),
 		func(s string) any {
@@ -443,11 +881,30 @@ func (g *Grammar) init() {
 	)
 
 	// Define task parsing rules
+	// Task name: a word, or quoted to hold any characters, like "build:prod"
+	// as a literal name rather than a namespaced one
+	g.taskName = p.Or(
+		p.Action(
+			p.Seq(
+				p.S("\""),
+				p.Named("name", p.Transform(
+					p.Plus(p.Seq(p.Not(p.Or(p.S("\""), p.S("\n"))), p.Any())),
+					func(s string) any { return s },
+				)),
+				p.S("\""),
+			),
+			func(v p.Values) any {
+				return v.Get("name")
+			},
+		),
+		g.word,
+	)
 	g.taskSimple = p.Action(
 		p.Seq(
 			p.S("task"),
 			g.requiredSpace,
-			p.Named("name", g.word),
+			p.Named("name", g.taskName),
+			p.Named("desc", p.Maybe(g.taskDesc)),
 			g.ws,
 			p.S("{"),
 			p.Named("content", g.content),
@@ -457,12 +914,16 @@ func (g *Grammar) init() {
 		),
 		func(v p.Values) any {
 			name := v.Get("name").(string)
-			content := v.Get("content").(string)
-			commands := parseCommands(content)
+			desc, commands, env := parseTaskBody(v.Get("content").(string))
+			if header, ok := v.Get("desc").(string); ok {
+				desc = header
+			}
 
 			return Task{
-				Name:     name,
-				Commands: commands,
+				Name:        name,
+				Description: desc,
+				Commands:    commands,
+				Env:         env,
 			}
 		},
 	)
@@ -471,10 +932,11 @@ func (g *Grammar) init() {
 		p.Seq(
 			p.S("task"),
 			g.requiredSpace,
-			p.Named("name", g.word),
+			p.Named("name", g.taskName),
 			p.S("("),
 			p.Named("args", g.argList),
 			p.S(")"),
+			p.Named("desc", p.Maybe(g.taskDesc)),
 			g.ws,
 			p.S("{"),
 			p.Named("content", g.content),
@@ -484,14 +946,22 @@ func (g *Grammar) init() {
 		),
 		func(v p.Values) any {
 			name := v.Get("name").(string)
-			args := v.Get("args").([]string)
-			content := v.Get("content").(string)
-			commands := parseCommands(content)
+			params := v.Get("args").(taskParams)
+			desc, commands, env := parseTaskBody(v.Get("content").(string))
+			if header, ok := v.Get("desc").(string); ok {
+				desc = header
+			}
 
 			return Task{
-				Name:      name,
-				Arguments: args,
-				Commands:  commands,
+				Name:        name,
+				Description: desc,
+				Arguments:   params.args,
+				ArgTypes:    params.argTypes,
+				Attributes:  params.attributes,
+				Group:       params.group,
+				Outputs:     params.outputs,
+				Commands:    commands,
+				Env:         env,
 			}
 		},
 	)
@@ -500,11 +970,12 @@ func (g *Grammar) init() {
 		p.Seq(
 			p.S("task"),
 			g.requiredSpace,
-			p.Named("name", g.word),
+			p.Named("name", g.taskName),
 			g.ws,
 			p.S("=>"),
 			g.ws,
 			p.Named("deps", g.dependencies),
+			p.Named("desc", p.Maybe(g.taskDesc)),
 			g.ws,
 			p.S("{"),
 			p.Named("content", g.content),
@@ -515,13 +986,17 @@ func (g *Grammar) init() {
 		func(v p.Values) any {
 			name := v.Get("name").(string)
 			deps := v.Get("deps").([]string)
-			content := v.Get("content").(string)
-			commands := parseCommands(content)
+			desc, commands, env := parseTaskBody(v.Get("content").(string))
+			if header, ok := v.Get("desc").(string); ok {
+				desc = header
+			}
 
 			return Task{
 				Name:         name,
+				Description:  desc,
 				Dependencies: deps,
 				Commands:     commands,
+				Env:          env,
 			}
 		},
 	)
@@ -530,7 +1005,7 @@ func (g *Grammar) init() {
 		p.Seq(
 			p.S("task"),
 			g.requiredSpace,
-			p.Named("name", g.word),
+			p.Named("name", g.taskName),
 			p.S("("),
 			p.Named("args", g.argList),
 			p.S(")"),
@@ -538,6 +1013,7 @@ func (g *Grammar) init() {
 			p.S("=>"),
 			g.ws,
 			p.Named("deps", g.dependencies),
+			p.Named("desc", p.Maybe(g.taskDesc)),
 			g.ws,
 			p.S("{"),
 			p.Named("content", g.content),
@@ -547,16 +1023,24 @@ func (g *Grammar) init() {
 		),
 		func(v p.Values) any {
 			name := v.Get("name").(string)
-			args := v.Get("args").([]string)
+			params := v.Get("args").(taskParams)
 			deps := v.Get("deps").([]string)
-			content := v.Get("content").(string)
-			commands := parseCommands(content)
+			desc, commands, env := parseTaskBody(v.Get("content").(string))
+			if header, ok := v.Get("desc").(string); ok {
+				desc = header
+			}
 
 			return Task{
 				Name:         name,
-				Arguments:    args,
+				Description:  desc,
+				Arguments:    params.args,
+				ArgTypes:     params.argTypes,
+				Attributes:   params.attributes,
+				Group:        params.group,
+				Outputs:      params.outputs,
 				Dependencies: deps,
 				Commands:     commands,
+				Env:          env,
 			}
 		},
 	)
@@ -566,32 +1050,72 @@ func (g *Grammar) init() {
 		p.Seq(
 			p.S("task"),
 			g.requiredSpace,
-			p.Named("name", g.word),
+			p.Named("name", g.taskName),
 			g.ws,
 			p.S("=>"),
 			g.ws,
 			p.Named("deps", g.dependencies),
+			p.Named("desc", p.Maybe(g.taskDesc)),
 			p.Star(p.Or(p.S(" "), p.S("\t"))),
 			p.Or(p.S("\n"), p.EOS()),
 		),
 		func(v p.Values) any {
 			name := v.Get("name").(string)
 			deps := v.Get("deps").([]string)
+			desc, _ := v.Get("desc").(string)
 
 			return Task{
 				Name:         name,
+				Description:  desc,
 				Dependencies: deps,
 				Commands:     []Command{}, // Empty commands for deps-only tasks
 			}
 		},
 	)
 
+	// One-line task: task fmt: go fmt ./...
+	// The colon ending the name must be followed by a space, which tells it
+	// apart from the colons of a namespaced name like docs:generate.
+	g.taskOneLine = p.Action(
+		p.Seq(
+			p.S("task"),
+			g.requiredSpace,
+			p.Named("name", p.Transform(
+				p.Plus(p.Or(
+					p.Range('a', 'z'),
+					p.Range('A', 'Z'),
+					p.Range('0', '9'),
+					p.S("_"),
+					p.S("."),
+					p.S("-"),
+					p.S("/"),
+					p.Seq(p.S(":"), p.Not(p.Or(p.S(" "), p.S("\t")))),
+				)),
+				func(s string) any { return s },
+			)),
+			p.S(":"),
+			g.requiredSpace,
+			p.Named("command", p.Transform(
+				p.Plus(p.Seq(p.Not(p.S("\n")), p.Any())),
+				func(s string) any { return s },
+			)),
+			p.Or(p.S("\n"), p.EOS()),
+		),
+		func(v p.Values) any {
+			return Task{
+				Name:     v.Get("name").(string),
+				Commands: parseCommands(v.Get("command").(string)),
+			}
+		},
+	)
+
 	g.task = p.Or(
 		g.taskWithArgsAndDeps,
 		g.taskWithDeps,
 		g.taskDepsOnly, // Add this before taskWithArgs to prioritize deps-only parsing
 		g.taskWithArgs,
 		g.taskSimple,
+		g.taskOneLine,
 	)
 
 	// Define namespace rule
@@ -605,19 +1129,20 @@ func (g *Grammar) init() {
 			p.Named("elements", p.Many(p.Action(
 				p.Seq(
 					g.ws,
-					p.Named("element", p.Or(
+					p.Named("element", withSpan(p.Or(
 						g.comment,
 						g.variable,
 						g.task,
 						g.namespaceRef,
-					)),
+					))),
 				),
 				func(v p.Values) any {
-					return v.Get("element")
+					return unwrapSpan(v.Get("element"))
 				},
 			), 0, -1, func(values []any) any {
 				return values
 			})),
+			g.ws, // The closing brace of a nested namespace is indented
 			p.S("}"),
 			p.Star(p.Or(p.S(" "), p.S("\t"))),
 			p.Or(p.S("\n"), p.EOS()),
@@ -669,7 +1194,8 @@ func (g *Grammar) init() {
 			),
 			func(v p.Values) any {
 				task := v.Get("task").(Task)
-				if doc, ok := v.Get("doc").(string); ok && doc != "" {
+				// A desc in the task itself takes precedence
+				if doc, ok := v.Get("doc").(string); ok && doc != "" && task.Description == "" {
 					task.Description = doc
 				}
 				return task
@@ -683,16 +1209,21 @@ func (g *Grammar) init() {
 	g.topLevelElement = p.Action(
 		p.Seq(
 			g.ws,
-			p.Named("element", p.Or(
+			p.Named("element", withSpan(p.Or(
 				g.taskWithDoc, // Try task with doc first
 				g.fileNamespaceDirective,
+				g.loadDirective,
+				g.onErrorDirective,
+				g.onMissingDirective,
+				g.goTasksBlock,
+				g.matrix,
 				g.variable,
 				g.namespace,
 				g.comment, // Standalone comments last
-			)),
+			))),
 		),
 		func(v p.Values) any {
-			return v.Get("element")
+			return unwrapSpan(v.Get("element"))
 		},
 	)
 
@@ -728,9 +1259,33 @@ func (g *Grammar) init() {
 						case Namespace:
 							qf.Namespaces = append(qf.Namespaces, e)
 						case Variable:
+							if shell, ok := stringDirective(e, "shell"); ok {
+								qf.Shell = shell
+								continue
+							}
+							if flags, ok := stringDirective(e, "shell_flags"); ok {
+								qf.ShellFlags = flags
+								continue
+							}
 							qf.Variables = append(qf.Variables, e)
 						case FileNamespaceDirective:
 							qf.FileNamespace = e.Name
+						case LoadDirective:
+							qf.Loads = append(qf.Loads, e.Pattern)
+							if e.SHA256 != "" {
+								if qf.LoadChecksums == nil {
+									qf.LoadChecksums = make(map[string]string)
+								}
+								qf.LoadChecksums[e.Pattern] = e.SHA256
+							}
+						case OnErrorDirective:
+							qf.OnError = e.Task
+						case OnMissingDirective:
+							qf.OnMissing = e.Mode
+						case GoTasksConfig:
+							qf.GoTasks = &e
+						case Matrix:
+							qf.matrices = append(qf.matrices, e)
 						}
 					}
 				default:
@@ -741,9 +1296,31 @@ func (g *Grammar) init() {
 					case Namespace:
 						qf.Namespaces = append(qf.Namespaces, e)
 					case Variable:
-						qf.Variables = append(qf.Variables, e)
+						if shell, ok := stringDirective(e, "shell"); ok {
+							qf.Shell = shell
+						} else if flags, ok := stringDirective(e, "shell_flags"); ok {
+							qf.ShellFlags = flags
+						} else {
+							qf.Variables = append(qf.Variables, e)
+						}
 					case FileNamespaceDirective:
 						qf.FileNamespace = e.Name
+					case LoadDirective:
+						qf.Loads = append(qf.Loads, e.Pattern)
+						if e.SHA256 != "" {
+							if qf.LoadChecksums == nil {
+								qf.LoadChecksums = make(map[string]string)
+							}
+							qf.LoadChecksums[e.Pattern] = e.SHA256
+						}
+					case OnErrorDirective:
+						qf.OnError = e.Task
+					case OnMissingDirective:
+						qf.OnMissing = e.Mode
+					case GoTasksConfig:
+						qf.GoTasks = &e
+					case Matrix:
+						qf.matrices = append(qf.matrices, e)
 					}
 				}
 			}
@@ -786,6 +1363,24 @@ func (g *Grammar) init() {
 		},
 	)
 
+	// Condition prefix on a command: if {{expr}}: command
+	g.commandCondition = p.Action(
+		p.Seq(
+			p.S("if"),
+			g.requiredSpace,
+			p.Named("condition", g.expressionElement),
+			p.Star(p.Or(p.S(" "), p.S("\t"))),
+			p.S(":"),
+			p.Named("command", p.Transform(p.Star(p.Any()), func(s string) any { return s })),
+		),
+		func(v p.Values) any {
+			return conditionalCommand{
+				condition: v.Get("condition").(ExpressionElement).Expression,
+				command:   strings.TrimSpace(v.Get("command").(string)),
+			}
+		},
+	)
+
 	// Backtick command: `cmd`
 	g.backtickCmd = p.Action(
 		p.Seq(
@@ -804,20 +1399,63 @@ func (g *Grammar) init() {
 		},
 	)
 
-	// Plain text that's not a special element
-	g.plainText = p.Transform(
-		p.Plus(p.Seq(
-			p.Not(p.Or(
-				p.S("$"),
-				p.S("{{"),
-				p.S("`"),
-				p.S("\n"),
-				p.EOS(),
+	// Command substitution: $(cmd), which can hold nested parentheses like
+	// $(echo $(date)). Parentheses inside quotes don't count.
+	parenContent := p.Star(p.Or(
+		p.Seq(
+			p.S("'"),
+			p.Star(p.Seq(p.Not(p.S("'")), p.Any())),
+			p.S("'"),
+		),
+		p.Seq(
+			p.S("\""),
+			p.Star(p.Or(
+				p.S("\\\""),
+				p.S("\\\\"),
+				p.Seq(p.Not(p.S("\"")), p.Any()),
 			)),
-			p.Any(),
-		)),
-		func(s string) any {
-			return StringElement{Value: s}
+			p.S("\""),
+		),
+		p.Seq(p.S("("), parenRef, p.S(")")),
+		p.Seq(p.Not(p.Or(p.S("("), p.S(")"))), p.Any()),
+	))
+	parenRef.Set(parenContent)
+
+	g.dollarCmd = p.Action(
+		p.Seq(
+			p.S("$("),
+			p.Named("cmd", p.Transform(parenContent, func(s string) any { return s })),
+			p.S(")"),
+		),
+		func(v p.Values) any {
+			return BacktickElement{Command: v.Get("cmd").(string), Dollar: true}
+		},
+	)
+
+	// Plain text that's not a special element. \$ and $$ are a literal dollar
+	// sign, kept as \$ so the shell doesn't expand it either. The evaluator
+	// writes it as a bare $ inside single quotes.
+	g.plainText = p.Many(
+		p.Or(
+			p.Transform(p.Or(p.S("\\$"), p.S("$$")), func(string) any { return "\\$" }),
+			p.Transform(p.Seq(
+				p.Not(p.Or(
+					p.S("$"),
+					p.S("{{"),
+					p.S("`"),
+					p.S("\n"),
+					p.EOS(),
+				)),
+				p.Any(),
+			), func(s string) any { return s }),
+		),
+		1, -1,
+		func(values []any) any {
+			var b strings.Builder
+			for _, v := range values {
+				b.WriteString(v.(string))
+			}
+			return StringElement{Value: b.String()}
 		},
 	)
 
@@ -825,6 +1463,7 @@ func (g *Grammar) init() {
 	g.commandElement = p.Or(
 		g.expressionElement,
 		g.backtickCmd,
+		g.dollarCmd,
 		g.variableRef,
 		g.plainText,
 	)
@@ -861,6 +1500,42 @@ func ParseQuakefile(input string) (QuakeFile, bool, error) {
 
 // ParseQuakefileWithSource parses a Quakefile and tracks the source file
 func ParseQuakefileWithSource(input string, sourceFile string) (QuakeFile, bool, error) {
+	quakeFile, ok, err := parseQuakefile(input, sourceFile)
+	if ok && err == nil {
+		clearSpans(&quakeFile)
+	}
+	return quakeFile, ok, err
+}
+
+// ParseExpression parses an expression as written between {{ and }}, like
+// env || "dev"
+func ParseExpression(input string) (Expression, error) {
+	grammar := NewGrammar()
+	rule := p.Action(
+		p.Seq(grammar.ws, p.Named("expr", grammar.expr), grammar.ws, p.EOS()),
+		func(v p.Values) any {
+			return v.Get("expr")
+		},
+	)
+	result, ok, err := p.New().Parse(rule, input, p.WithErrors())
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %w", input, err)
+	}
+	expr, isExpr := result.(Expression)
+	if !ok || !isExpr {
+		return nil, fmt.Errorf("invalid expression %q", input)
+	}
+	return expr, nil
+}
+
+// parseQuakefile parses a Quakefile, leaving the offsets of its elements in
+// their spans
+func parseQuakefile(input string, sourceFile string) (QuakeFile, bool, error) {
+	config, input, err := frontMatter(input)
+	if err != nil {
+		return QuakeFile{}, false, err
+	}
+
 	parser := p.New()
 	grammar := NewGrammar()
 	result, ok, err := parser.Parse(grammar.quakeFile, input, p.WithErrors())
@@ -870,10 +1545,14 @@ func ParseQuakefileWithSource(input string, sourceFile string) (QuakeFile, bool,
 	}
 
 	if result == nil {
-		return QuakeFile{Tasks: []Task{}}, true, nil
+		return QuakeFile{Tasks: []Task{}, Config: config}, true, nil
 	}
 
 	quakeFile := result.(QuakeFile)
+	quakeFile.Config = config
+	if err := expandMatrices(&quakeFile); err != nil {
+		return QuakeFile{}, true, err
+	}
 
 	// Set source file for all tasks if provided
 	if sourceFile != "" {
@@ -897,13 +1576,56 @@ func setNamespaceTaskSourceFile(namespaces []Namespace, sourceFile string) {
 	}
 }
 
+// stringDirective reports whether a top-level variable is a directive like
+// shell = "...", returning its unquoted value if so
+func stringDirective(v Variable, name string) (string, bool) {
+	if v.Name != name || v.IsExpression || v.CommandSubstitution || v.IsMultiline {
+		return "", false
+	}
+	value, ok := v.Value.(string)
+	if !ok {
+		return "", false
+	}
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		value = value[1 : len(value)-1]
+	}
+	return value, true
+}
+
 // FileNamespaceDirective represents a file-level namespace directive
 type FileNamespaceDirective struct {
 	Name string
 }
 
+// LoadDirective represents a load "pattern" directive for extra .quake files.
+// The pattern may be an http(s) URL, optionally pinned to a SHA-256 checksum.
+type LoadDirective struct {
+	Pattern string
+	SHA256  string
+}
+
+// OnErrorDirective represents an onerror task directive naming the task to
+// run when a task fails
+type OnErrorDirective struct {
+	Task string
+}
+
+// OnMissingDirective represents an on_missing directive choosing what happens
+// when the requested task doesn't exist
+type OnMissingDirective struct {
+	Mode string
+}
+
 // Helper function to parse commands from content string
 func parseCommands(content string) []Command {
+	return parseCommandsIn(content, false)
+}
+
+// parseCommandsIn parses commands like parseCommands. Inside an
+// allow-failure { ... } block, allowFailure is set and every command
+// continues on error, as if it had a - prefix.
+func parseCommandsIn(content string, allowFailure bool) []Command {
 	// Create a parser with the command line grammar
 	parser := p.New()
 	grammar := NewGrammar()
@@ -911,19 +1633,77 @@ func parseCommands(content string) []Command {
 	commands := []Command{}
 	lines := strings.Split(content, "\n")
 
+	// Parse a command line using the PEG grammar
+	parseElements := func(line string) []CommandElement {
+		result, ok, _ := parser.Parse(grammar.commandElements, line, p.WithErrors())
+		if ok && result != nil {
+			if elems, ok := result.([]CommandElement); ok {
+				return elems
+			}
+		}
+		// If parsing fails, treat the whole line as a string
+		return []CommandElement{StringElement{Value: line}}
+	}
+
 	for i := 0; i < len(lines); i++ {
 		line := strings.TrimRight(lines[i], " \t\r")
 		if line == "" {
 			continue
 		}
 
+		// Lines starting with # are comments, including one on the task header line
+		// (task build { # comment). A # later in the line is left for the shell.
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+
+		// A parallel { ... } block groups commands that run concurrently
+		if inner, next, ok := parallelBlock(lines, i); ok {
+			commands = append(commands, Command{
+				Elements: []CommandElement{},
+				Parallel: parseCommandsIn(inner, allowFailure),
+				Raw:      rawCommand(lines, i, next),
+			})
+			i = next
+			continue
+		}
+
+		// The failures of commands in an allow-failure { ... } block don't
+		// stop the task, except in a strict { ... } block nested inside
+		if inner, next, ok := commandBlock(lines, i, "allow-failure"); ok {
+			commands = append(commands, parseCommandsIn(inner, true)...)
+			i = next
+			continue
+		}
+		if inner, next, ok := commandBlock(lines, i, "strict"); ok {
+			commands = append(commands, parseCommandsIn(inner, false)...)
+			i = next
+			continue
+		}
+		start := i
+
 		// Check for special prefixes
 		trimmedLine := strings.TrimSpace(line)
 		silent := false
-		continueOnError := false
+		quiet := false
+		continueOnError := allowFailure
+
+		// An if {{expr}}: prefix only runs the command when expr is truthy
+		var condition Expression
+		if strings.HasPrefix(trimmedLine, "if {{") {
+			result, ok, _ := parser.Parse(grammar.commandCondition, trimmedLine, p.WithErrors())
+			if cond, isCond := result.(conditionalCommand); ok && isCond {
+				condition = cond.condition
+				trimmedLine = cond.command
+			}
+		}
 
-		// Handle special prefixes
-		if strings.HasPrefix(trimmedLine, "@") {
+		// Handle special prefixes. @@ hides the command's output as well as
+		// the command, for commands that print secrets.
+		if strings.HasPrefix(trimmedLine, "@@") {
+			silent, quiet = true, true
+			trimmedLine = strings.TrimSpace(trimmedLine[2:])
+		} else if strings.HasPrefix(trimmedLine, "@") {
 			silent = true
 			trimmedLine = strings.TrimSpace(trimmedLine[1:])
 		} else if strings.HasPrefix(trimmedLine, "-") {
@@ -948,40 +1728,289 @@ func parseCommands(content string) []Command {
 			}
 		}
 
-		// Parse the command line using PEG grammar
-		result, ok, _ := parser.Parse(grammar.commandElements, fullCommand, p.WithErrors())
+		// Handle `set NAME = value` statements, which assign a task-local variable
+		if strings.HasPrefix(fullCommand, "set ") {
+			assignment := strings.TrimSpace(fullCommand[len("set "):])
+			result, ok, _ := parser.Parse(grammar.simpleVariable, assignment, p.WithErrors())
+			if variable, isVar := result.(Variable); ok && isVar {
+				commands = append(commands, Command{
+					Elements:        []CommandElement{},
+					Silent:          silent,
+					Quiet:           quiet,
+					ContinueOnError: continueOnError,
+					Set:             &variable,
+					Condition:       condition,
+					Raw:             rawCommand(lines, start, i),
+				})
+				continue
+			}
+		}
 
-		var elements []CommandElement
-		if ok && result != nil {
-			if elems, ok := result.([]CommandElement); ok {
-				elements = elems
-			} else {
-				// Fallback to simple string if parsing fails
-				elements = []CommandElement{StringElement{Value: fullCommand}}
+		elements := parseElements(fullCommand)
+
+		// A heredoc continues the command up to its terminator line. The
+		// terminator is written unindented so the shell recognizes it.
+		if word, quoted, ok := findHeredoc(fullCommand); ok {
+			if body, end, found := heredocBody(lines, i, word); found {
+				for _, bodyLine := range body {
+					elements = appendElements(elements, StringElement{Value: "\n"})
+					if quoted {
+						// Like the shell, don't substitute in a quoted heredoc
+						elements = appendElements(elements, StringElement{Value: bodyLine})
+					} else {
+						elements = appendElements(elements, parseElements(bodyLine)...)
+					}
+				}
+				elements = appendElements(elements, StringElement{Value: "\n" + word})
+				i = end
 			}
-		} else {
-			// If parsing fails, treat the whole line as a string
-			elements = []CommandElement{StringElement{Value: fullCommand}}
 		}
 
 		cmd := Command{
 			Elements:        elements,
 			Silent:          silent,
+			Quiet:           quiet,
 			ContinueOnError: continueOnError,
+			Condition:       condition,
+			Raw:             rawCommand(lines, start, i),
 		}
 		commands = append(commands, cmd)
 	}
 	return commands
 }
 
-// parseArgumentsFromString parses argument string into array
+// rawCommand returns a command's source, lines[start] through lines[end], as
+// written. Later lines lose the first line's indentation.
+func rawCommand(lines []string, start, end int) string {
+	first := lines[start]
+	indent := first[:len(first)-len(strings.TrimLeft(first, " \t"))]
+	raw := make([]string, 0, end-start+1)
+	for _, line := range lines[start : end+1] {
+		raw = append(raw, strings.TrimRight(strings.TrimPrefix(line, indent), " \t\r"))
+	}
+	return strings.Join(raw, "\n")
+}
+
+// descriptionLine matches a desc "..." line at the start of a task body
+var descriptionLine = regexp.MustCompile(`^\s*desc\s+("(?:[^"\\]|\\.)*")\s*$`)
+
+// parseTaskBody parses a task body into its commands, the description given
+// by a desc "..." first line, if any, and the variables of its env blocks
+func parseTaskBody(content string) (string, []Command, map[string]string) {
+	env, content := taskEnv(content)
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if m := descriptionLine.FindStringSubmatch(line); m != nil {
+			rest := strings.Join(lines[i+1:], "\n")
+			return unquoteDescription(m[1]), parseCommands(rest), env
+		}
+		break
+	}
+	return "", parseCommands(content), env
+}
+
+// envAssignment matches one NAME = value entry of an env block
+var envAssignment = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)\s*=\s*(.+)$`)
+
+// taskEnv collects the variables of a task body's env { ... } blocks and
+// returns the body with the blocks blanked out. Blank lines are left in their
+// place so the commands keep their line numbers.
+func taskEnv(content string) (map[string]string, string) {
+	var env map[string]string
+	lines := strings.Split(content, "\n")
+	for i := 0; i < len(lines); i++ {
+		vars, next, ok := envBlock(lines, i)
+		if !ok {
+			continue
+		}
+		if env == nil {
+			env = make(map[string]string)
+		}
+		maps.Copy(env, vars)
+		for j := i; j <= next; j++ {
+			lines[j] = ""
+		}
+		i = next
+	}
+	return env, strings.Join(lines, "\n")
+}
+
+// envBlock checks whether lines[i] starts an env block, either spanning lines
+// up to a closing "}" line or on one line with assignments separated by
+// semicolons: env { A = "1"; B = "x" }. It returns the block's variables, with
+// their values as written, and the index of the block's last line.
+func envBlock(lines []string, i int) (map[string]string, int, bool) {
+	trimmed := strings.TrimSpace(lines[i])
+	rest, ok := strings.CutPrefix(trimmed, "env")
+	if !ok {
+		return nil, i, false
+	}
+	rest = strings.TrimSpace(rest)
+	if !strings.HasPrefix(rest, "{") {
+		return nil, i, false
+	}
+	rest = strings.TrimSpace(rest[1:])
+
+	var entries []string
+	last := i
+	if rest != "" {
+		// Single-line form
+		body, ok := strings.CutSuffix(rest, "}")
+		if !ok {
+			return nil, i, false
+		}
+		entries = splitOutsideQuotes(body, ';')
+	} else {
+		// Multi-line form
+		last = -1
+		for j := i + 1; j < len(lines); j++ {
+			if strings.TrimSpace(lines[j]) == "}" {
+				last = j
+				break
+			}
+			entries = append(entries, splitOutsideQuotes(lines[j], ';')...)
+		}
+		if last < 0 {
+			return nil, i, false
+		}
+	}
+
+	vars := make(map[string]string)
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		m := envAssignment.FindStringSubmatch(entry)
+		if m == nil {
+			return nil, i, false
+		}
+		vars[m[1]] = strings.TrimSpace(m[2])
+	}
+	return vars, last, true
+}
+
+// unquoteDescription removes the quotes and escapes of a desc "..." string
+func unquoteDescription(quoted string) string {
+	if s, err := strconv.Unquote(quoted); err == nil {
+		return s
+	}
+	return quoted[1 : len(quoted)-1]
+}
+
+// conditionalCommand is a command line split into its if {{expr}}: condition
+// and the command itself
+type conditionalCommand struct {
+	condition Expression
+	command   string
+}
+
+// parallelBlock checks whether lines[i] starts a parallel block, either
+// spanning lines up to a closing "}" line or on one line with commands
+// separated by semicolons: parallel { cmd1; cmd2 }. It returns the block's
+// commands, one per line, and the index of the block's last line.
+func parallelBlock(lines []string, i int) (string, int, bool) {
+	return commandBlock(lines, i, "parallel")
+}
+
+// commandBlock checks whether lines[i] starts a block of commands introduced
+// by keyword, in either of the forms of a parallel block
+func commandBlock(lines []string, i int, keyword string) (string, int, bool) {
+	trimmed := strings.TrimSpace(lines[i])
+	rest, ok := strings.CutPrefix(trimmed, keyword)
+	if !ok {
+		return "", i, false
+	}
+	rest = strings.TrimSpace(rest)
+	if !strings.HasPrefix(rest, "{") {
+		return "", i, false
+	}
+	rest = strings.TrimSpace(rest[1:])
+
+	// Single-line form
+	if rest != "" {
+		body, ok := strings.CutSuffix(rest, "}")
+		if !ok {
+			return "", i, false
+		}
+		return strings.Join(splitOutsideQuotes(body, ';'), "\n"), i, true
+	}
+
+	// Multi-line form, which may hold blocks of its own
+	var inner []string
+	depth := 0
+	for j := i + 1; j < len(lines); j++ {
+		line := strings.TrimSpace(lines[j])
+		if line == "}" {
+			if depth == 0 {
+				return strings.Join(inner, "\n"), j, true
+			}
+			depth--
+		} else if strings.HasSuffix(line, "{") {
+			depth++
+		}
+		inner = append(inner, lines[j])
+	}
+	return "", i, false
+}
+
+// splitOutsideQuotes splits s on sep, ignoring separators inside quotes
+func splitOutsideQuotes(s string, sep byte) []string {
+	var parts []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseArgumentsFromString parses argument string into array. Commas inside
+// quotes or a [...] list don't separate arguments, so an attribute can hold a
+// list like inputs: ["src/**", "go.mod"].
 func parseArgumentsFromString(argString string) []string {
 	if strings.TrimSpace(argString) == "" {
 		return []string{}
 	}
 
+	var parts []string
+	var quote byte
+	depth, start := 0, 0
+	for i := 0; i < len(argString); i++ {
+		switch c := argString[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '(':
+			depth++
+		case (c == ']' || c == ')') && depth > 0:
+			depth--
+		case c == ',' && depth == 0:
+			parts = append(parts, argString[start:i])
+			start = i + 1
+		}
+	}
+	parts = append(parts, argString[start:])
+
 	args := []string{}
-	parts := strings.Split(argString, ",")
 	for _, part := range parts {
 		arg := strings.TrimSpace(part)
 		if arg != "" {
@@ -991,22 +2020,120 @@ func parseArgumentsFromString(argString string) []string {
 	return args
 }
 
-// parseDependenciesFromString parses dependency string into array
-func parseDependenciesFromString(depString string) []string {
-	depString = strings.TrimSpace(depString)
-	if depString == "" {
-		return []string{}
+// taskParams holds the contents of a task's parenthesized list
+type taskParams struct {
+	args       []string
+	attributes map[string]string
+	group      string   // From the group attribute, kept out of attributes
+	outputs    []string // From the outputs attribute, kept out of attributes
+	argTypes   map[string]string
+}
+
+// parseTaskParams splits a task's parenthesized list into arguments and
+// attributes. Attributes are written as name: value, e.g. (env, retries: 3),
+// except that an argument type makes it a typed argument, e.g. (replicas: int).
+func parseTaskParams(paramString string) taskParams {
+	params := taskParams{args: []string{}}
+
+	for _, item := range parseArgumentsFromString(paramString) {
+		key, value, ok := strings.Cut(item, ":")
+		if !ok {
+			params.args = append(params.args, item)
+			continue
+		}
+
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		if IsArgType(value) {
+			params.args = append(params.args, strings.TrimSpace(key))
+			if params.argTypes == nil {
+				params.argTypes = make(map[string]string)
+			}
+			params.argTypes[strings.TrimSuffix(strings.TrimSpace(key), "...")] = value
+			continue
+		}
+
+		switch strings.TrimSpace(key) {
+		case "group":
+			params.group = value
+			continue
+		case "outputs":
+			params.outputs = ListAttribute(value)
+			continue
+		}
+
+		if params.attributes == nil {
+			params.attributes = make(map[string]string)
+		}
+		params.attributes[strings.TrimSpace(key)] = value
 	}
 
-	deps := []string{}
-	parts := strings.FieldsFunc(depString, func(r rune) bool {
-		return r == ',' || r == ' ' || r == '\t' || r == '\n'
-	})
+	return params
+}
 
-	for _, part := range parts {
-		if part != "" {
-			deps = append(deps, part)
+// argEnum matches an enum(a,b,c) argument type
+var argEnum = regexp.MustCompile(`^enum\(\s*[^(),\s]+(\s*,\s*[^(),\s]+)*\s*\)$`)
+
+// IsArgType reports whether s is a type an argument can be declared with:
+// int, bool, path or enum(a,b,c)
+func IsArgType(s string) bool {
+	switch s {
+	case "int", "bool", "path":
+		return true
+	}
+	return argEnum.MatchString(s)
+}
+
+// EnumValues returns the values of an enum(a,b,c) argument type
+func EnumValues(argType string) []string {
+	inner := strings.TrimSuffix(strings.TrimPrefix(argType, "enum("), ")")
+	return parseArgumentsFromString(inner)
+}
+
+// ListAttribute splits an attribute holding a list, like ["src/**", "go.mod"],
+// into its items. A value without brackets is a list of one item.
+func ListAttribute(value string) []string {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "[") || !strings.HasSuffix(value, "]") {
+		if value == "" {
+			return nil
+		}
+		return []string{value}
+	}
+
+	var items []string
+	for _, item := range parseArgumentsFromString(value[1 : len(value)-1]) {
+		if len(item) >= 2 && (item[0] == '"' || item[0] == '\'') && item[len(item)-1] == item[0] {
+			item = item[1 : len(item)-1]
 		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// parseDependenciesFromString parses dependency string into array. Names may
+// be quoted, like "build:prod", to match a task with a quoted name.
+func parseDependenciesFromString(depString string) []string {
+	deps := []string{}
+	var current strings.Builder
+	quoted := false
+	for _, r := range depString {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case !quoted && (r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'):
+			if current.Len() > 0 {
+				deps = append(deps, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		deps = append(deps, current.String())
 	}
 	return deps
 }
@@ -1100,3 +2227,110 @@ func parseNamespaceFromLines(lines []string, startIndex int) (*Namespace, int) {
 	// In a proper implementation, we'd use the PEG parser recursively
 	return nil, startIndex + 1
 }
+
+// findHeredoc looks for a heredoc redirection (<<WORD, <<-WORD, <<'WORD' or
+// <<"WORD") outside quotes in a command and returns its terminator word.
+// quoted reports whether the word was quoted, which stops substitution.
+func findHeredoc(cmd string) (word string, quoted bool, ok bool) {
+	var quote byte
+	for i := 0; i < len(cmd); i++ {
+		switch c := cmd[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '<' && (i == 0 || cmd[i-1] != '<'):
+			if word, quoted, ok := heredocDelimiter(cmd[i:]); ok {
+				return word, quoted, true
+			}
+		}
+	}
+	return "", false, false
+}
+
+// heredocDelimiter parses the heredoc redirection at the start of s
+func heredocDelimiter(s string) (word string, quoted bool, ok bool) {
+	rest, ok := strings.CutPrefix(s, "<<")
+	if !ok || strings.HasPrefix(rest, "<") {
+		// Not a heredoc, or a <<< here-string
+		return "", false, false
+	}
+	rest = strings.TrimPrefix(rest, "-")
+	rest = strings.TrimLeft(rest, " \t")
+
+	if rest != "" && (rest[0] == '\'' || rest[0] == '"') {
+		end := strings.IndexByte(rest[1:], rest[0])
+		if end <= 0 {
+			return "", false, false
+		}
+		return rest[1 : end+1], true, true
+	}
+
+	n := 0
+	for n < len(rest) && (rest[n] == '_' || rest[n] >= 'a' && rest[n] <= 'z' ||
+		rest[n] >= 'A' && rest[n] <= 'Z' || rest[n] >= '0' && rest[n] <= '9') {
+		n++
+	}
+	if n == 0 {
+		return "", false, false
+	}
+	return rest[:n], false, true
+}
+
+// heredocBody returns the lines after lines[i] up to the heredoc's terminator
+// line, which may be indented, and the terminator's index
+func heredocBody(lines []string, i int, word string) ([]string, int, bool) {
+	for j := i + 1; j < len(lines); j++ {
+		if strings.TrimSpace(lines[j]) == word {
+			return lines[i+1 : j], j, true
+		}
+	}
+	return nil, i, false
+}
+
+// scanHeredoc matches a heredoc at the start of s through its terminator
+// line, so a task body's brace matching skips over the heredoc's contents.
+// It returns -1 if s doesn't start with a terminated heredoc.
+func scanHeredoc(s string) int {
+	word, _, ok := heredocDelimiter(s)
+	if !ok {
+		return -1
+	}
+
+	pos := strings.IndexByte(s, '\n')
+	for pos >= 0 {
+		start := pos + 1
+		end := strings.IndexByte(s[start:], '\n')
+		if end < 0 {
+			end = len(s)
+		} else {
+			end += start
+		}
+		if strings.TrimSpace(s[start:end]) == word {
+			return end
+		}
+		if end == len(s) {
+			break
+		}
+		pos = end
+	}
+	return -1
+}
+
+// appendElements appends elems to dst, merging adjacent strings
+func appendElements(dst []CommandElement, elems ...CommandElement) []CommandElement {
+	for _, elem := range elems {
+		if str, ok := elem.(StringElement); ok && len(dst) > 0 {
+			if last, ok := dst[len(dst)-1].(StringElement); ok {
+				dst[len(dst)-1] = StringElement{Value: last.Value + str.Value}
+				continue
+			}
+		}
+		dst = append(dst, elem)
+	}
+	return dst
+}
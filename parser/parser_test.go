@@ -2,6 +2,7 @@ package parser
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -16,6 +17,39 @@ func makeQuakeFile() QuakeFile {
 	}
 }
 
+func TestParseRawCommands(t *testing.T) {
+	input := "task build {\n" +
+		"    @echo   \"spaced   out\"   $NAME  \n" +
+		"    if {{release}}: -go build\n" +
+		"    go test ./...\n" +
+		"      | grep -v cached\n" +
+		"    parallel {\n" +
+		"        lint\n" +
+		"        vet\n" +
+		"    }\n" +
+		"    cat <<EOF\n" +
+		"      indented\n" +
+		"EOF\n" +
+		"}"
+
+	result, ok, err := ParseQuakefile(input)
+	require.True(t, ok, "parsing should succeed")
+	require.NoError(t, err, "should not return error")
+
+	var raw []string
+	for _, cmd := range result.Tasks[0].Commands {
+		raw = append(raw, cmd.Raw)
+	}
+	require.Equal(t, []string{
+		`@echo   "spaced   out"   $NAME`,
+		"if {{release}}: -go build",
+		"go test ./...\n  | grep -v cached",
+		"parallel {\n    lint\n    vet\n}",
+		"cat <<EOF\n  indented\nEOF",
+	}, raw)
+	require.Equal(t, "lint", result.Tasks[0].Commands[3].Parallel[0].Raw)
+}
+
 func TestParseSimpleTask(t *testing.T) {
 	input := `task hello {
     echo "Hello, World!"
@@ -30,7 +64,7 @@ func TestParseSimpleTask(t *testing.T) {
 		{
 			Name: "hello",
 			Commands: []Command{
-				{Elements: []CommandElement{
+				{Raw: `echo "Hello, World!"`, Elements: []CommandElement{
 					StringElement{Value: "echo \"Hello, World!\""},
 				}},
 			},
@@ -55,7 +89,7 @@ func TestParseTaskWithArguments(t *testing.T) {
 			Name:      "greet",
 			Arguments: []string{"name"},
 			Commands: []Command{
-				{Elements: []CommandElement{
+				{Raw: `echo "Hello, $name!"`, Elements: []CommandElement{
 					StringElement{Value: "echo \"Hello, "},
 					VariableElement{Name: "name"},
 					StringElement{Value: "!\""},
@@ -84,18 +118,21 @@ func TestParseTaskWithSpecialCommands(t *testing.T) {
 			Name: "special",
 			Commands: []Command{
 				{
+					Raw: `@echo "silent command"`,
 					Elements: []CommandElement{
 						StringElement{Value: "echo \"silent command\""},
 					},
 					Silent: true,
 				},
 				{
+					Raw: "-false",
 					Elements: []CommandElement{
 						StringElement{Value: "false"},
 					},
 					ContinueOnError: true,
 				},
 				{
+					Raw: `echo "normal command"`,
 					Elements: []CommandElement{
 						StringElement{Value: "echo \"normal command\""},
 					},
@@ -158,7 +195,7 @@ func TestParseSimpleNamespace(t *testing.T) {
 				{
 					Name: "migrate",
 					Commands: []Command{
-						{Elements: []CommandElement{
+						{Raw: `echo "Running migrations"`, Elements: []CommandElement{
 							StringElement{Value: "echo \"Running migrations\""},
 						}},
 					},
@@ -172,6 +209,31 @@ func TestParseSimpleNamespace(t *testing.T) {
 	require.Equal(t, expected, result)
 }
 
+func TestParseNestedNamespace(t *testing.T) {
+	input := `namespace db {
+    task migrate {
+        migrate up
+    }
+
+    namespace cache {
+        task clear {
+            redis-cli flushall
+        }
+    }
+}`
+
+	result, ok, err := ParseQuakefile(input)
+	require.True(t, ok, "parsing should succeed")
+	require.NoError(t, err, "should not return error")
+
+	require.Len(t, result.Namespaces, 1)
+	db := result.Namespaces[0]
+	require.Equal(t, "migrate", db.Tasks[0].Name)
+	require.Len(t, db.Namespaces, 1)
+	require.Equal(t, "cache", db.Namespaces[0].Name)
+	require.Equal(t, "clear", db.Namespaces[0].Tasks[0].Name)
+}
+
 func TestParseFileNamespace(t *testing.T) {
 	input := `namespace api
 
@@ -189,7 +251,7 @@ task start {
 		{
 			Name: "start",
 			Commands: []Command{
-				{Elements: []CommandElement{
+				{Raw: `echo "Starting API server"`, Elements: []CommandElement{
 					StringElement{Value: "echo \"Starting API server\""},
 				}},
 			},
@@ -199,6 +261,137 @@ task start {
 	require.Equal(t, expected, result)
 }
 
+func TestParseLoadDirectives(t *testing.T) {
+	input := `load "tasks/**/*.quake"
+load "extra/*.quake"
+load "https://example.com/common.quake" sha256 "abc123"
+include "https://example.com/lint.quake"
+include_dirs = "vendor"
+
+task build {
+    go build
+}`
+
+	result, ok, err := ParseQuakefile(input)
+	require.True(t, ok, "parsing should succeed")
+	require.NoError(t, err, "should not return error")
+
+	require.Equal(t, []string{"tasks/**/*.quake", "extra/*.quake", "https://example.com/common.quake", "https://example.com/lint.quake"}, result.Loads)
+	require.Equal(t, map[string]string{"https://example.com/common.quake": "abc123"}, result.LoadChecksums)
+	require.Len(t, result.Tasks, 1)
+	require.Len(t, result.Variables, 1)
+	require.Equal(t, "include_dirs", result.Variables[0].Name)
+}
+
+func TestParseOnErrorDirective(t *testing.T) {
+	input := `onerror cleanup
+onerror = "still a variable"
+
+task deploy(onerror: db:rollback) {
+    ./deploy.sh
+}`
+
+	result, ok, err := ParseQuakefile(input)
+	require.True(t, ok, "parsing should succeed")
+	require.NoError(t, err, "should not return error")
+
+	require.Equal(t, "cleanup", result.OnError)
+	require.Len(t, result.Variables, 1)
+	require.Equal(t, "onerror", result.Variables[0].Name)
+	require.Len(t, result.Tasks, 1)
+	require.Equal(t, "db:rollback", result.Tasks[0].Attributes["onerror"])
+}
+
+func TestParseMatrix(t *testing.T) {
+	input := `matrix os = [linux, darwin], arch = [amd64, "arm64"] {
+    # Build for {{os}}/{{arch}}
+    task build:{{os}}-{{arch}} {
+        GOOS={{os}} GOARCH={{ arch }} go build -o bin/app-{{os}}-{{arch}}
+    }
+}
+
+task build => build:* {
+    echo done
+}`
+
+	result, ok, err := ParseQuakefile(input)
+	require.True(t, ok, "parsing should succeed")
+	require.NoError(t, err, "should not return error")
+
+	var names []string
+	for _, task := range result.Tasks {
+		names = append(names, task.Name)
+	}
+	require.Equal(t, []string{"build", "build:linux-amd64", "build:linux-arm64", "build:darwin-amd64", "build:darwin-arm64"}, names)
+
+	task := result.FindTask("build:darwin-arm64")
+	require.NotNil(t, task)
+	require.Equal(t, "Build for darwin/arm64", task.Description)
+	require.Equal(t, []CommandElement{
+		StringElement{Value: "GOOS=darwin GOARCH=arm64 go build -o bin/app-darwin-arm64"},
+	}, task.Commands[0].Elements)
+
+	_, ok, err = ParseQuakefile("matrix os = [linux], os = [darwin] {\n    task build {\n        echo\n    }\n}\n")
+	require.True(t, ok)
+	require.EqualError(t, err, "matrix variable 'os' is declared more than once")
+}
+
+func TestParseQuotedTaskNames(t *testing.T) {
+	input := `task "build:prod" {
+    go build -tags prod
+}
+
+# Build with docs
+task "build app"(target) {
+    go build $target
+}
+
+task build-app.v2 => "build:prod", "build app" {
+    echo done
+}`
+
+	result, ok, err := ParseQuakefile(input)
+	require.True(t, ok, "parsing should succeed")
+	require.NoError(t, err, "should not return error")
+
+	require.Len(t, result.Tasks, 3)
+	require.Equal(t, "build:prod", result.Tasks[0].Name)
+	require.Equal(t, "build app", result.Tasks[1].Name)
+	require.Equal(t, "Build with docs", result.Tasks[1].Description)
+	require.Equal(t, []string{"target"}, result.Tasks[1].Arguments)
+	require.Equal(t, "build-app.v2", result.Tasks[2].Name)
+	require.Equal(t, []string{"build:prod", "build app"}, result.Tasks[2].Dependencies)
+
+	// A quoted name with a colon is found as written, not as a namespace
+	require.Same(t, &result.Tasks[0], result.FindTask("build:prod"))
+}
+
+func TestParseCommandCondition(t *testing.T) {
+	input := `task ci {
+    if {{env.CI == "true"}}: @upload-coverage $FILE
+    if {{release}}: -set TAG = "latest"
+    if [ -f go.mod ]; then go build; fi
+}`
+
+	result, ok, err := ParseQuakefile(input)
+	require.True(t, ok, "parsing should succeed")
+	require.NoError(t, err, "should not return error")
+
+	cmds := result.Tasks[0].Commands
+	require.Len(t, cmds, 3)
+	require.Equal(t, Compare{Op: "==", Left: AccessId{Object: Identifier{Name: "env"}, Property: "CI"}, Right: StringLiteral{Value: "true"}}, cmds[0].Condition)
+	require.True(t, cmds[0].Silent)
+	require.Equal(t, []CommandElement{StringElement{Value: "upload-coverage "}, VariableElement{Name: "FILE"}}, cmds[0].Elements)
+	require.Equal(t, `if {{env.CI == "true"}}: @upload-coverage $FILE`, FormatCommand(cmds[0]))
+
+	require.Equal(t, Identifier{Name: "release"}, cmds[1].Condition)
+	require.True(t, cmds[1].ContinueOnError)
+	require.NotNil(t, cmds[1].Set)
+
+	// Shell if statements are left alone
+	require.Nil(t, cmds[2].Condition)
+}
+
 func TestParseTaskWithDependencies(t *testing.T) {
 	input := `task deploy => build, test {
     echo "Deploying..."
@@ -214,7 +407,7 @@ func TestParseTaskWithDependencies(t *testing.T) {
 			Name:         "deploy",
 			Dependencies: []string{"build", "test"},
 			Commands: []Command{
-				{Elements: []CommandElement{
+				{Raw: `echo "Deploying..."`, Elements: []CommandElement{
 					StringElement{Value: "echo \"Deploying...\""},
 				}},
 			},
@@ -240,13 +433,13 @@ func TestParseTaskWithQuotedBraces(t *testing.T) {
 		{
 			Name: "test",
 			Commands: []Command{
-				{Elements: []CommandElement{
+				{Raw: `echo "This has } inside quotes"`, Elements: []CommandElement{
 					StringElement{Value: `echo "This has } inside quotes"`},
 				}},
-				{Elements: []CommandElement{
+				{Raw: "echo 'Single quotes with } too'", Elements: []CommandElement{
 					StringElement{Value: `echo 'Single quotes with } too'`},
 				}},
-				{Elements: []CommandElement{
+				{Raw: `echo "Multiple } braces } in one line"`, Elements: []CommandElement{
 					StringElement{Value: `echo "Multiple } braces } in one line"`},
 				}},
 			},
@@ -273,16 +466,16 @@ func TestParseTaskWithNestedBraces(t *testing.T) {
 		{
 			Name: "complex",
 			Commands: []Command{
-				{Elements: []CommandElement{
+				{Raw: "if [ -f file.txt ]; then", Elements: []CommandElement{
 					StringElement{Value: `if [ -f file.txt ]; then`},
 				}},
-				{Elements: []CommandElement{
+				{Raw: `echo "File exists { with braces }"`, Elements: []CommandElement{
 					StringElement{Value: `echo "File exists { with braces }"`},
 				}},
-				{Elements: []CommandElement{
+				{Raw: "fi", Elements: []CommandElement{
 					StringElement{Value: `fi`},
 				}},
-				{Elements: []CommandElement{
+				{Raw: `echo "Done"`, Elements: []CommandElement{
 					StringElement{Value: `echo "Done"`},
 				}},
 			},
@@ -307,10 +500,10 @@ func TestParseTaskWithJSONInCommand(t *testing.T) {
 		{
 			Name: "json",
 			Commands: []Command{
-				{Elements: []CommandElement{
+				{Raw: `curl -d '{"key": "value", "nested": {"inner": "data"}}' api.com`, Elements: []CommandElement{
 					StringElement{Value: `curl -d '{"key": "value", "nested": {"inner": "data"}}' api.com`},
 				}},
-				{Elements: []CommandElement{
+				{Raw: `echo "JSON sent"`, Elements: []CommandElement{
 					StringElement{Value: `echo "JSON sent"`},
 				}},
 			},
@@ -319,3 +512,258 @@ func TestParseTaskWithJSONInCommand(t *testing.T) {
 
 	require.Equal(t, expected, result)
 }
+
+func TestParseTaskAttributes(t *testing.T) {
+	input := `task fetch(retries: 3, backoff: "2s") {
+    curl -fsSL https://example.com
+}
+
+task deploy(env, retries: 2) => build {
+    ./deploy.sh $env
+}`
+
+	result, ok, err := ParseQuakefile(input)
+	require.True(t, ok, "parsing should succeed")
+	require.NoError(t, err, "should not return error")
+
+	require.Len(t, result.Tasks, 2)
+	require.Equal(t, []string{}, result.Tasks[0].Arguments)
+	require.Equal(t, map[string]string{"retries": "3", "backoff": "2s"}, result.Tasks[0].Attributes)
+
+	require.Equal(t, []string{"env"}, result.Tasks[1].Arguments)
+	require.Equal(t, map[string]string{"retries": "2"}, result.Tasks[1].Attributes)
+	require.Equal(t, []string{"build"}, result.Tasks[1].Dependencies)
+}
+
+func TestParseGoTasksBlock(t *testing.T) {
+	result, ok, err := ParseQuakefile(`gotasks { tags = "integration"; flags = "-race -v" }
+
+task build {
+    go build
+}`)
+	require.True(t, ok, "parsing should succeed")
+	require.NoError(t, err, "should not return error")
+	require.Equal(t, &GoTasksConfig{Tags: "integration", Flags: "-race -v"}, result.GoTasks)
+	require.Len(t, result.Tasks, 1)
+
+	result, ok, err = ParseQuakefile(`gotasks {
+    tags = "e2e"
+    CGO_ENABLED = "1"
+}
+`)
+	require.True(t, ok, "parsing should succeed")
+	require.NoError(t, err, "should not return error")
+	require.Equal(t, &GoTasksConfig{Tags: "e2e", Env: map[string]string{"CGO_ENABLED": "1"}}, result.GoTasks)
+}
+
+func TestParseListAttribute(t *testing.T) {
+	result, ok, err := ParseQuakefile(`task test(pkg, inputs: ["src/**", 'go.mod'], retries: 2) {
+    go test $pkg
+}`)
+	require.True(t, ok, "parsing should succeed")
+	require.NoError(t, err, "should not return error")
+
+	task := result.Tasks[0]
+	require.Equal(t, []string{"pkg"}, task.Arguments)
+	require.Equal(t, "2", task.Attributes["retries"])
+	require.Equal(t, []string{"src/**", "go.mod"}, ListAttribute(task.Attributes["inputs"]))
+	require.Equal(t, []string{"src/**"}, ListAttribute("src/**"))
+	require.Empty(t, ListAttribute(""))
+}
+
+func TestExpandDependency(t *testing.T) {
+	result, ok, err := ParseQuakefile(`task test => test:*, lint:*? {
+    echo all
+}
+
+namespace test {
+    task unit {
+        go test ./...
+    }
+
+    task integration {
+        go test -tags integration ./...
+    }
+
+    namespace e2e {
+        task browser {
+            npx playwright test
+        }
+    }
+}
+`)
+	require.True(t, ok)
+	require.NoError(t, err)
+	require.Equal(t, []string{"test:*", "lint:*?"}, result.Tasks[0].Dependencies)
+
+	matches, err := result.ExpandDependency("test:*")
+	require.NoError(t, err)
+	require.Equal(t, []string{"test:integration", "test:unit"}, matches, "* doesn't match across namespaces")
+
+	matches, err = result.ExpandDependency("test:*:*")
+	require.NoError(t, err)
+	require.Equal(t, []string{"test:e2e:browser"}, matches)
+
+	matches, err = result.ExpandDependency("lint:*?")
+	require.NoError(t, err)
+	require.Empty(t, matches)
+
+	_, err = result.ExpandDependency("lint:*")
+	require.EqualError(t, err, "dependency pattern 'lint:*' matches no tasks (end it with ? to make it optional)")
+
+	matches, err = result.ExpandDependency("build")
+	require.NoError(t, err)
+	require.Equal(t, []string{"build"}, matches)
+}
+
+func TestParseQuakefileWithSpans(t *testing.T) {
+	input := `VERSION = "1.0"
+
+# Build it
+task build {
+    go build
+    parallel {
+        echo a
+    }
+}
+
+namespace db {
+    task migrate {
+        migrate up
+    }
+}
+`
+	qf, err := ParseQuakefileWithSpans(input, "Quakefile")
+	require.NoError(t, err)
+
+	text := func(span *Span) string {
+		require.NotNil(t, span)
+		return input[span.Start:span.End]
+	}
+
+	require.Equal(t, `VERSION = "1.0"`, text(qf.Variables[0].Span))
+	require.Equal(t, &Span{Start: 0, End: 15, StartLine: 1, StartCol: 1, EndLine: 1, EndCol: 16}, qf.Variables[0].Span)
+
+	build := qf.Tasks[0]
+	require.True(t, strings.HasPrefix(text(build.Span), "# Build it\ntask build {"))
+	require.Equal(t, 3, build.Span.StartLine)
+	require.Equal(t, 9, build.Span.EndLine)
+	require.Equal(t, "go build", text(build.Commands[0].Span))
+	require.Equal(t, 5, build.Commands[0].Span.StartLine)
+	require.Equal(t, 5, build.Commands[0].Span.StartCol)
+	require.Equal(t, "parallel {\n        echo a\n    }", text(build.Commands[1].Span))
+	require.Equal(t, "echo a", text(build.Commands[1].Parallel[0].Span))
+
+	ns := qf.Namespaces[0]
+	require.Equal(t, 11, ns.Span.StartLine)
+	require.Equal(t, 15, ns.Span.EndLine)
+	require.Equal(t, 12, ns.Tasks[0].Span.StartLine)
+	require.Equal(t, "migrate up", text(ns.Tasks[0].Commands[0].Span))
+
+	// The position-free API leaves spans out
+	plain, ok, err := ParseQuakefile(input)
+	require.True(t, ok)
+	require.NoError(t, err)
+	require.Nil(t, plain.Tasks[0].Span)
+	require.Nil(t, plain.Tasks[0].Commands[0].Span)
+	require.Nil(t, plain.Namespaces[0].Tasks[0].Span)
+}
+
+func TestParseOneLineTask(t *testing.T) {
+	qf, ok, err := ParseQuakefile(`# Format the code
+task fmt: go fmt ./...
+task docs:generate: mkdocs build
+task lint: -golangci-lint run {{FLAGS}}
+
+task docs:serve {
+    mkdocs serve
+}
+
+namespace db {
+    task migrate: ./migrate up
+}
+`)
+	require.True(t, ok)
+	require.NoError(t, err)
+	require.Len(t, qf.Tasks, 4)
+
+	require.Equal(t, "fmt", qf.Tasks[0].Name)
+	require.Equal(t, "Format the code", qf.Tasks[0].Description)
+	require.Len(t, qf.Tasks[0].Commands, 1)
+	require.Equal(t, "go fmt ./...", FormatCommand(qf.Tasks[0].Commands[0]))
+
+	require.Equal(t, "docs:generate", qf.Tasks[1].Name)
+	require.Equal(t, "mkdocs build", FormatCommand(qf.Tasks[1].Commands[0]))
+
+	require.Equal(t, "lint", qf.Tasks[2].Name)
+	require.True(t, qf.Tasks[2].Commands[0].ContinueOnError)
+
+	require.Equal(t, "docs:serve", qf.Tasks[3].Name)
+	require.Equal(t, "mkdocs serve", FormatCommand(qf.Tasks[3].Commands[0]))
+
+	require.Equal(t, "migrate", qf.Namespaces[0].Tasks[0].Name)
+	require.Equal(t, "./migrate up", FormatCommand(qf.Namespaces[0].Tasks[0].Commands[0]))
+}
+
+func TestParseTypedArguments(t *testing.T) {
+	qf, ok, err := ParseQuakefile(`task scale(replicas: int, env: enum(dev, staging,prod), name, retries: 3) {
+    kubectl scale --replicas=$replicas
+}`)
+	require.True(t, ok)
+	require.NoError(t, err)
+
+	task := qf.Tasks[0]
+	require.Equal(t, []string{"replicas", "env", "name"}, task.Arguments)
+	require.Equal(t, map[string]string{"replicas": "int", "env": "enum(dev, staging,prod)"}, task.ArgTypes)
+	require.Equal(t, map[string]string{"retries": "3"}, task.Attributes)
+	require.Equal(t, []string{"dev", "staging", "prod"}, EnumValues(task.ArgTypes["env"]))
+}
+
+func TestParseTaskGroup(t *testing.T) {
+	qf, ok, err := ParseQuakefile(`task build(group: "Compilation", retries: 2) {
+    go build
+}`)
+	require.True(t, ok)
+	require.NoError(t, err)
+	require.Equal(t, "Compilation", qf.Tasks[0].Group)
+	require.Equal(t, map[string]string{"retries": "2"}, qf.Tasks[0].Attributes)
+	require.Empty(t, qf.Tasks[0].Arguments)
+}
+
+func TestParseTaskOutputs(t *testing.T) {
+	qf, ok, err := ParseQuakefile(`task build(target, outputs: ["build/app", "dist/"]) => deps {
+    go build -o build/app
+}`)
+	require.True(t, ok)
+	require.NoError(t, err)
+	require.Equal(t, []string{"build/app", "dist/"}, qf.Tasks[0].Outputs)
+	require.Empty(t, qf.Tasks[0].Attributes)
+	require.Equal(t, []string{"target"}, qf.Tasks[0].Arguments)
+}
+
+func TestParseFrontMatter(t *testing.T) {
+	input := `---
+# Defaults for everyone
+shell: bash -eu
+color: "never"
+---
+task build {
+    go build
+}
+`
+	qf, ok, err := ParseQuakefile(input)
+	require.True(t, ok)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"shell": "bash -eu", "color": "never"}, qf.Config)
+	require.Equal(t, "build", qf.Tasks[0].Name)
+
+	// Positions after the block are unchanged
+	qf, err = ParseQuakefileWithSpans(input, "Quakefile")
+	require.NoError(t, err)
+	require.Equal(t, 6, qf.Tasks[0].Span.StartLine)
+
+	_, _, err = ParseQuakefile("---\nshell bash\n---\n")
+	require.EqualError(t, err, "invalid front matter on line 2: expected key: value")
+	_, _, err = ParseQuakefile("---\nshell: bash\n")
+	require.EqualError(t, err, "front matter isn't closed with ---")
+}
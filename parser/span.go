@@ -0,0 +1,209 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	p "github.com/lab47/peggysue"
+)
+
+// Span is where a node was found in its source, for tools like language
+// servers. Offsets are in bytes from the start of the input, with End just
+// past the node. Lines and columns start at 1; columns count bytes.
+type Span struct {
+	Start     int `json:"start"`
+	End       int `json:"end"`
+	StartLine int `json:"start_line"`
+	StartCol  int `json:"start_col"`
+	EndLine   int `json:"end_line"`
+	EndCol    int `json:"end_col"`
+}
+
+// spanned is an element of a Quakefile along with where it was matched.
+// peggysue reports the position through SetPosition.
+type spanned struct {
+	value      any
+	start, end int
+}
+
+func (s *spanned) SetPosition(start, end, line int, filename string) {
+	s.start, s.end = start, end
+}
+
+// withSpan records where the elements matched by rule are
+func withSpan(rule p.Rule) p.Rule {
+	return p.Action(p.Named("value", rule), func(v p.Values) any {
+		return &spanned{value: v.Get("value")}
+	})
+}
+
+// unwrapSpan returns the element matched by a withSpan rule, with the offsets
+// of tasks, variables and namespaces recorded in their Span
+func unwrapSpan(element any) any {
+	s, ok := element.(*spanned)
+	if !ok {
+		return element
+	}
+	span := &Span{Start: s.start, End: s.end}
+	switch e := s.value.(type) {
+	case Task:
+		e.Span = span
+		return e
+	case Variable:
+		e.Span = span
+		return e
+	case Namespace:
+		e.Span = span
+		return e
+	}
+	return s.value
+}
+
+// ParseQuakefileWithSpans parses a Quakefile like ParseQuakefileWithSource,
+// recording where each task, variable, namespace and command is in input.
+// Tasks generated by a matrix block have no span.
+func ParseQuakefileWithSpans(input string, file string) (QuakeFile, error) {
+	qf, ok, err := parseQuakefile(input, file)
+	if err != nil {
+		return QuakeFile{}, err
+	}
+	if !ok {
+		return QuakeFile{}, fmt.Errorf("failed to parse %s", file)
+	}
+
+	r := spanResolver{input: input, lineStarts: []int{0}}
+	for i, c := range input {
+		if c == '\n' {
+			r.lineStarts = append(r.lineStarts, i+1)
+		}
+	}
+	r.tasks(qf.Tasks)
+	r.variables(qf.Variables)
+	r.namespaces(qf.Namespaces)
+	return qf, nil
+}
+
+// spanResolver fills in the lines and columns of spans from their offsets
+type spanResolver struct {
+	input      string
+	lineStarts []int // Offset of the start of each line
+}
+
+// taskHeader matches the start of a task definition, after any doc comment
+var taskHeader = regexp.MustCompile(`(?m)^[ \t]*task[ \t]`)
+
+func (r spanResolver) tasks(tasks []Task) {
+	for i := range tasks {
+		task := &tasks[i]
+		if task.Span == nil {
+			continue
+		}
+		r.resolve(task.Span)
+
+		// Commands are found in the body, after the header's {
+		text := r.input[task.Span.Start:task.Span.End]
+		header := taskHeader.FindStringIndex(text)
+		if header == nil {
+			continue
+		}
+		open := strings.Index(text[header[1]:], "{")
+		if open < 0 {
+			continue
+		}
+		r.commands(task.Commands, task.Span.Start+header[1]+open+1, task.Span.End)
+	}
+}
+
+func (r spanResolver) variables(vars []Variable) {
+	for i := range vars {
+		if vars[i].Span != nil {
+			r.resolve(vars[i].Span)
+		}
+	}
+}
+
+func (r spanResolver) namespaces(namespaces []Namespace) {
+	for i := range namespaces {
+		ns := &namespaces[i]
+		if ns.Span != nil {
+			r.resolve(ns.Span)
+		}
+		r.tasks(ns.Tasks)
+		r.variables(ns.Variables)
+		r.namespaces(ns.Namespaces)
+	}
+}
+
+// commands finds each command's source in input[start:end] by its Raw text,
+// in order
+func (r spanResolver) commands(cmds []Command, start, end int) {
+	cursor := start
+	for i := range cmds {
+		cmd := &cmds[i]
+		if cmd.Raw == "" {
+			continue
+		}
+		lines := strings.Split(cmd.Raw, "\n")
+		first := strings.Index(r.input[cursor:end], lines[0])
+		if first < 0 {
+			continue
+		}
+		cmdStart := cursor + first
+		last := strings.Index(r.input[cmdStart:end], lines[len(lines)-1])
+		if last < 0 {
+			continue
+		}
+		cmdEnd := cmdStart + last + len(lines[len(lines)-1])
+
+		cmd.Span = &Span{Start: cmdStart, End: cmdEnd}
+		r.resolve(cmd.Span)
+		r.commands(cmd.Parallel, cmdStart, cmdEnd)
+		cursor = cmdEnd
+	}
+}
+
+// resolve trims trailing whitespace from a span and sets its lines and
+// columns
+func (r spanResolver) resolve(span *Span) {
+	span.End = span.Start + len(strings.TrimRight(r.input[span.Start:span.End], " \t\r\n"))
+	span.StartLine, span.StartCol = r.position(span.Start)
+	span.EndLine, span.EndCol = r.position(span.End)
+}
+
+// position returns the line and column of an offset
+func (r spanResolver) position(offset int) (int, int) {
+	line := 0
+	for line+1 < len(r.lineStarts) && r.lineStarts[line+1] <= offset {
+		line++
+	}
+	return line + 1, offset - r.lineStarts[line] + 1
+}
+
+// clearSpans removes the spans recorded while parsing, which only
+// ParseQuakefileWithSpans reports
+func clearSpans(qf *QuakeFile) {
+	clearTaskSpans(qf.Tasks)
+	for i := range qf.Variables {
+		qf.Variables[i].Span = nil
+	}
+	clearNamespaceSpans(qf.Namespaces)
+}
+
+func clearTaskSpans(tasks []Task) {
+	for i := range tasks {
+		tasks[i].Span = nil
+	}
+}
+
+func clearNamespaceSpans(namespaces []Namespace) {
+	for i := range namespaces {
+		ns := &namespaces[i]
+		ns.Span = nil
+		clearTaskSpans(ns.Tasks)
+		for j := range ns.Variables {
+			ns.Variables[j].Span = nil
+		}
+		clearNamespaceSpans(ns.Namespaces)
+	}
+}
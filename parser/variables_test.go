@@ -29,7 +29,46 @@ task info {
 			{
 				Name: "info",
 				Commands: []Command{
-					{Elements: []CommandElement{
+					{Raw: `echo "App: $APP_NAME v$VERSION"`, Elements: []CommandElement{
+						StringElement{Value: "echo \"App: "},
+						VariableElement{Name: "APP_NAME"},
+						StringElement{Value: " v"},
+						VariableElement{Name: "VERSION"},
+						StringElement{Value: "\""},
+					}},
+				},
+			},
+		},
+		Namespaces: []Namespace{},
+	}
+
+	require.Equal(t, expected, result)
+}
+
+func TestParseSingleQuotedVariables(t *testing.T) {
+	input := `VERSION = '1.2.3'
+APP_NAME = 'my "quoted" app'
+PATTERN = '$HOME/*.go'
+
+task info {
+    echo "App: $APP_NAME v$VERSION"
+}`
+
+	result, ok, err := ParseQuakefile(input)
+	require.True(t, ok, "parsing should succeed")
+	require.NoError(t, err, "should not return error")
+
+	expected := QuakeFile{
+		Variables: []Variable{
+			{Name: "VERSION", Value: `'1.2.3'`},
+			{Name: "APP_NAME", Value: `'my "quoted" app'`},
+			{Name: "PATTERN", Value: `'$HOME/*.go'`},
+		},
+		Tasks: []Task{
+			{
+				Name: "info",
+				Commands: []Command{
+					{Raw: `echo "App: $APP_NAME v$VERSION"`, Elements: []CommandElement{
 						StringElement{Value: "echo \"App: "},
 						VariableElement{Name: "APP_NAME"},
 						StringElement{Value: " v"},
@@ -67,12 +106,12 @@ task version {
 			{
 				Name: "version",
 				Commands: []Command{
-					{Elements: []CommandElement{
+					{Raw: `echo "Commit: $GIT_COMMIT"`, Elements: []CommandElement{
 						StringElement{Value: "echo \"Commit: "},
 						VariableElement{Name: "GIT_COMMIT"},
 						StringElement{Value: "\""},
 					}},
-					{Elements: []CommandElement{
+					{Raw: `echo "Date: $BUILD_DATE"`, Elements: []CommandElement{
 						StringElement{Value: "echo \"Date: "},
 						VariableElement{Name: "BUILD_DATE"},
 						StringElement{Value: "\""},
@@ -114,12 +153,12 @@ task deploy {
 			{
 				Name: "deploy",
 				Commands: []Command{
-					{Elements: []CommandElement{
+					{Raw: `echo "Env: $DEPLOY_ENV"`, Elements: []CommandElement{
 						StringElement{Value: "echo \"Env: "},
 						VariableElement{Name: "DEPLOY_ENV"},
 						StringElement{Value: "\""},
 					}},
-					{Elements: []CommandElement{
+					{Raw: `echo "Key: $API_KEY"`, Elements: []CommandElement{
 						StringElement{Value: "echo \"Key: "},
 						VariableElement{Name: "API_KEY"},
 						StringElement{Value: "\""},
@@ -162,7 +201,7 @@ task help {
 			{
 				Name: "help",
 				Commands: []Command{
-					{Elements: []CommandElement{
+					{Raw: `echo "$HELP_TEXT"`, Elements: []CommandElement{
 						StringElement{Value: "echo \""},
 						VariableElement{Name: "HELP_TEXT"},
 						StringElement{Value: "\""},
@@ -192,14 +231,14 @@ func TestParseTaskLocalVariables(t *testing.T) {
 				Name:      "build",
 				Arguments: []string{"target"},
 				Commands: []Command{
-					{Elements: []CommandElement{
+					{Raw: `TARGET = {{target || "release"}}`, Elements: []CommandElement{
 						StringElement{Value: "TARGET = "},
 						ExpressionElement{Expression: Or{
 							Left:  Identifier{Name: "target"},
 							Right: StringLiteral{Value: "release"},
 						}},
 					}},
-					{Elements: []CommandElement{
+					{Raw: `echo "Building $TARGET"`, Elements: []CommandElement{
 						StringElement{Value: "echo \"Building "},
 						VariableElement{Name: "TARGET"},
 						StringElement{Value: "\""},
@@ -240,7 +279,7 @@ func TestParseNamespaceVariables(t *testing.T) {
 					{
 						Name: "build",
 						Commands: []Command{
-							{Elements: []CommandElement{
+							{Raw: `echo "Building $IMAGE_NAME:$IMAGE_TAG"`, Elements: []CommandElement{
 								StringElement{Value: "echo \"Building "},
 								VariableElement{Name: "IMAGE_NAME"},
 								StringElement{Value: ":"},
@@ -259,3 +298,65 @@ func TestParseNamespaceVariables(t *testing.T) {
 
 	require.Equal(t, expected, result)
 }
+
+func TestParseExportedVariables(t *testing.T) {
+	input := `export CGO_ENABLED = "0"
+export GIT_SHA = ` + "`" + `git rev-parse HEAD` + "`" + `
+LOCAL = "only-substituted"
+
+namespace build {
+    export GOOS = "linux"
+}`
+
+	result, ok, err := ParseQuakefile(input)
+	require.True(t, ok, "parsing should succeed")
+	require.NoError(t, err, "should not return error")
+
+	require.Equal(t, []Variable{
+		{Name: "CGO_ENABLED", Value: `"0"`, Exported: true},
+		{Name: "GIT_SHA", Value: "`git rev-parse HEAD`", CommandSubstitution: true, Exported: true},
+		{Name: "LOCAL", Value: `"only-substituted"`},
+	}, result.Variables)
+	require.Equal(t, []Variable{
+		{Name: "GOOS", Value: `"linux"`, Exported: true},
+	}, result.Namespaces[0].Variables)
+}
+
+func TestParseShellDirective(t *testing.T) {
+	input := `shell = "bash -eo pipefail"
+VERSION = "1.0"
+
+task check(shell: "zsh") {
+    [[ -n "$VERSION" ]]
+}`
+
+	result, ok, err := ParseQuakefile(input)
+	require.True(t, ok, "parsing should succeed")
+	require.NoError(t, err, "should not return error")
+
+	require.Equal(t, "bash -eo pipefail", result.Shell)
+	require.Equal(t, []Variable{{Name: "VERSION", Value: `"1.0"`}}, result.Variables, "shell is a directive, not a variable")
+	require.Equal(t, map[string]string{"shell": "zsh"}, result.Tasks[0].Attributes)
+}
+
+func TestParseAppendVariables(t *testing.T) {
+	input := `CFLAGS = "-O2"
+CFLAGS += "-g"
+CFLAGS+='-Wall'
+
+task build {
+    set CFLAGS += "-DDEBUG"
+    cc $CFLAGS main.c
+}`
+
+	result, ok, err := ParseQuakefile(input)
+	require.True(t, ok, "parsing should succeed")
+	require.NoError(t, err, "should not return error")
+
+	require.Equal(t, []Variable{
+		{Name: "CFLAGS", Value: `"-O2"`},
+		{Name: "CFLAGS", Value: `"-g"`, Append: true},
+		{Name: "CFLAGS", Value: `'-Wall'`, Append: true},
+	}, result.Variables)
+	require.Equal(t, &Variable{Name: "CFLAGS", Value: `"-DDEBUG"`, Append: true}, result.Tasks[0].Commands[0].Set)
+}
@@ -0,0 +1,394 @@
+package quake
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"miren.dev/quake/internal/gotasks"
+	"miren.dev/quake/parser"
+)
+
+// Check loads the Quakefile at mainPath with its .quake files and Go tasks
+// and reports problems without running anything: files that fail to load,
+// duplicate tasks, dependencies and onerror handlers that aren't tasks,
+// dependency cycles, undefined variables used in commands, and Go functions
+// that can't be tasks. Warnings, like tasks that shadow common commands, are
+// returned separately since they aren't problems. The error is only set if
+// the main Quakefile can't be loaded.
+func Check(mainPath string) (findings, warnings []string, err error) {
+	qf, err := load(mainPath, false, func(err error) {
+		findings = append(findings, err.Error())
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, err := range duplicateTasks(qf) {
+		findings = append(findings, err.Error())
+	}
+
+	baseDir := filepath.Dir(mainPath)
+	findings = append(findings, checkDependencies(qf, baseDir)...)
+	findings = append(findings, checkCycles(qf)...)
+	findings = append(findings, checkVariables(qf)...)
+
+	for _, dir := range qtasksDirs(baseDir) {
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		problems, err := gotasks.CheckTasks(dir)
+		if err != nil {
+			findings = append(findings, fmt.Sprintf("failed to check Go tasks in %s: %v", dir, err))
+			continue
+		}
+		findings = append(findings, problems...)
+	}
+
+	return findings, Shadowed(qf), nil
+}
+
+// checkDependencies reports dependencies that are neither tasks nor files,
+// and onerror handlers that aren't tasks
+func checkDependencies(qf *parser.QuakeFile, baseDir string) []string {
+	var findings []string
+	if qf.OnError != "" && qf.FindTask(qf.OnError) == nil {
+		findings = append(findings, fmt.Sprintf("onerror handler '%s' is not a task", qf.OnError))
+	}
+	walkTasks(qf, func(name string, task *parser.Task, _ []parser.Variable) {
+		if handler := task.Attributes["onerror"]; handler != "" && qf.FindTask(handler) == nil {
+			findings = append(findings, fmt.Sprintf("%s: task '%s' has onerror handler '%s', which is not a task", sourceName(*task), name, handler))
+		}
+		for _, dep := range task.Dependencies {
+			if parser.IsTaskPattern(dep) {
+				if _, err := qf.ExpandDependency(dep); err != nil {
+					findings = append(findings, fmt.Sprintf("%s: task '%s': %v", sourceName(*task), name, err))
+				}
+				continue
+			}
+			if qf.FindTask(dep) != nil {
+				continue
+			}
+			path := dep
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(baseDir, path)
+			}
+			if _, err := os.Stat(path); err == nil {
+				continue
+			}
+			findings = append(findings, fmt.Sprintf("%s: task '%s' depends on undefined task '%s'", sourceName(*task), name, dep))
+		}
+	})
+	return findings
+}
+
+// checkCycles reports each dependency cycle once, starting from the first
+// task in the cycle that was defined
+func checkCycles(qf *parser.QuakeFile) []string {
+	var names []string
+	deps := make(map[string][]string)
+	walkTasks(qf, func(name string, task *parser.Task, _ []parser.Variable) {
+		if _, ok := deps[name]; !ok {
+			names = append(names, name)
+		}
+		for _, dep := range task.Dependencies {
+			// Patterns that match nothing are reported by checkDependencies
+			matches, _ := qf.ExpandDependency(dep)
+			for _, match := range matches {
+				if match != name {
+					deps[name] = append(deps[name], match)
+				}
+			}
+		}
+	})
+
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int)
+	var findings []string
+	var path []string
+
+	var visit func(name string)
+	visit = func(name string) {
+		state[name] = visiting
+		path = append(path, name)
+		for _, dep := range deps[name] {
+			switch state[dep] {
+			case visiting:
+				// Walk back to where the cycle starts
+				start := len(path) - 1
+				for path[start] != dep {
+					start--
+				}
+				cycle := append(append([]string{}, path[start:]...), dep)
+				findings = append(findings, fmt.Sprintf("dependency cycle: %s", strings.Join(cycle, " => ")))
+			case unvisited:
+				if _, ok := deps[dep]; ok {
+					visit(dep)
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = done
+	}
+
+	for _, name := range names {
+		if state[name] == unvisited {
+			visit(name)
+		}
+	}
+	return findings
+}
+
+var (
+	// Names assigned by the shell or as task-local variables in a command
+	shellAssignPattern = regexp.MustCompile(`(?:^|[\s;&|(])([A-Za-z_][A-Za-z0-9_]*)\+?=`)
+	localAssignPattern = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_]*)\s*\+?=`)
+	forLoopPattern     = regexp.MustCompile(`\bfor\s+([A-Za-z_][A-Za-z0-9_]*)\s+in\b`)
+	readPattern        = regexp.MustCompile(`\bread\s+(?:-\S+\s+)*([A-Za-z_][A-Za-z0-9_]*)`)
+)
+
+// checkVariables reports $VAR references in commands that aren't a Quakefile
+// variable, a task argument, assigned within the task, or set in the
+// environment
+func checkVariables(qf *parser.QuakeFile) []string {
+	global := make(map[string]bool)
+	for _, v := range qf.Variables {
+		global[v.Name] = true
+	}
+
+	var findings []string
+	walkTasks(qf, func(name string, task *parser.Task, scope []parser.Variable) {
+		known := make(map[string]bool)
+		for _, v := range scope {
+			known[v.Name] = true
+		}
+		for _, arg := range task.Arguments {
+			known[strings.TrimSuffix(arg, "...")] = true
+		}
+		forEachCommand(task.Commands, func(cmd parser.Command) {
+			if cmd.Set != nil {
+				known[cmd.Set.Name] = true
+			}
+			for i, elem := range cmd.Elements {
+				str, ok := elem.(parser.StringElement)
+				if !ok {
+					continue
+				}
+				if i == 0 {
+					if m := localAssignPattern.FindStringSubmatch(str.Value); m != nil {
+						known[m[1]] = true
+					}
+				}
+				for _, pattern := range []*regexp.Regexp{shellAssignPattern, forLoopPattern, readPattern} {
+					for _, m := range pattern.FindAllStringSubmatch(str.Value, -1) {
+						known[m[1]] = true
+					}
+				}
+			}
+		})
+
+		reported := make(map[string]bool)
+		forEachCommand(task.Commands, func(cmd parser.Command) {
+			for _, elem := range cmd.Elements {
+				ref, ok := elem.(parser.VariableElement)
+				if !ok || reported[ref.Name] || global[ref.Name] || known[ref.Name] {
+					continue
+				}
+				// Positional parameters like $1 belong to the shell
+				if ref.Name[0] >= '0' && ref.Name[0] <= '9' {
+					continue
+				}
+				if _, ok := os.LookupEnv(ref.Name); ok {
+					continue
+				}
+				reported[ref.Name] = true
+				findings = append(findings, fmt.Sprintf("%s: task '%s' uses undefined variable $%s", sourceName(*task), name, ref.Name))
+			}
+		})
+	})
+	return findings
+}
+
+// forEachCommand calls fn for every command, including those in parallel blocks
+func forEachCommand(cmds []parser.Command, fn func(parser.Command)) {
+	for _, cmd := range cmds {
+		if cmd.Parallel != nil {
+			forEachCommand(cmd.Parallel, fn)
+			continue
+		}
+		fn(cmd)
+	}
+}
+
+// variableUsePattern matches $NAME and ${NAME} in text the shell expands
+var variableUsePattern = regexp.MustCompile(`\$\{?([A-Za-z_][A-Za-z0-9_]*)`)
+
+// Unused reports top-level variables and task arguments that no command or
+// variable refers to. Exported variables count as used, since the commands'
+// subprocesses can read them.
+func Unused(qf *parser.QuakeFile) []string {
+	used := make(map[string]bool)
+	for _, v := range qf.Variables {
+		variableUses(v, used)
+	}
+	var findings []string
+	walkTasks(qf, func(name string, task *parser.Task, scope []parser.Variable) {
+		for _, v := range scope {
+			variableUses(v, used)
+		}
+		if task.IsGoTask {
+			return
+		}
+
+		taskUsed := make(map[string]bool)
+		forEachCommand(task.Commands, func(cmd parser.Command) {
+			commandUses(cmd, taskUsed)
+		})
+		for _, arg := range task.Arguments {
+			arg = strings.TrimSuffix(arg, "...")
+			if !taskUsed[arg] {
+				findings = append(findings, fmt.Sprintf("%s: task '%s' never uses its argument '%s'", sourceName(*task), name, arg))
+			}
+		}
+		for n := range taskUsed {
+			used[n] = true
+		}
+	})
+
+	var unused []string
+	for _, v := range qf.Variables {
+		if !v.Exported && !used[v.Name] {
+			unused = append(unused, fmt.Sprintf("variable '%s' is never used", v.Name))
+		}
+	}
+	return append(unused, findings...)
+}
+
+// shadowedCommands are shell built-ins and common commands that a task
+// shouldn't be named after, since running the task by mistake instead of the
+// command (or the other way around) is easy
+var shadowedCommands = map[string]string{
+	"cd":     "shell built-in",
+	"echo":   "shell built-in",
+	"eval":   "shell built-in",
+	"exec":   "shell built-in",
+	"exit":   "shell built-in",
+	"export": "shell built-in",
+	"read":   "shell built-in",
+	"set":    "shell built-in",
+	"source": "shell built-in",
+	"test":   "shell built-in",
+	"type":   "shell built-in",
+	"unset":  "shell built-in",
+	"wait":   "shell built-in",
+	"cat":    "command",
+	"chmod":  "command",
+	"cp":     "command",
+	"diff":   "command",
+	"find":   "command",
+	"git":    "command",
+	"go":     "command",
+	"grep":   "command",
+	"kill":   "command",
+	"ls":     "command",
+	"make":   "command",
+	"mkdir":  "command",
+	"mv":     "command",
+	"rm":     "command",
+	"sed":    "command",
+	"sort":   "command",
+	"ssh":    "command",
+	"tar":    "command",
+	"touch":  "command",
+}
+
+// Shadowed reports top-level tasks named like a shell built-in or common
+// command, such as ls, cd or test. Namespaced tasks can't be mistaken for
+// one.
+func Shadowed(qf *parser.QuakeFile) []string {
+	var warnings []string
+	for _, task := range qf.Tasks {
+		if kind, ok := shadowedCommands[task.Name]; ok {
+			warnings = append(warnings, fmt.Sprintf("%s: task '%s' shadows the %s %s", sourceName(task), task.Name, kind, task.Name))
+		}
+	}
+	return warnings
+}
+
+// commandUses records the variables a command refers to
+func commandUses(cmd parser.Command, used map[string]bool) {
+	if cmd.Set != nil {
+		variableUses(*cmd.Set, used)
+	}
+	if cmd.Condition != nil {
+		expressionUses(cmd.Condition, used)
+	}
+	for _, elem := range cmd.Elements {
+		switch el := elem.(type) {
+		case parser.VariableElement:
+			used[el.Name] = true
+		case parser.StringElement:
+			textUses(el.Value, used)
+		case parser.BacktickElement:
+			textUses(el.Command, used)
+		case parser.ExpressionElement:
+			expressionUses(el.Expression, used)
+		}
+	}
+}
+
+// variableUses records the variables a variable's value refers to
+func variableUses(v parser.Variable, used map[string]bool) {
+	switch value := v.Value.(type) {
+	case string:
+		textUses(value, used)
+	case parser.Expression:
+		expressionUses(value, used)
+	}
+}
+
+// textUses records $NAME and ${NAME} references in text
+func textUses(text string, used map[string]bool) {
+	for _, m := range variableUsePattern.FindAllStringSubmatch(text, -1) {
+		used[m[1]] = true
+	}
+}
+
+// expressionUses records the identifiers an expression refers to. env.NAME
+// counts as a use of NAME, since it reads Quakefile variables too.
+func expressionUses(expr parser.Expression, used map[string]bool) {
+	switch ex := expr.(type) {
+	case parser.Identifier:
+		used[ex.Name] = true
+	case parser.AccessId:
+		if id, ok := ex.Object.(parser.Identifier); ok && id.Name == "env" {
+			used[ex.Property] = true
+		}
+	case parser.Or:
+		expressionUses(ex.Left, used)
+		expressionUses(ex.Right, used)
+	case parser.And:
+		expressionUses(ex.Left, used)
+		expressionUses(ex.Right, used)
+	case parser.Concat:
+		expressionUses(ex.Left, used)
+		expressionUses(ex.Right, used)
+	case parser.Compare:
+		expressionUses(ex.Left, used)
+		expressionUses(ex.Right, used)
+	case parser.FuncCall:
+		for _, arg := range ex.Args {
+			expressionUses(arg, used)
+			// env.require("NAME") reads NAME like env.NAME
+			if lit, ok := arg.(parser.StringLiteral); ok && ex.Name == "env.require" {
+				used[lit.Value] = true
+			}
+		}
+	}
+}
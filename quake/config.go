@@ -0,0 +1,79 @@
+package quake
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+
+	"miren.dev/quake/parser"
+)
+
+// applyConfig applies the front matter settings of the main Quakefile:
+//
+//	shell: the shell commands run with, unless a shell = "..." directive says otherwise
+//	shell_flags: flags passed to the shell before -c, unless a shell_flags = "..." directive says otherwise
+//	container_runtime: what runs tasks with a run_in attribute, like podman (default docker)
+//	jobs: how many commands of a parallel block run at once, unless --jobs says otherwise
+//	color: always, never or auto, unless --color says otherwise (see Color)
+//
+// The settings the evaluator or the caller reads are only checked here.
+// quake has no profiles to pick from, so a profile setting is reported as
+// unsupported. Unknown settings and invalid values are reported to warn.
+func applyConfig(qf *parser.QuakeFile, source string, warn func(error)) {
+	for _, key := range slices.Sorted(maps.Keys(qf.Config)) {
+		value := qf.Config[key]
+		switch key {
+		case "shell":
+			if qf.Shell == "" {
+				qf.Shell = value
+			}
+		case "shell_flags":
+			if qf.ShellFlags == "" {
+				qf.ShellFlags = value
+			}
+		case "container_runtime":
+			// Read by the evaluator
+		case "jobs":
+			if n, err := strconv.Atoi(value); err != nil || n < 1 {
+				warn(fmt.Errorf("invalid jobs setting %q in the front matter of %s (expected a positive number)", value, source))
+			}
+		case "color":
+			if !validColor(value) {
+				warn(fmt.Errorf("invalid color setting %q in the front matter of %s (expected: always, never or auto)", value, source))
+			}
+		case "profile":
+			warn(fmt.Errorf("setting 'profile' in the front matter of %s isn't supported", source))
+		default:
+			warn(fmt.Errorf("unknown setting '%s' in the front matter of %s", key, source))
+		}
+	}
+}
+
+// validColor reports whether value is a color setting: always, never or auto,
+// or true or false for always or never
+func validColor(value string) bool {
+	switch value {
+	case "always", "never", "auto", "true", "false":
+		return true
+	}
+	return false
+}
+
+// Color returns whether quake should use colors for the loaded Quakefile qf:
+// always, never or auto. opts.Color wins over the front matter's color
+// setting, and an invalid setting counts as auto. Applying it is up to the
+// caller.
+func Color(qf *parser.QuakeFile, opts Options) string {
+	value := opts.Color
+	if value == "" {
+		value = qf.Config["color"]
+	}
+	switch value {
+	case "always", "true":
+		return "always"
+	case "never", "false":
+		return "never"
+	}
+	return "auto"
+}
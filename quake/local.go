@@ -0,0 +1,89 @@
+package quake
+
+import "miren.dev/quake/parser"
+
+// localSuffix names the personal, uncommitted counterpart of a Quakefile:
+// Quakefile.local next to Quakefile
+const localSuffix = ".local"
+
+// overrideWith applies a Quakefile.local to the loaded Quakefile. Precedence,
+// lowest first: the Quakefile, its .quake files and Go tasks, then the local
+// file. A task or variable in the local file replaces the one of the same name
+// (in the same namespace) instead of being reported as a duplicate, and
+// anything new is added. Its shell, shell_flags, onerror, on_missing and
+// gotasks settings win too.
+func overrideWith(qf *parser.QuakeFile, local parser.QuakeFile) {
+	qf.Tasks, qf.Variables, qf.Namespaces = overrideScope(
+		qf.Tasks, qf.Variables, qf.Namespaces,
+		local.Tasks, local.Variables, local.Namespaces,
+	)
+
+	if local.Shell != "" {
+		qf.Shell = local.Shell
+	}
+	if local.ShellFlags != "" {
+		qf.ShellFlags = local.ShellFlags
+	}
+	if local.OnError != "" {
+		qf.OnError = local.OnError
+	}
+	if local.OnMissing != "" {
+		qf.OnMissing = local.OnMissing
+	}
+	if local.GoTasks != nil {
+		qf.GoTasks = local.GoTasks
+	}
+}
+
+// overrideScope merges the tasks, variables and namespaces of one scope of a
+// local file into those of the Quakefile. Replaced definitions keep their
+// position, so variables that refer to an overridden one see the new value.
+func overrideScope(tasks []parser.Task, vars []parser.Variable, namespaces []parser.Namespace,
+	localTasks []parser.Task, localVars []parser.Variable, localNamespaces []parser.Namespace,
+) ([]parser.Task, []parser.Variable, []parser.Namespace) {
+	for _, task := range localTasks {
+		replaced := false
+		for i := range tasks {
+			if tasks[i].Name == task.Name {
+				tasks[i] = task
+				replaced = true
+			}
+		}
+		if !replaced {
+			tasks = append(tasks, task)
+		}
+	}
+
+	for _, v := range localVars {
+		replaced := false
+		for i := range vars {
+			// NAME += value extends the Quakefile's value, so it goes last
+			if vars[i].Name == v.Name && !v.Append {
+				vars[i] = v
+				replaced = true
+			}
+		}
+		if !replaced {
+			vars = append(vars, v)
+		}
+	}
+
+	for _, ns := range localNamespaces {
+		replaced := false
+		for i := range namespaces {
+			if namespaces[i].Name == ns.Name {
+				n := &namespaces[i]
+				n.Tasks, n.Variables, n.Namespaces = overrideScope(
+					n.Tasks, n.Variables, n.Namespaces,
+					ns.Tasks, ns.Variables, ns.Namespaces,
+				)
+				replaced = true
+			}
+		}
+		if !replaced {
+			namespaces = append(namespaces, ns)
+		}
+	}
+
+	return tasks, vars, namespaces
+}
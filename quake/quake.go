@@ -0,0 +1,547 @@
+// Package quake loads and runs Quakefiles. It is the API behind the quake
+// command and can be used to embed quake in other Go programs.
+package quake
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"miren.dev/quake/evaluator"
+	"miren.dev/quake/internal/glob"
+	"miren.dev/quake/internal/gotasks"
+	"miren.dev/quake/parser"
+)
+
+// Options control how Quakefiles are loaded and tasks are run
+type Options struct {
+	AlwaysMake     bool // Run file targets even if they are up to date
+	CaptureOutput  int  // Lines of a failing command's output to attach to its error
+	AllowOverrides bool // Let a task be defined more than once; the first definition wins
+	StrictVars     bool // Fail if a VAR = `cmd` command substitution fails
+	CleanEnv       bool // Run commands with only PATH, HOME, TERM and exported variables
+	WarnUnused     bool // Warn about variables and task arguments that are never used
+	WarnShadow     bool // Warn about tasks named like shell built-ins or common commands
+
+	// AssumeYes runs tasks with a confirm attribute without asking
+	AssumeYes bool
+
+	// Jobs, if set, is how many commands of a parallel block run at once,
+	// overriding the front matter's jobs setting
+	Jobs int
+
+	// Color is always, never or auto, overriding the front matter's color
+	// setting (see Color)
+	Color string
+
+	// NoRemote loads remote .quake files only from the cache, never the network
+	NoRemote bool
+
+	// Since, if set, is a git ref; tasks with an inputs attribute are skipped
+	// when none of their input files changed since it
+	Since string
+
+	// Variables override the Quakefile's variables, like `make VAR=value`
+	Variables map[string]string
+
+	// Timings, if set, records how long each task runs
+	Timings *evaluator.Timings
+
+	// Trace, if set, records when each task and command runs
+	Trace *evaluator.Trace
+
+	// PrintEnv prints the resolved variables to stderr before running, with
+	// secrets masked unless PrintEnvFull is set
+	PrintEnv     bool
+	PrintEnvFull bool
+}
+
+// Run executes a task from a loaded Quakefile. An empty task name runs the
+// default task. Commands run in the current working directory.
+func Run(qf *parser.QuakeFile, task string, args []string) error {
+	return RunWithOptions(qf, task, args, Options{})
+}
+
+// RunWithOptions executes a task from a loaded Quakefile with the given options
+func RunWithOptions(qf *parser.QuakeFile, task string, args []string, opts Options) error {
+	return NewEvaluator(qf, opts).RunTaskWithArgs(task, args)
+}
+
+// NewEvaluator creates an evaluator for a loaded Quakefile with the given
+// options. Running several tasks with it shares the results of task() calls
+// and command substitutions between them. An earlier evaluator.Interrupt
+// doesn't stop it from running commands.
+func NewEvaluator(qf *parser.QuakeFile, opts Options) *evaluator.Evaluator {
+	evaluator.ResetInterrupt()
+	eval := evaluator.NewWithOverrides(qf, opts.Variables)
+	eval.SetAlwaysMake(opts.AlwaysMake)
+	eval.SetCaptureOutput(opts.CaptureOutput)
+	eval.SetTimings(opts.Timings)
+	eval.SetTrace(opts.Trace)
+	eval.SetSince(opts.Since)
+	eval.SetAssumeYes(opts.AssumeYes)
+	eval.SetStrictVariables(opts.StrictVars)
+	eval.SetCleanEnv(opts.CleanEnv)
+	eval.SetJobs(opts.Jobs)
+	if opts.PrintEnv || opts.PrintEnvFull {
+		eval.PrintEnv(os.Stderr, opts.PrintEnvFull)
+	}
+	return eval
+}
+
+// RunFile loads the Quakefile at path and runs a task from the Quakefile's
+// directory, restoring the working directory afterwards
+func RunFile(path string, task string, args []string) (err error) {
+	quakefilePath, err := Find(path)
+	if err != nil {
+		return err
+	}
+
+	originalDir, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get current directory: %w", err)
+	}
+	if err := os.Chdir(filepath.Dir(quakefilePath)); err != nil {
+		return fmt.Errorf("failed to change to Quakefile directory: %w", err)
+	}
+	defer func() {
+		if chdirErr := os.Chdir(originalDir); chdirErr != nil && err == nil {
+			err = fmt.Errorf("failed to return to %s: %w", originalDir, chdirErr)
+		}
+	}()
+
+	qf, err := Load(quakefilePath)
+	if err != nil {
+		return err
+	}
+	return Run(qf, task, args)
+}
+
+// Cleanup removes the Go task dispatchers generated while loading Quakefiles
+func Cleanup() {
+	if taskCache != nil {
+		taskCache.Cleanup()
+	}
+}
+
+// qtasksDirs returns the directories searched for .quake files and Go tasks
+func qtasksDirs(baseDir string) []string {
+	return []string{
+		filepath.Join(baseDir, "qtasks"),
+		filepath.Join(baseDir, "lib", "qtasks"),
+		filepath.Join(baseDir, "internal", "qtasks"),
+	}
+}
+
+// knownOS lists the GOOS values recognized in names like build.linux.quake
+var knownOS = map[string]bool{
+	"aix": true, "android": true, "darwin": true, "dragonfly": true,
+	"freebsd": true, "illumos": true, "ios": true, "js": true, "linux": true,
+	"netbsd": true, "openbsd": true, "plan9": true, "solaris": true,
+	"wasip1": true, "windows": true,
+}
+
+// forThisOS reports whether a .quake file loads on this OS. One named like
+// build.linux.quake only loads when runtime.GOOS is linux; other names, like
+// build.quake or docker.compose.quake, always load.
+func forThisOS(path string) bool {
+	name := strings.TrimSuffix(filepath.Base(path), ".quake")
+	goos := strings.TrimPrefix(filepath.Ext(name), ".")
+	return !knownOS[goos] || goos == runtime.GOOS
+}
+
+// findQuakeFiles finds all .quake files in the qtasks directories and those
+// matching the Quakefile's load patterns, leaving out those for another OS
+func findQuakeFiles(baseDir string, loads []string) []string {
+	var quakeFiles []string
+
+	for _, dir := range qtasksDirs(baseDir) {
+		// Check if directory exists
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			continue
+		}
+
+		// Find all .quake files in the directory
+		files, err := filepath.Glob(filepath.Join(dir, "*.quake"))
+		if err != nil {
+			continue
+		}
+
+		for _, file := range files {
+			if forThisOS(file) {
+				quakeFiles = append(quakeFiles, file)
+			}
+		}
+	}
+
+	// Add files from load directives, skipping any already found
+	seen := make(map[string]bool, len(quakeFiles))
+	for _, file := range quakeFiles {
+		seen[file] = true
+	}
+	for _, pattern := range loads {
+		if isRemote(pattern) {
+			continue
+		}
+		files, err := glob.Files(baseDir, pattern)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: invalid load pattern %q: %v\n", pattern, err)
+			continue
+		}
+		for _, file := range files {
+			if !seen[file] && forThisOS(file) {
+				seen[file] = true
+				quakeFiles = append(quakeFiles, file)
+			}
+		}
+	}
+
+	return quakeFiles
+}
+
+// mergeQuakefiles merges multiple QuakeFile structs into one
+func mergeQuakefiles(files ...parser.QuakeFile) parser.QuakeFile {
+	result := parser.QuakeFile{}
+
+	for _, file := range files {
+		result.Tasks = append(result.Tasks, file.Tasks...)
+		result.Variables = append(result.Variables, file.Variables...)
+		result.Namespaces = append(result.Namespaces, file.Namespaces...)
+		// The first file to set a shell, shell flags, error handler, on_missing mode or gotasks block wins, so the main Quakefile takes precedence
+		if result.Shell == "" {
+			result.Shell = file.Shell
+		}
+		if result.ShellFlags == "" {
+			result.ShellFlags = file.ShellFlags
+		}
+		if result.OnError == "" {
+			result.OnError = file.OnError
+		}
+		if result.OnMissing == "" {
+			result.OnMissing = file.OnMissing
+		}
+		if result.GoTasks == nil {
+			result.GoTasks = file.GoTasks
+		}
+	}
+
+	return result
+}
+
+// taskCache holds generated Go task dispatchers until Cleanup is called
+var taskCache *gotasks.TaskCache
+
+// discoverGoTasks finds and prepares Go tasks in all qtasks directories
+func discoverGoTasks(baseDir string) ([]parser.Task, error) {
+	var allTasks []parser.Task
+
+	// Create task cache if not exists
+	if taskCache == nil {
+		var err error
+		taskCache, err = gotasks.NewTaskCache()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create task cache: %w", err)
+		}
+	}
+
+	for _, qtasksDir := range qtasksDirs(baseDir) {
+		// Check if directory exists
+		if _, err := os.Stat(qtasksDir); os.IsNotExist(err) {
+			continue
+		}
+
+		// Discover Go functions in this directory
+		taskFuncs, err := gotasks.DiscoverTasks(qtasksDir)
+		if err != nil {
+			// Warning but don't fail
+			fmt.Fprintf(os.Stderr, "Warning: failed to discover Go tasks in %s: %v\n", qtasksDir, err)
+			continue
+		}
+
+		if len(taskFuncs) == 0 {
+			// No Go tasks in this directory
+			continue
+		}
+
+		// Get the dispatcher path for this directory's tasks
+		dispatcherPath, err := taskCache.GetDispatcherPath(taskFuncs, qtasksDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to generate dispatcher for %s: %v\n", qtasksDir, err)
+			continue
+		}
+
+		// Convert discovered functions to Task structs for this directory
+		for _, fn := range taskFuncs {
+			// Use extracted comment as description, or fall back to generic description
+			description := fn.Description
+			if description == "" {
+				description = fmt.Sprintf("Go task from %s", filepath.Base(fn.SourceFile))
+			}
+
+			task := parser.Task{
+				Name:         fn.Name,
+				Description:  description,
+				Arguments:    fn.Params,
+				IsGoTask:     true,
+				GoDispatcher: dispatcherPath,
+				GoSourceDir:  qtasksDir,
+				GoFunction:   fn.FunctionName,
+				SourceFile:   fn.SourceFile,
+				Commands:     []parser.Command{}, // Go tasks don't have shell commands
+			}
+
+			// If task has a namespace, prepend it to the name
+			if fn.Namespace != "" {
+				task.Name = fn.Namespace + ":" + task.Name
+			}
+
+			allTasks = append(allTasks, task)
+		}
+	}
+
+	return allTasks, nil
+}
+
+// Load reads the Quakefile at mainPath and merges in the .quake files and
+// Go tasks found in its qtasks directories. It is an error for two files to
+// define the same task, except for the Quakefile.local next to the
+// Quakefile, whose tasks and variables override the others.
+func Load(mainPath string) (*parser.QuakeFile, error) {
+	return LoadWithOptions(mainPath, Options{})
+}
+
+// LoadErrors loads the Quakefile at mainPath like Load, also returning why
+// the .quake files and Go tasks that were skipped failed to load
+func LoadErrors(mainPath string) (*parser.QuakeFile, []error, error) {
+	var errs []error
+	qf, err := load(mainPath, false, func(err error) {
+		errs = append(errs, err)
+	})
+	return qf, errs, err
+}
+
+// LoadWithOptions is like Load, but allows duplicate task definitions if
+// opts.AllowOverrides is set. The main Quakefile's definition then wins. With
+// opts.WarnUnused, unused variables and task arguments are reported on stderr,
+// and with opts.WarnShadow, tasks that shadow common commands.
+func LoadWithOptions(mainPath string, opts Options) (*parser.QuakeFile, error) {
+	merged, err := load(mainPath, opts.NoRemote, func(err error) {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !opts.AllowOverrides {
+		if dups := duplicateTasks(merged); len(dups) > 0 {
+			return nil, dups[0]
+		}
+	}
+	if opts.WarnUnused {
+		for _, warning := range Unused(merged) {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+		}
+	}
+	if opts.WarnShadow {
+		for _, warning := range Shadowed(merged) {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+		}
+	}
+	return merged, nil
+}
+
+// load reads and merges the Quakefile at mainPath with its .quake files,
+// including remote ones unless noRemote is set, and Go tasks, then applies
+// the Quakefile.local next to it, if any (see overrideWith). Files that can't
+// be loaded are skipped and reported to warn.
+func load(mainPath string, noRemote bool, warn func(error)) (*parser.QuakeFile, error) {
+	// Read and parse the main Quakefile
+	data, err := os.ReadFile(mainPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Quakefile: %w", err)
+	}
+
+	mainResult, ok, err := parser.ParseQuakefileWithSource(string(data), mainPath)
+	if !ok {
+		return nil, fmt.Errorf("failed to parse Quakefile: %w", err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing Quakefile: %w", err)
+	}
+	applyConfig(&mainResult, mainPath, warn)
+
+	// Find and load .quake files from qtasks directories
+	baseDir := filepath.Dir(mainPath)
+	quakeFiles := findQuakeFiles(baseDir, mainResult.Loads)
+
+	var additionalResults []parser.QuakeFile
+	for _, qfile := range quakeFiles {
+		data, err := os.ReadFile(qfile)
+		if err != nil {
+			// Skip files that can't be read
+			warn(fmt.Errorf("failed to read %s: %w", qfile, err))
+			continue
+		}
+
+		result, ok, err := parser.ParseQuakefileWithSource(string(data), qfile)
+		if !ok || err != nil {
+			// Skip files that can't be parsed
+			warn(fmt.Errorf("failed to parse %s: %w", qfile, err))
+			continue
+		}
+
+		additionalResults = append(additionalResults, result)
+	}
+
+	// Fetch .quake files loaded from URLs
+	for _, url := range mainResult.Loads {
+		if !isRemote(url) {
+			continue
+		}
+		data, err := fetchRemote(url, mainResult.LoadChecksums[url], noRemote, warn)
+		if err != nil {
+			warn(err)
+			continue
+		}
+
+		result, ok, err := parser.ParseQuakefileWithSource(string(data), url)
+		if !ok || err != nil {
+			warn(fmt.Errorf("failed to parse %s: %w", url, err))
+			continue
+		}
+
+		additionalResults = append(additionalResults, result)
+	}
+
+	// Discover and add Go tasks
+	goTasks, err := discoverGoTasks(baseDir)
+	if err != nil {
+		// Warning but don't fail
+		warn(fmt.Errorf("failed to discover Go tasks: %w", err))
+	} else if len(goTasks) > 0 {
+		// Add Go tasks as a separate QuakeFile
+		goTasksFile := parser.QuakeFile{
+			Tasks: goTasks,
+		}
+		additionalResults = append(additionalResults, goTasksFile)
+	}
+
+	// Merge all results
+	allResults := append([]parser.QuakeFile{mainResult}, additionalResults...)
+	merged := mergeQuakefiles(allResults...)
+	merged.Config = mainResult.Config // Only the main Quakefile's front matter counts
+	if merged.Dir, err = filepath.Abs(baseDir); err != nil {
+		return nil, fmt.Errorf("failed to resolve Quakefile directory: %w", err)
+	}
+
+	// A Quakefile.local overrides everything else
+	localPath := mainPath + localSuffix
+	if data, err := os.ReadFile(localPath); err == nil {
+		local, ok, err := parser.ParseQuakefileWithSource(string(data), localPath)
+		if !ok || err != nil {
+			warn(fmt.Errorf("failed to parse %s: %w", localPath, err))
+		} else {
+			overrideWith(&merged, local)
+		}
+	}
+	return &merged, nil
+}
+
+// duplicateTasks returns an error for each task that shares a fully-qualified
+// name with an earlier one. Tasks with the same name in different namespaces
+// are distinct.
+func duplicateTasks(qf *parser.QuakeFile) []error {
+	var errs []error
+	sources := make(map[string]string)
+	walkTasks(qf, func(name string, task *parser.Task, _ []parser.Variable) {
+		if first, ok := sources[name]; ok {
+			errs = append(errs, fmt.Errorf("task '%s' is defined in both %s and %s (use --allow-overrides to let the first definition win)", name, first, sourceName(*task)))
+			return
+		}
+		sources[name] = sourceName(*task)
+	})
+	return errs
+}
+
+// walkTasks calls fn for every task in qf with its fully-qualified name and
+// the variables of the namespaces enclosing it
+func walkTasks(qf *parser.QuakeFile, fn func(name string, task *parser.Task, scope []parser.Variable)) {
+	for i := range qf.Tasks {
+		fn(qf.Tasks[i].Name, &qf.Tasks[i], nil)
+	}
+
+	var walkNamespaces func(namespaces []parser.Namespace, prefix string, scope []parser.Variable)
+	walkNamespaces = func(namespaces []parser.Namespace, prefix string, scope []parser.Variable) {
+		for i := range namespaces {
+			ns := &namespaces[i]
+			nsScope := append(append([]parser.Variable{}, scope...), ns.Variables...)
+			for j := range ns.Tasks {
+				fn(prefix+ns.Name+":"+ns.Tasks[j].Name, &ns.Tasks[j], nsScope)
+			}
+			walkNamespaces(ns.Namespaces, prefix+ns.Name+":", nsScope)
+		}
+	}
+	walkNamespaces(qf.Namespaces, "", nil)
+}
+
+// sourceName describes where a task was defined for error messages
+func sourceName(task parser.Task) string {
+	if task.SourceFile == "" {
+		return "an unknown file"
+	}
+	return task.SourceFile
+}
+
+// Find searches for a Quakefile in the current directory and parent directories.
+// If customPath is provided, it validates and returns that path instead; a
+// directory means the Quakefile inside it.
+func Find(customPath string) (string, error) {
+	// If a custom path was provided, use it
+	if customPath != "" {
+		// Convert to absolute path if relative
+		absPath, err := filepath.Abs(customPath)
+		if err != nil {
+			return "", fmt.Errorf("invalid path %s: %w", customPath, err)
+		}
+
+		// Check if file exists
+		info, err := os.Stat(absPath)
+		if err != nil {
+			return "", fmt.Errorf("Quakefile not found at %s: %w", absPath, err)
+		}
+
+		// If a directory was given, look for a Quakefile inside it
+		if info.IsDir() {
+			dirPath := filepath.Join(absPath, "Quakefile")
+			if _, err := os.Stat(dirPath); err != nil {
+				return "", fmt.Errorf("Quakefile not found in directory %s: %w", absPath, err)
+			}
+			return dirPath, nil
+		}
+
+		return absPath, nil
+	}
+
+	// Default behavior: search current and parent directories
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		quakefilePath := filepath.Join(dir, "Quakefile")
+		if _, err := os.Stat(quakefilePath); err == nil {
+			return quakefilePath, nil
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			// We've reached the root directory
+			break
+		}
+		dir = parent
+	}
+
+	return "", fmt.Errorf("no Quakefile found in current directory or any parent directory")
+}
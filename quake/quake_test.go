@@ -0,0 +1,429 @@
+package quake
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"miren.dev/quake/evaluator"
+	"miren.dev/quake/parser"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+}
+
+func TestFindDirectory(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Quakefile"), "task a {\n  echo a\n}\n")
+
+	path, err := Find(dir)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "Quakefile"), path)
+
+	_, err = Find(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+}
+
+func TestLoadMergesQtasks(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Quakefile"), "task build {\n  echo build\n}\n")
+	writeFile(t, filepath.Join(dir, "qtasks", "extra.quake"), "task extra {\n  echo extra\n}\n")
+
+	qf, err := Load(filepath.Join(dir, "Quakefile"))
+	require.NoError(t, err)
+
+	var names []string
+	for _, task := range qf.Tasks {
+		names = append(names, task.Name)
+	}
+	require.ElementsMatch(t, []string{"build", "extra"}, names)
+}
+
+func TestLoadQuakeFilesForThisOS(t *testing.T) {
+	other := "plan9"
+	if runtime.GOOS == other {
+		other = "linux"
+	}
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Quakefile"), "load \"tasks/*.quake\"\n")
+	writeFile(t, filepath.Join(dir, "qtasks", "build.quake"), "task build {\n  echo build\n}\n")
+	writeFile(t, filepath.Join(dir, "qtasks", "build."+runtime.GOOS+".quake"), "task native {\n  echo native\n}\n")
+	writeFile(t, filepath.Join(dir, "qtasks", "build."+other+".quake"), "task foreign {\n  echo foreign\n}\n")
+	writeFile(t, filepath.Join(dir, "qtasks", "docker.compose.quake"), "task compose {\n  echo compose\n}\n")
+	writeFile(t, filepath.Join(dir, "tasks", "release."+other+".quake"), "task release {\n  echo release\n}\n")
+
+	qf, err := Load(filepath.Join(dir, "Quakefile"))
+	require.NoError(t, err)
+
+	var names []string
+	for _, task := range qf.Tasks {
+		names = append(names, task.Name)
+	}
+	require.ElementsMatch(t, []string{"build", "native", "compose"}, names)
+}
+
+func TestRunFile(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Quakefile"), "task touch(name) {\n  touch $name\n}\n")
+
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+
+	require.NoError(t, RunFile(dir, "touch", []string{"out.txt"}))
+
+	// The task ran in the Quakefile's directory and the working directory was restored
+	require.FileExists(t, filepath.Join(dir, "out.txt"))
+	after, err := os.Getwd()
+	require.NoError(t, err)
+	require.Equal(t, cwd, after)
+
+	require.Error(t, RunFile(dir, "missing", nil))
+}
+
+func TestRunAfterInterrupt(t *testing.T) {
+	defer evaluator.ResetInterrupt()
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Quakefile"), "task touch(name) {\n  touch $name\n}\n")
+
+	// An interrupt of an earlier run doesn't stop the next one
+	evaluator.Interrupt(os.Interrupt)
+	require.NoError(t, RunFile(dir, "touch", []string{"out.txt"}))
+	require.FileExists(t, filepath.Join(dir, "out.txt"))
+}
+
+func TestFileFromQuakefileDir(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(t.TempDir(), "out.txt")
+	writeFile(t, filepath.Join(dir, "secrets", "token"), "s3cr3t\n")
+	writeFile(t, filepath.Join(dir, "Quakefile"), "TOKEN = file(\"secrets/token\")\n\ntask show {\n  echo $TOKEN > "+out+"\n}\n")
+
+	qf, err := Load(filepath.Join(dir, "Quakefile"))
+	require.NoError(t, err)
+
+	// Relative paths are from the Quakefile's directory, not the current one
+	t.Chdir(t.TempDir())
+	eval := NewEvaluator(qf, Options{StrictVars: true})
+	require.NoError(t, eval.RunTask("show"))
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "s3cr3t\n", string(data))
+}
+
+func TestLoadDirectiveGlobs(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Quakefile"), "load \"tasks/**/*.quake\"\n\ntask build {\n  echo build\n}\n")
+	writeFile(t, filepath.Join(dir, "tasks", "top.quake"), "task top {\n  echo top\n}\n")
+	writeFile(t, filepath.Join(dir, "tasks", "db", "deep", "migrate.quake"), "task migrate {\n  echo migrate\n}\n")
+	writeFile(t, filepath.Join(dir, "tasks", "notes.txt"), "not a quake file\n")
+
+	qf, err := Load(filepath.Join(dir, "Quakefile"))
+	require.NoError(t, err)
+
+	var names []string
+	for _, task := range qf.Tasks {
+		names = append(names, task.Name)
+	}
+	require.ElementsMatch(t, []string{"build", "top", "migrate"}, names)
+}
+
+func TestLoadDuplicateTasks(t *testing.T) {
+	dir := t.TempDir()
+	mainPath := filepath.Join(dir, "Quakefile")
+	extraPath := filepath.Join(dir, "qtasks", "build.quake")
+	writeFile(t, mainPath, "task build {\n  echo main\n}\n\nnamespace db {\n  task build {\n    echo db\n  }\n}\n")
+	writeFile(t, extraPath, "task build {\n  echo extra\n}\n")
+
+	_, err := Load(mainPath)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "task 'build' is defined in both")
+	require.Contains(t, err.Error(), mainPath)
+	require.Contains(t, err.Error(), extraPath)
+
+	// With overrides allowed, the main Quakefile's definition comes first
+	qf, err := LoadWithOptions(mainPath, Options{AllowOverrides: true})
+	require.NoError(t, err)
+	require.Equal(t, mainPath, qf.Tasks[0].SourceFile)
+}
+
+func TestLoadSameNameInNamespacesIsDistinct(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Quakefile"), "task build {\n  echo main\n}\n")
+	writeFile(t, filepath.Join(dir, "qtasks", "db.quake"), "namespace db {\n  task build {\n    echo db\n  }\n}\n")
+
+	_, err := Load(filepath.Join(dir, "Quakefile"))
+	require.NoError(t, err)
+}
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	mainPath := filepath.Join(dir, "Quakefile")
+	writeFile(t, mainPath, `VERSION = "1.0"
+
+task build => gen, missing {
+    echo "$VERSION $UNDEFINED $HOME $1"
+    for f in *.go; do echo $f; done
+}
+
+task gen(out) => input.txt {
+    OUT = {{out || "gen.txt"}}
+    echo $OUT
+}
+
+task a => b {
+    echo a
+}
+
+task b => a {
+    echo b
+}
+`)
+	writeFile(t, filepath.Join(dir, "input.txt"), "input\n")
+	writeFile(t, filepath.Join(dir, "qtasks", "gen.quake"), "task gen {\n  echo again\n}\n")
+	writeFile(t, filepath.Join(dir, "qtasks", "tasks.go"), "package main\n\nfunc Deploy(count int) {}\n")
+
+	findings, warnings, err := Check(mainPath)
+	require.NoError(t, err)
+	require.Empty(t, warnings)
+	require.Len(t, findings, 5, strings.Join(findings, "\n"))
+	require.Contains(t, findings[0], "task 'gen' is defined in both")
+	require.Equal(t, mainPath+": task 'build' depends on undefined task 'missing'", findings[1])
+	require.Equal(t, "dependency cycle: a => b => a", findings[2])
+	require.Equal(t, mainPath+": task 'build' uses undefined variable $UNDEFINED", findings[3])
+	require.Contains(t, findings[4], "tasks.go:3:1: Deploy is not a valid task")
+}
+
+func TestUnused(t *testing.T) {
+	qf, ok, err := parser.ParseQuakefile(`VERSION = "1.0"
+TAG = "v$VERSION"
+UNUSED = "x"
+export TOKEN = "secret"
+COMMIT = "abc"
+DATE = "today"
+OTHER = "y"
+
+task build(target, extra) {
+    echo "$TAG ${target}"
+    echo {{OTHER || "none"}}
+    echo ` + "`git log $COMMIT`" + `
+}
+
+task release(version) {
+    echo "$DATE"
+}
+`)
+	require.True(t, ok)
+	require.NoError(t, err)
+
+	require.Equal(t, []string{
+		"variable 'UNUSED' is never used",
+		"an unknown file: task 'build' never uses its argument 'extra'",
+		"an unknown file: task 'release' never uses its argument 'version'",
+	}, Unused(&qf))
+}
+
+func TestCheckClean(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Quakefile"), "task build => test {\n  echo build\n}\n\ntask test {\n  echo test\n}\n")
+
+	findings, warnings, err := Check(filepath.Join(dir, "Quakefile"))
+	require.NoError(t, err)
+	require.Empty(t, findings)
+	require.Equal(t, []string{filepath.Join(dir, "Quakefile") + ": task 'test' shadows the shell built-in test"}, warnings)
+}
+
+func TestShadowed(t *testing.T) {
+	qf, ok, err := parser.ParseQuakefile(`task ls {
+    echo listing
+}
+
+task build {
+    echo build
+}
+
+namespace fs {
+    task cp {
+        echo copying
+    }
+}
+`)
+	require.True(t, ok)
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"an unknown file: task 'ls' shadows the command ls"}, Shadowed(&qf))
+}
+
+func TestLoadRemote(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	const common = "task lint {\n  golangci-lint run\n}\n"
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(common))
+	}))
+	url := server.URL + "/common.quake"
+	sum := sha256.Sum256([]byte(common))
+
+	dir := t.TempDir()
+	mainPath := filepath.Join(dir, "Quakefile")
+	writeFile(t, mainPath, "load \""+url+"\" sha256 \""+hex.EncodeToString(sum[:])+"\"\n\ntask build {\n  go build\n}\n")
+
+	qf, err := Load(mainPath)
+	require.NoError(t, err)
+	require.NotNil(t, qf.FindTask("lint"))
+	require.Equal(t, url, qf.FindTask("lint").SourceFile)
+
+	// A fresh cached copy is used as is
+	_, err = Load(mainPath)
+	require.NoError(t, err)
+	require.Equal(t, 1, requests)
+
+	// Once it's stale, it's revalidated by its ETag
+	defer func(freshness time.Duration) { remoteFreshness = freshness }(remoteFreshness)
+	remoteFreshness = 0
+	_, err = Load(mainPath)
+	require.NoError(t, err)
+	require.Equal(t, 2, requests)
+
+	// Without the network, the cache is used
+	server.Close()
+	qf, err = LoadWithOptions(mainPath, Options{NoRemote: true})
+	require.NoError(t, err)
+	require.NotNil(t, qf.FindTask("lint"))
+	qf, err = Load(mainPath)
+	require.NoError(t, err)
+	require.NotNil(t, qf.FindTask("lint"))
+
+	noWarn := func(err error) { t.Error(err) }
+	_, err = fetchRemote(server.URL+"/other.quake", "", true, noWarn)
+	require.EqualError(t, err, server.URL+"/other.quake isn't cached and remote loads are disabled")
+
+	_, err = fetchRemote(url, "0000", true, noWarn)
+	require.ErrorContains(t, err, "checksum mismatch for "+url)
+
+	var warnings []string
+	qf, err = load(mainPath, false, func(err error) { warnings = append(warnings, err.Error()) })
+	require.NoError(t, err)
+	require.NotNil(t, qf.FindTask("lint"))
+	require.Len(t, warnings, 1)
+	require.Contains(t, warnings[0], "failed to fetch "+url+", using the cached copy: ")
+}
+
+func TestLoadRemoteServerError(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	defer func(freshness time.Duration) { remoteFreshness = freshness }(remoteFreshness)
+	remoteFreshness = 0
+
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("task lint {\n  golangci-lint run\n}\n"))
+	}))
+	defer server.Close()
+	url := server.URL + "/common.quake"
+
+	dir := t.TempDir()
+	mainPath := filepath.Join(dir, "Quakefile")
+	writeFile(t, mainPath, "include \""+url+"\"\n\ntask build {\n  go build\n}\n")
+
+	// Nothing cached yet, so a failing server means the file isn't loaded
+	failing = true
+	var warnings []string
+	warn := func(err error) { warnings = append(warnings, err.Error()) }
+	qf, err := load(mainPath, false, warn)
+	require.NoError(t, err)
+	require.Nil(t, qf.FindTask("lint"))
+	require.Equal(t, []string{"failed to fetch " + url + ": 503 Service Unavailable"}, warnings)
+
+	// Once it's cached, the cached copy is used instead
+	failing = false
+	_, err = load(mainPath, false, func(err error) { t.Error(err) })
+	require.NoError(t, err)
+
+	failing = true
+	warnings = nil
+	qf, err = load(mainPath, false, warn)
+	require.NoError(t, err)
+	require.NotNil(t, qf.FindTask("lint"))
+	require.Equal(t, []string{"failed to fetch " + url + ", using the cached copy: 503 Service Unavailable"}, warnings)
+}
+
+func TestLoadLocalOverride(t *testing.T) {
+	dir := t.TempDir()
+	mainPath := filepath.Join(dir, "Quakefile")
+	localPath := mainPath + localSuffix
+	writeFile(t, mainPath, "REGISTRY = \"ghcr.io\"\n\ntask build {\n  echo main\n}\n\ntask test {\n  go test\n}\n\nnamespace db {\n  task migrate {\n    echo main\n  }\n}\n")
+	writeFile(t, filepath.Join(dir, "qtasks", "lint.quake"), "task lint {\n  echo shared\n}\n")
+	writeFile(t, localPath, "REGISTRY = \"localhost:5000\"\n\ntask build {\n  echo local\n}\n\ntask lint {\n  echo local\n}\n\ntask scratch {\n  echo mine\n}\n\nnamespace db {\n  task migrate {\n    echo local\n  }\n}\n")
+
+	qf, err := Load(mainPath)
+	require.NoError(t, err)
+
+	require.Len(t, qf.Variables, 1)
+	require.Equal(t, "REGISTRY", qf.Variables[0].Name)
+	require.Equal(t, `"localhost:5000"`, qf.Variables[0].Value)
+
+	for _, name := range []string{"build", "lint", "scratch", "db:migrate"} {
+		task := qf.FindTask(name)
+		require.NotNil(t, task, name)
+		require.Equal(t, localPath, task.SourceFile, name)
+	}
+	require.Equal(t, mainPath, qf.FindTask("test").SourceFile)
+	require.Len(t, qf.Namespaces, 1)
+}
+
+func TestLoadFrontMatter(t *testing.T) {
+	dir := t.TempDir()
+	mainPath := filepath.Join(dir, "Quakefile")
+	writeFile(t, mainPath, "---\nshell: bash -eu\njobs: 4\ncolor: never\nprofile: ci\nverbose: true\n---\n\ntask build {\n  go build\n}\n")
+
+	var warnings []string
+	qf, err := load(mainPath, false, func(err error) { warnings = append(warnings, err.Error()) })
+	require.NoError(t, err)
+	require.Equal(t, "bash -eu", qf.Shell)
+	require.Equal(t, []string{
+		"setting 'profile' in the front matter of " + mainPath + " isn't supported",
+		"unknown setting 'verbose' in the front matter of " + mainPath,
+	}, warnings)
+
+	// Color is left to the caller, and the option wins over the front matter
+	require.Equal(t, "never", Color(qf, Options{}))
+	require.Equal(t, "always", Color(qf, Options{Color: "always"}))
+
+	writeFile(t, mainPath, "---\njobs: many\ncolor: sometimes\n---\n\ntask build {\n  go build\n}\n")
+	warnings = nil
+	qf, err = load(mainPath, false, func(err error) { warnings = append(warnings, err.Error()) })
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"invalid color setting \"sometimes\" in the front matter of " + mainPath + " (expected: always, never or auto)",
+		"invalid jobs setting \"many\" in the front matter of " + mainPath + " (expected a positive number)",
+	}, warnings)
+	require.Equal(t, "auto", Color(qf, Options{}))
+
+	// A shell directive is more specific than the front matter
+	writeFile(t, mainPath, "---\nshell: bash -eu\n---\nshell = \"zsh\"\n\ntask build {\n  go build\n}\n")
+	qf, err = load(mainPath, false, func(err error) { t.Error(err) })
+	require.NoError(t, err)
+	require.Equal(t, "zsh", qf.Shell)
+}
@@ -0,0 +1,139 @@
+package quake
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// remoteTimeout bounds how long fetching a remote .quake file may take
+const remoteTimeout = 30 * time.Second
+
+// cachedRemoteTimeout bounds how long revalidating a cached remote .quake
+// file may take before the cached copy is used instead
+const cachedRemoteTimeout = 3 * time.Second
+
+// remoteFreshness is how long a fetched or revalidated remote .quake file is
+// used from the cache without asking the server again
+var remoteFreshness = 5 * time.Minute
+
+// isRemote reports whether a load pattern is an http(s) URL
+func isRemote(pattern string) bool {
+	return strings.HasPrefix(pattern, "http://") || strings.HasPrefix(pattern, "https://")
+}
+
+// remoteCacheDir returns where fetched .quake files are cached
+func remoteCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find cache directory: %w", err)
+	}
+	return filepath.Join(dir, "quake", "remote"), nil
+}
+
+// fetchRemote returns the contents of a remote .quake file. It's cached by
+// URL along with its ETag, so an unchanged file isn't downloaded again and the
+// cached copy is used, reported to warn, when the server can't be reached or
+// fails. A copy younger than remoteFreshness is used without asking the
+// server. With noRemote, only the cache is used. If checksum is set, the
+// contents must have that SHA-256.
+func fetchRemote(url, checksum string, noRemote bool, warn func(error)) ([]byte, error) {
+	dir, err := remoteCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	key := sha256.Sum256([]byte(url))
+	cachePath := filepath.Join(dir, hex.EncodeToString(key[:])+".quake")
+	etagPath := cachePath + ".etag"
+
+	cached, cacheErr := os.ReadFile(cachePath)
+	if noRemote {
+		if cacheErr != nil {
+			return nil, fmt.Errorf("%s isn't cached and remote loads are disabled", url)
+		}
+		return verifyChecksum(url, cached, checksum)
+	}
+
+	if cacheErr == nil {
+		if info, err := os.Stat(cachePath); err == nil && time.Since(info.ModTime()) < remoteFreshness {
+			return verifyChecksum(url, cached, checksum)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %s: %w", url, err)
+	}
+	if cacheErr == nil {
+		if etag, err := os.ReadFile(etagPath); err == nil {
+			req.Header.Set("If-None-Match", string(etag))
+		}
+	}
+
+	timeout := remoteTimeout
+	if cacheErr == nil {
+		timeout = cachedRemoteTimeout
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		if cacheErr != nil {
+			return nil, fmt.Errorf("failed to fetch %s: %w", url, err)
+		}
+		warn(fmt.Errorf("failed to fetch %s, using the cached copy: %w", url, err))
+		return verifyChecksum(url, cached, checksum)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cacheErr == nil:
+		// Still fresh for another remoteFreshness
+		now := time.Now()
+		os.Chtimes(cachePath, now, now)
+		return verifyChecksum(url, cached, checksum)
+	case resp.StatusCode != http.StatusOK && cacheErr == nil:
+		warn(fmt.Errorf("failed to fetch %s, using the cached copy: %s", url, resp.Status))
+		return verifyChecksum(url, cached, checksum)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("failed to fetch %s: %s", url, resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", url, err)
+	}
+	if _, err := verifyChecksum(url, data, checksum); err != nil {
+		return nil, err
+	}
+
+	// A failure to cache only costs a download next time
+	if err := os.MkdirAll(dir, 0755); err == nil {
+		if err := os.WriteFile(cachePath, data, 0644); err == nil {
+			if etag := resp.Header.Get("ETag"); etag != "" {
+				os.WriteFile(etagPath, []byte(etag), 0644)
+			} else {
+				os.Remove(etagPath)
+			}
+		}
+	}
+	return data, nil
+}
+
+// verifyChecksum returns data if it has the expected SHA-256 checksum, or if
+// no checksum is pinned
+func verifyChecksum(url string, data []byte, checksum string) ([]byte, error) {
+	if checksum == "" {
+		return data, nil
+	}
+	sum := sha256.Sum256(data)
+	if actual := hex.EncodeToString(sum[:]); !strings.EqualFold(actual, checksum) {
+		return nil, fmt.Errorf("checksum mismatch for %s: expected sha256 %s, got %s", url, checksum, actual)
+	}
+	return data, nil
+}
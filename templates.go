@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"miren.dev/quake/quake"
+)
+
+const goTemplate = `# Build the project
+task build {
+    go build ./...
+}
+
+# Run the tests
+task test {
+    go test ./...
+}
+
+# Run the program
+task run {
+    go run .
+}
+
+# Format and vet the code
+task lint {
+    go fmt ./...
+    go vet ./...
+}
+
+# Remove build artifacts
+task clean {
+    go clean
+}
+
+# Default task - build and test
+task default => build, test
+`
+
+const rustTemplate = `# Build the project
+task build {
+    cargo build
+}
+
+# Run the tests
+task test {
+    cargo test
+}
+
+# Run the program
+task run {
+    cargo run
+}
+
+# Check formatting and lints
+task lint {
+    cargo fmt --check
+    cargo clippy
+}
+
+# Remove build artifacts
+task clean {
+    cargo clean
+}
+
+# Default task - build and test
+task default => build, test
+`
+
+const pythonTemplate = `# Install dependencies
+task deps {
+    pip install -e .
+}
+
+# Run the tests
+task test {
+    python -m pytest
+}
+
+# Remove caches and build artifacts
+task clean {
+    rm -rf build dist .pytest_cache
+}
+
+# Default task - run the tests
+task default => test
+`
+
+const genericTemplate = `# Build the project
+task build {
+    echo "TODO: build the project"
+}
+
+# Run the tests
+task test {
+    echo "TODO: run the tests"
+}
+
+# Default task - build and test
+task default => build, test
+`
+
+// initMinimalQuakefile writes a starter Quakefile for the project in the
+// current directory from built-in templates, without calling Claude
+func initMinimalQuakefile() error {
+	if existingPath, err := quake.Find(""); err == nil {
+		return fmt.Errorf("a Quakefile already exists at %s\nRemove it first or use 'quake -g' to add tasks to it", existingPath)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get current directory: %w", err)
+	}
+
+	content, kind, err := minimalQuakefile(cwd)
+	if err != nil {
+		return err
+	}
+
+	quakefilePath := filepath.Join(cwd, "Quakefile")
+	if err := os.WriteFile(quakefilePath, []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write Quakefile: %w", err)
+	}
+
+	fmt.Printf("✅ Created a %s Quakefile at %s\n", kind, quakefilePath)
+	fmt.Println("\nNext steps:")
+	fmt.Println("  quake -l          # List available tasks")
+	fmt.Println("  quake <task>      # Run a specific task")
+	fmt.Println("  quake             # Run the default task")
+	return nil
+}
+
+// minimalQuakefile picks a template for the dominant language in dir and
+// returns its content along with the name of the project type
+func minimalQuakefile(dir string) (string, string, error) {
+	langs, err := detectLanguages(dir)
+	if err != nil {
+		return "", "", err
+	}
+
+	buildFiles := make(map[string]bool)
+	for _, file := range detectBuildFiles(dir) {
+		buildFiles[file] = true
+	}
+
+	for _, lc := range langs {
+		switch lc.lang {
+		case "Go":
+			return goTemplate, "Go", nil
+		case "Rust":
+			return rustTemplate, "Rust", nil
+		case "Python":
+			return pythonTemplate, "Python", nil
+		case "JavaScript", "TypeScript":
+			if buildFiles["package.json"] {
+				content, err := nodeQuakefile(filepath.Join(dir, "package.json"))
+				return content, "Node.js", err
+			}
+		}
+	}
+
+	// No source files recognized yet; fall back to build files
+	switch {
+	case buildFiles["go.mod"]:
+		return goTemplate, "Go", nil
+	case buildFiles["Cargo.toml"]:
+		return rustTemplate, "Rust", nil
+	case buildFiles["package.json"]:
+		content, err := nodeQuakefile(filepath.Join(dir, "package.json"))
+		return content, "Node.js", err
+	case buildFiles["pyproject.toml"], buildFiles["setup.py"]:
+		return pythonTemplate, "Python", nil
+	}
+
+	return genericTemplate, "generic", nil
+}
+
+// nodeQuakefile builds a Quakefile with a task for each npm script in package.json
+func nodeQuakefile(packageJSON string) (string, error) {
+	data, err := os.ReadFile(packageJSON)
+	if err != nil {
+		return "", fmt.Errorf("failed to read package.json: %w", err)
+	}
+
+	var pkg struct {
+		Scripts map[string]string `json:"scripts"`
+	}
+	if err := json.Unmarshal(data, &pkg); err != nil {
+		return "", fmt.Errorf("failed to parse package.json: %w", err)
+	}
+
+	scripts := make([]string, 0, len(pkg.Scripts))
+	for name := range pkg.Scripts {
+		scripts = append(scripts, name)
+	}
+	sort.Strings(scripts)
+
+	var b strings.Builder
+	b.WriteString("# Install dependencies\ntask deps {\n    npm install\n}\n")
+
+	taskNames := make(map[string]bool)
+	for _, script := range scripts {
+		// Task names can't contain ':' (it separates namespaces)
+		name := strings.NewReplacer(":", "-", " ", "-").Replace(script)
+		if name == "deps" || name == "default" || taskNames[name] {
+			continue
+		}
+		taskNames[name] = true
+		fmt.Fprintf(&b, "\n# npm run %s\ntask %s {\n    npm run %s\n}\n", script, name, script)
+	}
+
+	switch {
+	case taskNames["test"]:
+		b.WriteString("\n# Default task - run the tests\ntask default => test\n")
+	case taskNames["build"]:
+		b.WriteString("\n# Default task - build the project\ntask default => build\n")
+	default:
+		b.WriteString("\n# Default task - install dependencies\ntask default => deps\n")
+	}
+
+	return b.String(), nil
+}
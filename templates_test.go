@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"miren.dev/quake/parser"
+)
+
+func TestMinimalQuakefileTemplates(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		kind  string
+		tasks []string
+	}{
+		{
+			name:  "go",
+			files: map[string]string{"go.mod": "module x\n", "main.go": "", "lib/a.go": "", "script.py": ""},
+			kind:  "Go",
+			tasks: []string{"build", "test", "default"},
+		},
+		{
+			name:  "rust",
+			files: map[string]string{"Cargo.toml": "", "src/main.rs": ""},
+			kind:  "Rust",
+			tasks: []string{"build", "test", "default"},
+		},
+		{
+			name: "node",
+			files: map[string]string{
+				"package.json": `{"scripts": {"build": "tsc", "test:unit": "jest"}}`,
+				"index.ts":     "",
+			},
+			kind:  "Node.js",
+			tasks: []string{"deps", "build", "test-unit", "default"},
+		},
+		{
+			name:  "build files only",
+			files: map[string]string{"pyproject.toml": ""},
+			kind:  "Python",
+			tasks: []string{"test", "default"},
+		},
+		{
+			name:  "unknown",
+			files: map[string]string{"README": ""},
+			kind:  "generic",
+			tasks: []string{"build", "test", "default"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range tt.files {
+				path := filepath.Join(dir, name)
+				require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+				require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+			}
+
+			content, kind, err := minimalQuakefile(dir)
+			require.NoError(t, err)
+			require.Equal(t, tt.kind, kind)
+
+			// The template must be a valid Quakefile
+			result, ok, err := parser.ParseQuakefile(content)
+			require.True(t, ok, "generated Quakefile should parse:\n%s", content)
+			require.NoError(t, err)
+
+			var names []string
+			for _, task := range result.Tasks {
+				names = append(names, task.Name)
+			}
+			for _, task := range tt.tasks {
+				require.Contains(t, names, task)
+			}
+		})
+	}
+}